@@ -19,6 +19,7 @@ import (
 
 var (
 	archive uint
+	version string // Set by build environment
 )
 
 func init() {
@@ -43,6 +44,7 @@ func noop() {
 	if err != nil {
 		alert.Abort(errors.Wrap(err, "create plugin failed"))
 	}
+	plugin.SetVersion(version)
 
 	mover := Mover{}
 	plugin.AddMover(&dmplugin.Config{
@@ -88,6 +88,8 @@ func getMergedConfig(plugin *dmplugin.Plugin) (*posixConfig, error) {
 	return baseCfg.Merge(&cfg), nil
 }
 
+var version string // Set by build environment
+
 func main() {
 	plugin, err := dmplugin.New(path.Base(os.Args[0]), func(path string) (fsroot.Client, error) {
 		return fsroot.New(path)
@@ -96,6 +98,7 @@ func main() {
 		alert.Abort(errors.Wrap(err, "failed to initialize plugin"))
 	}
 	defer plugin.Close()
+	plugin.SetVersion(version)
 
 	cfg, err := getMergedConfig(plugin)
 	if err != nil {
@@ -0,0 +1,744 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package posix
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	lustre "github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/lemur/dmplugin"
+	"github.com/intel-hpdd/lemur/dmplugin/dmio"
+	"github.com/intel-hpdd/lemur/pkg/checksum"
+	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/audit"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+// Small files can be archived into containers, which hold the data of
+// many files back to back, followed by an index of the files and a
+// trailer of containerMagic and the offset of the index, as a big endian
+// uint64. The index offset is also recorded in containerXattr. A file in
+// a container has the ID "<container id>:<offset>:<length>".
+const (
+	containerXattr  = "user.lhsm.container"
+	containerMagic  = "LHSMPACK"
+	memberSeparator = ":"
+
+	// deadSuffix is appended to a container's name to name the file
+	// that records the members that were removed, one "<offset>
+	// <length>" line each. Compact marks the members whose data it has
+	// punched out by appending deadPunched to their lines.
+	deadSuffix  = ".dead"
+	deadPunched = "punched"
+
+	defaultAggregateMaxFileSize = 1024 * 1024
+	defaultAggregateMaxSize     = 256 * 1024 * 1024
+	defaultAggregateMaxFiles    = 1024
+	defaultAggregateWindow      = 5 * time.Second
+)
+
+// fallocate(2) modes, which aren't defined by the unix package.
+const (
+	fallocKeepSize  = 0x1
+	fallocPunchHole = 0x2
+)
+
+type (
+	// AggregateConfig enables archiving small files into containers.
+	AggregateConfig struct {
+		MaxFileSize int64  `hcl:"max_file_size"` // Largest file aggregated, default 1 MiB
+		MaxSize     int64  `hcl:"max_size"`      // Data in a container, default 256 MiB
+		MaxFiles    int    `hcl:"max_files"`     // Files in a container, default 1024
+		Window      string `hcl:"window"`        // How long a container collects files, default 5s
+	}
+
+	// containerIndex lists the files in a container.
+	containerIndex struct {
+		Members []containerMember `json:"members"`
+	}
+
+	// containerMember is a file's data in a container.
+	containerMember struct {
+		Offset   int64                    `json:"offset"`
+		Length   int64                    `json:"length"`
+		Hash     []byte                   `json:"hash,omitempty"`
+		Metadata *dmplugin.ObjectMetadata `json:"metadata,omitempty"`
+	}
+
+	// packer holds the container small files are being added to.
+	packer struct {
+		sync.Mutex
+		open *container
+	}
+
+	// container is a container that is being written. Its files'
+	// archives are finished by calling done once it is committed.
+	container struct {
+		fileID string
+		dst    *objectFile
+		size   int64
+		index  containerIndex
+		timer  *time.Timer
+		done   []func(*container)
+		id     string
+		err    error
+	}
+
+	// deadMember is a member that was removed from a container.
+	deadMember struct {
+		length  int64
+		punched bool
+	}
+)
+
+// withDefaults returns a copy of the configuration with defaults for the
+// unset limits, or nil if aggregation isn't enabled.
+func (c *AggregateConfig) withDefaults() *AggregateConfig {
+	if c == nil {
+		return nil
+	}
+	result := *c
+	if result.MaxFileSize == 0 {
+		result.MaxFileSize = defaultAggregateMaxFileSize
+	}
+	if result.MaxSize == 0 {
+		result.MaxSize = defaultAggregateMaxSize
+	}
+	if result.MaxFiles == 0 {
+		result.MaxFiles = defaultAggregateMaxFiles
+	}
+	return &result
+}
+
+// window returns how long a container collects files before it is
+// written.
+func (c *AggregateConfig) window() time.Duration {
+	if d, err := time.ParseDuration(c.Window); err == nil && d > 0 {
+		return d
+	}
+	return defaultAggregateWindow
+}
+
+// checkAggregate returns the problems with the archive's aggregation
+// settings.
+func (a *ArchiveConfig) checkAggregate() []string {
+	c := a.Aggregate
+	if c == nil {
+		return nil
+	}
+	var errs []string
+	if c.MaxFileSize < 0 || c.MaxSize < 0 || c.MaxFiles < 0 {
+		errs = append(errs, fmt.Sprintf("Archive %s: aggregate settings must not be negative", a.Name))
+	}
+	if c.Window != "" {
+		if d, err := time.ParseDuration(c.Window); err != nil || d < 0 {
+			errs = append(errs, fmt.Sprintf("Archive %s: invalid aggregate window %q", a.Name, c.Window))
+		}
+	}
+	if a.Dedup {
+		errs = append(errs, fmt.Sprintf("Archive %s: aggregate can't be used with dedup", a.Name))
+	}
+	if a.Replicas > 1 {
+		errs = append(errs, fmt.Sprintf("Archive %s: aggregate can't be used with replicas", a.Name))
+	}
+	if a.Keyring != "" {
+		errs = append(errs, fmt.Sprintf("Archive %s: aggregate can't be used with keyring", a.Name))
+	}
+	return errs
+}
+
+// aggregate returns true if the action's file is archived into a
+// container. Only whole, uncompressed files are.
+func (m *Mover) aggregate(action dmplugin.Action, total int64, codec dmio.Codec) bool {
+	return m.Aggregate != nil && codec == nil && action.Offset() == 0 && total <= m.Aggregate.MaxFileSize
+}
+
+// memberID returns the ID of a file's data in a container.
+func memberID(containerID string, offset, length int64) string {
+	return fmt.Sprintf("%s%s%d%s%d", containerID, memberSeparator, offset, memberSeparator, length)
+}
+
+// splitMemberID returns the container ID, offset and length of the ID of
+// a file in a container. ok is false if it isn't one.
+func splitMemberID(id string) (containerID string, offset, length int64, ok bool) {
+	i := strings.LastIndex(id, memberSeparator)
+	if i < 0 {
+		return "", 0, 0, false
+	}
+	j := strings.LastIndex(id[:i], memberSeparator)
+	if j < 0 {
+		return "", 0, 0, false
+	}
+	offset, err := strconv.ParseInt(id[j+1:i], 10, 64)
+	if err != nil || offset < 0 {
+		return "", 0, 0, false
+	}
+	length, err = strconv.ParseInt(id[i+1:], 10, 64)
+	if err != nil || length < 0 {
+		return "", 0, 0, false
+	}
+	return id[:j], offset, length, true
+}
+
+// archiveMember reads the file being archived and adds it to a
+// container. The file's ID records where its data is in the container.
+func (m *Mover) archiveMember(action dmplugin.Action, rdr io.Reader, total int64, md *dmplugin.ObjectMetadata) error {
+	var buf bytes.Buffer
+	cw := m.ChecksumWriter(&buf)
+	n, err := CopyWithProgress(cw, rdr, total, action)
+	if err != nil {
+		debug.Printf("copy error %v read %d expected %d", err, n, total)
+		return errors.Wrap(err, "copy failed")
+	}
+	sum := cw.Sum()
+
+	if md != nil {
+		md.Hash = sum
+		md.Size = n
+	}
+	member := &containerMember{Length: n, Hash: sum, Metadata: md}
+
+	// The action is finished once the container is committed, so the
+	// handler can archive other files meanwhile. An action that can't
+	// be finished later waits for the container.
+	finisher, deferred := action.(dmplugin.Finisher)
+	done := make(chan error, 1)
+	err = m.pack(buf.Bytes(), member, func(c *container) {
+		err := m.memberArchived(action, c, member)
+		if deferred {
+			finisher.Finish(err)
+		} else {
+			done <- err
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if deferred {
+		return dmplugin.ErrDeferred
+	}
+	return <-done
+}
+
+// memberArchived records the ID of a file archived to a container once
+// the container has been committed.
+func (m *Mover) memberArchived(action dmplugin.Action, c *container, member *containerMember) error {
+	if c.err != nil {
+		return c.err
+	}
+	id := memberID(c.id, member.Offset, member.Length)
+	debug.Printf("%s id:%d Archived %d bytes to container %s at %d from %s %x", m.Name, action.ID(), member.Length,
+		c.id, member.Offset, action.PrimaryPath(), member.Hash)
+	u := url.URL{
+		Scheme:   "file",
+		Path:     m.Destination(c.id),
+		RawQuery: fmt.Sprintf("offset=%d&length=%d", member.Offset, member.Length),
+	}
+	action.SetUUID(id)
+	action.SetURL(u.String())
+	action.SetHash(member.Hash)
+	action.SetActualLength(member.Length)
+	return nil
+}
+
+// pack adds data to the open container. done is called once the container
+// has been committed, or has failed. A container is committed when it is
+// full, or when it has been open for the aggregation window.
+func (m *Mover) pack(data []byte, member *containerMember, done func(*container)) error {
+	size := int64(len(data))
+
+	m.packer.Lock()
+	defer m.packer.Unlock()
+	c := m.packer.open
+	if c != nil && c.size+size > m.Aggregate.MaxSize {
+		m.packer.open = nil
+		go m.seal(c)
+		c = nil
+	}
+	if c == nil {
+		var err error
+		if c, err = m.newContainer(); err != nil {
+			return err
+		}
+		m.packer.open = c
+		c.timer = time.AfterFunc(m.Aggregate.window(), func() {
+			m.packer.Lock()
+			open := m.packer.open == c
+			if open {
+				m.packer.open = nil
+			}
+			m.packer.Unlock()
+			if open {
+				m.seal(c)
+			}
+		})
+	}
+
+	member.Offset = c.size
+	if _, err := c.dst.WriteAt(data, c.size); err != nil {
+		// Nothing more can be added to the container.
+		c.err = errors.Wrapf(err, "%s: write failed", c.dst.Name())
+		m.packer.open = nil
+		go m.seal(c)
+		return c.err
+	}
+	c.size += size
+	c.index.Members = append(c.index.Members, *member)
+	c.done = append(c.done, done)
+	if c.size >= m.Aggregate.MaxSize || len(c.index.Members) >= m.Aggregate.MaxFiles {
+		m.packer.open = nil
+		go m.seal(c)
+	}
+	return nil
+}
+
+// sealOpen commits the open container at once, rather than at the end of
+// its window.
+func (m *Mover) sealOpen() {
+	m.packer.Lock()
+	c := m.packer.open
+	m.packer.open = nil
+	m.packer.Unlock()
+	if c != nil {
+		m.seal(c)
+	}
+}
+
+// newContainer creates the temporary file of a new container.
+func (m *Mover) newContainer() (*container, error) {
+	roots, err := m.placeReplicas()
+	if err != nil {
+		return nil, err
+	}
+	fileID, dst, err := m.createObject(nil, roots, newFileID())
+	if err != nil {
+		return nil, errors.Wrap(err, "create container failed")
+	}
+	return &container{
+		fileID: fileID,
+		dst:    dst,
+	}, nil
+}
+
+// seal writes a container's index and commits it, and finishes the
+// archives of its files.
+func (m *Mover) seal(c *container) {
+	c.timer.Stop()
+	defer func() {
+		for _, done := range c.done {
+			done(c)
+		}
+	}()
+	defer c.dst.Close()
+
+	if c.err == nil {
+		c.err = m.writeIndex(c)
+	}
+	if c.err == nil {
+		c.id, c.err = m.commitObject(c.dst, c.fileID)
+	}
+	if c.err != nil {
+		alert.Warnf("%s: write container of %d files failed: %v", m.Name, len(c.index.Members), c.err)
+		c.dst.remove()
+		return
+	}
+	debug.Printf("%s: wrote container %s of %d files, %d bytes", m.Name, c.id, len(c.index.Members), c.size)
+}
+
+// writeIndex writes a container's index and trailer after its data.
+func (m *Mover) writeIndex(c *container) error {
+	data, err := json.Marshal(&c.index)
+	if err != nil {
+		return errors.Wrap(err, "encode container index failed")
+	}
+	trailer := make([]byte, len(containerMagic)+8)
+	copy(trailer, containerMagic)
+	binary.BigEndian.PutUint64(trailer[len(containerMagic):], uint64(c.size))
+	data = append(data, trailer...)
+	if _, err := c.dst.WriteAt(data, c.size); err != nil {
+		return errors.Wrapf(err, "%s: write index failed", c.dst.Name())
+	}
+	err = c.dst.setxattr(containerXattr, []byte(strconv.FormatInt(c.size, 10)))
+	return errors.Wrapf(err, "%s: record container failed", c.dst.Name())
+}
+
+// readIndex reads the index of the container f.
+func readIndex(f *os.File) (*containerIndex, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: stat failed", f.Name())
+	}
+	trailer := make([]byte, len(containerMagic)+8)
+	if fi.Size() < int64(len(trailer)) {
+		return nil, errors.Errorf("%s: not a container", f.Name())
+	}
+	if _, err := f.ReadAt(trailer, fi.Size()-int64(len(trailer))); err != nil {
+		return nil, errors.Wrapf(err, "%s: read failed", f.Name())
+	}
+	if string(trailer[:len(containerMagic)]) != containerMagic {
+		return nil, errors.Errorf("%s: not a container", f.Name())
+	}
+	offset := int64(binary.BigEndian.Uint64(trailer[len(containerMagic):]))
+	end := fi.Size() - int64(len(trailer))
+	if offset > end {
+		return nil, errors.Errorf("%s: invalid index offset %d", f.Name(), offset)
+	}
+
+	var index containerIndex
+	dec := json.NewDecoder(io.NewSectionReader(f, offset, end-offset))
+	if err := dec.Decode(&index); err != nil {
+		return nil, errors.Wrapf(err, "%s: read index failed", f.Name())
+	}
+	return &index, nil
+}
+
+// containerIndex reads the index of a container.
+func (m *Mover) containerIndex(id string) (*containerIndex, error) {
+	f, err := os.Open(m.Destination(id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readIndex(f)
+}
+
+// find returns the member at offset with the given length, or nil if
+// there isn't one.
+func (index *containerIndex) find(offset, length int64) *containerMember {
+	i := sort.Search(len(index.Members), func(i int) bool {
+		return index.Members[i].Offset >= offset
+	})
+	if i < len(index.Members) && index.Members[i].Offset == offset && index.Members[i].Length == length {
+		return &index.Members[i]
+	}
+	return nil
+}
+
+// readDead returns the members that were removed from a container, by
+// offset.
+func (m *Mover) readDead(id string) (map[int64]deadMember, error) {
+	dead := make(map[int64]deadMember)
+	f, err := os.Open(m.Destination(id) + deadSuffix)
+	if os.IsNotExist(err) {
+		return dead, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var offset int64
+		var member deadMember
+		fields := strings.Fields(scanner.Text())
+		if _, err := fmt.Sscanf(scanner.Text(), "%d %d", &offset, &member.length); err != nil {
+			return nil, errors.Wrapf(err, "%s: invalid removed member %q", id, scanner.Text())
+		}
+		member.punched = len(fields) > 2 && fields[2] == deadPunched
+		dead[offset] = member
+	}
+	return dead, errors.Wrapf(scanner.Err(), "%s: read removed members failed", id)
+}
+
+// restoreMember restores the action's extent of a file archived in a
+// container.
+func (m *Mover) restoreMember(action dmplugin.Action, containerID string, offset, length int64, start time.Time) error {
+	src, err := os.Open(m.Destination(containerID))
+	if err != nil {
+		return errors.Wrapf(err, "%s: open failed", m.Destination(containerID))
+	}
+	defer src.Close()
+
+	skip := action.Offset()
+	if skip > length {
+		return errors.Errorf("%s: extent starts beyond the end of the file", action.UUID())
+	}
+	n := length - skip
+	if action.Length() != lustre.MaxExtentLength && action.Length() < n {
+		n = action.Length()
+	}
+
+	dst, err := dmio.NewActionWriter(action)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create ActionWriter for %s", action)
+	}
+	defer dst.Close()
+
+	cw := m.checksumWriter(dst, restoreAlgorithm(action))
+	copied, err := CopyWithProgress(cw, io.NewSectionReader(src, offset+skip, n), n, action)
+	if err != nil {
+		debug.Printf("copy error %v read %d expected %d", err, copied, n)
+		return errors.Wrap(err, "copy failed")
+	}
+	if copied != n {
+		return errors.Errorf("%s: restored %d bytes, expected %d", action.UUID(), copied, n)
+	}
+
+	// The file's checksum can only be compared if all of it was
+	// restored.
+	whole := skip == 0 && n == length
+	if action.Hash() != nil && whole && !m.Checksums.DisableCompareOnRestore {
+		if !bytes.Equal(action.Hash(), cw.Sum()) {
+			alert.Warnf("original checksum doesn't match new:  %s != %s", checksum.Format(action.Hash()), checksum.Format(cw.Sum()))
+			return errors.New("Checksum mismatch!")
+		}
+	}
+
+	debug.Printf("%s id:%d Restored %d bytes in %v from container %s to %s %x", m.Name, action.ID(), n,
+		time.Since(start),
+		containerID,
+		action.PrimaryPath(),
+		cw.Sum())
+	action.SetActualLength(n)
+	return nil
+}
+
+// verifyMember reads a file's data in the container src, and returns its
+// length and checksum.
+func (m *Mover) verifyMember(action dmplugin.Action, src *os.File, offset, length int64) (int64, []byte, error) {
+	cw := m.checksumWriter(ioutil.Discard, restoreAlgorithm(action))
+	n, err := CopyWithProgress(cw, io.NewSectionReader(src, offset, length), length, action)
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "%s: read failed", action.UUID())
+	}
+	if n != length {
+		return 0, nil, errors.Errorf("%s: read %d bytes, expected %d", action.UUID(), n, length)
+	}
+	return n, cw.Sum(), nil
+}
+
+// removeMember records that a file in a container was removed, and
+// removes the container with its last file. The space of the file's data
+// is reclaimed by Compact.
+func (m *Mover) removeMember(id, containerID string, offset, length int64) error {
+	f, err := m.lockObject(containerID)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	index, err := readIndex(f)
+	if err != nil {
+		return err
+	}
+	if index.find(offset, length) == nil {
+		return errors.Errorf("%s: not in container %s", id, containerID)
+	}
+	dead, err := m.readDead(containerID)
+	if err != nil {
+		return err
+	}
+	if _, ok := dead[offset]; ok {
+		return nil
+	}
+
+	p := m.Destination(containerID)
+	if len(dead)+1 == len(index.Members) {
+		debug.Printf("%s: removing container %s", m.Name, containerID)
+		if err := os.Remove(p + deadSuffix); err != nil && !os.IsNotExist(err) {
+			alert.Warnf("%s: remove %s failed: %v", m.Name, p+deadSuffix, err)
+		}
+		return os.Remove(p)
+	}
+
+	d, err := os.OpenFile(p+deadSuffix, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "%s: record removal failed", id)
+	}
+	defer d.Close()
+	if _, err := fmt.Fprintf(d, "%d %d\n", offset, length); err != nil {
+		return errors.Wrapf(err, "%s: record removal failed", id)
+	}
+	return errors.Wrapf(d.Sync(), "%s: record removal failed", id)
+}
+
+// memberMetadata returns the metadata stored with a file in a container.
+func (m *Mover) memberMetadata(id, containerID string, offset, length int64) (*dmplugin.ObjectMetadata, error) {
+	index, err := m.containerIndex(containerID)
+	if err != nil {
+		return nil, err
+	}
+	member := index.find(offset, length)
+	if member == nil || member.Metadata == nil {
+		return nil, &os.PathError{Op: "read metadata", Path: id, Err: os.ErrNotExist}
+	}
+	md := member.Metadata
+	md.UUID = id
+	return md, nil
+}
+
+// listMembers calls fn for each file in a container that hasn't been
+// removed.
+func (m *Mover) listMembers(containerID string, fi os.FileInfo, fn func(*dmplugin.ObjectInfo) error) error {
+	index, err := m.containerIndex(containerID)
+	if err != nil {
+		return err
+	}
+	dead, err := m.readDead(containerID)
+	if err != nil {
+		return err
+	}
+	for _, member := range index.Members {
+		if _, ok := dead[member.Offset]; ok {
+			continue
+		}
+		err := fn(&dmplugin.ObjectInfo{
+			ID:      memberID(containerID, member.Offset, member.Length),
+			Size:    member.Length,
+			ModTime: fi.ModTime(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact reclaims the space of the files that were removed from the
+// archive's containers, by punching holes over their data. The offsets of
+// the other files don't change, so their IDs remain valid.
+func (m *Mover) Compact() (*dmplugin.CompactResult, error) {
+	result := &dmplugin.CompactResult{}
+	for i := range m.Roots {
+		r := &m.Roots[i]
+		root := path.Join(r.Path, "objects")
+		err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && p == root {
+					return nil
+				}
+				return err
+			}
+			if !fi.Mode().IsRegular() || strings.HasSuffix(fi.Name(), metadataSuffix) ||
+				strings.HasSuffix(fi.Name(), deadSuffix) || isTemp(fi.Name()) {
+				return nil
+			}
+			id := objectID(fi.Name(), r)
+			if value, err := fileAttr(p, containerXattr); err != nil || value == "" {
+				return err
+			}
+			result.Containers++
+			reclaimed, compacted, err := m.compactContainer(id)
+			if err != nil {
+				return err
+			}
+			if compacted {
+				result.Compacted++
+				result.Reclaimed += reclaimed
+			}
+			return nil
+		})
+		if err != nil {
+			return result, errors.Wrapf(err, "%s: compact failed", root)
+		}
+	}
+	if result.Compacted > 0 {
+		audit.Logf("%s: compacted %d of %d containers, reclaimed %d bytes", m.Name, result.Compacted, result.Containers, result.Reclaimed)
+	}
+	return result, nil
+}
+
+// compactContainer punches holes over the data of a container's removed
+// files, and returns the number of bytes of space reclaimed, and whether
+// it had any removed files that weren't punched out before.
+func (m *Mover) compactContainer(id string) (int64, bool, error) {
+	lock, err := m.lockObject(id)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	defer lock.Close()
+
+	dead, err := m.readDead(id)
+	if err != nil {
+		return 0, false, err
+	}
+	removed := 0
+	for _, member := range dead {
+		if !member.punched {
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, false, nil
+	}
+
+	// Adjacent files are punched together, so blocks they share are
+	// freed. Extents of files that were all punched out before are
+	// skipped.
+	var offsets []int64
+	for offset := range dead {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	type extent struct {
+		offset, length int64
+		punched        bool
+	}
+	var extents []extent
+	for _, offset := range offsets {
+		member := dead[offset]
+		n := len(extents)
+		if n > 0 && extents[n-1].offset+extents[n-1].length == offset {
+			extents[n-1].length += member.length
+			extents[n-1].punched = extents[n-1].punched && member.punched
+		} else {
+			extents = append(extents, extent{offset, member.length, member.punched})
+		}
+	}
+
+	f, err := os.OpenFile(m.Destination(id), os.O_WRONLY, 0)
+	if err != nil {
+		return 0, true, err
+	}
+	defer f.Close()
+	var before, after unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &before); err != nil {
+		return 0, true, errors.Wrapf(err, "%s: stat failed", id)
+	}
+	for _, e := range extents {
+		if e.length == 0 || e.punched {
+			continue
+		}
+		if err := unix.Fallocate(int(f.Fd()), fallocPunchHole|fallocKeepSize, e.offset, e.length); err != nil {
+			return 0, true, errors.Wrapf(err, "%s: punch hole failed", id)
+		}
+	}
+	if err := unix.Fstat(int(f.Fd()), &after); err != nil {
+		return 0, true, errors.Wrapf(err, "%s: stat failed", id)
+	}
+	reclaimed := (before.Blocks - after.Blocks) * 512
+	if reclaimed > 0 {
+		debug.Printf("%s: reclaimed %d bytes of %d removed files in %s", m.Name, reclaimed, removed, id)
+	}
+
+	// The removed files are marked, so they aren't punched out again.
+	var buf bytes.Buffer
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%d %d %s\n", offset, dead[offset].length, deadPunched)
+	}
+	if err := writeFileAtomic(m.Destination(id)+deadSuffix, buf.Bytes(), 0600); err != nil {
+		return reclaimed, true, errors.Wrapf(err, "%s: record compaction failed", id)
+	}
+	return reclaimed, true, nil
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package posix
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/audit"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+// Objects are written to a temporary file in the directory they belong
+// in, named with tempPrefix and tempSuffix, and renamed into place once
+// their data is complete and synced. A crash leaves either no object or a
+// complete one.
+const (
+	tempPrefix = "."
+	tempSuffix = ".tmp"
+
+	// tempMaxAge is how long a temporary file is kept without being
+	// modified before it is assumed its copy failed. Several movers may
+	// share an archive, so recent files may be in use.
+	tempMaxAge = 24 * time.Hour
+)
+
+// isTemp returns true if name is the name of a temporary file.
+func isTemp(name string) bool {
+	return strings.HasPrefix(name, tempPrefix) && strings.HasSuffix(name, tempSuffix)
+}
+
+// tempPath returns the path of the temporary file an object is written to.
+func (m *Mover) tempPath(id string) string {
+	return tempName(m.Destination(id))
+}
+
+// tempPaths returns the paths of the temporary files of an object's
+// replicas.
+func (m *Mover) tempPaths(id string) []string {
+	var paths []string
+	for _, p := range m.replicaPaths(id) {
+		paths = append(paths, tempName(p))
+	}
+	return paths
+}
+
+// tempName returns the path of the temporary file the file at p is
+// written to.
+func tempName(p string) string {
+	return path.Join(path.Dir(p), tempPrefix+path.Base(p)+tempSuffix)
+}
+
+// syncDir flushes a directory, so entries that were added to it or
+// renamed into it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrapf(err, "%s: open failed", dir)
+	}
+	defer d.Close()
+	return errors.Wrapf(d.Sync(), "%s: sync failed", dir)
+}
+
+// commitObject syncs the temporary file of an object and renames it into
+// place, and returns the object's ID. Replicated objects are committed by
+// commitReplicas.
+func (m *Mover) commitObject(dst *objectFile, id string) (string, error) {
+	if len(dst.files) > 1 {
+		return m.commitReplicas(dst)
+	}
+	if err := dst.Sync(); err != nil {
+		return "", errors.Wrapf(err, "%s: sync failed", dst.Name())
+	}
+	p := m.Destination(id)
+	if err := os.Rename(dst.Name(), p); err != nil {
+		return "", errors.Wrapf(err, "%s: rename failed", id)
+	}
+	return id, syncDir(path.Dir(p))
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to name,
+// so readers never see a partially written file.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	dir := path.Dir(name)
+	f, err := ioutil.TempFile(dir, tempPrefix+path.Base(name)+"-*"+tempSuffix)
+	if err != nil {
+		return errors.Wrapf(err, "%s: create failed", name)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return errors.Wrapf(err, "%s: write failed", name)
+	}
+	if err := f.Chmod(perm); err != nil {
+		return errors.Wrapf(err, "%s: chmod failed", name)
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Wrapf(err, "%s: sync failed", name)
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		return errors.Wrapf(err, "%s: rename failed", name)
+	}
+	return syncDir(dir)
+}
+
+// SweepTemps removes temporary files left in the archive's roots by
+// copies that failed or were interrupted, and returns the number removed.
+// Files modified in the last maxAge are kept. Exported for testing.
+func (m *Mover) SweepTemps(maxAge time.Duration) (int, error) {
+	var removed int
+	for i := range m.Roots {
+		root := m.Roots[i].Path
+		n, err := m.sweepDir(path.Join(root, "objects"), isTemp, maxAge)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+		// Everything in tmp is a deduplicated object waiting to be
+		// linked into place.
+		n, err = m.sweepDir(path.Join(root, "tmp"), func(string) bool { return true }, maxAge)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+func (m *Mover) sweepDir(dir string, match func(string) bool, maxAge time.Duration) (int, error) {
+	var removed int
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == dir {
+				return nil
+			}
+			return err
+		}
+		if !fi.Mode().IsRegular() || !match(fi.Name()) || time.Since(fi.ModTime()) < maxAge {
+			return nil
+		}
+		debug.Printf("%s: removing stale temporary file %s", m.Name, p)
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, errors.Wrapf(err, "%s: sweep failed", dir)
+}
+
+// sweepTemps removes stale temporary files in the background. Partial
+// objects of checkpointed archives are kept as long as their checkpoints.
+func (m *Mover) sweepTemps() {
+	maxAge := tempMaxAge
+	if m.Checkpoints != nil {
+		maxAge = checkpointMaxAge
+	}
+	n, err := m.SweepTemps(maxAge)
+	if err != nil {
+		alert.Warnf("%s: %v", m.Name, err)
+	}
+	if n > 0 {
+		audit.Logf("%s: removed %d stale temporary files", m.Name, n)
+	}
+}
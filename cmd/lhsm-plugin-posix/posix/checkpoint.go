@@ -0,0 +1,252 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package posix
+
+import (
+	"encoding"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/intel-hpdd/lemur/dmplugin"
+	"github.com/intel-hpdd/lemur/dmplugin/dmio"
+	"github.com/intel-hpdd/lemur/pkg/checksum"
+	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+const (
+	defaultCheckpointInterval = 1024 * 1024 * 1024
+
+	// checkpointMaxAge is how long a checkpoint is kept without being
+	// updated before it is assumed its action was cancelled.
+	checkpointMaxAge = 7 * 24 * time.Hour
+
+	// checkpointSweepInterval is how often old checkpoints are looked
+	// for.
+	checkpointSweepInterval = time.Hour
+)
+
+// discardCheckpoint removes the partial object of an archive that won't
+// be resumed.
+func (m *Mover) discardCheckpoint(cp *dmplugin.Checkpoint) error {
+	if cp.Op != dmplugin.CheckpointArchive || cp.ObjectID == "" {
+		return nil
+	}
+	debug.Printf("%s: removing partial object %s", m.Name, cp.ObjectID)
+	for _, p := range m.tempPaths(cp.ObjectID) {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// resetCheckpoint discards the progress recorded in a checkpoint, so the
+// operation starts again.
+func (m *Mover) resetCheckpoint(cp *dmplugin.Checkpoint) {
+	if err := m.discardCheckpoint(cp); err != nil {
+		alert.Warnf("%s: remove partial object %s failed: %v", m.Name, cp.ObjectID, err)
+	}
+	cp.ObjectID = ""
+	cp.Done = 0
+	cp.Hash = nil
+	cp.Chunks = nil
+	cp.ChunkSize = 0
+	cp.Checksum = ""
+}
+
+// createObject creates the temporary file of a new object with the given
+// name in each of roots, or reopens the partial object recorded in the
+// checkpoint if there is one and its roots are still writable.
+func (m *Mover) createObject(cp *dmplugin.Checkpoint, roots []*RootConfig, name string) (string, *objectFile, error) {
+	if cp != nil && cp.ObjectID != "" && m.isReadOnly(cp.ObjectID) {
+		debug.Printf("%s: root of partial object %s is read only, archiving from the start", m.Name, cp.ObjectID)
+		m.resetCheckpoint(cp)
+	}
+	if cp != nil && cp.ObjectID != "" {
+		dst, err := m.openObject(cp.ObjectID)
+		if err == nil {
+			return cp.ObjectID, dst, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", nil, err
+		}
+		alert.Warnf("%s: partial object %s is missing, archiving from the start", m.Name, cp.ObjectID)
+		m.resetCheckpoint(cp)
+	}
+
+	fileID := replicaID(name, roots)
+	var dst *objectFile
+	if len(roots) > 1 {
+		var err error
+		if dst, err = m.createReplicas(name, roots); err != nil {
+			return "", nil, err
+		}
+	} else {
+		p, err := m.createPath(roots[0], name)
+		if err != nil {
+			return "", nil, err
+		}
+		f, err := os.OpenFile(tempName(p), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return "", nil, err
+		}
+		dst = newObjectFile(name, roots, []*os.File{f}, 1)
+	}
+	if cp != nil {
+		// Record the object before any data is written, so it is
+		// removed if the checkpoint is discarded.
+		cp.ObjectID = fileID
+		if err := m.Checkpoints.Save(cp); err != nil {
+			dst.Close()
+			return "", nil, err
+		}
+	}
+	return fileID, dst, nil
+}
+
+// openObject reopens the temporary file of a partial object.
+func (m *Mover) openObject(id string) (*objectFile, error) {
+	if isReplicated(id) {
+		return m.openReplicas(id)
+	}
+	f, err := os.OpenFile(m.tempPath(id), os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	name, root := m.locate(id)
+	return newObjectFile(name, []*RootConfig{root}, []*os.File{f}, 1), nil
+}
+
+// resumeChecksum restores the checksum state saved in a checkpoint into
+// cw, which calculates checksums with the algorithm alg. It returns false
+// if the state can't be restored, and the copy must start again.
+func resumeChecksum(cw checksum.Writer, alg string, cp *dmplugin.Checkpoint) bool {
+	if cp.Done == 0 {
+		return true
+	}
+	u, ok := cw.(encoding.BinaryUnmarshaler)
+	if !ok || checkpointAlgorithm(cp) != alg {
+		return false
+	}
+	if err := u.UnmarshalBinary(cp.Hash); err != nil {
+		alert.Warnf("checkpoint checksum state is invalid: %v", err)
+		return false
+	}
+	return true
+}
+
+// checkpointAlgorithm returns the algorithm of the checksums saved in a
+// checkpoint.
+func checkpointAlgorithm(cp *dmplugin.Checkpoint) string {
+	if cp.Checksum == "" {
+		return checksum.SHA1
+	}
+	return cp.Checksum
+}
+
+// restoreCheckpoint returns the checkpoint of a restore into dst, and
+// restores the checksum state of the data already restored into cw. The
+// restore can only be resumed if the file still holds that data, which
+// isn't the case when Lustre restores into a new volatile file.
+func (m *Mover) restoreCheckpoint(action dmplugin.Action, dst *dmio.ActionWriter, cw checksum.Writer) (*dmplugin.Checkpoint, error) {
+	cp, err := m.Checkpoints.Load(dmplugin.CheckpointRestore, action, action.UUID())
+	if err != nil {
+		return nil, err
+	}
+	cp.ObjectID = action.UUID()
+	if cp.Done == 0 {
+		cp.Checksum = restoreAlgorithm(action)
+		return cp, nil
+	}
+
+	fi, err := dst.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "stat failed")
+	}
+	if fi.Size() < action.Offset()+cp.Done || !resumeChecksum(cw, restoreAlgorithm(action), cp) {
+		debug.Printf("%s id:%d can't resume restore of %s at %d", m.Name, action.ID(), action.PrimaryPath(), cp.Done)
+		cp.Done = 0
+		cp.Hash = nil
+		cp.Checksum = restoreAlgorithm(action)
+		return cp, nil
+	}
+	debug.Printf("%s id:%d resuming restore of %s at %d", m.Name, action.ID(), action.PrimaryPath(), cp.Done)
+	if _, err := dst.Seek(cp.Done, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "seek failed")
+	}
+	return cp, nil
+}
+
+// archiveResumable copies the file's data to the object in a single
+// stream, continuing from the checkpoint, and returns the number of bytes
+// copied and their checksum.
+func (m *Mover) archiveResumable(action dmplugin.Action, rdr io.ReadSeeker, dst *objectFile, total int64, cp *dmplugin.Checkpoint) (int64, []byte, error) {
+	cw := m.ChecksumWriter(dst)
+	alg := m.checksumAlgorithm()
+	if !resumeChecksum(cw, alg, cp) || cp.Done > total {
+		cp.Done = 0
+	}
+	cp.Checksum = alg
+	if err := dst.Truncate(cp.Done); err != nil {
+		return 0, nil, errors.Wrapf(err, "%s: truncate failed", dst.Name())
+	}
+	if cp.Done > 0 {
+		debug.Printf("%s id:%d resuming archive of %s at %d", m.Name, action.ID(), action.PrimaryPath(), cp.Done)
+		if _, err := dst.Seek(cp.Done, io.SeekStart); err != nil {
+			return 0, nil, errors.Wrapf(err, "%s: seek failed", dst.Name())
+		}
+		if _, err := rdr.Seek(cp.Done, io.SeekStart); err != nil {
+			return 0, nil, errors.Wrapf(err, "%s: seek failed", action.PrimaryPath())
+		}
+	}
+
+	n, err := m.copyCheckpointed(action, cw, dst.Sync, rdr, total, cp)
+	if err != nil {
+		debug.Printf("copy error %v read %d expected %d", err, n, total)
+		return 0, nil, errors.Wrap(err, "copy failed")
+	}
+	return n, cw.Sum(), nil
+}
+
+// copyCheckpointed copies src to cw like CopyWithProgress, and saves a
+// checkpoint each time another CheckpointInterval bytes have been copied
+// and synced. It returns the total number of bytes copied, including
+// those copied before the checkpoint was loaded.
+func (m *Mover) copyCheckpointed(action dmplugin.Action, cw checksum.Writer, sync func() error, src io.Reader, total int64, cp *dmplugin.Checkpoint) (int64, error) {
+	base := cp.Done
+	progressFunc := func(offset, n int64) error {
+		return action.Update(base+offset, n, total)
+	}
+	progressWriter := dmio.NewProgressWriter(cw, updateInterval, progressFunc)
+	defer progressWriter.StopUpdates()
+
+	marshaler, _ := cw.(encoding.BinaryMarshaler)
+	for {
+		n, err := io.CopyN(progressWriter, src, m.CheckpointInterval)
+		cp.Done += n
+		if err == io.EOF {
+			return cp.Done, nil
+		} else if err != nil {
+			return cp.Done, err
+		}
+
+		if err := sync(); err != nil {
+			return cp.Done, errors.Wrap(err, "sync failed")
+		}
+		if marshaler == nil {
+			continue
+		}
+		if cp.Hash, err = marshaler.MarshalBinary(); err != nil {
+			return cp.Done, errors.Wrap(err, "save checksum state failed")
+		}
+		if err := m.Checkpoints.Save(cp); err != nil {
+			return cp.Done, err
+		}
+	}
+}
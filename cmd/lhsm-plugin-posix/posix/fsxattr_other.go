@@ -0,0 +1,11 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !ppc64le
+// +build !ppc64le
+
+package posix
+
+// iocFsGetXattr is FS_IOC_FSGETXATTR, which gets a file's project ID.
+const iocFsGetXattr = 0x801c581f
@@ -0,0 +1,8 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package posix
+
+// iocFsGetXattr is FS_IOC_FSGETXATTR, which gets a file's project ID.
+const iocFsGetXattr = 0x401c581f
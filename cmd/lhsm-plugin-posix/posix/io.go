@@ -0,0 +1,175 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package posix
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"github.com/intel-hpdd/lemur/dmplugin"
+	"github.com/intel-hpdd/lemur/dmplugin/dmio"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+type (
+	// IOConfig selects how an archive's data is read and written.
+	IOConfig struct {
+		BufferSize int  `hcl:"buffer_size"` // Default is dmio.BufferSize
+		Direct     bool `hcl:"direct"`      // Bypass the page cache with O_DIRECT
+		ZeroCopy   bool `hcl:"zero_copy"`   // Copy plain data within the kernel
+	}
+
+	// actionReader reads the extent of an archive action.
+	actionReader interface {
+		io.ReadSeeker
+		io.Closer
+	}
+
+	// decodedReader is a reader that decodes an object's data, and
+	// closes the reader of the object when it is closed.
+	decodedReader struct {
+		io.ReadCloser
+		src io.Closer
+	}
+)
+
+// withDefaults returns a copy of the configuration with the default
+// buffer size if it is unset. Buffers for direct I/O are rounded up to a
+// multiple of dmio.Alignment.
+func (c *IOConfig) withDefaults() IOConfig {
+	var result IOConfig
+	if c != nil {
+		result = *c
+	}
+	if result.BufferSize == 0 {
+		result.BufferSize = dmio.BufferSize
+	}
+	if result.Direct && result.BufferSize%dmio.Alignment != 0 {
+		result.BufferSize += dmio.Alignment - result.BufferSize%dmio.Alignment
+	}
+	return result
+}
+
+// Close closes the decoder and the object's reader.
+func (r *decodedReader) Close() error {
+	err := r.ReadCloser.Close()
+	if e := r.src.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// newActionReader returns a reader of the action's extent, and the
+// extent's length. The file is read with direct I/O if it is enabled and
+// the file's filesystem supports it.
+func (m *Mover) newActionReader(action dmplugin.Action) (actionReader, int64, error) {
+	if m.IO.Direct {
+		rdr, total, err := dmio.NewDirectActionReader(action, m.IO.BufferSize)
+		if err == nil {
+			return rdr, total, nil
+		} else if err != dmio.ErrDirectUnsupported {
+			return nil, 0, err
+		}
+		debug.Printf("%s id:%d direct I/O not supported for %s", m.Name, action.ID(), action.PrimaryPath())
+	}
+	rdr, total, err := dmio.NewBufferedActionReaderSize(action, m.IO.BufferSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rdr, total, nil
+}
+
+// newObjectSource returns a reader of an object's data from offset off,
+// with direct I/O if it is enabled. The reader doesn't close src.
+func (m *Mover) newObjectSource(src *os.File, off int64) (io.ReadCloser, error) {
+	if m.IO.Direct {
+		rdr, err := dmio.NewDirectReader(src.Name(), off, -1, m.IO.BufferSize)
+		if err == nil {
+			return rdr, nil
+		} else if err != dmio.ErrDirectUnsupported {
+			return nil, errors.Wrapf(err, "%s: open failed", src.Name())
+		}
+		debug.Printf("%s: direct I/O not supported for %s", m.Name, src.Name())
+	}
+	if _, err := src.Seek(off, io.SeekStart); err != nil {
+		return nil, errors.Wrapf(err, "%s: seek failed", src.Name())
+	}
+	return ioutil.NopCloser(bufio.NewReaderSize(src, m.IO.BufferSize)), nil
+}
+
+// newDirectWriter returns a writer to f from its current offset with
+// direct I/O, or nil if direct I/O isn't enabled or can't be used for f.
+// The writer must be closed to write the data it has buffered.
+func (m *Mover) newDirectWriter(f *os.File) (*dmio.DirectWriter, error) {
+	if !m.IO.Direct {
+		return nil, nil
+	}
+	w, err := dmio.NewDirectWriter(f, m.IO.BufferSize)
+	if err == dmio.ErrDirectUnsupported {
+		debug.Printf("%s: direct I/O not supported for %s", m.Name, f.Name())
+		return nil, nil
+	}
+	return w, err
+}
+
+// zeroCopy returns true if data copied with a codec and data key can be
+// copied within the kernel, which requires that it is neither transformed
+// nor checksummed.
+func (m *Mover) zeroCopy(codec dmio.Codec, dataKey []byte, checksummed bool) bool {
+	return m.IO.ZeroCopy && codec == nil && dataKey == nil && !checksummed
+}
+
+// copyRange copies length bytes from src at srcOff to dst at dstOff with
+// dmio.CopyRange, with progress updates. It returns
+// dmio.ErrZeroCopyUnsupported if the files can't be copied between that
+// way.
+func (m *Mover) copyRange(action dmplugin.Action, dst *os.File, dstOff int64, src *os.File, srcOff, length int64) (int64, error) {
+	progressFunc := func(offset, n int64) error {
+		return action.Update(offset, n, length)
+	}
+	counter := dmio.NewProgressCounter(updateInterval, progressFunc)
+	defer counter.StopUpdates()
+
+	return dmio.CopyRange(dst, dstOff, src, srcOff, length, counter.Add)
+}
+
+// archiveZeroCopy copies the action's extent to an object with a single
+// replica within the kernel, and returns the number of bytes copied.
+func (m *Mover) archiveZeroCopy(action dmplugin.Action, dst *objectFile, total int64) (int64, error) {
+	src, err := os.Open(action.PrimaryPath())
+	if err != nil {
+		return 0, errors.Wrapf(err, "%s: open failed", action.PrimaryPath())
+	}
+	defer src.Close()
+
+	n, err := m.copyRange(action, dst.files[0], 0, src, action.Offset(), total)
+	if err == dmio.ErrZeroCopyUnsupported {
+		return 0, err
+	} else if err != nil {
+		return 0, errors.Wrap(err, "copy failed")
+	}
+	if n != total {
+		return 0, errors.Errorf("copy failed: read %d expected %d", n, total)
+	}
+	return n, nil
+}
+
+// objectPlain returns true if the data of the object at p is stored as it
+// is, without compression or encryption.
+func objectPlain(p string) (bool, error) {
+	codec, err := objectCodec(p)
+	if err != nil {
+		return false, err
+	}
+	format, err := fileAttr(p, formatXattr)
+	if err != nil {
+		return false, err
+	}
+	return codec == nil && format == "" && !objectEncrypted(p), nil
+}
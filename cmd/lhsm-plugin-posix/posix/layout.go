@@ -0,0 +1,582 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package posix
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/intel-hpdd/lemur/dmplugin"
+	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/audit"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+// Group layouts store each new object under a top-level directory for
+// the owner or project of the file it was archived from.
+const (
+	GroupUID     = "uid"
+	GroupProject = "project"
+)
+
+// An object's path in a root is objects/[<group>/<id>/]<fan-out>/<name>,
+// where the fan-out directories are named by successive characters of the
+// object's name. Objects archived under a group layout have the group in
+// their names, as in "u1000.<uuid>" or "p42.<uuid>", so they can be found
+// from their IDs alone. The layouts objects were written under are
+// recorded in the layoutsFile of each root, one per line, oldest first,
+// and lookups try each of them.
+const (
+	layoutsFile    = "layouts"
+	groupSeparator = "."
+
+	// mirrorDir is the directory in each root where the mirror of the
+	// archived files' paths is kept, and mirrorXattr records an object's
+	// path in the mirror, so the link can be removed with the object.
+	mirrorDir   = "mirror"
+	mirrorXattr = "user.lhsm.mirror"
+
+	defaultLayoutDepth = 2
+	defaultLayoutWidth = 2
+	maxLayoutDepth     = 8
+	maxLayoutWidth     = 8
+)
+
+// legacyLayout is the layout of the objects written before layouts could
+// be configured.
+var legacyLayout = LayoutConfig{Depth: defaultLayoutDepth, Width: defaultLayoutWidth}
+
+// groupPrefixes are the prefixes of the groups in object names.
+var groupPrefixes = map[string]string{
+	GroupUID:     "u",
+	GroupProject: "p",
+}
+
+// LayoutConfig sets how new objects are arranged in an archive's roots.
+type LayoutConfig struct {
+	Depth  int    `hcl:"depth"`  // Levels of fan-out directories, default 2
+	Width  int    `hcl:"width"`  // Characters of the name per level, default 2
+	Group  string `hcl:"group"`  // "uid" or "project" top-level directories
+	Mirror bool   `hcl:"mirror"` // Symlinks to objects by file path
+}
+
+// withDefaults returns a copy of the configuration with the default
+// fan-out for the unset sizes.
+func (c *LayoutConfig) withDefaults() LayoutConfig {
+	var result LayoutConfig
+	if c != nil {
+		result = *c
+	}
+	if result.Depth == 0 {
+		result.Depth = defaultLayoutDepth
+	}
+	if result.Width == 0 {
+		result.Width = defaultLayoutWidth
+	}
+	return result
+}
+
+// checkLayout returns the problems with the archive's layout.
+func (a *ArchiveConfig) checkLayout() []string {
+	l := a.Layout
+	if l == nil {
+		return nil
+	}
+	var errs []string
+	if l.Depth < 0 || l.Depth > maxLayoutDepth {
+		errs = append(errs, fmt.Sprintf("Archive %s: layout depth must be between 1 and %d", a.Name, maxLayoutDepth))
+	}
+	if l.Width < 0 || l.Width > maxLayoutWidth {
+		errs = append(errs, fmt.Sprintf("Archive %s: layout width must be between 1 and %d", a.Name, maxLayoutWidth))
+	}
+	if _, ok := groupPrefixes[l.Group]; !ok && l.Group != "" {
+		errs = append(errs, fmt.Sprintf("Archive %s: unknown layout group %q", a.Name, l.Group))
+	}
+	return errs
+}
+
+// String returns the layout as it is recorded in a root's layouts file,
+// such as "2x2" or "uid:3x2". Mirroring doesn't change where objects are,
+// so isn't recorded.
+func (c LayoutConfig) String() string {
+	s := fmt.Sprintf("%dx%d", c.Depth, c.Width)
+	if c.Group != "" {
+		s = c.Group + ":" + s
+	}
+	return s
+}
+
+// parseLayout parses a layout recorded in a root's layouts file.
+func parseLayout(s string) (LayoutConfig, error) {
+	var l LayoutConfig
+	if i := strings.Index(s, ":"); i >= 0 {
+		l.Group, s = s[:i], s[i+1:]
+		if _, ok := groupPrefixes[l.Group]; !ok {
+			return l, errors.Errorf("unknown layout group %q", l.Group)
+		}
+	}
+	if _, err := fmt.Sscanf(s, "%dx%d", &l.Depth, &l.Width); err != nil {
+		return l, errors.Errorf("invalid layout %q", s)
+	}
+	if l.Depth < 1 || l.Depth > maxLayoutDepth || l.Width < 1 || l.Width > maxLayoutWidth {
+		return l, errors.Errorf("invalid layout %q", s)
+	}
+	return l, nil
+}
+
+// splitGroup returns the directories of the group in an object's name,
+// and the rest of the name, or false if the name has no group.
+func splitGroup(name string) (string, string, string, bool) {
+	i := strings.Index(name, groupSeparator)
+	if i < 2 {
+		return "", "", "", false
+	}
+	if _, err := strconv.ParseUint(name[1:i], 10, 32); err != nil {
+		return "", "", "", false
+	}
+	for group, prefix := range groupPrefixes {
+		if name[:1] == prefix {
+			return group, name[1:i], name[i+1:], true
+		}
+	}
+	return "", "", "", false
+}
+
+// objectDir returns the directory an object with the given name is stored
+// in under a root with this layout. The fan-out directories are named by
+// the part of the name after its group.
+func (c LayoutConfig) objectDir(root *RootConfig, name string) string {
+	parts := []string{root.Path, "objects"}
+	base := name
+	if group, id, rest, ok := splitGroup(name); ok {
+		if c.Group != "" {
+			parts = append(parts, group, id)
+		}
+		base = rest
+	}
+	for i := 0; i < c.Depth && (i+1)*c.Width <= len(base); i++ {
+		parts = append(parts, base[i*c.Width:(i+1)*c.Width])
+	}
+	return path.Join(parts...)
+}
+
+// readLayouts returns the layouts recorded in a root, oldest first, and
+// whether the root has a layouts file. A root with objects but no layouts
+// file has objects written under the legacy layout.
+func readLayouts(root *RootConfig) ([]LayoutConfig, bool, error) {
+	f, err := os.Open(path.Join(root.Path, layoutsFile))
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(path.Join(root.Path, "objects")); err == nil {
+			return []LayoutConfig{legacyLayout}, false, nil
+		}
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	var layouts []LayoutConfig
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		l, err := parseLayout(line)
+		if err != nil {
+			return nil, true, errors.Wrapf(err, "%s", f.Name())
+		}
+		layouts = append(layouts, l)
+	}
+	return layouts, true, errors.Wrapf(scanner.Err(), "%s: read failed", f.Name())
+}
+
+// loadLayouts reads the layouts recorded in each root, and records the
+// current layout in the roots new objects can be written to. Lookups try
+// the current layout first, then the recorded ones from newest to oldest.
+func (m *Mover) loadLayouts() error {
+	m.layouts = make([][]LayoutConfig, len(m.Roots))
+	for i := range m.Roots {
+		r := &m.Roots[i]
+		recorded, exists, err := readLayouts(r)
+		if err != nil {
+			return err
+		}
+		// A root without a layouts file has the legacy layout, so
+		// the file is only needed once another one is used. A new
+		// file starts with the legacy layout if the root already has
+		// objects.
+		implied := !exists && m.layoutKey() == legacyLayout
+		if !r.ReadOnly && !implied && (len(recorded) == 0 || recorded[len(recorded)-1] != m.layoutKey()) {
+			add := []LayoutConfig{m.layoutKey()}
+			if !exists {
+				add = append(recorded, add...)
+			}
+			if err := m.recordLayouts(r, add); err != nil {
+				alert.Warnf("%s: %v", m.Name, err)
+			}
+		}
+
+		layouts := []LayoutConfig{m.layoutKey()}
+		for j := len(recorded) - 1; j >= 0; j-- {
+			known := false
+			for _, l := range layouts {
+				known = known || l == recorded[j]
+			}
+			if !known {
+				layouts = append(layouts, recorded[j])
+			}
+		}
+		m.layouts[i] = layouts
+	}
+	return nil
+}
+
+// layoutKey returns the current layout without the settings that don't
+// change where objects are.
+func (m *Mover) layoutKey() LayoutConfig {
+	l := m.Layout
+	l.Mirror = false
+	return l
+}
+
+// recordLayouts appends layouts to a root's layouts file. They are
+// appended in a single write, so movers sharing a root can record layouts
+// at the same time.
+func (m *Mover) recordLayouts(r *RootConfig, layouts []LayoutConfig) error {
+	if err := os.MkdirAll(r.Path, 0700); err != nil {
+		return errors.Wrapf(err, "%s: create root failed", r.Path)
+	}
+	p := path.Join(r.Path, layoutsFile)
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "%s: open failed", p)
+	}
+	defer f.Close()
+	var lines string
+	for _, l := range layouts {
+		lines += l.String() + "\n"
+	}
+	if _, err := f.WriteString(lines); err != nil {
+		return errors.Wrapf(err, "%s: write failed", p)
+	}
+	return errors.Wrapf(f.Sync(), "%s: sync failed", p)
+}
+
+// rootLayouts returns the layouts tried to find objects in a root.
+func (m *Mover) rootLayouts(root *RootConfig) []LayoutConfig {
+	for i := range m.Roots {
+		if &m.Roots[i] == root && i < len(m.layouts) {
+			return m.layouts[i]
+		}
+	}
+	return []LayoutConfig{m.layoutKey(), legacyLayout}
+}
+
+// findPath returns the path of the object with the given name in a root,
+// and true if it or its temporary file exists under one of the root's
+// layouts. An object that doesn't exist has its path under the current
+// layout.
+func (m *Mover) findPath(root *RootConfig, name string) (string, bool) {
+	for _, l := range m.rootLayouts(root) {
+		p := path.Join(l.objectDir(root, name), name)
+		if _, err := os.Lstat(p); err == nil {
+			return p, true
+		}
+		if _, err := os.Lstat(tempName(p)); err == nil {
+			return p, true
+		}
+	}
+	return path.Join(m.Layout.objectDir(root, name), name), false
+}
+
+// createPath returns the path of the object with the given name in a root
+// like findPath, and creates its directory if it doesn't exist yet.
+func (m *Mover) createPath(root *RootConfig, name string) (string, error) {
+	p, found := m.findPath(root, name)
+	if !found {
+		if err := os.MkdirAll(path.Dir(p), 0700); err != nil {
+			return "", errors.Wrapf(err, "%s: create directory failed", path.Dir(p))
+		}
+	}
+	return p, nil
+}
+
+// objectName returns the name of a new object for the file being archived
+// by the action, with the file's group if the layout has groups.
+func (m *Mover) objectName(action dmplugin.Action) (string, error) {
+	name := newFileID()
+	var id uint32
+	switch m.Layout.Group {
+	case GroupUID:
+		fi, err := os.Stat(action.PrimaryPath())
+		if err != nil {
+			return "", errors.Wrap(err, "stat failed")
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return "", errors.Errorf("%s: no stat data", action.PrimaryPath())
+		}
+		id = st.Uid
+	case GroupProject:
+		var err error
+		if id, err = projectID(action.PrimaryPath()); err != nil {
+			return "", err
+		}
+	default:
+		return name, nil
+	}
+	return groupPrefixes[m.Layout.Group] + strconv.FormatUint(uint64(id), 10) + groupSeparator + name, nil
+}
+
+// fsxattr is the struct of the FS_IOC_FSGETXATTR ioctl.
+type fsxattr struct {
+	XFlags     uint32
+	ExtSize    uint32
+	NExtents   uint32
+	ProjID     uint32
+	CoWExtSize uint32
+	Pad        [8]byte
+}
+
+// projectID returns the project ID of a file.
+func projectID(name string) (uint32, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, errors.Wrapf(err, "%s: open failed", name)
+	}
+	defer f.Close()
+	var fsx fsxattr
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), iocFsGetXattr, uintptr(unsafe.Pointer(&fsx))); errno != 0 {
+		return 0, errors.Wrapf(errno, "%s: get project failed", name)
+	}
+	return fsx.ProjID, nil
+}
+
+// mirrorRoot returns the root an object's path is in.
+func (m *Mover) mirrorRoot(p string) *RootConfig {
+	for i := range m.Roots {
+		if strings.HasPrefix(p, path.Join(m.Roots[i].Path, "objects")+"/") {
+			return &m.Roots[i]
+		}
+	}
+	return nil
+}
+
+// linkMirror links the file's path in the mirror of the root of the
+// object at p to the object, replacing the link of an earlier archive of
+// the file.
+func (m *Mover) linkMirror(p, filePath string) error {
+	root := m.mirrorRoot(p)
+	if root == nil {
+		return errors.Errorf("%s: not in a root", p)
+	}
+	link := path.Join(root.Path, mirrorDir, path.Clean("/"+filePath))
+	target, err := filepath.Rel(path.Dir(link), p)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(link), 0700); err != nil {
+		return errors.Wrapf(err, "%s: create directory failed", path.Dir(link))
+	}
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "%s: remove failed", link)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		return errors.Wrapf(err, "%s: link failed", link)
+	}
+	return errors.Wrapf(unix.Setxattr(p, mirrorXattr, []byte(filePath), 0), "%s: record mirror failed", p)
+}
+
+// mirrorObject links the path of the file archived by the action to each
+// replica of its object in the mirror. Failures are only warned about, as
+// the mirror is a convenience.
+func (m *Mover) mirrorObject(action dmplugin.Action, id string, md *dmplugin.ObjectMetadata) {
+	var filePath string
+	if md != nil {
+		filePath = md.Path
+	} else {
+		var err error
+		if filePath, err = m.PathFunc(action); err != nil {
+			alert.Warnf("%s: mirror %s failed: %v", m.Name, id, err)
+			return
+		}
+	}
+	for _, p := range m.replicaPaths(id) {
+		if err := m.linkMirror(p, filePath); err != nil {
+			alert.Warnf("%s: mirror %s failed: %v", m.Name, id, err)
+		}
+	}
+}
+
+// mirrorLink returns the mirror's link to the object at p, and the path
+// of the file it mirrors, or empty strings if the object isn't mirrored or
+// the link was replaced by one to a later object.
+func (m *Mover) mirrorLink(p string) (string, string) {
+	filePath, err := fileAttr(p, mirrorXattr)
+	if err != nil || filePath == "" {
+		return "", ""
+	}
+	root := m.mirrorRoot(p)
+	if root == nil {
+		return "", ""
+	}
+	link := path.Join(root.Path, mirrorDir, path.Clean("/"+filePath))
+	target, err := os.Readlink(link)
+	if err != nil || path.Join(path.Dir(link), target) != path.Clean(p) {
+		return "", ""
+	}
+	return link, filePath
+}
+
+// unlinkMirror removes the mirror's link to the object at p, as returned
+// by mirrorLink before the object was removed.
+func (m *Mover) unlinkMirror(p, link string) {
+	if link == "" {
+		return
+	}
+	if err := os.Remove(link); err != nil {
+		alert.Warnf("%s: remove mirror of %s failed: %v", m.Name, p, err)
+	}
+}
+
+// fileAttr returns the value of an extended attribute of the file at p,
+// or an empty string if it isn't set.
+func fileAttr(p, name string) (string, error) {
+	buf := make([]byte, 4096)
+	sz, err := unix.Getxattr(p, name, buf)
+	switch {
+	case err == nil:
+		return string(buf[:sz]), nil
+	case err == unix.ENODATA || err == unix.ENOTSUP:
+		return "", nil
+	default:
+		return "", errors.Wrapf(err, "%s: read %s failed", p, name)
+	}
+}
+
+// Migrate moves the objects in the archive's writable roots that were
+// written under older layouts to their places under the current layout,
+// without changing their IDs. A root whose objects were all moved has its
+// older layouts forgotten. The archive should not be in use.
+func (m *Mover) Migrate() (*dmplugin.MigrateResult, error) {
+	result := &dmplugin.MigrateResult{Layout: m.Layout.String()}
+	for i := range m.Roots {
+		r := &m.Roots[i]
+		if r.ReadOnly {
+			debug.Printf("%s: root %q is read only, not migrating it", m.Name, r.Name)
+			continue
+		}
+		objects, moved, err := m.migrateRoot(r)
+		result.Objects += objects
+		result.Moved += moved
+		if err != nil {
+			return result, err
+		}
+		if objects == 0 && moved == 0 && len(m.rootLayouts(r)) == 1 {
+			continue
+		}
+		p := path.Join(r.Path, layoutsFile)
+		if err := writeFileAtomic(p, []byte(m.layoutKey().String()+"\n"), 0600); err != nil {
+			return result, err
+		}
+		if i < len(m.layouts) {
+			m.layouts[i] = []LayoutConfig{m.layoutKey()}
+		}
+	}
+	audit.Logf("%s: %d of %d objects moved to layout %s", m.Name, result.Moved, result.Objects, result.Layout)
+	return result, nil
+}
+
+// migrateRoot moves the objects in a root to their places under the
+// current layout, with their metadata and removal records, and removes the
+// directories left empty. It returns the number of objects in the root,
+// and the number moved.
+func (m *Mover) migrateRoot(r *RootConfig) (int, int, error) {
+	root := path.Join(r.Path, "objects")
+	var files, dirs []string
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == root {
+				return nil
+			}
+			return err
+		}
+		switch {
+		case fi.IsDir():
+			dirs = append(dirs, p)
+		case fi.Mode().IsRegular() && !strings.HasSuffix(fi.Name(), metadataSuffix) &&
+			!strings.HasSuffix(fi.Name(), deadSuffix):
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "%s: migrate failed", root)
+	}
+
+	var objects, moved int
+	for _, p := range files {
+		base := path.Base(p)
+		name := base
+		if isTemp(base) {
+			name = strings.TrimSuffix(strings.TrimPrefix(base, tempPrefix), tempSuffix)
+		} else {
+			objects++
+		}
+		dir := m.Layout.objectDir(r, name)
+		if dir == path.Dir(p) {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return objects, moved, errors.Wrapf(err, "%s: create directory failed", dir)
+		}
+		dst := path.Join(dir, base)
+		if _, err := os.Lstat(dst); err == nil {
+			return objects, moved, errors.Errorf("%s: %s already exists", p, dst)
+		}
+		link, filePath := m.mirrorLink(p)
+		if err := os.Rename(p, dst); err != nil {
+			return objects, moved, errors.Wrapf(err, "%s: move failed", p)
+		}
+		for _, suffix := range []string{metadataSuffix, deadSuffix} {
+			if err := os.Rename(p+suffix, dst+suffix); err != nil && !os.IsNotExist(err) {
+				return objects, moved, errors.Wrapf(err, "%s: move failed", p+suffix)
+			}
+		}
+		if err := syncDir(dir); err != nil {
+			return objects, moved, err
+		}
+		if link != "" {
+			if err := m.linkMirror(dst, filePath); err != nil {
+				alert.Warnf("%s: %v", m.Name, err)
+			}
+		}
+		debug.Printf("%s: moved %s to %s", m.Name, p, dst)
+		if !isTemp(base) {
+			moved++
+		}
+	}
+
+	// Remove the empty directories, deepest first.
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	for _, d := range dirs {
+		if d != root {
+			os.Remove(d)
+		}
+	}
+	return objects, moved, nil
+}
@@ -5,28 +5,32 @@
 package posix
 
 import (
-	"bufio"
 	"bytes"
-	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
+	lustre "github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/pkg/xattr"
 	"github.com/intel-hpdd/lemur/dmplugin"
 	"github.com/intel-hpdd/lemur/dmplugin/dmio"
 	"github.com/intel-hpdd/lemur/pkg/checksum"
-	"github.com/intel-hpdd/lemur/pkg/zipcheck"
 	"github.com/intel-hpdd/logging/alert"
 	"github.com/intel-hpdd/logging/audit"
 	"github.com/intel-hpdd/logging/debug"
 	"github.com/pborman/uuid"
 	"github.com/pkg/errors"
 	"github.com/rcrowley/go-metrics"
+	"golang.org/x/sys/unix"
 )
 
 var rate metrics.Meter
@@ -57,15 +61,64 @@ func init() {
 // Should this be configurable?
 const updateInterval = 10 * time.Second
 
+// metadataSuffix is appended to an object's name to name its metadata
+// sidecar.
+const metadataSuffix = ".meta"
+
+// codecXattr records the compression codec used to write an object. Objects
+// written before codecs were recorded are gzip compressed if their ID has a
+// .gz suffix.
+const codecXattr = "user.lhsm.codec"
+
+// keyXattr records the wrapped data key an encrypted object was encrypted
+// with.
+const keyXattr = "user.lhsm.key"
+
+// formatXattr records the format of a compressed object that isn't a
+// single compressed stream. Objects written in frames by
+// dmio.NewFrameWriter have the format formatFrames.
+const (
+	formatXattr  = "user.lhsm.format"
+	formatFrames = "frames"
+)
+
+// offsetXattr records the file offset of the start of an object that was
+// archived from an extent that didn't start at 0.
+const offsetXattr = "user.lhsm.offset"
+
+// sparseXattr records the logical size of an object archived from a
+// sparse file. The object's data starts with a dmio.SparseMap, followed by
+// the data of its extents.
+const sparseXattr = "user.lhsm.sparse"
+
+// refsXattr records the number of archived files that refer to a
+// deduplicated object. Objects without it have a single reference.
+const refsXattr = "user.lhsm.refs"
+
 type (
 
 	// ArchiveConfig is configuration for one mover.
 	ArchiveConfig struct {
-		Name        string          `hcl:",key"`
-		ID          int             `hcl:"id"`
-		Root        string          `hcl:"root"`
-		Compression string          `hcl:"compression"`
-		Checksums   *ChecksumConfig `hcl:"checksums"`
+		Name        string           `hcl:",key"`
+		ID          int              `hcl:"id"`
+		Root        string           `hcl:"root"`
+		Roots       []*RootConfig    `hcl:"roots"`
+		Placement   string           `hcl:"placement"`
+		Replicas    int              `hcl:"replicas"`
+		Quorum      int              `hcl:"quorum"`
+		Compression string           `hcl:"compression"`
+		Keyring     string           `hcl:"keyring"`
+		Dedup       bool             `hcl:"dedup"`
+		Sparse      bool             `hcl:"sparse"`
+		Metadata    bool             `hcl:"metadata"`
+		Checksums   *ChecksumConfig  `hcl:"checksums"`
+		Parallel    *ParallelConfig  `hcl:"parallel"`
+		Aggregate   *AggregateConfig `hcl:"aggregate"`
+		IO          *IOConfig        `hcl:"io"`
+		Layout      *LayoutConfig    `hcl:"layout"`
+
+		StateDir           string `hcl:"state_dir"`
+		CheckpointInterval int64  `hcl:"checkpoint_interval"`
 	}
 
 	// ArchiveSet is a list of mover configs.
@@ -74,28 +127,77 @@ type (
 	// ChecksumConfig defines the configured behavior for file
 	// checksumming in the POSIX data mover
 	ChecksumConfig struct {
-		Disabled                bool `hcl:"disabled"`
-		DisableCompareOnRestore bool `hcl:"disable_compare_on_restore"`
+		Disabled                bool   `hcl:"disabled"`
+		DisableCompareOnRestore bool   `hcl:"disable_compare_on_restore"`
+		Algorithm               string `hcl:"algorithm"` // Default is checksum.DefaultAlgorithm
 	}
-	// CompressionOption value determines  if data compression is enabled.
-	CompressionOption int
 
+	// ParallelConfig enables copying large uncompressed files with
+	// several concurrent streams.
+	ParallelConfig struct {
+		Streams   int   `hcl:"streams"`    // Disabled if less than 2
+		MinSize   int64 `hcl:"min_size"`   // Smallest file copied in parallel
+		ChunkSize int64 `hcl:"chunk_size"` // Rounded up to the file's stripe width
+	}
 	// Mover is a POSIX data mover
 	Mover struct {
 		Name        string
-		ArchiveDir  string
-		Compression CompressionOption
+		Compression *dmio.Compression
 		Checksums   ChecksumConfig
-	}
-)
+		Parallel    ParallelConfig
 
-const (
-	// CompressOff disables data compression
-	CompressOff CompressionOption = iota
-	// CompressOn enables data compression
-	CompressOn
-	// CompressAuto enables compression when a compressible file is detection
-	CompressAuto
+		// IO selects the buffer size of copies, and whether they use
+		// direct I/O or are copied within the kernel when they can be.
+		IO IOConfig
+
+		// Roots are the directories objects are stored in, and
+		// Placement the policy that chooses the root of each new
+		// object.
+		Roots     []RootConfig
+		Placement string
+		placer    placer
+
+		// Layout arranges new objects in the roots. Objects are also
+		// looked for under the older layouts recorded in each root,
+		// which are in layouts, newest first. PathFunc returns the path
+		// of an archived file in the mirror.
+		Layout   LayoutConfig
+		layouts  [][]LayoutConfig
+		PathFunc func(dmplugin.Action) (string, error)
+
+		// Replicas is the number of roots each new object is written
+		// to, and Quorum the number of them that must be written for
+		// an archive to succeed, which is all of them if it is 0.
+		Replicas int
+		Quorum   int
+
+		// Keyring enables encryption of archived data, with data keys
+		// wrapped by the keyring's current key.
+		Keyring *dmio.Keyring
+
+		// Dedup stores objects under the checksum of their content,
+		// so files with the same content share one object.
+		Dedup bool
+
+		// Sparse skips the holes in sparse files.
+		Sparse bool
+
+		// Checkpoints saves the progress of uncompressed, unencrypted
+		// copies every CheckpointInterval bytes, so they can be
+		// resumed after a restart.
+		Checkpoints        *dmplugin.CheckpointStore
+		CheckpointInterval int64
+
+		// Aggregate archives small files into containers, or is nil
+		// if they are archived as objects of their own.
+		Aggregate *AggregateConfig
+		packer    packer
+
+		// Metadata enables storing an ObjectMetadata sidecar with each
+		// object, collected by MetadataFunc.
+		Metadata     bool
+		MetadataFunc func(dmplugin.Action) (*dmplugin.ObjectMetadata, error)
+	}
 )
 
 var (
@@ -104,21 +206,50 @@ var (
 )
 
 func (a *ArchiveConfig) String() string {
-	return fmt.Sprintf("%d:%s", a.ID, a.Root)
+	var paths []string
+	for _, r := range a.rootConfigs() {
+		paths = append(paths, r.Path)
+	}
+	return fmt.Sprintf("%d:%s", a.ID, strings.Join(paths, ","))
 }
 
 // CheckValid determines if the archive configuration is a valid one.
 func (a *ArchiveConfig) CheckValid() error {
 	var errs []string
 
-	if a.Root == "" {
-		errs = append(errs, fmt.Sprintf("Archive %s: archive root not set", a.Name))
-	}
+	errs = append(errs, a.checkRoots()...)
+	errs = append(errs, a.checkAggregate()...)
+	errs = append(errs, a.checkLayout()...)
+	errs = append(errs, a.checkDedup()...)
 
 	if a.ID < 1 {
 		errs = append(errs, fmt.Sprintf("Archive %s: archive id not set", a.Name))
 	}
 
+	if _, err := dmio.ParseCompression(a.Compression); err != nil {
+		errs = append(errs, fmt.Sprintf("Archive %s: %v", a.Name, err))
+	}
+
+	if a.Checksums != nil && a.Checksums.Algorithm != "" {
+		if err := checksum.CheckAlgorithm(a.Checksums.Algorithm); err != nil {
+			errs = append(errs, fmt.Sprintf("Archive %s: %v", a.Name, err))
+		} else if a.Dedup && !checksum.Cryptographic(a.Checksums.Algorithm) {
+			errs = append(errs, fmt.Sprintf("Archive %s: dedup requires a cryptographic checksum algorithm", a.Name))
+		}
+	}
+
+	if p := a.Parallel; p != nil && (p.Streams < 0 || p.MinSize < 0 || p.ChunkSize < 0) {
+		errs = append(errs, fmt.Sprintf("Archive %s: parallel settings must not be negative", a.Name))
+	}
+
+	if a.IO != nil && a.IO.BufferSize < 0 {
+		errs = append(errs, fmt.Sprintf("Archive %s: io buffer_size must not be negative", a.Name))
+	}
+
+	if a.CheckpointInterval < 0 {
+		errs = append(errs, fmt.Sprintf("Archive %s: checkpoint_interval must not be negative", a.Name))
+	}
+
 	if len(errs) > 0 {
 		return errors.Errorf("Errors: %s", strings.Join(errs, ", "))
 	}
@@ -126,20 +257,6 @@ func (a *ArchiveConfig) CheckValid() error {
 	return nil
 }
 
-// CompressionOption parses Compression config parameter
-func (a *ArchiveConfig) CompressionOption() CompressionOption {
-	switch a.Compression {
-	case "on":
-		return CompressOn
-	case "off":
-		return CompressOff
-	case "auto":
-		return CompressAuto
-	default:
-		return CompressOff
-	}
-}
-
 // Merge the two configs and return a copy.
 // Does not return nil, even if both a and other are nil.
 func (a *ArchiveConfig) Merge(other *ArchiveConfig) *ArchiveConfig {
@@ -154,9 +271,55 @@ func (a *ArchiveConfig) Merge(other *ArchiveConfig) *ArchiveConfig {
 		if other.Root != "" {
 			result.Root = other.Root
 		}
+		if len(other.Roots) > 0 {
+			result.Roots = other.Roots
+		}
+		if other.Placement != "" {
+			result.Placement = other.Placement
+		}
+		if other.Replicas != 0 {
+			result.Replicas = other.Replicas
+		}
+		if other.Quorum != 0 {
+			result.Quorum = other.Quorum
+		}
 		if other.Compression != "" {
 			result.Compression = other.Compression
 		}
+		if other.Keyring != "" {
+			result.Keyring = other.Keyring
+		}
+		if other.Dedup {
+			result.Dedup = true
+		}
+		if other.Sparse {
+			result.Sparse = true
+		}
+		if other.Metadata {
+			result.Metadata = true
+		}
+		if other.Parallel != nil {
+			parallel := *other.Parallel
+			result.Parallel = &parallel
+		}
+		if other.Aggregate != nil {
+			aggregate := *other.Aggregate
+			result.Aggregate = &aggregate
+		}
+		if other.IO != nil {
+			io := *other.IO
+			result.IO = &io
+		}
+		if other.Layout != nil {
+			layout := *other.Layout
+			result.Layout = &layout
+		}
+		if other.StateDir != "" {
+			result.StateDir = other.StateDir
+		}
+		if other.CheckpointInterval != 0 {
+			result.CheckpointInterval = other.CheckpointInterval
+		}
 		result.Checksums = result.Checksums.Merge(other.Checksums)
 	} else {
 		// Ensure we have a new copy of Checksums
@@ -191,18 +354,90 @@ func (c *ChecksumConfig) Merge(other *ChecksumConfig) *ChecksumConfig {
 	return &result
 }
 
+// checkDedup returns the settings that can't be used with dedup. A
+// deduplicated object is shared by every file with its content, so it
+// can't carry the metadata of any one of them.
+func (a *ArchiveConfig) checkDedup() []string {
+	if !a.Dedup {
+		return nil
+	}
+	var errs []string
+	if a.Checksums != nil && a.Checksums.Disabled {
+		errs = append(errs, fmt.Sprintf("Archive %s: dedup requires checksums", a.Name))
+	}
+	if a.Replicas > 1 {
+		errs = append(errs, fmt.Sprintf("Archive %s: dedup can't be used with replicas", a.Name))
+	}
+	if a.Metadata {
+		errs = append(errs, fmt.Sprintf("Archive %s: dedup can't be used with metadata", a.Name))
+	}
+	return errs
+}
+
 // NewMover returns a new *Mover
 func NewMover(config *ArchiveConfig) (*Mover, error) {
-	if config.Root == "" {
-		return nil, errors.Errorf("Invalid mover config: ArchiveDir is unset")
+	errs := append(config.checkRoots(), config.checkAggregate()...)
+	errs = append(errs, config.checkLayout()...)
+	if errs = append(errs, config.checkDedup()...); len(errs) > 0 {
+		return nil, errors.Errorf("Invalid mover config: %s", strings.Join(errs, ", "))
+	}
+
+	compression, err := dmio.ParseCompression(config.Compression)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid mover config")
 	}
 
-	return &Mover{
-		Name:        config.Name,
-		ArchiveDir:  config.Root,
-		Compression: config.CompressionOption(),
-		Checksums:   *DefaultChecksums.Merge(config.Checksums),
-	}, nil
+	var keyring *dmio.Keyring
+	if config.Keyring != "" {
+		keyring, err = dmio.OpenKeyring(config.Keyring)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid mover config")
+		}
+	}
+
+	m := &Mover{
+		Name:               config.Name,
+		Roots:              config.rootConfigs(),
+		Placement:          config.Placement,
+		Replicas:           config.Replicas,
+		Quorum:             config.Quorum,
+		Compression:        compression,
+		Keyring:            keyring,
+		Dedup:              config.Dedup,
+		Sparse:             config.Sparse,
+		Parallel:           config.Parallel.withDefaults(),
+		Aggregate:          config.Aggregate.withDefaults(),
+		IO:                 config.IO.withDefaults(),
+		Layout:             config.Layout.withDefaults(),
+		PathFunc:           dmplugin.FilePath,
+		Checksums:          *DefaultChecksums.Merge(config.Checksums),
+		CheckpointInterval: config.CheckpointInterval,
+		Metadata:           config.Metadata,
+		MetadataFunc:       dmplugin.NewObjectMetadata,
+	}
+	if m.CheckpointInterval == 0 {
+		m.CheckpointInterval = defaultCheckpointInterval
+	}
+	if err := checksum.CheckAlgorithm(m.checksumAlgorithm()); err != nil {
+		return nil, errors.Wrap(err, "Invalid mover config")
+	}
+	if m.Dedup && !checksum.Cryptographic(m.checksumAlgorithm()) {
+		return nil, errors.New("Invalid mover config: dedup requires a cryptographic checksum algorithm")
+	}
+	if err := m.loadLayouts(); err != nil {
+		return nil, errors.Wrap(err, "load layouts failed")
+	}
+
+	// Each archive has its own checkpoints, as the same file may be
+	// archived to several of them.
+	if config.StateDir != "" {
+		dir := path.Join(config.StateDir, "posix-"+strconv.Itoa(config.ID))
+		if m.Checkpoints, err = dmplugin.OpenCheckpointStore(dir); err != nil {
+			return nil, errors.Wrap(err, "Invalid mover config")
+		}
+		m.Checkpoints.Discard = m.discardCheckpoint
+	}
+	return m, nil
 }
 
 func newFileID() string {
@@ -233,36 +468,75 @@ func (m *Mover) ChecksumEnabled() bool {
 	return !m.Checksums.Disabled
 }
 
-// ChecksumWriter returns an instance of its namesake.
-func (m *Mover) ChecksumWriter(dst io.Writer) (cw checksum.Writer) {
-	if m.ChecksumEnabled() {
-		cw = checksum.NewSha1HashWriter(dst)
-	} else {
-		cw = checksum.NewNoopHashWriter(dst)
+// ChecksumWriter returns an instance of its namesake, which calculates
+// checksums with the configured algorithm.
+func (m *Mover) ChecksumWriter(dst io.Writer) checksum.Writer {
+	return m.checksumWriter(dst, m.checksumAlgorithm())
+}
+
+// checksumWriter returns a checksum.Writer for the algorithm, or one that
+// doesn't calculate a checksum if checksums are disabled.
+func (m *Mover) checksumWriter(dst io.Writer, alg string) checksum.Writer {
+	if !m.ChecksumEnabled() {
+		return checksum.NewNoopHashWriter(dst)
+	}
+	cw, err := checksum.NewHashWriter(dst, alg)
+	if err != nil {
+		// The algorithm is checked when the mover is created.
+		alert.Abort(err)
 	}
-	return
+	return cw
+}
+
+// checksumAlgorithm returns the algorithm new archives are checksummed
+// with.
+func (m *Mover) checksumAlgorithm() string {
+	if m.Checksums.Algorithm == "" {
+		return checksum.DefaultAlgorithm
+	}
+	return m.Checksums.Algorithm
+}
+
+// restoreAlgorithm returns the algorithm of the checksum recorded when the
+// action's object was archived, which its data is checksummed with when
+// it is read back.
+func restoreAlgorithm(action dmplugin.Action) string {
+	return checksum.Algorithm(action.Hash())
 }
 
-// Destination returns the path to archived file.
+// Destination returns the path to archived file, under the layout it was
+// written with, or the current layout if it doesn't exist. It doesn't
+// create any directories.
 // Exported for testing.
 func (m *Mover) Destination(id string) string {
-	dir := path.Join(m.ArchiveDir,
-		"objects",
-		fmt.Sprintf("%s", id[0:2]),
-		fmt.Sprintf("%s", id[2:4]))
-
-	err := os.MkdirAll(dir, 0700)
-	if err != nil {
-		alert.Abort(errors.Wrap(err, "mkdirall failed"))
-	}
-	return path.Join(dir, id)
+	name, root := m.locate(id)
+	p, _ := m.findPath(root, name)
+	return p
 }
 
 // Start signals the mover to begin any asynchronous processing (e.g. stats)
 func (m *Mover) Start() {
+	go m.sweepTemps()
+	go m.Checkpoints.SweepEvery(m.Name, checkpointSweepInterval, checkpointMaxAge)
 	debug.Printf("%s started", m.Name)
 }
 
+// Stop signals the mover that the action stream has ended, and finishes
+// the archives of the files in its open container
+func (m *Mover) Stop() {
+	m.sealOpen()
+	debug.Printf("%s stopped", m.Name)
+}
+
+// Features returns the optional protocol features supported by the mover
+func (m *Mover) Features() []string {
+	features := []string{dmplugin.FeaturePartialRestore}
+	if !m.Checksums.Disabled {
+		features = append(features, dmplugin.FeatureChecksums)
+	}
+	return features
+}
+
 // Archive fulfills an HSM Archive request
 func (m *Mover) Archive(action dmplugin.Action) error {
 	debug.Printf("%s id:%d ARCHIVE %s", m.Name, action.ID(), action.PrimaryPath())
@@ -270,67 +544,414 @@ func (m *Mover) Archive(action dmplugin.Action) error {
 	start := time.Now()
 
 	// Initialize Reader for Lustre file
-	rdr, total, err := dmio.NewBufferedActionReader(action)
+	rdr, total, err := m.newActionReader(action)
 	if err != nil {
 		return errors.Wrapf(err, "Could not create archive reader for %s", action)
 	}
 	defer rdr.Close()
 
-	// If auto-compression enabled, determine "compressibility"
-	enableZip := false
-	switch m.Compression {
-	case CompressOn:
-		enableZip = true
-	case CompressAuto:
-		reduction, e2 := zipcheck.AnalyzeFile(action.PrimaryPath())
-		if e2 != nil {
-			return errors.Wrapf(e2, "AnalyzeFile failed")
+	codec, err := m.Compression.Select(action.PrimaryPath())
+	if err != nil {
+		return err
+	}
+
+	var md *dmplugin.ObjectMetadata
+	if m.Metadata {
+		md, err = m.MetadataFunc(action)
+		if err != nil {
+			return errors.Wrapf(err, "%s: read metadata failed", action.PrimaryPath())
 		}
-		if reduction > 30.0 {
-			debug.Printf("%s id:%d ZIP %s estimate %0.1f%% reduction", m.Name, action.ID(), action.PrimaryPath(), reduction)
-			enableZip = true
+	}
+
+	// Small files are added to a container with other files.
+	if m.aggregate(action, total, codec) {
+		return m.archiveMember(action, rdr, total, md)
+	}
+
+	var sm *dmio.SparseMap
+	if m.Sparse {
+		if sm, err = m.sparseMap(action, total); err != nil {
+			return err
 		}
 	}
 
-	// Initialize Writer for backing file
-	fileID := newFileID()
-	if enableZip {
-		fileID += ".gz"
+	// Uncompressed, unencrypted copies can be resumed from a checkpoint
+	// after a restart, as long as the file hasn't changed.
+	var chunkSize int64
+	if codec == nil && m.Keyring == nil && sm == nil && m.parallel(total) {
+		chunkSize = m.layoutChunkSize(action.PrimaryPath())
+	}
+	var cp *dmplugin.Checkpoint
+	if m.Checkpoints != nil && codec == nil && m.Keyring == nil && sm == nil && !m.Dedup {
+		version, err := dmplugin.FileVersion(action.PrimaryPath())
+		if err != nil {
+			return err
+		}
+		if cp, err = m.Checkpoints.Load(dmplugin.CheckpointArchive, action, version); err != nil {
+			return err
+		}
+		if cp.ObjectID != "" && cp.ChunkSize != chunkSize {
+			// The object was being copied differently.
+			m.resetCheckpoint(cp)
+		}
+		cp.ChunkSize = chunkSize
 	}
 
-	dst, err := os.Create(m.Destination(fileID))
+	// Initialize Writer for backing file. A deduplicated object's id
+	// isn't known until its checksum has been computed, so it is written
+	// to a temporary file first. A replicated object is written to a
+	// temporary file in each of its roots at once.
+	roots, err := m.placeReplicas()
+	if err != nil {
+		return err
+	}
+	var fileID string
+	var dst *objectFile
+	if m.Dedup {
+		var f *os.File
+		if f, err = m.createTemp(roots[0]); err == nil {
+			dst = newObjectFile("", roots, []*os.File{f}, 1)
+		}
+	} else {
+		var name string
+		if name, err = m.objectName(action); err == nil {
+			fileID, dst, err = m.createObject(cp, roots, name)
+		}
+	}
 	if err != nil {
-		return errors.Wrapf(err, "%s: create backing file failed", m.Destination(fileID))
+		return errors.Wrap(err, "create backing file failed")
 	}
 	defer dst.Close()
 
-	var cw checksum.Writer
-	if enableZip {
-		zip := gzip.NewWriter(dst)
-		defer zip.Close()
-		cw = m.ChecksumWriter(zip)
-	} else {
-		cw = m.ChecksumWriter(dst)
+	// The temporary files are kept after a failure only if the archive
+	// can be resumed from them. A deduplicated object's temporary file is
+	// always removed, as it is linked into place.
+	committed := false
+	defer func() {
+		if m.Dedup || (!committed && cp == nil) {
+			dst.remove()
+		}
+	}()
+
+	if codec != nil {
+		err = dst.setxattr(codecXattr, []byte(codec.Name()))
+		if err != nil {
+			return errors.Wrapf(err, "%s: record codec failed", dst.Name())
+		}
+	}
+	var dataKey []byte
+	var wk *dmio.WrappedKey
+	if m.Keyring != nil {
+		if dataKey, wk, err = m.Keyring.NewDataKey(); err != nil {
+			return err
+		}
+		err = dst.setxattr(keyXattr, []byte(wk.String()))
+		if err != nil {
+			return errors.Wrapf(err, "%s: record key failed", dst.Name())
+		}
+	}
+
+	if action.Offset() != 0 {
+		offset := strconv.FormatInt(action.Offset(), 10)
+		if err := dst.setxattr(offsetXattr, []byte(offset)); err != nil {
+			return errors.Wrapf(err, "%s: record offset failed", dst.Name())
+		}
 	}
 
 	// Copy
-	n, err := CopyWithProgress(cw, rdr, total, action)
+	var n int64
+	var sum []byte
+	if sm != nil {
+		n, sum, err = m.archiveSparse(action, dst, codec, dataKey, sm)
+	} else if chunkSize > 0 {
+		n, sum, err = m.archiveChunks(action, dst, total, chunkSize, cp)
+	} else if cp != nil {
+		n, sum, err = m.archiveResumable(action, rdr, dst, total, cp)
+	} else {
+		n, sum, err = m.archiveStream(action, rdr, dst, codec, dataKey, total)
+	}
 	if err != nil {
-		debug.Printf("copy error %v read %d expected %d", err, n, total)
-		return errors.Wrap(err, "copy failed")
+		return err
 	}
 
+	if m.Dedup {
+		if err := dst.Sync(); err != nil {
+			return errors.Wrapf(err, "%s: sync failed", dst.Name())
+		}
+		if fileID, err = m.linkObject(dst.files[0], sum, action.Offset(), roots[0]); err != nil {
+			return err
+		}
+		if err := syncDir(path.Dir(m.Destination(fileID))); err != nil {
+			return err
+		}
+	} else if fileID, err = m.commitObject(dst, fileID); err != nil {
+		return err
+	}
+	committed = true
+
 	debug.Printf("%s id:%d Archived %d bytes in %v from %s to %s %x", m.Name, action.ID(), n,
 		time.Since(start),
 		action.PrimaryPath(),
 		m.Destination(fileID),
-		cw.Sum())
+		sum)
+
+	if md != nil {
+		md.UUID = fileID
+		if codec != nil {
+			md.Codec = codec.Name()
+		}
+		if wk != nil {
+			md.KeyID = wk.KeyID
+		}
+		md.Hash = sum
+		md.Size = n
+		if err := m.writeMetadata(md); err != nil {
+			return err
+		}
+	}
+	if m.Layout.Mirror {
+		m.mirrorObject(action, fileID, md)
+	}
+
+	if err := m.Checkpoints.Remove(cp); err != nil {
+		alert.Warnf("%s: %v", m.Name, err)
+	}
 
 	action.SetUUID(fileID)
-	action.SetHash(cw.Sum())
+	action.SetHash(sum)
+	action.SetActualLength(n)
 	return nil
 }
 
+// archiveStream copies the file's data to the object in a single stream,
+// compressing and encrypting it if enabled, and returns the number of
+// bytes copied and their checksum. Data that is neither transformed nor
+// checksummed is copied within the kernel if zero-copy is enabled, unless
+// it is replicated, so the file is only read once.
+func (m *Mover) archiveStream(action dmplugin.Action, rdr io.Reader, dst *objectFile, codec dmio.Codec, dataKey []byte, total int64) (int64, []byte, error) {
+	if m.zeroCopy(codec, dataKey, m.ChecksumEnabled()) && len(dst.files) == 1 {
+		n, err := m.archiveZeroCopy(action, dst, total)
+		if err != dmio.ErrZeroCopyUnsupported {
+			return n, nil, err
+		}
+		debug.Printf("%s id:%d zero-copy not supported for %s", m.Name, action.ID(), action.PrimaryPath())
+	}
+
+	if m.IO.Direct {
+		if err := dst.startDirect(m); err != nil {
+			return 0, nil, err
+		}
+		defer dst.stopDirect()
+	}
+	enc, err := m.newObjectWriter(dst, codec, dataKey)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer enc.Close()
+	cw := m.ChecksumWriter(enc)
+
+	n, err := CopyWithProgress(cw, rdr, total, action)
+	if err != nil {
+		debug.Printf("copy error %v read %d expected %d", err, n, total)
+		return 0, nil, errors.Wrap(err, "copy failed")
+	}
+	if err := enc.Close(); err != nil {
+		return 0, nil, errors.Wrap(err, "flush encoder failed")
+	}
+	if err := dst.stopDirect(); err != nil {
+		return 0, nil, err
+	}
+	return n, cw.Sum(), nil
+}
+
+// newObjectWriter returns a writer that encodes data written to the
+// object. Compressed objects are written in frames so extents can be
+// restored without decompressing the whole object. Encrypted objects are
+// a single stream and are decoded from the start on restore.
+func (m *Mover) newObjectWriter(dst *objectFile, codec dmio.Codec, dataKey []byte) (io.WriteCloser, error) {
+	if codec != nil && dataKey == nil {
+		if err := dst.setxattr(formatXattr, []byte(formatFrames)); err != nil {
+			return nil, errors.Wrapf(err, "%s: record format failed", dst.Name())
+		}
+		return dmio.NewFrameWriter(dst, codec, dmio.FrameSize), nil
+	}
+	enc, err := dmio.NewEncoder(dst, codec, dataKey)
+	return enc, errors.Wrap(err, "create encoder failed")
+}
+
+// createTemp creates a temporary file in a root of the archive, from
+// which a deduplicated object is linked into place.
+func (m *Mover) createTemp(root *RootConfig) (*os.File, error) {
+	dir := path.Join(root.Path, "tmp")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(dir, "archive-")
+}
+
+// linkObject links the temporary file f into place in root as the object
+// for data with the checksum sum, and returns the object's id. If the
+// object already exists in a writable root its reference count is
+// incremented instead. Objects archived from an offset other than 0 are
+// only shared with objects from the same offset, and objects whose
+// checksum isn't SHA1 only with objects with the same algorithm.
+func (m *Mover) linkObject(f *os.File, sum []byte, offset int64, root *RootConfig) (string, error) {
+	alg, raw := checksum.Split(sum)
+	name := hex.EncodeToString(raw)
+	if alg != checksum.SHA1 {
+		name += "-" + alg
+	}
+	if offset != 0 {
+		name = fmt.Sprintf("%s-%d", name, offset)
+	}
+	if err := xattr.Fsetxattr(int(f.Fd()), refsXattr, []byte("1"), 0); err != nil {
+		return "", errors.Wrapf(err, "%s: record references failed", f.Name())
+	}
+	for {
+		for i := range m.Roots {
+			other := &m.Roots[i]
+			if other == root || other.ReadOnly {
+				continue
+			}
+			if _, found := m.findPath(other, name); !found {
+				continue
+			}
+			id := objectID(name, other)
+			added, err := m.addReference(id)
+			if err != nil {
+				return "", err
+			}
+			if added {
+				debug.Printf("%s: %s already archived", m.Name, id)
+				return id, nil
+			}
+		}
+
+		id := objectID(name, root)
+		p, err := m.createPath(root, name)
+		if err != nil {
+			return "", err
+		}
+		err = os.Link(f.Name(), p)
+		if err == nil {
+			return id, nil
+		}
+		if !os.IsExist(err) {
+			return "", errors.Wrapf(err, "%s: link object failed", id)
+		}
+		added, err := m.addReference(id)
+		if err != nil {
+			return "", err
+		}
+		if added {
+			debug.Printf("%s: %s already archived", m.Name, id)
+			return id, nil
+		}
+		// The existing object was removed before the reference
+		// could be added, so try to link this one again.
+	}
+}
+
+// lockObject opens an object and takes an exclusive lock on it, which
+// serializes changes to its reference count.
+func (m *Mover) lockObject(id string) (*os.File, error) {
+	f, err := os.Open(m.Destination(id))
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "%s: lock failed", id)
+	}
+	return f, nil
+}
+
+// addReference increments an existing object's reference count. It
+// returns false if the object no longer exists.
+func (m *Mover) addReference(id string) (bool, error) {
+	f, err := m.lockObject(id)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	var st unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &st); err != nil {
+		return false, errors.Wrapf(err, "%s: stat failed", id)
+	}
+	if st.Nlink == 0 {
+		return false, nil
+	}
+	refs, err := m.objectRefs(id)
+	if err != nil {
+		return false, err
+	}
+	return true, m.setRefs(id, refs+1)
+}
+
+// objectRefs returns the number of files that refer to an object.
+func (m *Mover) objectRefs(id string) (int, error) {
+	buf := make([]byte, 32)
+	sz, err := unix.Getxattr(m.Destination(id), refsXattr, buf)
+	switch {
+	case err == nil:
+		refs, err := strconv.Atoi(string(buf[:sz]))
+		if err != nil || refs < 1 {
+			return 0, errors.Errorf("%s: invalid reference count %q", id, buf[:sz])
+		}
+		return refs, nil
+	case err == unix.ENODATA || err == unix.ENOTSUP:
+		return 1, nil
+	default:
+		return 0, errors.Wrapf(err, "%s: read references failed", id)
+	}
+}
+
+func (m *Mover) setRefs(id string, refs int) error {
+	err := unix.Setxattr(m.Destination(id), refsXattr, []byte(strconv.Itoa(refs)), 0)
+	return errors.Wrapf(err, "%s: record references failed", id)
+}
+
+func (m *Mover) writeMetadata(md *dmplugin.ObjectMetadata) error {
+	data, err := json.Marshal(md)
+	if err != nil {
+		return errors.Wrap(err, "encode metadata failed")
+	}
+	for _, p := range m.replicaPaths(md.UUID) {
+		p += metadataSuffix
+		if err := writeFileAtomic(p, data, 0600); err != nil {
+			return errors.Wrapf(err, "%s: write metadata failed", p)
+		}
+	}
+	return nil
+}
+
+// ReadMetadata returns the metadata stored with an object, read from the
+// first of its replicas that has it. If the object has no metadata the
+// error satisfies os.IsNotExist.
+func (m *Mover) ReadMetadata(id string) (*dmplugin.ObjectMetadata, error) {
+	if containerID, offset, length, ok := splitMemberID(id); ok {
+		return m.memberMetadata(id, containerID, offset, length)
+	}
+	var data []byte
+	var err error
+	for _, p := range m.replicaPaths(id) {
+		if data, err = ioutil.ReadFile(p + metadataSuffix); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var md dmplugin.ObjectMetadata
+	if err := json.Unmarshal(data, &md); err != nil {
+		return nil, errors.Wrapf(err, "%s: decode metadata failed", id)
+	}
+	return &md, nil
+}
+
 // Restore fulfills an HSM Restore request
 func (m *Mover) Restore(action dmplugin.Action) error {
 	debug.Printf("%s id:%d RESTORE %s %s %x", m.Name, action.ID(), action.PrimaryPath(), action.UUID(), action.Hash())
@@ -342,27 +963,49 @@ func (m *Mover) Restore(action dmplugin.Action) error {
 		return errors.New("Missing UUID")
 	}
 
-	enableUnzip := false
-	if filepath.Ext(action.UUID()) == ".gz" {
-		debug.Printf("%s: id:%d decompressing %s", m.Name, action.ID(), action.UUID())
-		enableUnzip = true
+	if containerID, offset, length, ok := splitMemberID(action.UUID()); ok {
+		return m.restoreMember(action, containerID, offset, length, start)
+	}
+
+	// A replicated object is restored from the next of its replicas if
+	// one is missing or can't be restored.
+	paths := m.replicaPaths(action.UUID())
+	var err error
+	for i, p := range paths {
+		if err = m.restoreReplica(action, p, start); err == nil {
+			return nil
+		}
+		if i < len(paths)-1 {
+			alert.Warnf("%s id:%d restore from %s failed, trying the next replica: %v", m.Name, action.ID(), p, err)
+		}
 	}
+	return err
+}
 
-	src, err := os.Open(m.Destination(action.UUID()))
+// restoreReplica restores the action's extent from the replica of its
+// object at p.
+func (m *Mover) restoreReplica(action dmplugin.Action, p string, start time.Time) error {
+	src, err := os.Open(p)
 	if err != nil {
-		return errors.Wrapf(err, "%s: open failed", m.Destination(action.UUID()))
+		return errors.Wrapf(err, "%s: open failed", p)
 	}
 	defer src.Close()
 
-	var rdr io.Reader = bufio.NewReaderSize(src, dmio.BufferSize)
+	// The object may start at an offset in the file, and the extent
+	// being restored may start anywhere in the object.
+	base, err := objectOffset(p)
+	if err != nil {
+		return err
+	}
+	if action.Offset() < base {
+		return errors.Errorf("%s: extent at %d starts before object at %d", action.UUID(), action.Offset(), base)
+	}
+	skip := action.Offset() - base
 
-	if enableUnzip {
-		unzip, er2 := gzip.NewReader(rdr)
-		if er2 != nil {
-			return errors.Wrap(er2, "gzip NewReader failed")
-		}
-		defer unzip.Close()
-		rdr = unzip
+	if size, err := fileAttr(p, sparseXattr); err != nil {
+		return err
+	} else if size != "" {
+		return m.restoreSparse(action, src, skip, start)
 	}
 
 	// Initialize Writer for restore file on Lustre
@@ -377,21 +1020,112 @@ func (m *Mover) Restore(action dmplugin.Action) error {
 		return errors.Wrap(err, "Unable to determine actual file length")
 	}
 
-	cw := m.ChecksumWriter(dst)
+	// Objects that were archived in chunks have a chunked checksum, and
+	// can be restored in parallel.
+	chunkSize, err := objectChunkSize(p)
+	if err != nil {
+		return err
+	}
+	if chunkSize > 0 && m.Parallel.Streams > 1 {
+		return m.restoreChunks(action, src, dst, skip, chunkSize, start)
+	}
+
+	// Plain data whose checksum won't be compared is copied within the
+	// kernel if zero-copy is enabled.
+	compare := action.Hash() != nil && !m.Checksums.DisableCompareOnRestore
+	if m.zeroCopy(nil, nil, compare) && m.Checkpoints == nil {
+		if plain, err := objectPlain(p); err != nil {
+			return err
+		} else if plain {
+			n, err := m.copyRange(action, dst.File(), action.Offset(), src, skip, length)
+			if err == nil {
+				debug.Printf("%s id:%d Restored %d bytes in %v to %s without copying", m.Name, action.ID(), n,
+					time.Since(start),
+					action.PrimaryPath())
+				action.SetActualLength(n)
+				return nil
+			} else if err != dmio.ErrZeroCopyUnsupported {
+				return errors.Wrap(err, "copy failed")
+			}
+			debug.Printf("%s id:%d zero-copy not supported for %s", m.Name, action.ID(), action.PrimaryPath())
+		}
+	}
 
-	// Copy
-	n, err := CopyWithProgress(cw, rdr, length, action)
+	// Restores that aren't checkpointed write the file with direct I/O if
+	// it is enabled, as checkpoints sync the file as they go.
+	var out io.Writer = dst
+	if m.Checkpoints == nil {
+		dw, err := m.newDirectWriter(dst.File())
+		if err != nil {
+			return err
+		}
+		if dw != nil {
+			defer dw.Close()
+			out = dw
+		}
+	}
+
+	// The data is checksummed with the algorithm it was archived with.
+	var cw checksum.Writer
+	if chunkSize > 0 && m.ChecksumEnabled() {
+		if cw, err = checksum.NewChunkedHashWriter(out, chunkSize, restoreAlgorithm(action)); err != nil {
+			return err
+		}
+	} else {
+		cw = m.checksumWriter(out, restoreAlgorithm(action))
+	}
+
+	// Restores with a plain checksum can be resumed from a checkpoint.
+	var cp *dmplugin.Checkpoint
+	var done int64
+	if m.Checkpoints != nil && chunkSize == 0 {
+		if cp, err = m.restoreCheckpoint(action, dst, cw); err != nil {
+			return err
+		}
+		done = cp.Done
+	}
+
+	rdr, err := m.objectReader(action, src, skip+done)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+
+	// Copy the extent, or the rest of the object if the extent extends
+	// to the end of the file.
+	var in io.Reader = rdr
+	if action.Length() != lustre.MaxExtentLength {
+		in = io.LimitReader(rdr, length-done)
+	}
+	var n int64
+	if cp != nil {
+		n, err = m.copyCheckpointed(action, cw, dst.Sync, in, length, cp)
+	} else {
+		n, err = CopyWithProgress(cw, in, length, action)
+	}
 	if err != nil {
 		debug.Printf("copy error %v read %d expected %d", err, n, length)
 		return errors.Wrap(err, "copy failed")
 	}
+	if dw, ok := out.(*dmio.DirectWriter); ok {
+		if err := dw.Close(); err != nil {
+			return errors.Wrap(err, "copy failed")
+		}
+	}
 
-	if action.Hash() != nil && !m.Checksums.DisableCompareOnRestore {
+	// The file's checksum can only be compared if all of the object was
+	// restored.
+	whole := skip == 0 && atEOF(rdr)
+	if action.Hash() != nil && whole && !m.Checksums.DisableCompareOnRestore {
 		if bytes.Compare(action.Hash(), cw.Sum()) != 0 {
-			alert.Warnf("original checksum doesn't match new:  %x != %x", action.Hash(), cw.Sum())
+			alert.Warnf("original checksum doesn't match new:  %s != %s", checksum.Format(action.Hash()), checksum.Format(cw.Sum()))
+			m.Checkpoints.Remove(cp)
 			return errors.New("Checksum mismatch!")
 		}
 	}
+	if err := m.Checkpoints.Remove(cp); err != nil {
+		alert.Warnf("%s: %v", m.Name, err)
+	}
 
 	debug.Printf("%s id:%d Restored %d bytes in %v to %s %x", m.Name, action.ID(), n,
 		time.Since(start),
@@ -401,6 +1135,267 @@ func (m *Mover) Restore(action dmplugin.Action) error {
 	return nil
 }
 
+// objectReader returns a reader of an object's data, starting skip bytes
+// into the object. The object's encoding is read from the replica src was
+// opened from.
+func (m *Mover) objectReader(action dmplugin.Action, src *os.File, skip int64) (io.ReadCloser, error) {
+	id := action.UUID()
+	codec, err := objectCodec(src.Name())
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := m.objectKey(src.Name())
+	if err != nil {
+		return nil, err
+	}
+	format, err := fileAttr(src.Name(), formatXattr)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case format == formatFrames:
+		if codec == nil {
+			return nil, errors.Errorf("%s: framed object has no codec", id)
+		}
+		debug.Printf("%s: id:%d decompressing %s frames with %s from %d", m.Name, action.ID(), id, codec.Name(), skip)
+		fi, err := src.Stat()
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: stat failed", id)
+		}
+		fr, err := dmio.NewFrameReader(src, fi.Size(), codec)
+		if err != nil {
+			return nil, errors.Wrap(err, id)
+		}
+		if _, err := fr.Seek(skip, io.SeekStart); err != nil {
+			return nil, errors.Wrap(err, id)
+		}
+		return fr, nil
+	case format != "":
+		return nil, errors.Errorf("%s: unknown object format %q", id, format)
+	case codec == nil && dataKey == nil:
+		return m.newObjectSource(src, skip)
+	}
+
+	// Streams can only be read from the start.
+	in, err := m.newObjectSource(src, 0)
+	if err != nil {
+		return nil, err
+	}
+	if codec != nil {
+		debug.Printf("%s: id:%d decompressing %s with %s", m.Name, action.ID(), id, codec.Name())
+	}
+	dec, err := dmio.NewDecoder(in, codec, dataKey)
+	if err != nil {
+		in.Close()
+		return nil, errors.Wrapf(err, "%s: create decoder failed", id)
+	}
+	rdr := &decodedReader{ReadCloser: dec, src: in}
+	if skip > 0 {
+		if _, err := io.CopyN(ioutil.Discard, rdr, skip); err != nil {
+			rdr.Close()
+			return nil, errors.Wrapf(err, "%s: skip to %d failed", id, skip)
+		}
+	}
+	return rdr, nil
+}
+
+// atEOF returns true if there is no more data to read from r.
+func atEOF(r io.Reader) bool {
+	var buf [1]byte
+	n, _ := io.ReadFull(r, buf[:])
+	return n == 0
+}
+
+// objectOffset returns the file offset the data of the object at p
+// starts at.
+func objectOffset(p string) (int64, error) {
+	value, err := fileAttr(p, offsetXattr)
+	if err != nil || value == "" {
+		return 0, err
+	}
+	offset, err := strconv.ParseInt(value, 10, 64)
+	return offset, errors.Wrapf(err, "%s: invalid offset", p)
+}
+
+// List calls fn for each object in the archive's roots.
+func (m *Mover) List(fn func(*dmplugin.ObjectInfo) error) error {
+	for i := range m.Roots {
+		if err := m.listRoot(&m.Roots[i], fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Mover) listRoot(r *RootConfig, fn func(*dmplugin.ObjectInfo) error) error {
+	root := path.Join(r.Path, "objects")
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == root {
+				return nil
+			}
+			return err
+		}
+		if !fi.Mode().IsRegular() || strings.HasSuffix(fi.Name(), metadataSuffix) ||
+			strings.HasSuffix(fi.Name(), deadSuffix) || isTemp(fi.Name()) {
+			return nil
+		}
+		id := objectID(fi.Name(), r)
+
+		// The files in a container are listed instead of the
+		// container.
+		if value, err := fileAttr(p, containerXattr); err != nil {
+			return err
+		} else if value != "" {
+			return m.listMembers(id, fi, fn)
+		}
+
+		// A replicated object is listed once, with the first of
+		// its replicas.
+		if rid, err := fileAttr(p, replicasXattr); err != nil {
+			return err
+		} else if rid != "" {
+			if first := m.firstReplica(rid); first != nil && first != r {
+				return nil
+			}
+			id = rid
+		}
+
+		codec, err := objectCodec(p)
+		if err != nil {
+			return err
+		}
+		return fn(&dmplugin.ObjectInfo{
+			ID:      id,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+			Encoded: codec != nil || objectEncrypted(p) || objectSparse(p),
+		})
+	})
+	return errors.Wrapf(err, "%s: list failed", root)
+}
+
+// objectCodec returns the codec the object at p was compressed with, or
+// nil if it isn't compressed.
+func objectCodec(p string) (dmio.Codec, error) {
+	buf := make([]byte, 64)
+	sz, err := unix.Getxattr(p, codecXattr, buf)
+	switch {
+	case err == nil:
+		return dmio.NewCodec(string(buf[:sz]))
+	case err == unix.ENODATA || err == unix.ENOTSUP:
+		if filepath.Ext(p) == ".gz" {
+			return dmio.NewCodec(dmio.CodecGzip)
+		}
+		return nil, nil
+	default:
+		return nil, errors.Wrapf(err, "%s: read codec failed", p)
+	}
+}
+
+// objectWrappedKey returns the wrapped data key the object at p was
+// encrypted with, or nil if it isn't encrypted.
+func objectWrappedKey(p string) (*dmio.WrappedKey, error) {
+	buf := make([]byte, 1024)
+	sz, err := unix.Getxattr(p, keyXattr, buf)
+	switch {
+	case err == nil:
+		return dmio.ParseWrappedKey(string(buf[:sz]))
+	case err == unix.ENODATA || err == unix.ENOTSUP:
+		return nil, nil
+	default:
+		return nil, errors.Wrapf(err, "%s: read key failed", p)
+	}
+}
+
+func objectSparse(p string) bool {
+	size, _ := fileAttr(p, sparseXattr)
+	return size != ""
+}
+
+func objectEncrypted(p string) bool {
+	wk, _ := objectWrappedKey(p)
+	return wk != nil
+}
+
+// objectKey returns the data key the object at p was encrypted with, or
+// nil if it isn't encrypted.
+func (m *Mover) objectKey(p string) ([]byte, error) {
+	wk, err := objectWrappedKey(p)
+	if err != nil || wk == nil {
+		return nil, err
+	}
+	if m.Keyring == nil {
+		return nil, errors.Errorf("%s: object is encrypted with key %s but no keyring is configured", p, wk.KeyID)
+	}
+	return m.Keyring.Unwrap(wk)
+}
+
+// replicaWrappedKey returns the wrapped data key of the first replica of
+// an object that exists, or nil if the object isn't encrypted.
+func (m *Mover) replicaWrappedKey(id string) (*dmio.WrappedKey, error) {
+	var err error
+	for _, p := range m.replicaPaths(id) {
+		var wk *dmio.WrappedKey
+		if wk, err = objectWrappedKey(p); err == nil {
+			return wk, nil
+		} else if !os.IsNotExist(errors.Cause(err)) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// Rekey rewraps an encrypted object's data key with the keyring's current
+// key, and returns the ids of the old and new keys. The object's data is
+// not rewritten.
+func (m *Mover) Rekey(id string) (string, string, error) {
+	wk, err := m.replicaWrappedKey(id)
+	if err != nil || wk == nil {
+		return "", "", err
+	}
+	if m.Keyring == nil {
+		return wk.KeyID, wk.KeyID, errors.New("no keyring is configured")
+	}
+	nwk, changed, err := m.Keyring.Rewrap(wk)
+	if err != nil || !changed {
+		return wk.KeyID, wk.KeyID, err
+	}
+	for _, p := range m.replicaPaths(id) {
+		err := unix.Setxattr(p, keyXattr, []byte(nwk.String()), 0)
+		if err == unix.ENOENT && isReplicated(id) {
+			continue
+		} else if err != nil {
+			return wk.KeyID, wk.KeyID, errors.Wrapf(err, "%s: record key failed", id)
+		}
+		if err := rekeyMetadata(p+metadataSuffix, nwk.KeyID); err != nil {
+			return wk.KeyID, wk.KeyID, err
+		}
+	}
+	return wk.KeyID, nwk.KeyID, nil
+}
+
+// rekeyMetadata records an object's new key in the metadata stored at p,
+// if there is any.
+func rekeyMetadata(p string, keyID string) error {
+	data, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "%s: read metadata failed", p)
+	}
+	var md dmplugin.ObjectMetadata
+	if err := json.Unmarshal(data, &md); err != nil {
+		return errors.Wrapf(err, "%s: decode metadata failed", p)
+	}
+	md.KeyID = keyID
+	if data, err = json.Marshal(&md); err != nil {
+		return errors.Wrap(err, "encode metadata failed")
+	}
+	return errors.Wrapf(writeFileAtomic(p, data, 0600), "%s: write metadata failed", p)
+}
+
 // Remove fulfills an HSM Remove request
 func (m *Mover) Remove(action dmplugin.Action) error {
 	debug.Printf("%s id:%d REMOVE %s %s", m.Name, action.ID(), action.PrimaryPath(), action.UUID())
@@ -408,6 +1403,49 @@ func (m *Mover) Remove(action dmplugin.Action) error {
 	if action.UUID() == "" {
 		return errors.New("Missing uuid")
 	}
+	if containerID, offset, length, ok := splitMemberID(action.UUID()); ok {
+		return m.removeMember(action.UUID(), containerID, offset, length)
+	}
+
+	// Deduplicated objects are only removed with their last reference.
+	f, err := m.lockObject(action.UUID())
+	if err == nil {
+		defer f.Close()
+		refs, err := m.objectRefs(action.UUID())
+		if err != nil {
+			return err
+		}
+		if refs > 1 {
+			debug.Printf("%s: %s has %d references", m.Name, action.UUID(), refs-1)
+			return m.setRefs(action.UUID(), refs-1)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
 
-	return os.Remove(m.Destination(action.UUID()))
+	// Every replica is removed. The object is gone if any was, and
+	// none failed to be removed for any other reason than not
+	// existing. A replica's metadata and mirror link are only removed
+	// after it, so a replica left behind can still be rebuilt.
+	var removed bool
+	var notExist error
+	for _, p := range m.replicaPaths(action.UUID()) {
+		link, _ := m.mirrorLink(p)
+		switch err := os.Remove(p); {
+		case err == nil:
+			removed = true
+		case os.IsNotExist(err):
+			notExist = err
+		default:
+			return err
+		}
+		if err := os.Remove(p + metadataSuffix); err != nil && !os.IsNotExist(err) {
+			alert.Warnf("%s: remove metadata failed: %v", action.UUID(), err)
+		}
+		m.unlinkMirror(p, link)
+	}
+	if !removed {
+		return notExist
+	}
+	return nil
 }
@@ -0,0 +1,305 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package posix
+
+import (
+	"bytes"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	lustre "github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/llapi"
+	"github.com/intel-hpdd/lemur/dmplugin"
+	"github.com/intel-hpdd/lemur/dmplugin/dmio"
+	"github.com/intel-hpdd/lemur/pkg/checksum"
+	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+// chunkXattr records the chunk size of an object that was archived in
+// parallel. Its checksum is the combination of the checksums of each chunk
+// calculated by checksum.CombineSums.
+const chunkXattr = "user.lhsm.chunk"
+
+const (
+	defaultParallelMinSize = 1024 * 1024 * 1024
+	defaultChunkSize       = 64 * 1024 * 1024
+)
+
+// withDefaults returns a copy of the configuration with defaults for the
+// unset sizes.
+func (c *ParallelConfig) withDefaults() ParallelConfig {
+	var result ParallelConfig
+	if c != nil {
+		result = *c
+	}
+	if result.MinSize == 0 {
+		result.MinSize = defaultParallelMinSize
+	}
+	if result.ChunkSize == 0 {
+		result.ChunkSize = defaultChunkSize
+	}
+	return result
+}
+
+// parallel returns true if a file of the given size should be copied with
+// several streams.
+func (m *Mover) parallel(size int64) bool {
+	return m.Parallel.Streams > 1 && size >= m.Parallel.MinSize
+}
+
+// layoutChunkSize returns the configured chunk size rounded up to a
+// multiple of the Lustre file's stripe width, so each chunk covers whole
+// stripes.
+func (m *Mover) layoutChunkSize(name string) int64 {
+	chunkSize := m.Parallel.ChunkSize
+	layout, err := llapi.FileDataLayout(name)
+	if err != nil {
+		debug.Printf("%s: can't get layout, using chunk size %d: %v", name, chunkSize, err)
+		return chunkSize
+	}
+	width := int64(layout.StripeSize)
+	if layout.StripeCount > 1 {
+		width *= int64(layout.StripeCount)
+	}
+	if width <= 0 {
+		return chunkSize
+	}
+	return (chunkSize + width - 1) / width * width
+}
+
+// objectChunkSize returns the chunk size the object at p was archived
+// with, or 0 if it was archived in a single stream.
+func objectChunkSize(p string) (int64, error) {
+	value, err := fileAttr(p, chunkXattr)
+	if err != nil || value == "" {
+		return 0, err
+	}
+	chunkSize, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || chunkSize <= 0 {
+		return 0, errors.Errorf("%s: invalid chunk size %q", p, value)
+	}
+	return chunkSize, nil
+}
+
+// archiveChunks copies the file's data to the object in chunks of
+// chunkSize bytes with several concurrent streams, and returns the number
+// of bytes copied and their chunked checksum. Chunks recorded in the
+// checkpoint, if any, aren't copied again.
+func (m *Mover) archiveChunks(action dmplugin.Action, dst *objectFile, total, chunkSize int64, cp *dmplugin.Checkpoint) (int64, []byte, error) {
+	src, err := os.Open(action.PrimaryPath())
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "%s: open failed", action.PrimaryPath())
+	}
+	defer src.Close()
+
+	value := strconv.FormatInt(chunkSize, 10)
+	if err := dst.setxattr(chunkXattr, []byte(value)); err != nil {
+		return 0, nil, errors.Wrapf(err, "%s: record chunk size failed", dst.Name())
+	}
+
+	debug.Printf("%s id:%d copying %d bytes in %d byte chunks with %d streams", m.Name, action.ID(), total, chunkSize, m.Parallel.Streams)
+	sum, err := m.copyChunks(action, dst, 0, src, action.Offset(), total, chunkSize, m.checksumAlgorithm(), cp)
+	if err != nil {
+		return 0, nil, err
+	}
+	return total, sum, nil
+}
+
+// restoreChunks copies an object that was archived in chunks to the file
+// with several concurrent streams, starting skip bytes into the object.
+func (m *Mover) restoreChunks(action dmplugin.Action, src *os.File, dst *dmio.ActionWriter, skip, chunkSize int64, start time.Time) error {
+	fi, err := src.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "%s: stat failed", action.UUID())
+	}
+	length := fi.Size() - skip
+	if action.Length() != lustre.MaxExtentLength && action.Length() < length {
+		length = action.Length()
+	}
+	if length < 0 {
+		return errors.Errorf("%s: extent starts beyond the end of the object", action.UUID())
+	}
+
+	sum, err := m.copyChunks(action, dst, 0, src, skip, length, chunkSize, restoreAlgorithm(action), nil)
+	if err != nil {
+		return err
+	}
+
+	// The file's checksum can only be compared if all of the object was
+	// restored.
+	whole := skip == 0 && length == fi.Size()
+	if action.Hash() != nil && whole && !m.Checksums.DisableCompareOnRestore {
+		if !bytes.Equal(action.Hash(), sum) {
+			alert.Warnf("original checksum doesn't match new:  %s != %s", checksum.Format(action.Hash()), checksum.Format(sum))
+			return errors.New("Checksum mismatch!")
+		}
+	}
+
+	debug.Printf("%s id:%d Restored %d bytes in %v to %s %x", m.Name, action.ID(), length,
+		time.Since(start),
+		action.PrimaryPath(),
+		sum)
+	action.SetActualLength(length)
+	return nil
+}
+
+// copyChunks copies length bytes from src at srcOff to dst at dstOff, in
+// chunks of chunkSize bytes that are copied concurrently by the configured
+// number of streams. It returns the combined checksum of the chunks with
+// the algorithm alg, or an empty checksum if checksums are disabled. If cp isn't nil the chunks it
+// records are skipped, and each chunk copied is synced and added to it.
+func (m *Mover) copyChunks(action dmplugin.Action, dst io.WriterAt, dstOff int64, src io.ReaderAt, srcOff, length, chunkSize int64, alg string, cp *dmplugin.Checkpoint) ([]byte, error) {
+	progressFunc := func(offset, n int64) error {
+		return action.Update(offset, n, length)
+	}
+	pw := dmio.NewProgressWriterAt(dst, updateInterval, progressFunc)
+	defer pw.StopUpdates()
+
+	chunks := int((length + chunkSize - 1) / chunkSize)
+	sums := make([][]byte, chunks)
+	work := make(chan int)
+
+	var mu sync.Mutex
+	var firstErr error
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+
+	copied := make(map[int]bool)
+	if cp != nil {
+		if checkpointAlgorithm(cp) != alg {
+			// Chunks checksummed with another algorithm are
+			// copied again.
+			cp.Chunks = nil
+		}
+		cp.Checksum = alg
+		if cp.Chunks == nil {
+			cp.Chunks = make(map[int][]byte)
+		}
+		for c, sum := range cp.Chunks {
+			if c < chunks {
+				sums[c] = sum
+				copied[c] = true
+			}
+		}
+		if len(cp.Chunks) > 0 {
+			debug.Printf("%s id:%d resuming with %d of %d chunks copied", m.Name, action.ID(), len(cp.Chunks), chunks)
+		}
+	}
+	// completed records a copied chunk in the checkpoint once its data
+	// is durable.
+	completed := func(c int) error {
+		if cp == nil {
+			return nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if s, ok := dst.(interface {
+			Sync() error
+		}); ok {
+			if err := s.Sync(); err != nil {
+				return errors.Wrap(err, "sync failed")
+			}
+		}
+		cp.Chunks[c] = sums[c]
+		if cp.Chunks[c] == nil {
+			cp.Chunks[c] = []byte{}
+		}
+		return m.Checkpoints.Save(cp)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < m.Parallel.Streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, dmio.BufferSize)
+			var h hash.Hash
+			if m.ChecksumEnabled() {
+				h, _ = checksum.NewHash(alg)
+			}
+			for c := range work {
+				offset := int64(c) * chunkSize
+				n := chunkSize
+				if offset+n > length {
+					n = length - offset
+				}
+				if h != nil {
+					h.Reset()
+				}
+				err := copyChunk(pw, dstOff+offset, src, srcOff+offset, n, buf, h)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = errors.Wrapf(err, "copy chunk at %d failed", offset)
+					}
+					mu.Unlock()
+					continue
+				}
+				if h != nil {
+					sums[c] = h.Sum(nil)
+				}
+				if err := completed(c); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for c := 0; c < chunks && !failed(); c++ {
+		if copied[c] {
+			continue
+		}
+		work <- c
+	}
+	close(work)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if !m.ChecksumEnabled() {
+		return []byte{}, nil
+	}
+	return checksum.CombineSums(alg, sums), nil
+}
+
+// copyChunk copies n bytes from src at srcOff to dst at dstOff through
+// buf, adding the data to h if it isn't nil.
+func copyChunk(dst io.WriterAt, dstOff int64, src io.ReaderAt, srcOff, n int64, buf []byte, h hash.Hash) error {
+	for done := int64(0); done < n; {
+		p := buf
+		if remaining := n - done; int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+		nr, err := src.ReadAt(p, srcOff+done)
+		if nr < len(p) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if h != nil {
+			h.Write(p)
+		}
+		if _, err := dst.WriteAt(p, dstOff+done); err != nil {
+			return err
+		}
+		done += int64(nr)
+	}
+	return nil
+}
@@ -6,9 +6,18 @@ package posix_test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/pborman/uuid"
 	"github.com/pkg/errors"
@@ -16,9 +25,11 @@ import (
 	lustre "github.com/intel-hpdd/go-lustre"
 	"github.com/intel-hpdd/lemur/cmd/lhsm-plugin-posix/posix"
 	"github.com/intel-hpdd/lemur/dmplugin"
+	"github.com/intel-hpdd/lemur/dmplugin/dmio"
 	"github.com/intel-hpdd/lemur/internal/testhelpers"
 	"github.com/intel-hpdd/lemur/pkg/checksum"
 	"github.com/intel-hpdd/logging/debug"
+	"golang.org/x/sys/unix"
 )
 
 func testArchive(t *testing.T, mover *posix.Mover, path string, offset int64, length int64, fileID string, data []byte) *dmplugin.TestAction {
@@ -47,6 +58,26 @@ func testRestore(t *testing.T, mover *posix.Mover, offset int64, length int64, f
 	return action
 }
 
+// testRestoreHash restores an object and checks its checksum against the
+// one recorded when it was archived.
+func testRestoreHash(t *testing.T, mover *posix.Mover, length int64, archived *dmplugin.TestAction) {
+	tfile, cleanFile := testhelpers.TempFile(t, 0)
+	defer cleanFile()
+	action := dmplugin.NewTestAction(t, tfile, 0, length, archived.UUID(), nil)
+	action.SetHash(archived.Hash())
+	if err := mover.Restore(action); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testVerify verifies an archived object against the checksum recorded
+// when it was archived.
+func testVerify(t *testing.T, mover *posix.Mover, archived *dmplugin.TestAction) error {
+	action := dmplugin.NewTestAction(t, "", 0, lustre.MaxExtentLength, archived.UUID(), nil)
+	action.SetHash(archived.Hash())
+	return mover.Verify(action)
+}
+
 func testRestoreFail(t *testing.T, mover *posix.Mover, offset int64, length int64, fileID string, data []byte, outer error) *dmplugin.TestAction {
 	debug.Printf("restore %s", fileID)
 	tfile, cleanFile := testhelpers.TempFile(t, 0)
@@ -61,6 +92,24 @@ func testRestoreFail(t *testing.T, mover *posix.Mover, offset int64, length int6
 	return action
 }
 
+// testEncoded returns true if the mover lists the object as compressed.
+func testEncoded(t *testing.T, mover *posix.Mover, fileID string) bool {
+	var encoded, found bool
+	err := mover.List(func(oi *dmplugin.ObjectInfo) error {
+		if oi.ID == fileID {
+			encoded, found = oi.Encoded, true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatalf("%s not listed", fileID)
+	}
+	return encoded
+}
+
 func testDestinationFile(t *testing.T, mover *posix.Mover, fileID string) string {
 	return mover.Destination(fileID)
 }
@@ -132,6 +181,490 @@ func TestPosixExtents(t *testing.T) {
 	})
 }
 
+func TestPosixPartialRestore(t *testing.T) {
+	// Use small frames so extents span several of them.
+	defer func(size int) { dmio.FrameSize = size }(dmio.FrameSize)
+	dmio.FrameSize = 64 * 1024
+
+	for _, compression := range []string{"off", "zstd", "gzip"} {
+		withCompression := func(cfg *posix.ArchiveConfig) *posix.ArchiveConfig {
+			return cfg.Merge(&posix.ArchiveConfig{Compression: compression})
+		}
+		WithPosixMover(t, withCompression, func(t *testing.T, mover *posix.Mover) {
+			var extentSize int64 = 300000
+			tfile, cleanFile := testhelpers.TempFile(t, 1024*1024+42)
+			defer cleanFile()
+			st, err := os.Stat(tfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fileSize := st.Size()
+			startSum, err := checksum.FileSha1Sum(tfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			action := testArchive(t, mover, tfile, 0, fileSize, "", nil)
+			if err := os.Truncate(tfile, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			// Restore the extents of the whole file object in reverse
+			// order, so none of them start at the beginning of the
+			// object except the last.
+			last := (fileSize - 1) / extentSize * extentSize
+			for offset := last; offset >= 0; offset -= extentSize {
+				length := extentSize
+				if offset+length > fileSize {
+					length = fileSize - offset
+				}
+				ra := dmplugin.NewTestAction(t, tfile, offset, length, action.UUID(), nil)
+				ra.SetHash(action.Hash())
+				if err := mover.Restore(ra); err != nil {
+					t.Fatalf("%s: restore %d-%d: %v", compression, offset, offset+length, err)
+				}
+			}
+
+			endSum, err := checksum.FileSha1Sum(tfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(endSum, startSum) {
+				t.Fatalf("%s: end sum (%x) != start sum (%x)", compression, endSum, startSum)
+			}
+		})
+	}
+}
+
+func TestPosixParallel(t *testing.T) {
+	enableParallel := func(cfg *posix.ArchiveConfig) *posix.ArchiveConfig {
+		return cfg.Merge(&posix.ArchiveConfig{
+			Parallel: &posix.ParallelConfig{Streams: 4, MinSize: 1, ChunkSize: 100000},
+		})
+	}
+	WithPosixMover(t, enableParallel, func(t *testing.T, mover *posix.Mover) {
+		var length int64 = 1024 * 1024
+		tfile, cleanFile := testhelpers.TempFile(t, length)
+		defer cleanFile()
+
+		action := testArchive(t, mover, tfile, 0, length, "", nil)
+		testRestoreHash(t, mover, length, action)
+
+		// The chunked checksum is also verified by a sequential restore.
+		mover.Parallel.Streams = 1
+		testRestoreHash(t, mover, length, action)
+		mover.Parallel.Streams = 4
+
+		// Extents are restored from the right offset.
+		startSum, err := checksum.FileSha1Sum(tfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Truncate(tfile, 0); err != nil {
+			t.Fatal(err)
+		}
+		for offset := int64(0); offset < length; offset += 300000 {
+			n := int64(300000)
+			if offset+n > length {
+				n = length - offset
+			}
+			ra := dmplugin.NewTestAction(t, tfile, offset, n, action.UUID(), nil)
+			if err := mover.Restore(ra); err != nil {
+				t.Fatal(err)
+			}
+		}
+		endSum, err := checksum.FileSha1Sum(tfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(endSum, startSum) {
+			t.Fatalf("end sum (%x) != start sum (%x)", endSum, startSum)
+		}
+
+		testhelpers.CorruptFile(t, mover.Destination(action.UUID()))
+		testRestoreFail(t, mover, 0, length, action.UUID(), action.Hash(), errors.New(""))
+	})
+}
+
+// ioModes are the I/O configurations the posix mover is tested and
+// benchmarked with. Zero-copy is only used when checksums are disabled.
+var ioModes = []struct {
+	name        string
+	io          posix.IOConfig
+	compression string
+	checksums   bool
+}{
+	{"buffered", posix.IOConfig{}, "off", true},
+	{"direct", posix.IOConfig{Direct: true, BufferSize: 64 * 1024}, "off", true},
+	{"direct-zstd", posix.IOConfig{Direct: true, BufferSize: 64 * 1024}, "zstd", true},
+	{"zero-copy", posix.IOConfig{ZeroCopy: true}, "off", false},
+	{"zero-copy-checksums", posix.IOConfig{ZeroCopy: true}, "off", true},
+	{"direct-zero-copy", posix.IOConfig{Direct: true, ZeroCopy: true}, "off", false},
+}
+
+func withIOMode(io posix.IOConfig, compression string, checksums bool) func(*posix.ArchiveConfig) *posix.ArchiveConfig {
+	return func(cfg *posix.ArchiveConfig) *posix.ArchiveConfig {
+		return cfg.Merge(&posix.ArchiveConfig{
+			Compression: compression,
+			IO:          &io,
+			Checksums:   &posix.ChecksumConfig{Disabled: !checksums},
+		})
+	}
+}
+
+func TestPosixIO(t *testing.T) {
+	for _, mode := range ioModes {
+		WithPosixMover(t, withIOMode(mode.io, mode.compression, mode.checksums), func(t *testing.T, mover *posix.Mover) {
+			// Several buffers and an unaligned tail.
+			var fileSize int64 = 5*64*1024 + 1234
+			tfile, cleanFile := testhelpers.TempFile(t, 0)
+			defer cleanFile()
+			data := make([]byte, fileSize)
+			for i := range data {
+				data[i] = byte(i * 7)
+			}
+			if err := ioutil.WriteFile(tfile, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			action := testArchive(t, mover, tfile, 0, fileSize, "", nil)
+			if mode.checksums && action.Hash() == nil {
+				t.Fatalf("%s: archive has no checksum", mode.name)
+			}
+
+			// An extent that starts at an unaligned offset.
+			var offset int64 = 70000
+			extent := testArchive(t, mover, tfile, offset, fileSize-offset, "", nil)
+
+			if err := os.Truncate(tfile, 0); err != nil {
+				t.Fatal(err)
+			}
+			restore := func(id string, offset, length int64, hash []byte) {
+				ra := dmplugin.NewTestAction(t, tfile, offset, length, id, nil)
+				ra.SetHash(hash)
+				if err := mover.Restore(ra); err != nil {
+					t.Fatalf("%s: restore %d-%d: %v", mode.name, offset, offset+length, err)
+				}
+				if int64(ra.ActualLength) != length {
+					t.Fatalf("%s: restored %d bytes, expected %d", mode.name, ra.ActualLength, length)
+				}
+			}
+			check := func() {
+				buf, err := ioutil.ReadFile(tfile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(buf, data) {
+					t.Fatalf("%s: restored data differs", mode.name)
+				}
+			}
+
+			restore(action.UUID(), 0, fileSize, action.Hash())
+			check()
+
+			// Restore the unaligned extent's object, and the start of
+			// the file from the whole file's object.
+			if err := os.Truncate(tfile, 0); err != nil {
+				t.Fatal(err)
+			}
+			restore(extent.UUID(), offset, fileSize-offset, extent.Hash())
+			restore(action.UUID(), 0, offset, nil)
+			check()
+		})
+	}
+}
+
+func TestPosixSparse(t *testing.T) {
+	for _, compression := range []string{"off", "zstd"} {
+		enableSparse := func(cfg *posix.ArchiveConfig) *posix.ArchiveConfig {
+			return cfg.Merge(&posix.ArchiveConfig{Compression: compression, Sparse: true})
+		}
+		WithPosixMover(t, enableSparse, func(t *testing.T, mover *posix.Mover) {
+			// A 4MiB file with two data extents and a trailing hole.
+			var length int64 = 4 * 1024 * 1024
+			tfile, cleanFile := testhelpers.TempFile(t, 0)
+			defer cleanFile()
+			data := bytes.Repeat([]byte("sparse data "), 20000)
+			for _, offset := range []int64{1024 * 1024, 2*1024*1024 + 4096} {
+				f, err := os.OpenFile(tfile, os.O_WRONLY, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := f.WriteAt(data, offset); err != nil {
+					t.Fatal(err)
+				}
+				f.Close()
+			}
+			if err := os.Truncate(tfile, length); err != nil {
+				t.Fatal(err)
+			}
+			startSum, err := checksum.FileSha1Sum(tfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			action := testArchive(t, mover, tfile, 0, length, "", nil)
+			if !bytes.Equal(action.Hash(), startSum) {
+				t.Fatalf("%s: archive sum (%x) != file sum (%x)", compression, action.Hash(), startSum)
+			}
+			st, err := os.Stat(mover.Destination(action.UUID()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.Size() >= length/2 {
+				t.Fatalf("%s: object is %d bytes, expected holes to be skipped", compression, st.Size())
+			}
+			testRestoreHash(t, mover, length, action)
+
+			// Extents that start and end in holes and data are restored
+			// from the right offsets.
+			if err := os.Truncate(tfile, 0); err != nil {
+				t.Fatal(err)
+			}
+			var extentSize int64 = 700000
+			last := (length - 1) / extentSize * extentSize
+			for offset := last; offset >= 0; offset -= extentSize {
+				n := extentSize
+				if offset+n > length {
+					n = length - offset
+				}
+				ra := dmplugin.NewTestAction(t, tfile, offset, n, action.UUID(), nil)
+				if err := mover.Restore(ra); err != nil {
+					t.Fatalf("%s: restore %d-%d: %v", compression, offset, offset+n, err)
+				}
+			}
+			endSum, err := checksum.FileSha1Sum(tfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(endSum, startSum) {
+				t.Fatalf("%s: end sum (%x) != start sum (%x)", compression, endSum, startSum)
+			}
+
+			testhelpers.CorruptFile(t, mover.Destination(action.UUID()))
+			testRestoreFail(t, mover, 0, length, action.UUID(), action.Hash(), errors.New(""))
+		})
+	}
+}
+
+// withFileSizeLimit runs fn with writes limited to files of limit bytes,
+// so copies fail part way through.
+func withFileSizeLimit(t *testing.T, limit uint64, fn func()) {
+	var old unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_FSIZE, &old); err != nil {
+		t.Fatal(err)
+	}
+	signal.Ignore(unix.SIGXFSZ)
+	defer signal.Reset(unix.SIGXFSZ)
+	if err := unix.Setrlimit(unix.RLIMIT_FSIZE, &unix.Rlimit{Cur: limit, Max: old.Max}); err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Setrlimit(unix.RLIMIT_FSIZE, &old)
+	fn()
+}
+
+// testCheckpoints returns the number of checkpoints saved in dir.
+func testCheckpoints(t *testing.T, dir string) int {
+	names, err := filepath.Glob(filepath.Join(dir, "*", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(names)
+}
+
+// testCheckpointObject returns the object recorded in the only checkpoint
+// saved in dir.
+func testCheckpointObject(t *testing.T, dir string) string {
+	names, err := filepath.Glob(filepath.Join(dir, "*", "*.json"))
+	if err != nil || len(names) != 1 {
+		t.Fatalf("expected one checkpoint, got %v %v", names, err)
+	}
+	data, err := ioutil.ReadFile(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cp dmplugin.Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		t.Fatal(err)
+	}
+	return cp.ObjectID
+}
+
+// testObjects returns the number of objects the mover lists.
+func testObjects(t *testing.T, mover *posix.Mover) int {
+	var n int
+	if err := mover.List(func(oi *dmplugin.ObjectInfo) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// testFiles returns the paths of the regular files under dir.
+func testFiles(t *testing.T, dir string) []string {
+	var files []string
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			files = append(files, p)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestPosixAtomicWrites(t *testing.T) {
+	var root string
+	getRoot := func(cfg *posix.ArchiveConfig) *posix.ArchiveConfig {
+		root = cfg.Root
+		cfg.Metadata = true
+		return cfg
+	}
+	WithPosixMover(t, getRoot, func(t *testing.T, mover *posix.Mover) {
+		mover.MetadataFunc = func(action dmplugin.Action) (*dmplugin.ObjectMetadata, error) {
+			return &dmplugin.ObjectMetadata{Path: "project/a"}, nil
+		}
+		var length int64 = 1024 * 1024
+		tfile, cleanFile := testhelpers.TempFile(t, length)
+		defer cleanFile()
+
+		// A failed archive leaves nothing behind.
+		action := dmplugin.NewTestAction(t, tfile, 0, length, "", nil)
+		withFileSizeLimit(t, 450000, func() {
+			if err := mover.Archive(action); err == nil {
+				t.Fatal("expected archive to fail")
+			}
+		})
+		if files := testFiles(t, root); len(files) != 0 {
+			t.Fatalf("files left after failed archive: %v", files)
+		}
+
+		// A successful one leaves only the object and its metadata.
+		action = testArchive(t, mover, tfile, 0, length, "", nil)
+		files := testFiles(t, root)
+		if len(files) != 2 || files[0] != mover.Destination(action.UUID()) {
+			t.Fatalf("unexpected files after archive: %v", files)
+		}
+		testRestoreHash(t, mover, length, action)
+
+		// Stale temporary files are swept, and recent ones kept as
+		// they may belong to copies in progress.
+		dir := filepath.Dir(mover.Destination(action.UUID()))
+		stale := filepath.Join(dir, ".stale.tmp")
+		recent := filepath.Join(dir, ".recent.tmp")
+		for _, name := range []string{stale, recent} {
+			if err := ioutil.WriteFile(name, []byte("partial"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		old := time.Now().Add(-48 * time.Hour)
+		if err := os.Chtimes(stale, old, old); err != nil {
+			t.Fatal(err)
+		}
+		if n := testObjects(t, mover); n != 1 {
+			t.Fatalf("listed %d objects, expected 1", n)
+		}
+		n, err := mover.SweepTemps(24 * time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(stale); n != 1 || !os.IsNotExist(err) {
+			t.Fatalf("stale temporary file not removed: %d %v", n, err)
+		}
+		if _, err := os.Stat(recent); err != nil {
+			t.Fatalf("recent temporary file removed: %v", err)
+		}
+	})
+}
+
+func TestPosixResume(t *testing.T) {
+	for _, streams := range []int{0, 4} {
+		stateDir, cleanState := testhelpers.TempDir(t)
+		defer cleanState()
+		enableCheckpoints := func(cfg *posix.ArchiveConfig) *posix.ArchiveConfig {
+			return cfg.Merge(&posix.ArchiveConfig{
+				StateDir:           stateDir,
+				CheckpointInterval: 100000,
+				Parallel:           &posix.ParallelConfig{Streams: streams, MinSize: 1, ChunkSize: 100000},
+			})
+		}
+		WithPosixMover(t, enableCheckpoints, func(t *testing.T, mover *posix.Mover) {
+			var length int64 = 1024 * 1024
+			tfile, cleanFile := testhelpers.TempFile(t, length)
+			defer cleanFile()
+			startSum, err := checksum.FileSha1Sum(tfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Interrupt the archive part way through.
+			action := dmplugin.NewTestAction(t, tfile, 0, length, "", nil)
+			withFileSizeLimit(t, 450000, func() {
+				if err := mover.Archive(action); err == nil {
+					t.Fatalf("streams %d: expected archive to fail", streams)
+				}
+			})
+			if n := testObjects(t, mover); n != 0 {
+				t.Fatalf("streams %d: %d objects listed after failed archive", streams, n)
+			}
+			if testCheckpoints(t, stateDir) != 1 {
+				t.Fatalf("streams %d: expected a checkpoint", streams)
+			}
+			partial := testCheckpointObject(t, stateDir)
+
+			// The retry continues with the partial object.
+			action = testArchive(t, mover, tfile, 0, length, "", nil)
+			if action.UUID() != partial {
+				t.Fatalf("streams %d: archive to %s wasn't resumed from %s", streams, action.UUID(), partial)
+			}
+			if n := testCheckpoints(t, stateDir); n != 0 {
+				t.Fatalf("streams %d: %d checkpoints left after archive", streams, n)
+			}
+			testRestoreHash(t, mover, length, action)
+			if streams > 1 {
+				return
+			}
+			if !bytes.Equal(action.Hash(), startSum) {
+				t.Fatalf("archive sum (%x) != start sum (%x)", action.Hash(), startSum)
+			}
+
+			// Interrupt a restore, and then restore into the same
+			// file again.
+			rfile, cleanRestore := testhelpers.TempFile(t, 0)
+			defer cleanRestore()
+			ra := dmplugin.NewTestAction(t, rfile, 0, length, action.UUID(), nil)
+			ra.SetHash(action.Hash())
+			withFileSizeLimit(t, 450000, func() {
+				if err := mover.Restore(ra); err == nil {
+					t.Fatal("expected restore to fail")
+				}
+			})
+			if n := testCheckpoints(t, stateDir); n != 1 {
+				t.Fatalf("expected a restore checkpoint, got %d", n)
+			}
+			ra = dmplugin.NewTestAction(t, rfile, 0, length, action.UUID(), nil)
+			ra.SetHash(action.Hash())
+			if err := mover.Restore(ra); err != nil {
+				t.Fatal(err)
+			}
+			endSum, err := checksum.FileSha1Sum(rfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(endSum, startSum) {
+				t.Fatalf("end sum (%x) != start sum (%x)", endSum, startSum)
+			}
+			if n := testCheckpoints(t, stateDir); n != 0 {
+				t.Fatalf("%d checkpoints left after restore", n)
+			}
+		})
+	}
+}
+
 func TestPosixArchive(t *testing.T) {
 	WithPosixMover(t, nil, func(t *testing.T, mover *posix.Mover) {
 		// trigger two updates (at current interval of 10MB
@@ -185,42 +718,217 @@ func TestPosixArchiveDefaultChecksumCompress(t *testing.T) {
 		defer cleanFile()
 
 		action := testArchive(t, mover, tfile, 0, length, "", nil)
-		if filepath.Ext(action.UUID()) != ".gz" {
+		if !testEncoded(t, mover, action.UUID()) {
 			t.Fatal(errors.New("file not compressed"))
 		}
 		testRestore(t, mover, 0, length, action.UUID(), nil)
 	})
 }
 
-func TestPosixArchiveRestoreBrokenFileID(t *testing.T) {
-	WithPosixMover(t, defaultChecksum, func(t *testing.T, mover *posix.Mover) {
-		var length int64 = 100
+func TestPosixArchiveCodecs(t *testing.T) {
+	// Several frames are written and read with each codec's reset writer
+	// and reader.
+	defer func(size int) { dmio.FrameSize = size }(dmio.FrameSize)
+	dmio.FrameSize = 16 * 1024
+
+	for _, compression := range []string{"gzip:9", "zstd", "zstd:3", "lz4", "lz4:5"} {
+		withCodec := func(cfg *posix.ArchiveConfig) *posix.ArchiveConfig {
+			return cfg.Merge(&posix.ArchiveConfig{Compression: compression})
+		}
+		WithPosixMover(t, withCodec, func(t *testing.T, mover *posix.Mover) {
+			var length int64 = 100000
+			tfile, cleanFile := testhelpers.TempFile(t, length)
+			defer cleanFile()
+
+			action := testArchive(t, mover, tfile, 0, length, "", nil)
+			if !testEncoded(t, mover, action.UUID()) {
+				t.Fatalf("%s: file not compressed", compression)
+			}
+			testRestoreHash(t, mover, length, action)
+			testRestore(t, mover, 50000, 30000, action.UUID(), nil)
+		})
+	}
+}
+
+func TestPosixRestoreLegacyGzip(t *testing.T) {
+	WithPosixMover(t, nil, func(t *testing.T, mover *posix.Mover) {
+		var length int64 = 1000
 		tfile, cleanFile := testhelpers.TempFile(t, length)
 		defer cleanFile()
+		data, err := ioutil.ReadFile(tfile)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-		action := testArchive(t, mover, tfile, 0, length, "", nil)
-		newID := uuid.New()
-		// Wrong UUID
-		action.SetUUID(newID)
-		testRestoreFail(t, mover, 0, length, action.UUID(), nil, errors.New(""))
+		// Objects used to be named with a .gz suffix instead of having
+		// their codec recorded.
+		fileID := uuid.New() + ".gz"
+		p := mover.Destination(fileID)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Create(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw := gzip.NewWriter(f)
+		if _, err := zw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
 
-		// Missing FileID
-		action.SetUUID("")
-		testRestoreFail(t, mover, 0, length, action.UUID(), nil, errors.New(""))
+		if !testEncoded(t, mover, fileID) {
+			t.Fatal("legacy object not listed as compressed")
+		}
 
-		// Garbage FildID
-		action.SetUUID("Not a FileID")
-		testRestoreFail(t, mover, 0, length, action.UUID(), nil, errors.New(""))
+		// The restore fails if the checksum of the decompressed data
+		// doesn't match.
+		sum := sha1.Sum(data)
+		rfile, cleanRestore := testhelpers.TempFile(t, 0)
+		defer cleanRestore()
+		action := dmplugin.NewTestAction(t, rfile, 0, length, fileID, nil)
+		action.SetHash(sum[:])
+		if err := mover.Restore(action); err != nil {
+			t.Fatal(err)
+		}
 	})
 }
 
-func TestPosixArchiveRestoreError(t *testing.T) {
-	WithPosixMover(t, defaultChecksum, func(t *testing.T, mover *posix.Mover) {
-		var length int64 = 100
-		tfile, cleanFile := testhelpers.TempFile(t, length)
-		defer cleanFile()
+func TestPosixBadCompression(t *testing.T) {
+	cfg := &posix.ArchiveConfig{Name: "posix-test", ID: 1, Root: "/tmp", Compression: "zstd:99"}
+	if err := cfg.CheckValid(); err == nil {
+		t.Fatal("expected error for bad compression level")
+	}
+	cfg.Compression = "bzip2"
+	if _, err := posix.NewMover(cfg); err == nil {
+		t.Fatal("expected error for unknown codec")
+	}
+}
 
-		// we received MaxExtentLength from coordinator, so test this as well
+// writeKeyring writes a keyring file with the given keys, the last of
+// which is current.
+func writeKeyring(t *testing.T, path string, ids ...string) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "current = %q\n", ids[len(ids)-1])
+	for _, id := range ids {
+		secret := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte(id[:1]), 32))
+		fmt.Fprintf(&buf, "key %q {\n  secret = %q\n}\n", id, secret)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the keyring notices the change.
+	mtime := time.Now().Add(time.Duration(len(ids)) * time.Second)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPosixEncryption(t *testing.T) {
+	keyDir, cleanKeys := testhelpers.TempDir(t)
+	defer cleanKeys()
+	keyring := filepath.Join(keyDir, "keyring")
+	writeKeyring(t, keyring, "a")
+
+	withKeyring := func(cfg *posix.ArchiveConfig) *posix.ArchiveConfig {
+		cfg = defaultChecksum(cfg)
+		cfg = cfg.Merge(&posix.ArchiveConfig{Compression: "zstd", Keyring: keyring})
+		cfg.Metadata = true
+		return cfg
+	}
+	WithPosixMover(t, withKeyring, func(t *testing.T, mover *posix.Mover) {
+		mover.MetadataFunc = func(action dmplugin.Action) (*dmplugin.ObjectMetadata, error) {
+			return &dmplugin.ObjectMetadata{Path: "project/a"}, nil
+		}
+		var length int64 = 100000
+		tfile, cleanFile := testhelpers.TempFile(t, length)
+		defer cleanFile()
+
+		first := testArchive(t, mover, tfile, 0, length, "", nil)
+		if !testEncoded(t, mover, first.UUID()) {
+			t.Fatal("file not encoded")
+		}
+
+		// Rotate to a new key; old objects can still be restored.
+		writeKeyring(t, keyring, "a", "b")
+		second := testArchive(t, mover, tfile, 0, length, "", nil)
+		testRestoreHash(t, mover, length, first)
+		testRestoreHash(t, mover, length, second)
+
+		from, to, err := mover.Rekey(first.UUID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from != "a" || to != "b" {
+			t.Fatalf("rekey: got %s -> %s, expected a -> b", from, to)
+		}
+		md, err := mover.ReadMetadata(first.UUID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if md.KeyID != "b" || md.Path != "project/a" {
+			t.Fatalf("unexpected metadata after rekey: %+v", md)
+		}
+		from, to, err = mover.Rekey(second.UUID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from != to {
+			t.Fatalf("rekey of current object: got %s -> %s", from, to)
+		}
+
+		// Once rekeyed, the old key is no longer needed.
+		writeKeyring(t, keyring, "b")
+		testRestoreHash(t, mover, length, first)
+	})
+}
+
+func TestPosixKeyringPermissions(t *testing.T) {
+	keyDir, cleanKeys := testhelpers.TempDir(t)
+	defer cleanKeys()
+	keyring := filepath.Join(keyDir, "keyring")
+	writeKeyring(t, keyring, "a")
+	if err := os.Chmod(keyring, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &posix.ArchiveConfig{Name: "posix-test", ID: 1, Root: keyDir, Keyring: keyring}
+	if _, err := posix.NewMover(cfg); err == nil {
+		t.Fatal("expected error for readable keyring")
+	}
+}
+
+func TestPosixArchiveRestoreBrokenFileID(t *testing.T) {
+	WithPosixMover(t, defaultChecksum, func(t *testing.T, mover *posix.Mover) {
+		var length int64 = 100
+		tfile, cleanFile := testhelpers.TempFile(t, length)
+		defer cleanFile()
+
+		action := testArchive(t, mover, tfile, 0, length, "", nil)
+		newID := uuid.New()
+		// Wrong UUID
+		action.SetUUID(newID)
+		testRestoreFail(t, mover, 0, length, action.UUID(), nil, errors.New(""))
+
+		// Missing FileID
+		action.SetUUID("")
+		testRestoreFail(t, mover, 0, length, action.UUID(), nil, errors.New(""))
+
+		// Garbage FildID
+		action.SetUUID("Not a FileID")
+		testRestoreFail(t, mover, 0, length, action.UUID(), nil, errors.New(""))
+	})
+}
+
+func TestPosixArchiveRestoreError(t *testing.T) {
+	WithPosixMover(t, defaultChecksum, func(t *testing.T, mover *posix.Mover) {
+		var length int64 = 100
+		tfile, cleanFile := testhelpers.TempFile(t, length)
+		defer cleanFile()
+
+		// we received MaxExtentLength from coordinator, so test this as well
 		action := testArchive(t, mover, tfile, 0, length, "", nil)
 
 		failRestore := func(t *testing.T, mover *posix.Mover, offset int64, length int64, fileID string, data []byte) *dmplugin.TestAction {
@@ -333,6 +1041,169 @@ func TestPosixCorruptArchive(t *testing.T) {
 	})
 }
 
+func TestPosixVerify(t *testing.T) {
+	for _, compression := range []string{"off", "zstd"} {
+		update := func(cfg *posix.ArchiveConfig) *posix.ArchiveConfig {
+			return cfg.Merge(&posix.ArchiveConfig{
+				Compression: compression,
+				Sparse:      true,
+				Parallel:    &posix.ParallelConfig{Streams: 4, MinSize: 500000, ChunkSize: 100000},
+			})
+		}
+		WithPosixMover(t, update, func(t *testing.T, mover *posix.Mover) {
+			var archived []*dmplugin.TestAction
+			for _, length := range []int64{0, 1000, 1000000} {
+				tfile, cleanFile := testhelpers.TempFile(t, length)
+				defer cleanFile()
+				archived = append(archived, testArchive(t, mover, tfile, 0, length, "", nil))
+			}
+
+			// A file with a hole, archived without it.
+			tfile, cleanFile := testhelpers.TempFile(t, 0)
+			defer cleanFile()
+			if err := ioutil.WriteFile(tfile, bytes.Repeat([]byte("sparse data "), 1000), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Truncate(tfile, 4*1024*1024); err != nil {
+				t.Fatal(err)
+			}
+			archived = append(archived, testArchive(t, mover, tfile, 0, 4*1024*1024, "", nil))
+
+			for _, action := range archived {
+				if err := testVerify(t, mover, action); err != nil {
+					t.Fatalf("%s: verify %s failed: %v", compression, action.UUID(), err)
+				}
+			}
+
+			for i, action := range archived[1:] {
+				testhelpers.CorruptFile(t, mover.Destination(action.UUID()))
+				err := testVerify(t, mover, action)
+				if err == nil {
+					t.Fatalf("%s: corrupt object %s verified", compression, action.UUID())
+				}
+				// Corrupt compressed data may not decompress at all, and
+				// the start of a sparse object is its map.
+				sparse := i == len(archived)-2
+				if compression == "off" && !sparse && errors.Cause(err) != dmplugin.ErrChecksumMismatch {
+					t.Fatalf("%s: expected checksum mismatch, got %v", compression, err)
+				}
+			}
+
+			missing := dmplugin.NewTestAction(t, "", 0, 0, "missing", nil)
+			if err := mover.Verify(missing); err == nil {
+				t.Fatal("missing object verified")
+			}
+		})
+	}
+}
+
+func TestPosixChecksumAlgorithms(t *testing.T) {
+	for _, alg := range checksum.Algorithms() {
+		update := func(cfg *posix.ArchiveConfig) *posix.ArchiveConfig {
+			return cfg.Merge(&posix.ArchiveConfig{
+				Checksums: &posix.ChecksumConfig{Algorithm: alg},
+				Sparse:    true,
+				Parallel:  &posix.ParallelConfig{Streams: 4, MinSize: 500000, ChunkSize: 100000},
+			})
+		}
+		WithPosixMover(t, update, func(t *testing.T, mover *posix.Mover) {
+			var archived []*dmplugin.TestAction
+			for _, length := range []int64{1000, 1000000} {
+				tfile, cleanFile := testhelpers.TempFile(t, length)
+				defer cleanFile()
+				action := testArchive(t, mover, tfile, 0, length, "", nil)
+				if got := checksum.Algorithm(action.Hash()); got != alg {
+					t.Fatalf("%s: archived with %s", alg, got)
+				}
+				archived = append(archived, action)
+			}
+
+			// A file with a hole, archived without it.
+			tfile, cleanFile := testhelpers.TempFile(t, 0)
+			defer cleanFile()
+			if err := ioutil.WriteFile(tfile, bytes.Repeat([]byte("sparse data "), 1000), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Truncate(tfile, 4*1024*1024); err != nil {
+				t.Fatal(err)
+			}
+			archived = append(archived, testArchive(t, mover, tfile, 0, 4*1024*1024, "", nil))
+
+			// Objects are compared with the algorithm they were
+			// archived with, whatever the algorithm is now.
+			for _, other := range checksum.Algorithms() {
+				mover.Checksums.Algorithm = other
+				for _, action := range archived {
+					testRestoreHash(t, mover, lustre.MaxExtentLength, action)
+					if err := testVerify(t, mover, action); err != nil {
+						t.Fatalf("%s: verify %s with %s configured failed: %v", alg, action.UUID(), other, err)
+					}
+				}
+			}
+
+			testhelpers.CorruptFile(t, mover.Destination(archived[0].UUID()))
+			if err := testVerify(t, mover, archived[0]); errors.Cause(err) != dmplugin.ErrChecksumMismatch {
+				t.Fatalf("%s: expected checksum mismatch, got %v", alg, err)
+			}
+		})
+	}
+}
+
+func TestPosixLegacyChecksum(t *testing.T) {
+	WithPosixMover(t, nil, func(t *testing.T, mover *posix.Mover) {
+		var length int64 = 100000
+		tfile, cleanFile := testhelpers.TempFile(t, length)
+		defer cleanFile()
+
+		// SHA1 checksums are recorded without a tag, as they were
+		// before algorithms could be selected.
+		action := testArchive(t, mover, tfile, 0, length, "", nil)
+		sum, err := checksum.FileSha1Sum(tfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(action.Hash(), sum) {
+			t.Fatalf("expected bare SHA1 %x, got %x", sum, action.Hash())
+		}
+		legacy, err := checksum.Parse(checksum.Format(action.Hash()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(legacy, sum) {
+			t.Fatalf("expected %x, got %x", sum, legacy)
+		}
+	})
+}
+
+func TestPosixChecksumAlgorithmValidation(t *testing.T) {
+	for _, tc := range []struct {
+		alg   string
+		dedup bool
+		valid bool
+	}{
+		{"", false, true},
+		{checksum.SHA256, true, true},
+		{checksum.XXH64, false, true},
+		{checksum.XXH64, true, false},
+		{"md4", false, false},
+	} {
+		cfg := &posix.ArchiveConfig{
+			Name:      "posix-test",
+			ID:        1,
+			Root:      "/tmp",
+			Dedup:     tc.dedup,
+			Checksums: &posix.ChecksumConfig{Algorithm: tc.alg},
+		}
+		err := cfg.CheckValid()
+		if tc.valid && err != nil {
+			t.Errorf("%q dedup:%v: unexpected error: %v", tc.alg, tc.dedup, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%q dedup:%v: expected an error", tc.alg, tc.dedup)
+		}
+	}
+}
+
 func TestPosixRemove(t *testing.T) {
 	WithPosixMover(t, nil, func(t *testing.T, mover *posix.Mover) {
 		var length int64 = 1000000
@@ -357,6 +1228,789 @@ func TestPosixRemove(t *testing.T) {
 	})
 }
 
+func TestPosixDedup(t *testing.T) {
+	enableDedup := func(cfg *posix.ArchiveConfig) *posix.ArchiveConfig {
+		return cfg.Merge(&posix.ArchiveConfig{Dedup: true, Compression: "lz4"})
+	}
+	WithPosixMover(t, enableDedup, func(t *testing.T, mover *posix.Mover) {
+		var length int64 = 100000
+		tfile, cleanFile := testhelpers.TempFile(t, length)
+		defer cleanFile()
+		other, cleanOther := testhelpers.TempFile(t, length)
+		defer cleanOther()
+		testhelpers.CorruptFile(t, other)
+
+		first := testArchive(t, mover, tfile, 0, length, "", nil)
+		second := testArchive(t, mover, tfile, 0, length, "", nil)
+		if first.UUID() != second.UUID() {
+			t.Fatalf("identical files stored as %s and %s", first.UUID(), second.UUID())
+		}
+		third := testArchive(t, mover, other, 0, length, "", nil)
+		if third.UUID() == first.UUID() {
+			t.Fatal("different files stored as the same object")
+		}
+
+		// The object is kept until its last reference is removed.
+		path := mover.Destination(first.UUID())
+		testRemove(t, mover, first.UUID(), nil)
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("shared object removed: %v", err)
+		}
+		testRestoreHash(t, mover, length, second)
+		testRemove(t, mover, second.UUID(), nil)
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("unreferenced object not removed: %v", err)
+		}
+		testRestoreHash(t, mover, length, third)
+	})
+}
+
+func TestPosixDedupNoChecksums(t *testing.T) {
+	cfg := &posix.ArchiveConfig{
+		Name:      "posix-test",
+		ID:        1,
+		Root:      "/tmp",
+		Dedup:     true,
+		Checksums: &posix.ChecksumConfig{Disabled: true},
+	}
+	if err := cfg.CheckValid(); err == nil {
+		t.Fatal("expected error for dedup without checksums")
+	}
+}
+
+func TestPosixDedupMetadata(t *testing.T) {
+	cfg := &posix.ArchiveConfig{
+		Name:     "posix-test",
+		ID:       1,
+		Root:     "/tmp",
+		Dedup:    true,
+		Metadata: true,
+	}
+	if err := cfg.CheckValid(); err == nil {
+		t.Fatal("expected error for dedup with metadata")
+	}
+	if _, err := posix.NewMover(cfg); err == nil {
+		t.Fatal("expected mover error for dedup with metadata")
+	}
+}
+
+func TestPosixList(t *testing.T) {
+	WithPosixMover(t, nil, func(t *testing.T, mover *posix.Mover) {
+		objects := make(map[string]int64)
+		list := func() {
+			for id := range objects {
+				delete(objects, id)
+			}
+			err := mover.List(func(oi *dmplugin.ObjectInfo) error {
+				objects[oi.ID] = oi.Size
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		list()
+		if len(objects) != 0 {
+			t.Fatalf("expected empty archive, got %v", objects)
+		}
+
+		var length int64 = 1000
+		tfile, cleanFile := testhelpers.TempFile(t, length)
+		defer cleanFile()
+		a1 := testArchive(t, mover, tfile, 0, length, "", nil)
+		a2 := testArchive(t, mover, tfile, 0, length, "", nil)
+
+		list()
+		if len(objects) != 2 || objects[a1.UUID()] != length || objects[a2.UUID()] != length {
+			t.Fatalf("unexpected objects: %v", objects)
+		}
+
+		testRemove(t, mover, a1.UUID(), nil)
+		list()
+		if _, ok := objects[a1.UUID()]; ok || len(objects) != 1 {
+			t.Fatalf("unexpected objects after remove: %v", objects)
+		}
+	})
+}
+
+func TestPosixRoots(t *testing.T) {
+	dirA, cleanA := testhelpers.TempDir(t)
+	defer cleanA()
+	dirB, cleanB := testhelpers.TempDir(t)
+	defer cleanB()
+
+	var cfg *posix.ArchiveConfig
+	addRoots := func(c *posix.ArchiveConfig) *posix.ArchiveConfig {
+		c.Roots = []*posix.RootConfig{
+			{Name: "a", Path: dirA},
+			{Name: "b", Path: dirB},
+		}
+		cfg = c
+		return c
+	}
+	WithPosixMover(t, addRoots, func(t *testing.T, mover *posix.Mover) {
+		var length int64 = 1000
+		tfile, cleanFile := testhelpers.TempFile(t, length)
+		defer cleanFile()
+
+		// New objects go to each root in turn, and are restored and
+		// listed from all of them.
+		var actions []*dmplugin.TestAction
+		for i := 0; i < 3; i++ {
+			actions = append(actions, testArchive(t, mover, tfile, 0, length, "", nil))
+		}
+		for i, suffix := range []string{"", "@a", "@b"} {
+			id := actions[i].UUID()
+			if !strings.HasSuffix(id, suffix) || (suffix == "" && strings.Contains(id, "@")) {
+				t.Fatalf("object %d has id %s, expected root %q", i, id, suffix)
+			}
+			testRestoreHash(t, mover, length, actions[i])
+		}
+		if !strings.HasPrefix(mover.Destination(actions[2].UUID()), dirB) {
+			t.Fatalf("%s stored in %s", actions[2].UUID(), mover.Destination(actions[2].UUID()))
+		}
+		var listed int
+		mover.List(func(oi *dmplugin.ObjectInfo) error {
+			listed++
+			return nil
+		})
+		if listed != 3 {
+			t.Fatalf("listed %d objects, expected 3", listed)
+		}
+
+		// Read only roots still restore and remove objects, but don't
+		// get new ones.
+		cfg.Roots[1].ReadOnly = true
+		cfg.Root = ""
+		drained, err := posix.NewMover(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			action := testArchive(t, drained, tfile, 0, length, "", nil)
+			if !strings.HasSuffix(action.UUID(), "@a") {
+				t.Fatalf("object %s written to read only root", action.UUID())
+			}
+		}
+		testRestoreHash(t, drained, length, actions[2])
+		testRemove(t, drained, actions[2].UUID(), nil)
+
+		cfg.Roots[0].ReadOnly = true
+		drained, err = posix.NewMover(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		action := dmplugin.NewTestAction(t, tfile, 0, length, "", nil)
+		if err := drained.Archive(action); err == nil {
+			t.Fatal("expected archive to fail with all roots read only")
+		}
+	})
+}
+
+func TestPosixWeightedPlacement(t *testing.T) {
+	dirA, cleanA := testhelpers.TempDir(t)
+	defer cleanA()
+	dirB, cleanB := testhelpers.TempDir(t)
+	defer cleanB()
+
+	weighted := func(c *posix.ArchiveConfig) *posix.ArchiveConfig {
+		c.Root = ""
+		c.Placement = posix.PlacementWeighted
+		c.Roots = []*posix.RootConfig{
+			{Name: "a", Path: dirA, Weight: 3},
+			{Name: "b", Path: dirB},
+		}
+		return c
+	}
+	WithPosixMover(t, weighted, func(t *testing.T, mover *posix.Mover) {
+		var length int64 = 100
+		tfile, cleanFile := testhelpers.TempFile(t, length)
+		defer cleanFile()
+
+		counts := make(map[string]int)
+		for i := 0; i < 8; i++ {
+			action := testArchive(t, mover, tfile, 0, length, "", nil)
+			counts[action.UUID()[strings.LastIndex(action.UUID(), "@"):]]++
+		}
+		if counts["@a"] != 6 || counts["@b"] != 2 {
+			t.Fatalf("unexpected placement: %v", counts)
+		}
+	})
+}
+
+func TestPosixRootsValidation(t *testing.T) {
+	for _, roots := range [][]*posix.RootConfig{
+		{{Name: "a", Path: "/tmp/a"}, {Name: "a", Path: "/tmp/b"}},
+		{{Path: "/tmp/b"}},
+		{{Name: "a@b", Path: "/tmp/b"}},
+		{{Name: "a"}},
+	} {
+		cfg := &posix.ArchiveConfig{Name: "posix-test", ID: 1, Root: "/tmp", Roots: roots}
+		if err := cfg.CheckValid(); err == nil {
+			t.Fatalf("expected error for roots %v", roots)
+		}
+	}
+	cfg := &posix.ArchiveConfig{Name: "posix-test", ID: 1, Root: "/tmp", Placement: "random"}
+	if err := cfg.CheckValid(); err == nil {
+		t.Fatal("expected error for unknown placement")
+	}
+}
+
+func TestPosixReplicas(t *testing.T) {
+	dirA, cleanA := testhelpers.TempDir(t)
+	defer cleanA()
+	dirB, cleanB := testhelpers.TempDir(t)
+	defer cleanB()
+
+	var cfg *posix.ArchiveConfig
+	replicated := func(c *posix.ArchiveConfig) *posix.ArchiveConfig {
+		c.Root = ""
+		c.Replicas = 2
+		c.Roots = []*posix.RootConfig{
+			{Name: "a", Path: dirA},
+			{Name: "b", Path: dirB},
+		}
+		cfg = c
+		return c
+	}
+	replicaPaths := func(id string) []string {
+		name := id[:strings.LastIndex(id, "@")]
+		var paths []string
+		for _, dir := range []string{dirA, dirB} {
+			paths = append(paths, filepath.Join(dir, "objects", name[0:2], name[2:4], name))
+		}
+		return paths
+	}
+	WithPosixMover(t, replicated, func(t *testing.T, mover *posix.Mover) {
+		var length int64 = 100000
+		tfile, cleanFile := testhelpers.TempFile(t, length)
+		defer cleanFile()
+
+		// Each object is written to both roots, and listed once.
+		action := testArchive(t, mover, tfile, 0, length, "", nil)
+		id := action.UUID()
+		if !strings.HasSuffix(id, "@a,b") && !strings.HasSuffix(id, "@b,a") {
+			t.Fatalf("object has id %s, expected both roots", id)
+		}
+		for _, p := range replicaPaths(id) {
+			if fi, err := os.Stat(p); err != nil || fi.Size() != length {
+				t.Fatalf("replica %s: %v", p, err)
+			}
+		}
+		var ids []string
+		if err := mover.List(func(oi *dmplugin.ObjectInfo) error {
+			ids = append(ids, oi.ID)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != 1 || ids[0] != id {
+			t.Fatalf("unexpected objects: %v", ids)
+		}
+		if err := testVerify(t, mover, action); err != nil {
+			t.Fatal(err)
+		}
+
+		// A corrupt replica fails verification, and the object is
+		// restored from the other one until that is missing too.
+		first := replicaPaths(id)[0]
+		if strings.HasSuffix(id, "@b,a") {
+			first = replicaPaths(id)[1]
+		}
+		testhelpers.CorruptFile(t, first)
+		if err := testVerify(t, mover, action); errors.Cause(err) != dmplugin.ErrChecksumMismatch {
+			t.Fatalf("expected checksum mismatch, got %v", err)
+		}
+		testRestoreHash(t, mover, length, action)
+		for _, p := range replicaPaths(id) {
+			if p != first {
+				os.Remove(p)
+			}
+		}
+		testRestoreFail(t, mover, 0, length, id, action.Hash(), errors.New("no good replica"))
+
+		// Remove removes every replica.
+		action = testArchive(t, mover, tfile, 0, length, "", nil)
+		testRemove(t, mover, action.UUID(), nil)
+		for _, p := range replicaPaths(action.UUID()) {
+			if _, err := os.Stat(p); !os.IsNotExist(err) {
+				t.Fatalf("replica %s not removed: %v", p, err)
+			}
+		}
+
+		// An archive succeeds with fewer replicas only if they make a
+		// quorum.
+		cfg.Roots[1].ReadOnly = true
+		drained, err := posix.NewMover(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := drained.Archive(dmplugin.NewTestAction(t, tfile, 0, length, "", nil)); err == nil {
+			t.Fatal("expected archive to fail without a quorum")
+		}
+		cfg.Quorum = 1
+		drained, err = posix.NewMover(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		action = testArchive(t, drained, tfile, 0, length, "", nil)
+		if !strings.HasSuffix(action.UUID(), "@a") {
+			t.Fatalf("object has id %s, expected root a", action.UUID())
+		}
+		testRestoreHash(t, drained, length, action)
+	})
+
+	// The encoding of a compressed object is read from the replica
+	// being restored or verified.
+	compressed := func(c *posix.ArchiveConfig) *posix.ArchiveConfig {
+		c = replicated(c)
+		c.Compression = "zstd"
+		return c
+	}
+	ordered := func(id string) []string {
+		paths := replicaPaths(id)
+		if strings.HasSuffix(id, "@b,a") {
+			paths[0], paths[1] = paths[1], paths[0]
+		}
+		return paths
+	}
+	WithPosixMover(t, compressed, func(t *testing.T, mover *posix.Mover) {
+		var length int64 = 100000
+		tfile, cleanFile := testhelpers.TempFile(t, length)
+		defer cleanFile()
+
+		// A second replica without its attributes fails verification
+		// even though the first is intact.
+		action := testArchive(t, mover, tfile, 0, length, "", nil)
+		if err := testVerify(t, mover, action); err != nil {
+			t.Fatal(err)
+		}
+		removeXattrs(t, ordered(action.UUID())[1])
+		if err := testVerify(t, mover, action); err == nil {
+			t.Fatal("expected replica without attributes to fail verification")
+		}
+		testRestoreHash(t, mover, length, action)
+
+		// The object is restored from the second replica if the first
+		// is missing, or has lost its attributes.
+		action = testArchive(t, mover, tfile, 0, length, "", nil)
+		if err := os.Remove(ordered(action.UUID())[0]); err != nil {
+			t.Fatal(err)
+		}
+		testRestoreHash(t, mover, length, action)
+
+		action = testArchive(t, mover, tfile, 0, length, "", nil)
+		removeXattrs(t, ordered(action.UUID())[0])
+		testRestoreHash(t, mover, length, action)
+	})
+}
+
+// removeXattrs removes the extended attributes of a file.
+func removeXattrs(t *testing.T, p string) {
+	buf := make([]byte, 64*1024)
+	sz, err := unix.Listxattr(p, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range bytes.Split(buf[:sz], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		if err := unix.Removexattr(p, string(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPosixReplicasValidation(t *testing.T) {
+	roots := []*posix.RootConfig{{Name: "a", Path: "/tmp/a"}, {Name: "b", Path: "/tmp/b"}}
+	for _, cfg := range []*posix.ArchiveConfig{
+		{Replicas: 3},
+		{Replicas: 2, Quorum: 3},
+		{Replicas: -1},
+		{Replicas: 2, Dedup: true},
+	} {
+		cfg.Name, cfg.ID, cfg.Roots = "posix-test", 1, roots
+		if err := cfg.CheckValid(); err == nil {
+			t.Fatalf("expected error for replicas %d quorum %d", cfg.Replicas, cfg.Quorum)
+		}
+	}
+	cfg := &posix.ArchiveConfig{Name: "posix-test", ID: 1, Roots: []*posix.RootConfig{{Name: "a,b", Path: "/tmp/b"}}}
+	if err := cfg.CheckValid(); err == nil {
+		t.Fatal("expected error for root name with a comma")
+	}
+}
+
+func TestPosixAggregateStop(t *testing.T) {
+	aggregate := func(c *posix.ArchiveConfig) *posix.ArchiveConfig {
+		c.Aggregate = &posix.AggregateConfig{Window: "1h"}
+		return c
+	}
+	WithPosixMover(t, aggregate, func(t *testing.T, mover *posix.Mover) {
+		// The open container is committed when the action stream
+		// ends, rather than at the end of its window.
+		var length int64 = 1024
+		actions := make([]*dmplugin.TestAction, 2)
+		for i := range actions {
+			tfile, cleanFile := testhelpers.TempFile(t, length)
+			defer cleanFile()
+			actions[i] = dmplugin.NewTestAction(t, tfile, 0, length, "", nil)
+			if err := mover.Archive(actions[i]); err != dmplugin.ErrDeferred {
+				t.Fatalf("expected deferred archive, got %v", err)
+			}
+		}
+		mover.Stop()
+		for _, action := range actions {
+			done := make(chan error, 1)
+			go func() {
+				done <- action.Wait()
+			}()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("archive not finished after stop")
+			}
+			if !strings.Contains(action.UUID(), ":") {
+				t.Fatalf("file not archived to a container: %s", action.UUID())
+			}
+			testRestoreHash(t, mover, length, action)
+		}
+	})
+}
+
+func TestPosixAggregate(t *testing.T) {
+	aggregate := func(c *posix.ArchiveConfig) *posix.ArchiveConfig {
+		c.Metadata = true
+		c.Aggregate = &posix.AggregateConfig{MaxFiles: 3, Window: "1s"}
+		return c
+	}
+	WithPosixMover(t, aggregate, func(t *testing.T, mover *posix.Mover) {
+		mover.MetadataFunc = func(action dmplugin.Action) (*dmplugin.ObjectMetadata, error) {
+			return &dmplugin.ObjectMetadata{Path: action.PrimaryPath()}, nil
+		}
+
+		// Files archived together share containers of up to 3 files.
+		// Archive returns at once, and the actions are finished when
+		// their container is committed.
+		var length int64 = 64 * 1024
+		actions := make([]*dmplugin.TestAction, 4)
+		for i := range actions {
+			tfile, cleanFile := testhelpers.TempFile(t, length)
+			defer cleanFile()
+			actions[i] = dmplugin.NewTestAction(t, tfile, 0, length, "", nil)
+			if err := mover.Archive(actions[i]); err != dmplugin.ErrDeferred {
+				t.Fatalf("expected deferred archive, got %v", err)
+			}
+		}
+		containers := make(map[string][]*dmplugin.TestAction)
+		for _, action := range actions {
+			if err := action.Wait(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, action := range actions {
+			parts := strings.Split(action.UUID(), ":")
+			if len(parts) != 3 || parts[2] != fmt.Sprint(length) || !strings.Contains(action.URL(), "offset="+parts[1]) {
+				t.Fatalf("unexpected id %s url %s", action.UUID(), action.URL())
+			}
+			containers[parts[0]] = append(containers[parts[0]], action)
+			testRestoreHash(t, mover, length, action)
+			if err := testVerify(t, mover, action); err != nil {
+				t.Fatal(err)
+			}
+			md, err := mover.ReadMetadata(action.UUID())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if md.UUID != action.UUID() || md.Path != action.PrimaryPath() || !bytes.Equal(md.Hash, action.Hash()) {
+				t.Fatalf("unexpected metadata: %+v", md)
+			}
+		}
+		if len(containers) != 2 {
+			t.Fatalf("expected 2 containers, got %d", len(containers))
+		}
+
+		// Large files are archived as objects of their own.
+		large, cleanLarge := testhelpers.TempFile(t, 2*1024*1024)
+		defer cleanLarge()
+		action := testArchive(t, mover, large, 0, 2*1024*1024, "", nil)
+		if strings.Contains(action.UUID(), ":") {
+			t.Fatalf("large file archived to a container: %s", action.UUID())
+		}
+		testRemove(t, mover, action.UUID(), nil)
+
+		listed := func() map[string]bool {
+			ids := make(map[string]bool)
+			if err := mover.List(func(oi *dmplugin.ObjectInfo) error {
+				ids[oi.ID] = true
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			return ids
+		}
+		if ids := listed(); len(ids) != len(actions) {
+			t.Fatalf("unexpected objects: %v", ids)
+		}
+
+		// Removed files are no longer listed, and compaction reclaims
+		// their space without moving the others.
+		var full []*dmplugin.TestAction
+		for _, members := range containers {
+			if len(members) == 3 {
+				full = members
+			}
+		}
+		testRemove(t, mover, full[0].UUID(), nil)
+		testRemove(t, mover, full[1].UUID(), nil)
+		if ids := listed(); len(ids) != len(actions)-2 || ids[full[0].UUID()] {
+			t.Fatalf("unexpected objects after remove: %v", ids)
+		}
+		result, err := mover.Compact()
+		if errors.Cause(err) == unix.EOPNOTSUPP {
+			t.Logf("hole punching not supported: %v", err)
+		} else if err != nil {
+			t.Fatal(err)
+		} else if result.Containers != 2 || result.Compacted != 1 || result.Reclaimed == 0 {
+			t.Fatalf("unexpected compaction: %+v", result)
+		}
+
+		// Files that were punched out aren't compacted again.
+		if result, err := mover.Compact(); err == nil && (result.Compacted != 0 || result.Reclaimed != 0) {
+			t.Fatalf("unexpected second compaction: %+v", result)
+		}
+		testRemove(t, mover, full[0].UUID(), nil)
+		if ids := listed(); len(ids) != len(actions)-2 {
+			t.Fatalf("unexpected objects after compaction: %v", ids)
+		}
+		testRestoreHash(t, mover, length, full[2])
+
+		// The container is removed with its last file.
+		container := testDestinationFile(t, mover, full[2].UUID())
+		testRemove(t, mover, full[2].UUID(), nil)
+		if _, err := os.Stat(container); !os.IsNotExist(err) {
+			t.Fatalf("container %s not removed: %v", container, err)
+		}
+		if _, err := os.Stat(container + ".dead"); !os.IsNotExist(err) {
+			t.Fatalf("removed files of %s not removed: %v", container, err)
+		}
+	})
+
+	for _, cfg := range []*posix.ArchiveConfig{
+		{Dedup: true},
+		{Keyring: "/etc/keyring"},
+		{Aggregate: &posix.AggregateConfig{Window: "soon"}},
+	} {
+		cfg.Name, cfg.ID, cfg.Root = "posix-test", 1, "/tmp"
+		if cfg.Aggregate == nil {
+			cfg.Aggregate = &posix.AggregateConfig{}
+		}
+		if err := cfg.CheckValid(); err == nil {
+			t.Fatalf("expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestPosixLayout(t *testing.T) {
+	var root string
+	withLayout := func(cfg *posix.ArchiveConfig) *posix.ArchiveConfig {
+		root = cfg.Root
+		cfg.Layout = &posix.LayoutConfig{Depth: 3, Width: 1, Group: posix.GroupUID, Mirror: true}
+		return cfg
+	}
+	WithPosixMover(t, withLayout, func(t *testing.T, mover *posix.Mover) {
+		mover.PathFunc = func(action dmplugin.Action) (string, error) {
+			return "project/a", nil
+		}
+		var length int64 = 1000
+		tfile, cleanFile := testhelpers.TempFile(t, length)
+		defer cleanFile()
+
+		// Objects are named and stored by the owner of their file,
+		// with one character of the name per level.
+		action := testArchive(t, mover, tfile, 0, length, "", nil)
+		uid := fmt.Sprint(os.Getuid())
+		prefix := "u" + uid + "."
+		if !strings.HasPrefix(action.UUID(), prefix) {
+			t.Fatalf("object id %s doesn't start with %s", action.UUID(), prefix)
+		}
+		name := strings.TrimPrefix(action.UUID(), prefix)
+		expected := filepath.Join(root, "objects", "uid", uid, name[0:1], name[1:2], name[2:3], action.UUID())
+		if p := mover.Destination(action.UUID()); p != expected {
+			t.Fatalf("object stored at %s, expected %s", p, expected)
+		}
+		testRestoreHash(t, mover, length, action)
+
+		// The file's path in the mirror links to the object until
+		// it is removed.
+		link := filepath.Join(root, "mirror", "project", "a")
+		target, err := filepath.EvalSymlinks(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target != expected {
+			t.Fatalf("mirror links to %s, expected %s", target, expected)
+		}
+		testRemove(t, mover, action.UUID(), nil)
+		if _, err := os.Lstat(link); !os.IsNotExist(err) {
+			t.Fatalf("mirror link not removed: %v", err)
+		}
+	})
+}
+
+func TestPosixLayoutMigrate(t *testing.T) {
+	defer testhelpers.ChdirTemp(t)()
+	root, cleanRoot := testhelpers.TempDir(t)
+	defer cleanRoot()
+	newMover := func(layout *posix.LayoutConfig) *posix.Mover {
+		mover, err := posix.NewMover(&posix.ArchiveConfig{
+			Name:     "posix-test",
+			Root:     root,
+			Metadata: true,
+			Layout:   layout,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mover.MetadataFunc = func(action dmplugin.Action) (*dmplugin.ObjectMetadata, error) {
+			return &dmplugin.ObjectMetadata{Path: "project/a"}, nil
+		}
+		return mover
+	}
+	var length int64 = 1000
+	tfile, cleanFile := testhelpers.TempFile(t, length)
+	defer cleanFile()
+
+	legacy := newMover(nil)
+	old := testArchive(t, legacy, tfile, 0, length, "", nil)
+	oldPath := filepath.Join(root, "objects", old.UUID()[0:2], old.UUID()[2:4], old.UUID())
+	if p := legacy.Destination(old.UUID()); p != oldPath {
+		t.Fatalf("object stored at %s, expected %s", p, oldPath)
+	}
+
+	// Objects written under the older layout are still found after the
+	// layout changes.
+	layout := &posix.LayoutConfig{Depth: 1, Width: 3}
+	mover := newMover(layout)
+	action := testArchive(t, mover, tfile, 0, length, "", nil)
+	if p := mover.Destination(action.UUID()); p != filepath.Join(root, "objects", action.UUID()[0:3], action.UUID()) {
+		t.Fatalf("unexpected path %s", p)
+	}
+	if p := mover.Destination(old.UUID()); p != oldPath {
+		t.Fatalf("old object found at %s, expected %s", p, oldPath)
+	}
+	testRestoreHash(t, mover, length, old)
+	testRestoreHash(t, mover, length, action)
+	if data, err := ioutil.ReadFile(filepath.Join(root, "layouts")); err != nil || string(data) != "2x2\n1x3\n" {
+		t.Fatalf("unexpected layouts %q: %v", data, err)
+	}
+
+	// Migration moves the old object and its metadata without
+	// changing its ID, and removes the directories left empty.
+	result, err := mover.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Objects != 2 || result.Moved != 1 || result.Layout != "1x3" {
+		t.Fatalf("unexpected migration: %+v", result)
+	}
+	if _, err := os.Stat(filepath.Dir(filepath.Dir(oldPath))); !os.IsNotExist(err) {
+		t.Fatalf("old directories not removed: %v", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(root, "layouts")); err != nil || string(data) != "1x3\n" {
+		t.Fatalf("unexpected layouts %q: %v", data, err)
+	}
+	mover = newMover(layout)
+	if p := mover.Destination(old.UUID()); p != filepath.Join(root, "objects", old.UUID()[0:3], old.UUID()) {
+		t.Fatalf("migrated object found at %s", p)
+	}
+	testRestoreHash(t, mover, length, old)
+	if md, err := mover.ReadMetadata(old.UUID()); err != nil || md.UUID != old.UUID() {
+		t.Fatalf("metadata not migrated: %+v %v", md, err)
+	}
+}
+
+func TestPosixLayoutValidation(t *testing.T) {
+	for _, layout := range []*posix.LayoutConfig{
+		{Depth: -1},
+		{Depth: 9},
+		{Width: 9},
+		{Group: "gid"},
+	} {
+		cfg := &posix.ArchiveConfig{Name: "posix-test", ID: 1, Root: "/tmp", Layout: layout}
+		if err := cfg.CheckValid(); err == nil {
+			t.Fatalf("expected error for layout %+v", layout)
+		}
+	}
+}
+
+func TestPosixMetadata(t *testing.T) {
+	WithPosixMover(t, func(cfg *posix.ArchiveConfig) *posix.ArchiveConfig {
+		cfg.Metadata = true
+		return cfg
+	}, func(t *testing.T, mover *posix.Mover) {
+		mover.MetadataFunc = func(action dmplugin.Action) (*dmplugin.ObjectMetadata, error) {
+			return &dmplugin.ObjectMetadata{Path: "project/a", UID: 1000, Mode: 0100644}, nil
+		}
+
+		var length int64 = 1000
+		tfile, cleanFile := testhelpers.TempFile(t, length)
+		defer cleanFile()
+		action := testArchive(t, mover, tfile, 0, length, "", nil)
+
+		md, err := mover.ReadMetadata(action.UUID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if md.Path != "project/a" || md.UID != 1000 || md.UUID != action.UUID() ||
+			md.Size != length || !bytes.Equal(md.Hash, action.Hash()) {
+			t.Fatalf("unexpected metadata: %+v", md)
+		}
+
+		var ids []string
+		err = mover.List(func(oi *dmplugin.ObjectInfo) error {
+			ids = append(ids, oi.ID)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != 1 || ids[0] != action.UUID() {
+			t.Fatalf("unexpected objects: %v", ids)
+		}
+
+		// The metadata is kept if the object can't be removed.
+		p := testDestinationFile(t, mover, action.UUID())
+		if err := os.Rename(p, p+".saved"); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(p, "busy"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := mover.Remove(action); err == nil {
+			t.Fatal("expected remove of a directory to fail")
+		}
+		if _, err := mover.ReadMetadata(action.UUID()); err != nil {
+			t.Fatalf("expected metadata to be kept, got %v", err)
+		}
+		if err := os.RemoveAll(p); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(p+".saved", p); err != nil {
+			t.Fatal(err)
+		}
+
+		testRemove(t, mover, action.UUID(), nil)
+		if _, err := mover.ReadMetadata(action.UUID()); !os.IsNotExist(err) {
+			t.Fatalf("expected metadata to be removed, got %v", err)
+		}
+	})
+}
+
 func WithPosixMover(t *testing.T, updateConfig func(*posix.ArchiveConfig) *posix.ArchiveConfig,
 	tester func(t *testing.T, mover *posix.Mover)) {
 
@@ -379,3 +2033,44 @@ func WithPosixMover(t *testing.T, updateConfig func(*posix.ArchiveConfig) *posix
 
 	tester(t, mover)
 }
+
+func BenchmarkPosixIO(b *testing.B) {
+	var fileSize int64 = 64 * 1024 * 1024
+	defer testhelpers.ChdirTemp(b)()
+	tfile, cleanFile := testhelpers.TempFile(b, fileSize)
+	defer cleanFile()
+	rfile, cleanRestore := testhelpers.TempFile(b, 0)
+	defer cleanRestore()
+
+	for _, mode := range ioModes {
+		b.Run(mode.name, func(b *testing.B) {
+			archiveDir, cleanArchive := testhelpers.TempDir(b)
+			defer cleanArchive()
+			config := withIOMode(mode.io, mode.compression, mode.checksums)(&posix.ArchiveConfig{
+				Name: "posix-bench",
+				Root: archiveDir,
+			})
+			mover, err := posix.NewMover(config)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.SetBytes(2 * fileSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				action := dmplugin.NewTestAction(b, tfile, 0, fileSize, "", nil)
+				if err := mover.Archive(action); err != nil {
+					b.Fatal(err)
+				}
+				ra := dmplugin.NewTestAction(b, rfile, 0, fileSize, action.UUID(), nil)
+				ra.SetHash(action.Hash())
+				if err := mover.Restore(ra); err != nil {
+					b.Fatal(err)
+				}
+				if err := mover.Remove(ra); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,427 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package posix
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/intel-hpdd/go-lustre/pkg/xattr"
+	"github.com/intel-hpdd/lemur/dmplugin/dmio"
+	"github.com/intel-hpdd/logging/alert"
+)
+
+// replicaSeparator separates the names of the roots an object was
+// replicated to in its ID, so a replicated object's ID is its name and
+// the names of its roots, such as "name@a,b". The unnamed root has an
+// empty name.
+const replicaSeparator = ","
+
+// replicasXattr records the ID of a replicated object on each replica, so
+// the object is listed with its ID.
+const replicasXattr = "user.lhsm.replicas"
+
+// objectFile is the temporary file of a new object, or a temporary file
+// in each of the roots a replicated object is written to. Data written to
+// it is written to every replica. A replica that can't be written is
+// dropped, and writes fail only when fewer than quorum replicas are
+// left.
+type objectFile struct {
+	name   string
+	roots  []*RootConfig
+	files  []*os.File
+	quorum int
+
+	// direct are the writers of the replicas while they are written
+	// with direct I/O. A replica whose filesystem doesn't support it
+	// has none.
+	direct []*dmio.DirectWriter
+
+	mu     sync.Mutex
+	failed []error
+}
+
+func newObjectFile(name string, roots []*RootConfig, files []*os.File, quorum int) *objectFile {
+	if quorum > len(files) || quorum < 1 {
+		quorum = len(files)
+	}
+	return &objectFile{
+		name:   name,
+		roots:  roots,
+		files:  files,
+		quorum: quorum,
+		failed: make([]error, len(files)),
+	}
+}
+
+// Name returns the name of the first replica's temporary file.
+func (f *objectFile) Name() string {
+	return f.files[0].Name()
+}
+
+// live returns the indexes of the replicas that haven't failed.
+func (f *objectFile) live() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var live []int
+	for i := range f.files {
+		if f.failed[i] == nil {
+			live = append(live, i)
+		}
+	}
+	return live
+}
+
+// fail drops a replica, and returns an error if too few are left. An
+// object with a single replica fails with the replica.
+func (f *objectFile) fail(i int, err error) error {
+	if len(f.files) == 1 {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failed[i] == nil {
+		f.failed[i] = err
+		alert.Warnf("%s: replica in root %q failed: %v", f.name, f.roots[i].Name, err)
+		os.Remove(f.files[i].Name())
+	}
+	var live int
+	for _, e := range f.failed {
+		if e == nil {
+			live++
+		}
+	}
+	if live < f.quorum {
+		return errors.Wrapf(err, "%s: %d of %d replicas left, quorum is %d", f.name, live, len(f.files), f.quorum)
+	}
+	return nil
+}
+
+// each calls fn with each replica that hasn't failed.
+func (f *objectFile) each(fn func(*os.File) error) error {
+	return f.eachIndex(func(i int) error {
+		return fn(f.files[i])
+	})
+}
+
+// eachIndex calls fn with the index of each replica that hasn't failed.
+func (f *objectFile) eachIndex(fn func(int) error) error {
+	for _, i := range f.live() {
+		if err := fn(i); err != nil {
+			if err := f.fail(i, err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f *objectFile) Write(p []byte) (int, error) {
+	err := f.eachIndex(func(i int) error {
+		var w io.Writer = f.files[i]
+		if f.direct != nil && f.direct[i] != nil {
+			w = f.direct[i]
+		}
+		n, err := w.Write(p)
+		if err == nil && n < len(p) {
+			err = io.ErrShortWrite
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (f *objectFile) WriteAt(p []byte, off int64) (int, error) {
+	err := f.each(func(file *os.File) error {
+		_, err := file.WriteAt(p, off)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (f *objectFile) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	err := f.each(func(file *os.File) error {
+		var err error
+		pos, err = file.Seek(offset, whence)
+		return err
+	})
+	return pos, err
+}
+
+func (f *objectFile) Truncate(size int64) error {
+	return f.each(func(file *os.File) error {
+		return file.Truncate(size)
+	})
+}
+
+func (f *objectFile) Sync() error {
+	return f.each(func(file *os.File) error {
+		return file.Sync()
+	})
+}
+
+// startDirect makes the following Writes write each replica with direct
+// I/O, from its current offset, until stopDirect is called. Replicas
+// that can't be written with direct I/O are written through the page
+// cache.
+func (f *objectFile) startDirect(m *Mover) error {
+	f.direct = make([]*dmio.DirectWriter, len(f.files))
+	return f.eachIndex(func(i int) error {
+		var err error
+		f.direct[i], err = m.newDirectWriter(f.files[i])
+		return err
+	})
+}
+
+// stopDirect writes the data buffered for direct I/O, and makes Writes
+// write through the page cache again.
+func (f *objectFile) stopDirect() error {
+	if f.direct == nil {
+		return nil
+	}
+	err := f.eachIndex(func(i int) error {
+		if f.direct[i] == nil {
+			return nil
+		}
+		return f.direct[i].Close()
+	})
+	f.direct = nil
+	return err
+}
+
+// setxattr sets an extended attribute of each replica.
+func (f *objectFile) setxattr(name string, value []byte) error {
+	return f.each(func(file *os.File) error {
+		return xattr.Fsetxattr(int(file.Fd()), name, value, 0)
+	})
+}
+
+// Close closes the temporary files.
+func (f *objectFile) Close() error {
+	err := f.stopDirect()
+	for _, file := range f.files {
+		if e := file.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// remove removes the temporary files.
+func (f *objectFile) remove() {
+	for _, file := range f.files {
+		os.Remove(file.Name())
+	}
+}
+
+// isReplicated returns true if an ID is the ID of an object written to
+// several roots.
+func isReplicated(id string) bool {
+	i := strings.LastIndex(id, rootSeparator)
+	return i >= 0 && strings.Contains(id[i+1:], replicaSeparator)
+}
+
+// replicaID returns the ID of the object with the given name in roots.
+func replicaID(name string, roots []*RootConfig) string {
+	if len(roots) == 1 {
+		return objectID(name, roots[0])
+	}
+	names := make([]string, len(roots))
+	for i, r := range roots {
+		names[i] = r.Name
+	}
+	return name + rootSeparator + strings.Join(names, replicaSeparator)
+}
+
+// replicaRoots returns the name of a replicated object, and the roots
+// recorded in its ID that are configured.
+func (m *Mover) replicaRoots(id string) (string, []*RootConfig) {
+	i := strings.LastIndex(id, rootSeparator)
+	if i < 0 {
+		return id, nil
+	}
+	var roots []*RootConfig
+	for _, name := range strings.Split(id[i+1:], replicaSeparator) {
+		for j := range m.Roots {
+			if m.Roots[j].Name == name {
+				roots = append(roots, &m.Roots[j])
+				break
+			}
+		}
+	}
+	return id[:i], roots
+}
+
+// replicaPaths returns the paths of an object's replicas, in the order
+// they are read. An object that isn't replicated has one.
+func (m *Mover) replicaPaths(id string) []string {
+	if !isReplicated(id) {
+		return []string{m.Destination(id)}
+	}
+	name, roots := m.replicaRoots(id)
+	if len(roots) == 0 {
+		return []string{m.Destination(id)}
+	}
+	paths := make([]string, len(roots))
+	for i, r := range roots {
+		paths[i], _ = m.findPath(r, name)
+	}
+	return paths
+}
+
+// firstReplica returns the first root recorded in a replicated object's
+// ID that has a replica of it, or nil if none does.
+func (m *Mover) firstReplica(id string) *RootConfig {
+	name, roots := m.replicaRoots(id)
+	for _, r := range roots {
+		if _, found := m.findPath(r, name); found {
+			return r
+		}
+	}
+	return nil
+}
+
+// placeReplicas returns the roots a new object is written to. The first
+// is chosen by the placement policy and the others are the writable roots
+// that follow it.
+func (m *Mover) placeReplicas() ([]*RootConfig, error) {
+	first, err := m.placeObject()
+	if err != nil {
+		return nil, err
+	}
+	if m.Replicas < 2 {
+		return []*RootConfig{first}, nil
+	}
+	roots := []*RootConfig{first}
+	start := 0
+	for i := range m.Roots {
+		if &m.Roots[i] == first {
+			start = i
+		}
+	}
+	for i := 1; i < len(m.Roots) && len(roots) < m.Replicas; i++ {
+		r := &m.Roots[(start+i)%len(m.Roots)]
+		if !r.ReadOnly {
+			roots = append(roots, r)
+		}
+	}
+	if len(roots) < m.quorum() {
+		return nil, errors.Errorf("%s: %d roots are writable, quorum is %d", m.Name, len(roots), m.quorum())
+	}
+	return roots, nil
+}
+
+// quorum returns the number of replicas that must be written for an
+// archive to succeed.
+func (m *Mover) quorum() int {
+	if m.Quorum > 0 {
+		return m.Quorum
+	}
+	return m.Replicas
+}
+
+// createReplicas creates the temporary files of a new replicated object
+// in each of its roots.
+func (m *Mover) createReplicas(name string, roots []*RootConfig) (*objectFile, error) {
+	var files []*os.File
+	for _, r := range roots {
+		p, err := m.createPath(r, name)
+		var f *os.File
+		if err == nil {
+			f, err = os.OpenFile(tempName(p), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		}
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+				os.Remove(f.Name())
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return newObjectFile(name, roots, files, m.quorum()), nil
+}
+
+// openReplicas reopens the temporary files of a partial replicated
+// object. Replicas whose files are missing are dropped, and the error
+// satisfies os.IsNotExist if fewer than the quorum are left.
+func (m *Mover) openReplicas(id string) (*objectFile, error) {
+	name, all := m.replicaRoots(id)
+	var roots []*RootConfig
+	var files []*os.File
+	for _, r := range all {
+		p, _ := m.findPath(r, name)
+		f, err := os.OpenFile(tempName(p), os.O_WRONLY, 0600)
+		if os.IsNotExist(err) {
+			alert.Warnf("%s: partial replica of %s in root %q is missing", m.Name, id, r.Name)
+			continue
+		} else if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		roots = append(roots, r)
+		files = append(files, f)
+	}
+	if len(files) == 0 || len(files) < m.quorum() {
+		for _, f := range files {
+			f.Close()
+		}
+		return nil, &os.PathError{Op: "open", Path: id, Err: os.ErrNotExist}
+	}
+	return newObjectFile(name, roots, files, m.quorum()), nil
+}
+
+// commitReplicas renames the temporary files of a replicated object into
+// place, and returns the object's ID, which records the roots whose
+// replicas were committed.
+func (m *Mover) commitReplicas(dst *objectFile) (string, error) {
+	if err := dst.Sync(); err != nil {
+		return "", errors.Wrapf(err, "%s: sync failed", dst.name)
+	}
+	var roots []*RootConfig
+	var paths []string
+	for _, i := range dst.live() {
+		p := path.Join(path.Dir(dst.files[i].Name()), dst.name)
+		if err := os.Rename(dst.files[i].Name(), p); err != nil {
+			if err := dst.fail(i, errors.Wrapf(err, "%s: rename failed", p)); err != nil {
+				for _, p := range paths {
+					os.Remove(p)
+				}
+				return "", err
+			}
+			continue
+		}
+		roots = append(roots, dst.roots[i])
+		paths = append(paths, p)
+	}
+
+	id := replicaID(dst.name, roots)
+	for _, p := range paths {
+		if len(paths) > 1 {
+			if err := unix.Setxattr(p, replicasXattr, []byte(id), 0); err != nil {
+				alert.Warnf("%s: record replicas failed: %v", p, err)
+			}
+		}
+		if err := syncDir(path.Dir(p)); err != nil {
+			return "", err
+		}
+	}
+	return id, nil
+}
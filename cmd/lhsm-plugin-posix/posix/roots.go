@@ -0,0 +1,257 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package posix
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+// Placement policies choose the root each new object is written to.
+const (
+	PlacementRoundRobin = "round-robin"
+	PlacementMostFree   = "most-free"
+	PlacementWeighted   = "weighted"
+)
+
+// rootSeparator separates the name of an object from the name of the root
+// it was written to in the object's ID. Objects written to the unnamed
+// root, including all objects written before an archive had several
+// roots, have IDs without it.
+const rootSeparator = "@"
+
+type (
+	// RootConfig configures one of the directories an archive's objects
+	// are stored in. The name is recorded in the ID of each object
+	// written to the root, so it must not be changed.
+	RootConfig struct {
+		Name     string `hcl:"name"`
+		Path     string `hcl:"path"`
+		Weight   int    `hcl:"weight"`    // Used by the weighted policy, default 1
+		ReadOnly bool   `hcl:"read_only"` // No new objects, for draining
+	}
+
+	// placer holds the state of the placement policies.
+	placer struct {
+		sync.Mutex
+		next    int
+		current []int
+	}
+)
+
+// rootConfigs returns the archive's roots. The root set with root is the
+// unnamed root, and comes first.
+func (a *ArchiveConfig) rootConfigs() []RootConfig {
+	var roots []RootConfig
+	if a.Root != "" {
+		roots = append(roots, RootConfig{Path: a.Root})
+	}
+	for _, r := range a.Roots {
+		if r != nil {
+			roots = append(roots, *r)
+		}
+	}
+	return roots
+}
+
+// checkRoots returns the problems with the archive's roots, placement
+// policy and replication.
+func (a *ArchiveConfig) checkRoots() []string {
+	var errs []string
+	roots := a.rootConfigs()
+	if len(roots) == 0 {
+		errs = append(errs, fmt.Sprintf("Archive %s: archive root not set", a.Name))
+	}
+	names := make(map[string]bool)
+	for _, r := range roots {
+		if r.Path == "" {
+			errs = append(errs, fmt.Sprintf("Archive %s: root %q has no path", a.Name, r.Name))
+		}
+		if names[r.Name] {
+			if r.Name == "" {
+				errs = append(errs, fmt.Sprintf("Archive %s: only one root may be unnamed", a.Name))
+			} else {
+				errs = append(errs, fmt.Sprintf("Archive %s: root name %q is used more than once", a.Name, r.Name))
+			}
+		}
+		names[r.Name] = true
+		if strings.ContainsAny(r.Name, "/"+rootSeparator+replicaSeparator+memberSeparator) {
+			errs = append(errs, fmt.Sprintf("Archive %s: root name %q must not contain /, %s, %s or %s", a.Name, r.Name, rootSeparator, replicaSeparator, memberSeparator))
+		}
+		if r.Weight < 0 {
+			errs = append(errs, fmt.Sprintf("Archive %s: root %q weight must not be negative", a.Name, r.Name))
+		}
+	}
+	switch a.Placement {
+	case "", PlacementRoundRobin, PlacementMostFree, PlacementWeighted:
+	default:
+		errs = append(errs, fmt.Sprintf("Archive %s: unknown placement policy %q", a.Name, a.Placement))
+	}
+	switch {
+	case a.Replicas < 0 || a.Quorum < 0:
+		errs = append(errs, fmt.Sprintf("Archive %s: replicas and quorum must not be negative", a.Name))
+	case a.Replicas > 1 && a.Replicas > len(roots):
+		errs = append(errs, fmt.Sprintf("Archive %s: %d replicas need as many roots", a.Name, a.Replicas))
+	case a.Quorum > a.Replicas && a.Quorum > 1:
+		errs = append(errs, fmt.Sprintf("Archive %s: quorum must not be more than replicas", a.Name))
+	}
+	return errs
+}
+
+// splitObjectID returns the name of an object in its root, and the root
+// it was written to, or nil if the root isn't configured. The object of a
+// file in a container is the container.
+func (m *Mover) splitObjectID(id string) (string, *RootConfig) {
+	if containerID, _, _, ok := splitMemberID(id); ok {
+		id = containerID
+	}
+	name, root := id, ""
+	if i := strings.LastIndex(id, rootSeparator); i >= 0 {
+		name, root = id[:i], id[i+1:]
+	}
+	for i := range m.Roots {
+		if m.Roots[i].Name == root {
+			return name, &m.Roots[i]
+		}
+	}
+	return name, nil
+}
+
+// objectID returns the ID of the object with the given name in a root.
+func objectID(name string, root *RootConfig) string {
+	if root.Name == "" {
+		return name
+	}
+	return name + rootSeparator + root.Name
+}
+
+// findObject returns the root an object with the given name is stored in,
+// or nil if there is none.
+func (m *Mover) findObject(name string) *RootConfig {
+	for i := range m.Roots {
+		if _, found := m.findPath(&m.Roots[i], name); found {
+			return &m.Roots[i]
+		}
+	}
+	return nil
+}
+
+// locate returns the root an object is stored in. That is the root
+// recorded in its ID, unless the object isn't there and another root has
+// it, which allows objects to be found after their root was renamed or
+// they were moved. IDs of unknown roots with no such object are located
+// in the first root.
+func (m *Mover) locate(id string) (string, *RootConfig) {
+	name, root := m.splitObjectID(id)
+	if root != nil {
+		if _, found := m.findPath(root, name); found || len(m.Roots) == 1 {
+			return name, root
+		}
+	}
+	if found := m.findObject(name); found != nil {
+		if root != nil {
+			debug.Printf("%s: %s found in root %q", m.Name, id, found.Name)
+		}
+		return name, found
+	}
+	if root == nil {
+		root = &m.Roots[0]
+	}
+	return name, root
+}
+
+// isReadOnly returns true if any of an object's roots doesn't accept new
+// data.
+func (m *Mover) isReadOnly(id string) bool {
+	if isReplicated(id) {
+		_, roots := m.replicaRoots(id)
+		for _, r := range roots {
+			if r.ReadOnly {
+				return true
+			}
+		}
+		return false
+	}
+	_, root := m.locate(id)
+	return root.ReadOnly
+}
+
+// placeObject returns the root a new object is written to.
+func (m *Mover) placeObject() (*RootConfig, error) {
+	var writable []int
+	for i := range m.Roots {
+		if !m.Roots[i].ReadOnly {
+			writable = append(writable, i)
+		}
+	}
+	if len(writable) == 0 {
+		return nil, errors.Errorf("%s: all roots are read only", m.Name)
+	}
+
+	switch m.Placement {
+	case PlacementMostFree:
+		return m.mostFree(writable), nil
+	case PlacementWeighted:
+		return m.weighted(writable), nil
+	default:
+		m.placer.Lock()
+		defer m.placer.Unlock()
+		i := writable[m.placer.next%len(writable)]
+		m.placer.next++
+		return &m.Roots[i], nil
+	}
+}
+
+// mostFree returns the writable root with the most space available.
+// Roots that can't be checked are only used if none can.
+func (m *Mover) mostFree(writable []int) *RootConfig {
+	best := writable[0]
+	var bestFree uint64
+	for _, i := range writable {
+		var st unix.Statfs_t
+		if err := unix.Statfs(m.Roots[i].Path, &st); err != nil {
+			alert.Warnf("%s: statfs %s failed: %v", m.Name, m.Roots[i].Path, err)
+			continue
+		}
+		free := st.Bavail * uint64(st.Bsize)
+		if free > bestFree {
+			best, bestFree = i, free
+		}
+	}
+	return &m.Roots[best]
+}
+
+// weighted returns the next writable root in a smooth weighted round
+// robin, so each root receives a share of new objects proportional to its
+// weight, interleaved with the others.
+func (m *Mover) weighted(writable []int) *RootConfig {
+	m.placer.Lock()
+	defer m.placer.Unlock()
+	if len(m.placer.current) != len(m.Roots) {
+		m.placer.current = make([]int, len(m.Roots))
+	}
+
+	best, total := -1, 0
+	for _, i := range writable {
+		weight := m.Roots[i].Weight
+		if weight == 0 {
+			weight = 1
+		}
+		total += weight
+		m.placer.current[i] += weight
+		if best < 0 || m.placer.current[i] > m.placer.current[best] {
+			best = i
+		}
+	}
+	m.placer.current[best] -= total
+	return &m.Roots[best]
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package posix
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	lustre "github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/lemur/dmplugin"
+	"github.com/intel-hpdd/lemur/dmplugin/dmio"
+	"github.com/intel-hpdd/lemur/pkg/checksum"
+	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+// sparseMap returns the map of the data in the extent of the file being
+// archived, or nil if it has no holes.
+func (m *Mover) sparseMap(action dmplugin.Action, total int64) (*dmio.SparseMap, error) {
+	f, err := os.Open(action.PrimaryPath())
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: open failed", action.PrimaryPath())
+	}
+	defer f.Close()
+	return dmio.FindSparseMap(f, action.Offset(), total)
+}
+
+// archiveSparse writes the sparse map and the data of its extents to the
+// object, and returns the logical size of the data and its checksum,
+// which is calculated as if the holes had been read as zeros.
+func (m *Mover) archiveSparse(action dmplugin.Action, dst *objectFile, codec dmio.Codec, dataKey []byte, sm *dmio.SparseMap) (int64, []byte, error) {
+	src, err := os.Open(action.PrimaryPath())
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "%s: open failed", action.PrimaryPath())
+	}
+	defer src.Close()
+
+	size := strconv.FormatInt(sm.Size, 10)
+	if err := dst.setxattr(sparseXattr, []byte(size)); err != nil {
+		return 0, nil, errors.Wrapf(err, "%s: record sparse size failed", dst.Name())
+	}
+	debug.Printf("%s id:%d %s has %d bytes of data in %d extents", m.Name, action.ID(),
+		action.PrimaryPath(), sm.DataSize(), len(sm.Extents))
+
+	enc, err := m.newObjectWriter(dst, codec, dataKey)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer enc.Close()
+
+	header, err := sm.MarshalBinary()
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err := enc.Write(header); err != nil {
+		return 0, nil, errors.Wrap(err, "write sparse map failed")
+	}
+
+	cw := m.ChecksumWriter(ioutil.Discard)
+	sr := dmio.NewSparseReader(src, action.Offset(), sm)
+	sr.Logical = cw
+	n, err := CopyWithProgress(enc, sr, sm.DataSize(), action)
+	if err != nil {
+		debug.Printf("copy error %v read %d expected %d", err, n, sm.DataSize())
+		return 0, nil, errors.Wrap(err, "copy failed")
+	}
+	if err := enc.Close(); err != nil {
+		return 0, nil, errors.Wrap(err, "flush encoder failed")
+	}
+	return sm.Size, cw.Sum(), nil
+}
+
+// restoreSparse restores the extents of a sparse object that overlap the
+// action's extent, starting skip bytes into the object, and leaves the
+// holes unwritten.
+func (m *Mover) restoreSparse(action dmplugin.Action, src *os.File, skip int64, start time.Time) error {
+	rdr, err := m.objectReader(action, src, 0)
+	if err != nil {
+		return err
+	}
+	sm, headerLen, err := dmio.ReadSparseMap(rdr)
+	rdr.Close()
+	if err != nil {
+		return errors.Wrap(err, action.UUID())
+	}
+
+	end := sm.Size
+	if action.Length() != lustre.MaxExtentLength && skip+action.Length() < end {
+		end = skip + action.Length()
+	}
+	if skip > end {
+		return errors.Errorf("%s: extent starts beyond the end of the object", action.UUID())
+	}
+	packedStart := sm.PackedOffset(skip)
+	packedEnd := sm.PackedOffset(end)
+
+	rdr, err = m.objectReader(action, src, headerLen+packedStart)
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+
+	dst, err := dmio.NewActionWriter(action)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create ActionWriter for %s", action)
+	}
+	defer dst.Close()
+
+	// The file's checksum can only be compared if all of the object is
+	// restored.
+	whole := skip == 0 && end == sm.Size
+	sw := dmio.NewSparseWriter(dst, sm, skip)
+	if _, err := sw.Seek(packedStart, io.SeekStart); err != nil {
+		return err
+	}
+	cw := m.checksumWriter(ioutil.Discard, restoreAlgorithm(action))
+	if whole {
+		sw.Logical = cw
+	}
+
+	length := packedEnd - packedStart
+	n, err := CopyWithProgress(sw, io.LimitReader(rdr, length), length, action)
+	if err != nil {
+		debug.Printf("copy error %v read %d expected %d", err, n, length)
+		return errors.Wrap(err, "copy failed")
+	}
+	if n != length {
+		return errors.Errorf("%s: restored %d bytes of data, expected %d", action.UUID(), n, length)
+	}
+	if err := sw.Flush(); err != nil {
+		return err
+	}
+	if err := dst.Extend(end - skip); err != nil {
+		return err
+	}
+
+	if action.Hash() != nil && whole && !m.Checksums.DisableCompareOnRestore {
+		if !bytes.Equal(action.Hash(), cw.Sum()) {
+			alert.Warnf("original checksum doesn't match new:  %s != %s", checksum.Format(action.Hash()), checksum.Format(cw.Sum()))
+			return errors.New("Checksum mismatch!")
+		}
+	}
+
+	debug.Printf("%s id:%d Restored %d bytes (%d of data) in %v to %s %x", m.Name, action.ID(), end-skip, n,
+		time.Since(start),
+		action.PrimaryPath(),
+		cw.Sum())
+	action.SetActualLength(end - skip)
+	return nil
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package posix
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/intel-hpdd/lemur/dmplugin"
+	"github.com/intel-hpdd/lemur/dmplugin/dmio"
+	"github.com/intel-hpdd/lemur/pkg/checksum"
+	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+// discardAt is an io.WriterAt that discards what is written to it.
+type discardAt struct{}
+
+func (discardAt) WriteAt(p []byte, off int64) (int, error) {
+	return len(p), nil
+}
+
+// Verify fulfills a Verify request. It reads all of an object's data, as
+// a restore would, and compares its checksum with the one recorded when it
+// was archived. Objects archived without a checksum are only checked to be
+// readable. Every replica of a replicated object is verified, and the
+// object fails if any of them does.
+func (m *Mover) Verify(action dmplugin.Action) error {
+	debug.Printf("%s id:%d VERIFY %s %x", m.Name, action.ID(), action.UUID(), action.Hash())
+	rate.Mark(1)
+	start := time.Now()
+
+	if action.UUID() == "" {
+		return errors.New("Missing UUID")
+	}
+
+	paths := m.replicaPaths(action.UUID())
+	var n int64
+	var failed error
+	for _, p := range paths {
+		size, sum, err := m.verifyReplica(action, p)
+		if err == nil && len(action.Hash()) > 0 && !bytes.Equal(action.Hash(), sum) {
+			alert.Warnf("%s: original checksum doesn't match object: %s != %s", p, checksum.Format(action.Hash()), checksum.Format(sum))
+			err = errors.Wrap(dmplugin.ErrChecksumMismatch, action.UUID())
+		}
+		if err != nil {
+			if len(paths) > 1 {
+				alert.Warnf("%s id:%d replica %s failed verification: %v", m.Name, action.ID(), p, err)
+			}
+			// A mismatch is reported in preference to other errors.
+			if failed == nil || errors.Cause(err) == dmplugin.ErrChecksumMismatch {
+				failed = err
+			}
+			continue
+		}
+		n = size
+		debug.Printf("%s id:%d Verified %d bytes in %v of %s %x", m.Name, action.ID(), n,
+			time.Since(start),
+			p,
+			sum)
+	}
+	if failed != nil {
+		return failed
+	}
+	action.SetActualLength(n)
+	return nil
+}
+
+// verifyReplica reads the replica of an object at p, and returns the
+// logical size of its data and its checksum.
+func (m *Mover) verifyReplica(action dmplugin.Action, p string) (int64, []byte, error) {
+	src, err := os.Open(p)
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "%s: open failed", p)
+	}
+	defer src.Close()
+
+	if _, offset, length, ok := splitMemberID(action.UUID()); ok {
+		return m.verifyMember(action, src, offset, length)
+	}
+	if size, err := fileAttr(p, sparseXattr); err != nil {
+		return 0, nil, err
+	} else if size != "" {
+		return m.verifySparse(action, src)
+	}
+
+	chunkSize, err := objectChunkSize(p)
+	if err != nil {
+		return 0, nil, err
+	}
+	var cw checksum.Writer
+	if chunkSize > 0 {
+		cw, err = checksum.NewChunkedHashWriter(ioutil.Discard, chunkSize, restoreAlgorithm(action))
+	} else {
+		cw, err = checksum.NewHashWriter(ioutil.Discard, restoreAlgorithm(action))
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	rdr, err := m.objectReader(action, src, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rdr.Close()
+	n, err := CopyWithProgress(cw, rdr, action.Length(), action)
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "%s: read failed", action.UUID())
+	}
+	return n, cw.Sum(), nil
+}
+
+// verifySparse reads a sparse object, and returns its logical size and the
+// checksum of its logical data.
+func (m *Mover) verifySparse(action dmplugin.Action, src *os.File) (int64, []byte, error) {
+	rdr, err := m.objectReader(action, src, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rdr.Close()
+	sm, _, err := dmio.ReadSparseMap(rdr)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, action.UUID())
+	}
+
+	cw, err := checksum.NewHashWriter(ioutil.Discard, restoreAlgorithm(action))
+	if err != nil {
+		return 0, nil, err
+	}
+	sw := dmio.NewSparseWriter(discardAt{}, sm, 0)
+	sw.Logical = cw
+	length := sm.DataSize()
+	n, err := CopyWithProgress(sw, io.LimitReader(rdr, length), length, action)
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "%s: read failed", action.UUID())
+	}
+	if n != length {
+		return 0, nil, errors.Errorf("%s: read %d bytes of data, expected %d", action.UUID(), n, length)
+	}
+	if err := sw.Flush(); err != nil {
+		return 0, nil, err
+	}
+	return sm.Size, cw.Sum(), nil
+}
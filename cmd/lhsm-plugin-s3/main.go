@@ -24,6 +24,8 @@ import (
 	"github.com/rcrowley/go-metrics"
 
 	"github.com/intel-hpdd/lemur/dmplugin"
+	"github.com/intel-hpdd/lemur/dmplugin/dmio"
+	"github.com/intel-hpdd/lemur/pkg/checksum"
 	"github.com/intel-hpdd/lemur/pkg/fsroot"
 	"github.com/intel-hpdd/logging/alert"
 	"github.com/intel-hpdd/logging/audit"
@@ -41,8 +43,17 @@ type (
 		Bucket             string
 		Prefix             string
 		UploadPartSize     int64 `hcl:"upload_part_size"`
+		Compression        string
+		Keyring            string
+		Metadata           bool   `hcl:"metadata"`
+		Sparse             bool   `hcl:"sparse"`
+		Checksum           string `hcl:"checksum"`
+		StateDir           string `hcl:"state_dir"`
 
-		s3Creds *credentials.Credentials
+		s3Creds     *credentials.Credentials
+		compression *dmio.Compression
+		keyring     *dmio.Keyring
+		checkpoints *dmplugin.CheckpointStore
 	}
 
 	archiveSet []*archiveConfig
@@ -54,6 +65,8 @@ type (
 		Endpoint           string     `hcl:"endpoint"`
 		Region             string     `hcl:"region"`
 		UploadPartSize     int64      `hcl:"upload_part_size"`
+		Checksum           string     `hcl:"checksum"`
+		StateDir           string     `hcl:"state_dir"`
 		Archives           archiveSet `hcl:"archive"`
 	}
 )
@@ -83,6 +96,33 @@ func (a *archiveConfig) checkValid() error {
 
 	}
 
+	compression, err := dmio.ParseCompression(a.Compression)
+	if err != nil {
+		errors = append(errors, fmt.Sprintf("Archive %s: %v", a.Name, err))
+	}
+	a.compression = compression
+
+	if a.Keyring != "" {
+		if a.keyring, err = dmio.OpenKeyring(a.Keyring); err != nil {
+			errors = append(errors, fmt.Sprintf("Archive %s: %v", a.Name, err))
+		}
+	}
+
+	if a.Checksum != "" && a.Checksum != checksumNone {
+		if err := checksum.CheckAlgorithm(a.Checksum); err != nil {
+			errors = append(errors, fmt.Sprintf("Archive %s: %v", a.Name, err))
+		}
+	}
+
+	// Each archive has its own checkpoints, as the same file may be
+	// archived to several of them.
+	if a.StateDir != "" {
+		dir := path.Join(a.StateDir, fmt.Sprintf("s3-%d", a.ID))
+		if a.checkpoints, err = dmplugin.OpenCheckpointStore(dir); err != nil {
+			errors = append(errors, fmt.Sprintf("Archive %s: %v", a.Name, err))
+		}
+	}
+
 	if a.UploadPartSize < s3manager.MinUploadPartSize {
 		errors = append(errors, fmt.Sprintf("Archive %s: upload_part_size %d is less than minimum (%d)", a.Name, a.UploadPartSize, s3manager.MinUploadPartSize))
 	}
@@ -127,6 +167,14 @@ func (a *archiveConfig) mergeGlobals(g *s3Config) {
 		a.Region = g.Region
 	}
 
+	if a.StateDir == "" {
+		a.StateDir = g.StateDir
+	}
+
+	if a.Checksum == "" {
+		a.Checksum = g.Checksum
+	}
+
 	if a.UploadPartSize == 0 {
 		a.UploadPartSize = g.UploadPartSize
 	} else {
@@ -179,6 +227,16 @@ func (c *s3Config) Merge(other *s3Config) *s3Config {
 		result.AWSSecretAccessKey = other.AWSSecretAccessKey
 	}
 
+	result.StateDir = c.StateDir
+	if other.StateDir != "" {
+		result.StateDir = other.StateDir
+	}
+
+	result.Checksum = c.Checksum
+	if other.Checksum != "" {
+		result.Checksum = other.Checksum
+	}
+
 	result.Archives = c.Archives
 	if len(other.Archives) > 0 {
 		result.Archives = other.Archives
@@ -244,6 +302,8 @@ func getMergedConfig(plugin *dmplugin.Plugin) (*s3Config, error) {
 	return baseCfg.Merge(&cfg), nil
 }
 
+var version string // Set by build environment
+
 func main() {
 	plugin, err := dmplugin.New(path.Base(os.Args[0]), func(path string) (fsroot.Client, error) {
 		return fsroot.New(path)
@@ -252,6 +312,7 @@ func main() {
 		alert.Abort(errors.Wrap(err, "failed to initialize plugin"))
 	}
 	defer plugin.Close()
+	plugin.SetVersion(version)
 
 	cfg, err := getMergedConfig(plugin)
 	if err != nil {
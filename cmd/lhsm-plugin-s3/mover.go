@@ -5,36 +5,100 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/url"
+	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/pkg/errors"
 
 	"github.com/intel-hpdd/lemur/dmplugin"
 	"github.com/intel-hpdd/lemur/dmplugin/dmio"
+	"github.com/intel-hpdd/lemur/pkg/checksum"
 	"github.com/intel-hpdd/logging/debug"
 	"github.com/pborman/uuid"
 )
 
+const (
+	// metadataKey is the user metadata key an object's ObjectMetadata
+	// was stored under, base64 encoded, before it was always stored in
+	// a sidecar object.
+	metadataKey = "Lhsm-Metadata"
+
+	// metadataSuffix is appended to an object's key to name the
+	// sidecar object its ObjectMetadata is stored in.
+	metadataSuffix = ".meta"
+
+	// codecKey is the user metadata key that records the codec an
+	// object was compressed with.
+	codecKey = "Lhsm-Codec"
+
+	// keyKey is the user metadata key that records the wrapped data key
+	// an object was encrypted with.
+	keyKey = "Lhsm-Key"
+
+	// sparseKey is the user metadata key that records the sparse map
+	// of an object that was archived without the holes of its file.
+	sparseKey = "Lhsm-Sparse"
+
+	// maxSparseMapSize is the largest sparse map stored in an object's
+	// user metadata. Files with more extents are archived with their
+	// holes.
+	maxSparseMapSize = 1024
+
+	// chunkKey is the user metadata key that records the part size of
+	// an object uploaded with a resumable multipart upload. Its
+	// checksum is the combination of the checksums of each part
+	// calculated by checksum.CombineSums.
+	chunkKey = "Lhsm-Chunk"
+
+	// checksumNone is the checksum setting that disables checksums.
+	checksumNone = "none"
+)
+
 // Mover is an S3 data mover
 type Mover struct {
-	name  string
-	s3Svc *s3.S3
-	cfg   *archiveConfig
+	name         string
+	s3Svc        *s3.S3
+	cfg          *archiveConfig
+	metadataFunc func(dmplugin.Action) (*dmplugin.ObjectMetadata, error)
 }
 
 // S3Mover returns a new *Mover
 func S3Mover(cfg *archiveConfig, s3Svc *s3.S3, archiveID uint32) *Mover {
-	return &Mover{
-		name:  fmt.Sprintf("s3-%d", archiveID),
-		s3Svc: s3Svc,
-		cfg:   cfg,
+	m := &Mover{
+		name:         fmt.Sprintf("s3-%d", archiveID),
+		s3Svc:        s3Svc,
+		cfg:          cfg,
+		metadataFunc: dmplugin.NewObjectMetadata,
 	}
+	if cfg.checkpoints != nil {
+		cfg.checkpoints.Discard = m.abortUpload
+	}
+	return m
+}
+
+// checksumAlgorithm returns the algorithm archived data is checksummed
+// with, or "" if checksums are disabled.
+func (m *Mover) checksumAlgorithm() string {
+	switch m.cfg.Checksum {
+	case checksumNone:
+		return ""
+	case "":
+		return checksum.DefaultAlgorithm
+	}
+	return m.cfg.Checksum
 }
 
 func newFileID() string {
@@ -62,8 +126,10 @@ func (m *Mover) newDownloader() *s3manager.Downloader {
 
 // Start signals the mover to begin any asynchronous processing (e.g. stats)
 func (m *Mover) Start() {
+	go m.cfg.checkpoints.SweepEvery(m.name, checkpointSweepInterval, checkpointMaxAge)
 	debug.Printf("%s started", m.name)
 }
+
 func (m *Mover) fileIDtoBucketPath(fileID string) (string, string, error) {
 	var bucket, path string
 
@@ -97,25 +163,92 @@ func (m *Mover) Archive(action dmplugin.Action) error {
 	}
 	defer rdr.Close()
 
+	var src io.ReadSeeker = rdr
+	dataSize := total
+	sm, err := m.sparseMap(action, total)
+	if err != nil {
+		return err
+	}
+	if sm != nil {
+		f, err := os.Open(action.PrimaryPath())
+		if err != nil {
+			return errors.Wrapf(err, "%s: open failed", action.PrimaryPath())
+		}
+		defer f.Close()
+		src = dmio.NewSparseReader(f, action.Offset(), sm)
+		dataSize = sm.DataSize()
+	}
+
 	progressFunc := func(offset, length int64) error {
-		return action.Update(offset, length, total)
+		return action.Update(offset, length, dataSize)
 	}
-	progressReader := dmio.NewProgressReader(rdr, updateInterval, progressFunc)
+	progressReader := dmio.NewProgressReader(src, updateInterval, progressFunc)
 	defer progressReader.StopUpdates()
 
-	uploader := m.newUploader()
-	out, err := uploader.Upload(&s3manager.UploadInput{
+	codec, err := m.cfg.compression.Select(action.PrimaryPath())
+	if err != nil {
+		return err
+	}
+
+	if m.resumable(total, codec != nil || sm != nil || m.cfg.keyring != nil) {
+		return m.archiveMultipart(action, total, start)
+	}
+
+	input := &s3manager.UploadInput{
 		Body:        progressReader,
 		Bucket:      aws.String(m.cfg.Bucket),
 		Key:         aws.String(fileKey),
 		ContentType: aws.String("application/octet-stream"),
-	})
+		Metadata:    make(map[string]*string),
+	}
+	if codec != nil {
+		input.Metadata[codecKey] = aws.String(codec.Name())
+	}
+	if sm != nil {
+		input.Metadata[sparseKey] = aws.String(sm.String())
+	}
+	var dataKey []byte
+	var wk *dmio.WrappedKey
+	if m.cfg.keyring != nil {
+		if dataKey, wk, err = m.cfg.keyring.NewDataKey(); err != nil {
+			return err
+		}
+		input.Metadata[keyKey] = aws.String(wk.String())
+	}
+	// The checksum is of the file's data, including any holes, and is
+	// calculated as the data is read for the upload.
+	var cw checksum.Writer
+	var sw *dmio.SparseWriter
+	if alg := m.checksumAlgorithm(); alg != "" {
+		if cw, err = checksum.NewHashWriter(ioutil.Discard, alg); err != nil {
+			return err
+		}
+		var w io.Writer = cw
+		if sm != nil {
+			sw = dmio.NewSparseWriter(discardAt{}, sm, 0)
+			sw.Logical = cw
+			w = sw
+		}
+		input.Body = io.TeeReader(progressReader, w)
+	}
+	if codec != nil || dataKey != nil {
+		body := dmio.EncodeReader(input.Body, codec, dataKey)
+		defer body.Close()
+		input.Body = body
+	}
+	uploader := m.newUploader()
+	out, err := uploader.Upload(input)
 	if err != nil {
 		if multierr, ok := err.(s3manager.MultiUploadFailure); ok {
 			return errors.Errorf("Upload error on %s: %s (%s)", multierr.UploadID(), multierr.Code(), multierr.Message())
 		}
 		return errors.Wrap(err, "upload failed")
 	}
+	if sw != nil {
+		if err := sw.Flush(); err != nil {
+			return err
+		}
+	}
 
 	debug.Printf("%s id:%d Archived %d bytes in %v from %s to %s", m.name, action.ID(), total,
 		time.Since(start),
@@ -127,13 +260,141 @@ func (m *Mover) Archive(action dmplugin.Action) error {
 		Host:   m.cfg.Bucket,
 		Path:   fileKey,
 	}
+	var sum []byte
+	if cw != nil {
+		sum = cw.Sum()
+	}
+	if m.cfg.Metadata {
+		if err := m.writeMetadata(action, fileID, u.String(), total, codec, wk, sum); err != nil {
+			return err
+		}
+	}
 
 	action.SetUUID(fileID)
 	action.SetURL(u.String())
+	if sum != nil {
+		action.SetHash(sum)
+	}
 	action.SetActualLength(total)
 	return nil
 }
 
+// sparseMap returns the map of the data in the extent of the file being
+// archived if sparse files are enabled for the archive. It returns nil if
+// the file has no holes, or too many extents for the map to be stored in
+// the object's user metadata.
+func (m *Mover) sparseMap(action dmplugin.Action, total int64) (*dmio.SparseMap, error) {
+	if !m.cfg.Sparse {
+		return nil, nil
+	}
+	f, err := os.Open(action.PrimaryPath())
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: open failed", action.PrimaryPath())
+	}
+	defer f.Close()
+	sm, err := dmio.FindSparseMap(f, action.Offset(), total)
+	if err != nil || sm == nil {
+		return nil, err
+	}
+	if len(sparseKey)+len(sm.String()) > maxSparseMapSize {
+		debug.Printf("%s: %d extents, archiving holes", action.PrimaryPath(), len(sm.Extents))
+		return nil, nil
+	}
+	return sm, nil
+}
+
+// writeMetadata stores the metadata of the archived file in a sidecar
+// object. It is written once the object has been uploaded, so that it
+// includes the object's checksum.
+func (m *Mover) writeMetadata(action dmplugin.Action, fileID, fileURL string, size int64, codec dmio.Codec, wk *dmio.WrappedKey, sum []byte) error {
+	md, err := m.metadataFunc(action)
+	if err != nil {
+		return errors.Wrapf(err, "%s: read metadata failed", action.PrimaryPath())
+	}
+	md.UUID = fileID
+	md.URL = fileURL
+	md.Hash = sum
+	md.Size = size
+	if codec != nil {
+		md.Codec = codec.Name()
+	}
+	if wk != nil {
+		md.KeyID = wk.KeyID
+	}
+	return m.putMetadata(m.destination(fileID), md)
+}
+
+// putMetadata writes an object's metadata to its sidecar object.
+func (m *Mover) putMetadata(key string, md *dmplugin.ObjectMetadata) error {
+	data, err := json.Marshal(md)
+	if err != nil {
+		return errors.Wrap(err, "encode metadata failed")
+	}
+	_, err = m.s3Svc.PutObject(&s3.PutObjectInput{
+		Body:        bytes.NewReader(data),
+		Bucket:      aws.String(m.cfg.Bucket),
+		Key:         aws.String(key + metadataSuffix),
+		ContentType: aws.String("application/json"),
+	})
+	return errors.Wrapf(err, "upload %s%s failed", key, metadataSuffix)
+}
+
+// decodeMetadata decodes metadata stored in an object's user metadata.
+func decodeMetadata(key, encoded string) (*dmplugin.ObjectMetadata, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: decode metadata failed", key)
+	}
+	var md dmplugin.ObjectMetadata
+	if err := json.Unmarshal(data, &md); err != nil {
+		return nil, errors.Wrapf(err, "%s: decode metadata failed", key)
+	}
+	return &md, nil
+}
+
+// ReadMetadata returns the metadata stored with an object. If the object
+// has no metadata the error satisfies os.IsNotExist.
+func (m *Mover) ReadMetadata(id string) (*dmplugin.ObjectMetadata, error) {
+	key := m.destination(id)
+	head, err := m.s3Svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(m.cfg.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "s3.HeadObject() on %s failed", key)
+	}
+
+	if encoded, ok := head.Metadata[metadataKey]; ok {
+		return decodeMetadata(key, aws.StringValue(encoded))
+	}
+	return m.getMetadata(key)
+}
+
+// getMetadata reads an object's metadata from its sidecar object. If the
+// object has no sidecar the error satisfies os.IsNotExist.
+func (m *Mover) getMetadata(key string) (*dmplugin.ObjectMetadata, error) {
+	out, err := m.s3Svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(m.cfg.Bucket),
+		Key:    aws.String(key + metadataSuffix),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, os.ErrNotExist
+		}
+		return nil, errors.Wrapf(err, "get %s%s failed", key, metadataSuffix)
+	}
+	defer out.Body.Close()
+	data, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s%s failed", key, metadataSuffix)
+	}
+	var md dmplugin.ObjectMetadata
+	if err := json.Unmarshal(data, &md); err != nil {
+		return nil, errors.Wrapf(err, "%s: decode metadata failed", key)
+	}
+	return &md, nil
+}
+
 // Restore fulfills an HSM Restore request
 func (m *Mover) Restore(action dmplugin.Action) error {
 	debug.Printf("%s id:%d restore %s %s", m.name, action.ID(), action.PrimaryPath(), action.UUID())
@@ -164,10 +425,28 @@ func (m *Mover) Restore(action dmplugin.Action) error {
 	}
 	defer dst.Close()
 
+	codec, dataKey, err := m.objectEncoding(srcObj, out.Metadata)
+	if err != nil {
+		return err
+	}
+	var sm *dmio.SparseMap
+	if encoded, ok := out.Metadata[sparseKey]; ok {
+		if sm, err = dmio.ParseSparseMap(aws.StringValue(encoded)); err != nil {
+			return errors.Wrapf(err, "%s: bad sparse map", srcObj)
+		}
+	}
+	if codec != nil || dataKey != nil {
+		return m.restoreEncoded(action, codec, dataKey, sm, bucket, srcObj, dst, start)
+	}
+
+	var w io.WriterAt = dst
+	if sm != nil {
+		w = dmio.NewSparseWriter(dst, sm, 0)
+	}
 	progressFunc := func(offset, length int64) error {
 		return action.Update(offset, length, dstSize)
 	}
-	progressWriter := dmio.NewProgressWriterAt(dst, updateInterval, progressFunc)
+	progressWriter := dmio.NewProgressWriterAt(w, updateInterval, progressFunc)
 	defer progressWriter.StopUpdates()
 
 	downloader := m.newDownloader()
@@ -179,6 +458,12 @@ func (m *Mover) Restore(action dmplugin.Action) error {
 	if err != nil {
 		return errors.Errorf("s3.Download() of %s failed: %s", srcObj, err)
 	}
+	if sm != nil {
+		if err := dst.Extend(sm.Size); err != nil {
+			return err
+		}
+		n = sm.Size
+	}
 
 	debug.Printf("%s id:%d Restored %d bytes in %v from %s to %s", m.name, action.ID(), n,
 		time.Since(start),
@@ -188,6 +473,256 @@ func (m *Mover) Restore(action dmplugin.Action) error {
 	return nil
 }
 
+// objectEncoding returns the codec and data key recorded in an object's
+// metadata, either of which is nil if the object isn't compressed or
+// encrypted.
+func (m *Mover) objectEncoding(key string, metadata map[string]*string) (dmio.Codec, []byte, error) {
+	var codec dmio.Codec
+	if name, ok := metadata[codecKey]; ok {
+		var err error
+		if codec, err = dmio.NewCodec(aws.StringValue(name)); err != nil {
+			return nil, nil, errors.Wrapf(err, "%s: unknown codec", key)
+		}
+	}
+
+	encoded, ok := metadata[keyKey]
+	if !ok {
+		return codec, nil, nil
+	}
+	wk, err := dmio.ParseWrappedKey(aws.StringValue(encoded))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "%s: bad key", key)
+	}
+	if m.cfg.keyring == nil {
+		return nil, nil, errors.Errorf("%s: object is encrypted with key %s but no keyring is configured", key, wk.KeyID)
+	}
+	dataKey, err := m.cfg.keyring.Unwrap(wk)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, key)
+	}
+	return codec, dataKey, nil
+}
+
+// restoreEncoded streams a compressed or encrypted object through its
+// decoder, as the decoded data can't be written in parallel parts. If sm
+// isn't nil the decoded data is written to the extents of the sparse map.
+func (m *Mover) restoreEncoded(action dmplugin.Action, codec dmio.Codec, dataKey []byte, sm *dmio.SparseMap, bucket, srcObj string, dst *dmio.ActionWriter, start time.Time) error {
+	obj, err := m.s3Svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(srcObj),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "s3.GetObject() of %s failed", srcObj)
+	}
+	defer obj.Body.Close()
+
+	zr, err := dmio.NewDecoder(obj.Body, codec, dataKey)
+	if err != nil {
+		return errors.Wrapf(err, "%s: create decoder failed", srcObj)
+	}
+	defer zr.Close()
+
+	progressFunc := func(offset, length int64) error {
+		return action.Update(offset, length, action.Length())
+	}
+	var w io.Writer = dst
+	if sm != nil {
+		w = dmio.NewSparseWriter(dst, sm, 0)
+	}
+	progressWriter := dmio.NewProgressWriter(w, updateInterval, progressFunc)
+	defer progressWriter.StopUpdates()
+
+	n, err := io.Copy(progressWriter, zr)
+	if err != nil {
+		return errors.Wrapf(err, "restore of %s failed", srcObj)
+	}
+	if sm != nil {
+		if err := dst.Extend(sm.Size); err != nil {
+			return err
+		}
+		n = sm.Size
+	}
+
+	debug.Printf("%s id:%d Restored %d bytes (decoded) in %v from %s to %s", m.name, action.ID(), n,
+		time.Since(start),
+		srcObj,
+		action.PrimaryPath())
+	action.SetActualLength(n)
+	return nil
+}
+
+// List calls fn for each object in the archive. Every object is checked
+// for compression, encryption or holes, as they may have been enabled for
+// the archive when it was archived.
+func (m *Mover) List(fn func(*dmplugin.ObjectInfo) error) error {
+	prefix := m.destination("") + "/"
+	var fnErr error
+	err := m.s3Svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(m.cfg.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if strings.HasSuffix(aws.StringValue(obj.Key), metadataSuffix) {
+				continue
+			}
+			oi := &dmplugin.ObjectInfo{
+				ID:      strings.TrimPrefix(aws.StringValue(obj.Key), prefix),
+				Size:    aws.Int64Value(obj.Size),
+				ModTime: aws.TimeValue(obj.LastModified),
+			}
+
+			// The encoding is only recorded in the object's metadata,
+			// which isn't included in the listing.
+			head, err := m.s3Svc.HeadObject(&s3.HeadObjectInput{
+				Bucket: aws.String(m.cfg.Bucket),
+				Key:    obj.Key,
+			})
+			if err != nil {
+				fnErr = errors.Wrapf(err, "s3.HeadObject() on %s failed", aws.StringValue(obj.Key))
+				return false
+			}
+			_, compressed := head.Metadata[codecKey]
+			_, encrypted := head.Metadata[keyKey]
+			_, sparse := head.Metadata[sparseKey]
+			oi.Encoded = compressed || encrypted || sparse
+			if fnErr = fn(oi); fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return errors.Wrapf(err, "list %s/%s failed", m.cfg.Bucket, prefix)
+	}
+	return fnErr
+}
+
+// maxCopySize is the largest object S3 can copy in a single request.
+const maxCopySize = 5 * 1024 * 1024 * 1024
+
+// Rekey rewraps an encrypted object's data key with the keyring's current
+// key, and returns the ids of the old and new keys. The object's metadata
+// is replaced by copying the object onto itself.
+func (m *Mover) Rekey(id string) (string, string, error) {
+	key := m.destination(id)
+	head, err := m.s3Svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(m.cfg.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", "", errors.Wrapf(err, "s3.HeadObject() on %s failed", key)
+	}
+	encoded, ok := head.Metadata[keyKey]
+	if !ok {
+		return "", "", nil
+	}
+	wk, err := dmio.ParseWrappedKey(aws.StringValue(encoded))
+	if err != nil {
+		return "", "", errors.Wrapf(err, "%s: bad key", key)
+	}
+	if m.cfg.keyring == nil {
+		return wk.KeyID, wk.KeyID, errors.New("no keyring is configured")
+	}
+	nwk, changed, err := m.cfg.keyring.Rewrap(wk)
+	if err != nil || !changed {
+		return wk.KeyID, wk.KeyID, err
+	}
+
+	head.Metadata[keyKey] = aws.String(nwk.String())
+	if err := m.rekeyMetadata(key, head, nwk.KeyID); err != nil {
+		return wk.KeyID, wk.KeyID, err
+	}
+	if err := m.replaceMetadata(key, head); err != nil {
+		return wk.KeyID, wk.KeyID, err
+	}
+	return wk.KeyID, nwk.KeyID, nil
+}
+
+// rekeyMetadata records the object's new key in its ObjectMetadata, if it
+// has one. Metadata stored in the user metadata of an older object is
+// moved to a sidecar, and removed from head to be replaced with the rest
+// of the object's user metadata.
+func (m *Mover) rekeyMetadata(key string, head *s3.HeadObjectOutput, keyID string) error {
+	var md *dmplugin.ObjectMetadata
+	var err error
+	if encoded, ok := head.Metadata[metadataKey]; ok {
+		md, err = decodeMetadata(key, aws.StringValue(encoded))
+		delete(head.Metadata, metadataKey)
+	} else {
+		md, err = m.getMetadata(key)
+		if os.IsNotExist(err) {
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	md.KeyID = keyID
+	return m.putMetadata(key, md)
+}
+
+// replaceMetadata copies an object onto itself with new user metadata.
+// Objects too large to copy in one request are copied in parts.
+func (m *Mover) replaceMetadata(key string, head *s3.HeadObjectOutput) error {
+	source := m.cfg.Bucket + "/" + key
+	size := aws.Int64Value(head.ContentLength)
+	if size <= maxCopySize {
+		_, err := m.s3Svc.CopyObject(&s3.CopyObjectInput{
+			Bucket:            aws.String(m.cfg.Bucket),
+			Key:               aws.String(key),
+			CopySource:        aws.String(source),
+			ContentType:       head.ContentType,
+			Metadata:          head.Metadata,
+			MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+		})
+		return errors.Wrapf(err, "copy %s failed", key)
+	}
+
+	mp, err := m.s3Svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(m.cfg.Bucket),
+		Key:         aws.String(key),
+		ContentType: head.ContentType,
+		Metadata:    head.Metadata,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "create multipart copy of %s failed", key)
+	}
+	var parts []*s3.CompletedPart
+	for offset, num := int64(0), int64(1); offset < size; offset, num = offset+maxCopySize, num+1 {
+		end := offset + maxCopySize - 1
+		if end >= size {
+			end = size - 1
+		}
+		out, err := m.s3Svc.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(m.cfg.Bucket),
+			Key:             aws.String(key),
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end)),
+			PartNumber:      aws.Int64(num),
+			UploadId:        mp.UploadId,
+		})
+		if err != nil {
+			m.s3Svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(m.cfg.Bucket),
+				Key:      aws.String(key),
+				UploadId: mp.UploadId,
+			})
+			return errors.Wrapf(err, "copy part %d of %s failed", num, key)
+		}
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       out.CopyPartResult.ETag,
+			PartNumber: aws.Int64(num),
+		})
+	}
+	_, err = m.s3Svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(m.cfg.Bucket),
+		Key:             aws.String(key),
+		UploadId:        mp.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return errors.Wrapf(err, "complete multipart copy of %s failed", key)
+}
+
 // Remove fulfills an HSM Remove request
 func (m *Mover) Remove(action dmplugin.Action) error {
 	debug.Printf("%s id:%d remove %s %s", m.name, action.ID(), action.PrimaryPath(), action.UUID())
@@ -197,10 +732,29 @@ func (m *Mover) Remove(action dmplugin.Action) error {
 	}
 
 	bucket, srcObj, err := m.fileIDtoBucketPath(string(action.UUID()))
+	if err != nil {
+		return errors.Wrap(err, "fileIDtoBucketPath failed")
+	}
 
+	// The metadata is deleted last, so an object that couldn't be
+	// deleted can still be rebuilt from.
 	_, err = m.s3Svc.DeleteObject(&s3.DeleteObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(srcObj),
 	})
-	return errors.Wrap(err, "delete object failed")
+	if err != nil {
+		return errors.Wrap(err, "delete object failed")
+	}
+
+	if m.cfg.Metadata {
+		// Deleting a key that doesn't exist succeeds.
+		_, err = m.s3Svc.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(srcObj + metadataSuffix),
+		})
+		if err != nil {
+			return errors.Wrap(err, "delete metadata object failed")
+		}
+	}
+	return nil
 }
@@ -0,0 +1,346 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+
+	"github.com/intel-hpdd/lemur/dmplugin"
+	"github.com/intel-hpdd/lemur/pkg/checksum"
+	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+const (
+	// checkpointMaxAge is how long a checkpoint is kept without being
+	// updated before it is assumed its action was cancelled.
+	checkpointMaxAge = 7 * 24 * time.Hour
+
+	// checkpointSweepInterval is how often old checkpoints are looked
+	// for.
+	checkpointSweepInterval = time.Hour
+)
+
+// abortUpload aborts the multipart upload of an archive that won't be
+// resumed, so the storage used by its parts is released.
+func (m *Mover) abortUpload(cp *dmplugin.Checkpoint) error {
+	if cp.Op != dmplugin.CheckpointArchive || cp.UploadID == "" {
+		return nil
+	}
+	debug.Printf("%s: aborting upload %s of %s", m.name, cp.UploadID, cp.ObjectID)
+	_, err := m.s3Svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(m.cfg.Bucket),
+		Key:      aws.String(m.destination(cp.ObjectID)),
+		UploadId: aws.String(cp.UploadID),
+	})
+	if isNoSuchUpload(err) {
+		return nil
+	}
+	return err
+}
+
+func isNoSuchUpload(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == s3.ErrCodeNoSuchUpload
+}
+
+// resumable returns true if an archive of total bytes can be checkpointed.
+// Only plain uploads large enough to be uploaded in parts are, as the
+// state of an encoder can't be saved.
+func (m *Mover) resumable(total int64, encoded bool) bool {
+	return m.cfg.checkpoints != nil && !encoded && total > m.cfg.UploadPartSize
+}
+
+// archiveMultipart archives the file with a multipart upload whose
+// progress is recorded in a checkpoint, so that a retry of the action
+// only uploads the parts that haven't been uploaded yet.
+func (m *Mover) archiveMultipart(action dmplugin.Action, total int64, start time.Time) error {
+	version, err := dmplugin.FileVersion(action.PrimaryPath())
+	if err != nil {
+		return err
+	}
+	cp, err := m.cfg.checkpoints.Load(dmplugin.CheckpointArchive, action, version)
+	if err != nil {
+		return err
+	}
+
+	if cp.UploadID != "" {
+		_, err := m.s3Svc.ListParts(&s3.ListPartsInput{
+			Bucket:   aws.String(m.cfg.Bucket),
+			Key:      aws.String(m.destination(cp.ObjectID)),
+			UploadId: aws.String(cp.UploadID),
+			MaxParts: aws.Int64(1),
+		})
+		if isNoSuchUpload(err) {
+			alert.Warnf("%s: upload %s of %s is gone, archiving from the start", m.name, cp.UploadID, cp.ObjectID)
+			cp.UploadID = ""
+			cp.Parts = nil
+		} else if err != nil {
+			return errors.Wrap(err, "list parts failed")
+		} else {
+			debug.Printf("%s id:%d resuming upload %s of %s with %d parts", m.name, action.ID(),
+				cp.UploadID, action.PrimaryPath(), len(cp.Parts))
+		}
+	}
+	if cp.UploadID == "" {
+		if err := m.createUpload(action, total, cp); err != nil {
+			return err
+		}
+	}
+	fileKey := m.destination(cp.ObjectID)
+
+	if err := m.uploadParts(action, total, cp); err != nil {
+		return err
+	}
+
+	sort.Slice(cp.Parts, func(i, j int) bool { return cp.Parts[i].Number < cp.Parts[j].Number })
+	parts := make([]*s3.CompletedPart, len(cp.Parts))
+	for i, p := range cp.Parts {
+		parts[i] = &s3.CompletedPart{
+			ETag:       aws.String(p.ETag),
+			PartNumber: aws.Int64(p.Number),
+		}
+	}
+	sum, err := m.combinePartSums(action, total, cp)
+	if err != nil {
+		return err
+	}
+	out, err := m.s3Svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(m.cfg.Bucket),
+		Key:             aws.String(fileKey),
+		UploadId:        aws.String(cp.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return errors.Wrap(err, "complete upload failed")
+	}
+	if err := m.cfg.checkpoints.Remove(cp); err != nil {
+		alert.Warnf("%s: %v", m.name, err)
+	}
+
+	debug.Printf("%s id:%d Archived %d bytes in %v from %s to %s", m.name, action.ID(), total,
+		time.Since(start),
+		action.PrimaryPath(),
+		aws.StringValue(out.Location))
+
+	u := url.URL{
+		Scheme: "s3",
+		Host:   m.cfg.Bucket,
+		Path:   fileKey,
+	}
+	if m.cfg.Metadata {
+		if err := m.writeMetadata(action, cp.ObjectID, u.String(), total, nil, nil, sum); err != nil {
+			return err
+		}
+	}
+	action.SetUUID(cp.ObjectID)
+	action.SetURL(u.String())
+	if sum != nil {
+		action.SetHash(sum)
+	}
+	action.SetActualLength(total)
+	return nil
+}
+
+// combinePartSums returns the checksum of an upload from the checksums of
+// its parts, calculating those that weren't recorded when the parts were
+// uploaded. It returns nil if the object wasn't created for the
+// configured algorithm, as its chunk size isn't recorded for any other.
+func (m *Mover) combinePartSums(action dmplugin.Action, total int64, cp *dmplugin.Checkpoint) ([]byte, error) {
+	alg := m.checksumAlgorithm()
+	if alg == "" || cp.Checksum != alg {
+		return nil, nil
+	}
+	src, err := os.Open(action.PrimaryPath())
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: open failed", action.PrimaryPath())
+	}
+	defer src.Close()
+
+	sums := make([][]byte, len(cp.Parts))
+	for i, p := range cp.Parts {
+		sums[i] = p.Sum
+		if len(sums[i]) == 0 {
+			if sums[i], err = m.partSum(action, src, total, cp, p.Number); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return checksum.CombineSums(alg, sums), nil
+}
+
+// partSum returns the untagged checksum of one part of the file with the
+// algorithm recorded in the checkpoint.
+func (m *Mover) partSum(action dmplugin.Action, src *os.File, total int64, cp *dmplugin.Checkpoint, number int64) ([]byte, error) {
+	h, err := checksum.NewHash(cp.Checksum)
+	if err != nil {
+		return nil, err
+	}
+	off, size := partExtent(total, cp, number)
+	if _, err := io.Copy(h, io.NewSectionReader(src, action.Offset()+off, size)); err != nil {
+		return nil, errors.Wrapf(err, "%s: checksum of part %d failed", action.PrimaryPath(), number)
+	}
+	return h.Sum(nil), nil
+}
+
+// partExtent returns the offset and size of the data of a part.
+func partExtent(total int64, cp *dmplugin.Checkpoint, number int64) (int64, int64) {
+	off := (number - 1) * cp.ChunkSize
+	size := cp.ChunkSize
+	if off+size > total {
+		size = total - off
+	}
+	return off, size
+}
+
+// createUpload starts the multipart upload of a new object and records it
+// in the checkpoint.
+func (m *Mover) createUpload(action dmplugin.Action, total int64, cp *dmplugin.Checkpoint) error {
+	fileID := newFileID()
+	fileKey := m.destination(fileID)
+
+	// S3 allows at most MaxUploadParts parts, so the part size of very
+	// large files is increased to fit.
+	partSize := m.cfg.UploadPartSize
+	if total/partSize >= s3manager.MaxUploadParts {
+		partSize = total/s3manager.MaxUploadParts + 1
+	}
+
+	// The object's checksum is calculated from the checksums of its
+	// parts, which are uploaded in any order.
+	metadata := make(map[string]*string)
+	alg := m.checksumAlgorithm()
+	if alg != "" {
+		metadata[chunkKey] = aws.String(strconv.FormatInt(partSize, 10))
+	}
+	out, err := m.s3Svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(m.cfg.Bucket),
+		Key:         aws.String(fileKey),
+		ContentType: aws.String("application/octet-stream"),
+		Metadata:    metadata,
+	})
+	if err != nil {
+		return errors.Wrap(err, "create upload failed")
+	}
+
+	cp.ObjectID = fileID
+	cp.UploadID = aws.StringValue(out.UploadId)
+	cp.ChunkSize = partSize
+	cp.Checksum = alg
+	cp.Parts = nil
+	return m.cfg.checkpoints.Save(cp)
+}
+
+// uploadParts uploads the parts of the file that aren't recorded in the
+// checkpoint, and records each one as it completes.
+func (m *Mover) uploadParts(action dmplugin.Action, total int64, cp *dmplugin.Checkpoint) error {
+	src, err := os.Open(action.PrimaryPath())
+	if err != nil {
+		return errors.Wrapf(err, "%s: open failed", action.PrimaryPath())
+	}
+	defer src.Close()
+
+	var done int64
+	uploaded := make(map[int64]bool)
+	for _, p := range cp.Parts {
+		uploaded[p.Number] = true
+		done += p.Size
+	}
+
+	var mu sync.Mutex
+	var firstErr error
+	completed := func(part dmplugin.CheckpointPart) error {
+		mu.Lock()
+		defer mu.Unlock()
+		cp.Parts = append(cp.Parts, part)
+		done += part.Size
+		if err := m.cfg.checkpoints.Save(cp); err != nil {
+			return err
+		}
+		return action.Update(done, part.Size, total)
+	}
+
+	work := make(chan int64)
+	var wg sync.WaitGroup
+	for i := 0; i < s3manager.DefaultUploadConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for number := range work {
+				part, err := m.uploadPart(action, src, total, cp, number)
+				if err == nil {
+					err = completed(part)
+				}
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	parts := (total + cp.ChunkSize - 1) / cp.ChunkSize
+	for number := int64(1); number <= parts; number++ {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		if !uploaded[number] {
+			work <- number
+		}
+	}
+	close(work)
+	wg.Wait()
+	return firstErr
+}
+
+// uploadPart uploads one part of the file. The part's checksum is
+// calculated before it is uploaded, if the upload has one, so that its
+// data is cached when it is read again by the upload.
+func (m *Mover) uploadPart(action dmplugin.Action, src *os.File, total int64, cp *dmplugin.Checkpoint, number int64) (dmplugin.CheckpointPart, error) {
+	var sum []byte
+	if cp.Checksum != "" {
+		var err error
+		if sum, err = m.partSum(action, src, total, cp, number); err != nil {
+			return dmplugin.CheckpointPart{}, err
+		}
+	}
+	off, size := partExtent(total, cp, number)
+	body := io.NewSectionReader(src, action.Offset()+off, size)
+	out, err := m.s3Svc.UploadPart(&s3.UploadPartInput{
+		Body:          body,
+		Bucket:        aws.String(m.cfg.Bucket),
+		Key:           aws.String(m.destination(cp.ObjectID)),
+		UploadId:      aws.String(cp.UploadID),
+		PartNumber:    aws.Int64(number),
+		ContentLength: aws.Int64(size),
+	})
+	if err != nil {
+		return dmplugin.CheckpointPart{}, errors.Wrapf(err, "upload part %d failed", number)
+	}
+	return dmplugin.CheckpointPart{
+		Number: number,
+		ETag:   aws.StringValue(out.ETag),
+		Size:   size,
+		Sum:    sum,
+	}, nil
+}
@@ -6,12 +6,20 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	lustre "github.com/intel-hpdd/go-lustre"
 	"github.com/intel-hpdd/lemur/dmplugin"
+	"github.com/intel-hpdd/lemur/dmplugin/dmio"
 	"github.com/intel-hpdd/lemur/internal/testhelpers"
 	"github.com/intel-hpdd/lemur/pkg/checksum"
 	"github.com/intel-hpdd/logging/debug"
@@ -167,6 +175,415 @@ func TestS3Archive(t *testing.T) {
 	})
 }
 
+func TestS3ArchiveCompressed(t *testing.T) {
+	compress := func(cfg *archiveConfig) *archiveConfig {
+		cfg.compression, _ = dmio.ParseCompression("zstd:3")
+		return cfg
+	}
+	WithS3Mover(t, compress, func(t *testing.T, mover *Mover) {
+		var length int64 = 1024 * 1024
+		tfile, cleanFile := testhelpers.TempFile(t, length)
+		defer cleanFile()
+
+		action := testArchive(t, mover, tfile, 0, length, "", nil)
+		encoded := func() bool {
+			var encoded bool
+			err := mover.List(func(oi *dmplugin.ObjectInfo) error {
+				if oi.ID == action.UUID() {
+					encoded = oi.Encoded
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return encoded
+		}
+		if !encoded() {
+			t.Fatal("object not compressed")
+		}
+
+		// The object is still listed as compressed once compression
+		// is turned off.
+		mover.cfg.compression = nil
+		if !encoded() {
+			t.Fatal("object not listed as compressed after compression was turned off")
+		}
+		testRestore(t, mover, 0, length, action.UUID(), nil)
+		testRemove(t, mover, action.UUID(), nil)
+	})
+}
+
+func TestS3ArchiveSparse(t *testing.T) {
+	for _, compression := range []string{"off", "zstd"} {
+		enableSparse := func(cfg *archiveConfig) *archiveConfig {
+			cfg.compression, _ = dmio.ParseCompression(compression)
+			cfg.Sparse = true
+			return cfg
+		}
+		WithS3Mover(t, enableSparse, func(t *testing.T, mover *Mover) {
+			// A 4MiB file with two data extents and a trailing hole.
+			var length int64 = 4 * 1024 * 1024
+			tfile, cleanFile := testhelpers.TempFile(t, 0)
+			defer cleanFile()
+			data := bytes.Repeat([]byte("sparse data "), 20000)
+			f, err := os.OpenFile(tfile, os.O_WRONLY, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, offset := range []int64{1024 * 1024, 2*1024*1024 + 4096} {
+				if _, err := f.WriteAt(data, offset); err != nil {
+					t.Fatal(err)
+				}
+			}
+			f.Close()
+			if err := os.Truncate(tfile, length); err != nil {
+				t.Fatal(err)
+			}
+			startSum, err := checksum.FileSha1Sum(tfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			action := testArchive(t, mover, tfile, 0, length, "", nil)
+			defer testRemove(t, mover, action.UUID(), nil)
+			head, err := mover.s3Svc.HeadObject(&s3.HeadObjectInput{
+				Bucket: aws.String(mover.cfg.Bucket),
+				Key:    aws.String(mover.destination(action.UUID())),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := head.Metadata[sparseKey]; !ok {
+				t.Fatalf("%s: object has no sparse map", compression)
+			}
+			if size := aws.Int64Value(head.ContentLength); size >= length/2 {
+				t.Fatalf("%s: object is %d bytes, expected holes to be skipped", compression, size)
+			}
+
+			// Zap the test file like it was released before restoring
+			// the data, including the trailing hole.
+			if err := os.Truncate(tfile, 0); err != nil {
+				t.Fatal(err)
+			}
+			ra := dmplugin.NewTestAction(t, tfile, 0, length, action.UUID(), nil)
+			if err := mover.Restore(ra); err != nil {
+				t.Fatalf("%s: %v", compression, err)
+			}
+			endSum, err := checksum.FileSha1Sum(tfile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(endSum, startSum) {
+				t.Fatalf("%s: end sum (%x) != start sum (%x)", compression, endSum, startSum)
+			}
+		})
+	}
+}
+
+// withCheckpoints returns a config update that records the progress of
+// multipart uploads of 5 MiB parts in a checkpoint store in dir.
+func withCheckpoints(t *testing.T, dir string) func(*archiveConfig) *archiveConfig {
+	return func(cfg *archiveConfig) *archiveConfig {
+		var err error
+		if cfg.checkpoints, err = dmplugin.OpenCheckpointStore(dir); err != nil {
+			t.Fatal(err)
+		}
+		cfg.UploadPartSize = s3manager.MinUploadPartSize
+		return cfg
+	}
+}
+
+// testRestoreSum restores an archived file and checks it has the data
+// the file had when it was archived.
+func testRestoreSum(t *testing.T, mover *Mover, length int64, fileID string, sum []byte) {
+	tfile, cleanFile := testhelpers.TempFile(t, 0)
+	defer cleanFile()
+	action := dmplugin.NewTestAction(t, tfile, 0, length, fileID, nil)
+	if err := mover.Restore(action); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := checksum.FileSha1Sum(tfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored, sum) {
+		t.Fatalf("restored sum (%x) != archived sum (%x)", restored, sum)
+	}
+}
+
+func TestS3MultipartResume(t *testing.T) {
+	stateDir, cleanState := testhelpers.TempDir(t)
+	defer cleanState()
+
+	WithS3Mover(t, withCheckpoints(t, stateDir), func(t *testing.T, mover *Mover) {
+		// Three parts, the last of them short.
+		length := 2*s3manager.MinUploadPartSize + 4242
+		tfile, cleanFile := testhelpers.TempFile(t, length)
+		defer cleanFile()
+		fileSum, err := checksum.FileSha1Sum(tfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// An archive that has uploaded its first part before being
+		// interrupted. The part's checksum wasn't recorded, so it is
+		// calculated again when the upload is completed.
+		action := dmplugin.NewTestAction(t, tfile, 0, length, "", nil)
+		version, err := dmplugin.FileVersion(tfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cp, err := mover.cfg.checkpoints.Load(dmplugin.CheckpointArchive, action, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mover.createUpload(action, length, cp); err != nil {
+			t.Fatal(err)
+		}
+		src, err := os.Open(tfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part, err := mover.uploadPart(action, src, length, cp, 1)
+		src.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Sum = nil
+		cp.Parts = append(cp.Parts, part)
+		if err := mover.cfg.checkpoints.Save(cp); err != nil {
+			t.Fatal(err)
+		}
+
+		// The retry completes the same upload.
+		if err := mover.Archive(action); err != nil {
+			t.Fatal(err)
+		}
+		defer testRemove(t, mover, action.UUID(), nil)
+		if action.UUID() != cp.ObjectID {
+			t.Fatalf("resumed archive created %s, expected %s", action.UUID(), cp.ObjectID)
+		}
+		if action.Updates != 2 {
+			t.Fatalf("expected 2 parts to be uploaded, got %d", action.Updates)
+		}
+		cp, err = mover.cfg.checkpoints.Load(dmplugin.CheckpointArchive, action, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cp.UploadID != "" {
+			t.Fatalf("checkpoint of completed upload %s not removed", cp.UploadID)
+		}
+
+		// The checksum combined from the parts is that of an upload
+		// that wasn't interrupted.
+		whole := testArchive(t, mover, tfile, 0, length, "", nil)
+		defer testRemove(t, mover, whole.UUID(), nil)
+		if !bytes.Equal(action.Hash(), whole.Hash()) {
+			t.Fatalf("resumed hash %x != uninterrupted hash %x", action.Hash(), whole.Hash())
+		}
+		testRestoreSum(t, mover, length, action.UUID(), fileSum)
+	})
+}
+
+func TestS3MultipartUploadGone(t *testing.T) {
+	stateDir, cleanState := testhelpers.TempDir(t)
+	defer cleanState()
+
+	WithS3Mover(t, withCheckpoints(t, stateDir), func(t *testing.T, mover *Mover) {
+		length := s3manager.MinUploadPartSize + 4242
+		tfile, cleanFile := testhelpers.TempFile(t, length)
+		defer cleanFile()
+		fileSum, err := checksum.FileSha1Sum(tfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The upload recorded in the checkpoint was aborted, as by a
+		// bucket lifecycle rule, before the archive was retried.
+		action := dmplugin.NewTestAction(t, tfile, 0, length, "", nil)
+		version, err := dmplugin.FileVersion(tfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cp, err := mover.cfg.checkpoints.Load(dmplugin.CheckpointArchive, action, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mover.createUpload(action, length, cp); err != nil {
+			t.Fatal(err)
+		}
+		if err := mover.abortUpload(cp); err != nil {
+			t.Fatal(err)
+		}
+
+		// The retry starts a new upload.
+		if err := mover.Archive(action); err != nil {
+			t.Fatal(err)
+		}
+		defer testRemove(t, mover, action.UUID(), nil)
+		if action.UUID() == cp.ObjectID {
+			t.Fatalf("archive reused the object %s of an aborted upload", cp.ObjectID)
+		}
+		testRestoreSum(t, mover, length, action.UUID(), fileSum)
+	})
+}
+
+func TestS3Metadata(t *testing.T) {
+	stateDir, cleanState := testhelpers.TempDir(t)
+	defer cleanState()
+
+	withMetadata := func(cfg *archiveConfig) *archiveConfig {
+		cfg = withCheckpoints(t, stateDir)(cfg)
+		cfg.Metadata = true
+		return cfg
+	}
+	WithS3Mover(t, withMetadata, func(t *testing.T, mover *Mover) {
+		mover.metadataFunc = func(action dmplugin.Action) (*dmplugin.ObjectMetadata, error) {
+			return &dmplugin.ObjectMetadata{Path: "project/a", UID: 1000, Mode: 0100644}, nil
+		}
+		// A single upload, and a multipart upload.
+		for _, length := range []int64{100000, s3manager.MinUploadPartSize + 4242} {
+			tfile, cleanFile := testhelpers.TempFile(t, length)
+			defer cleanFile()
+
+			action := testArchive(t, mover, tfile, 0, length, "", nil)
+			md, err := mover.ReadMetadata(action.UUID())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if md.Path != "project/a" || md.UUID != action.UUID() || md.URL != action.URL() ||
+				md.Size != length || len(md.Hash) == 0 || !bytes.Equal(md.Hash, action.Hash()) {
+				t.Fatalf("unexpected metadata: %+v", md)
+			}
+
+			testRemove(t, mover, action.UUID(), nil)
+			if _, err := mover.ReadMetadata(action.UUID()); err == nil {
+				t.Fatal("expected metadata to be removed")
+			}
+		}
+	})
+}
+
+// writeKeyring writes a keyring file with the given keys, the last of
+// which is current.
+func writeKeyring(t *testing.T, path string, ids ...string) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "current = %q\n", ids[len(ids)-1])
+	for _, id := range ids {
+		secret := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte(id[:1]), 32))
+		fmt.Fprintf(&buf, "key %q {\n  secret = %q\n}\n", id, secret)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the keyring notices the change.
+	mtime := time.Now().Add(time.Duration(len(ids)) * time.Second)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestS3Encryption(t *testing.T) {
+	keyDir, cleanKeys := testhelpers.TempDir(t)
+	defer cleanKeys()
+	keyring := filepath.Join(keyDir, "keyring")
+	writeKeyring(t, keyring, "a")
+
+	withKeyring := func(cfg *archiveConfig) *archiveConfig {
+		var err error
+		if cfg.keyring, err = dmio.OpenKeyring(keyring); err != nil {
+			t.Fatal(err)
+		}
+		cfg.Metadata = true
+		return cfg
+	}
+	WithS3Mover(t, withKeyring, func(t *testing.T, mover *Mover) {
+		mover.metadataFunc = func(action dmplugin.Action) (*dmplugin.ObjectMetadata, error) {
+			return &dmplugin.ObjectMetadata{Path: "project/a"}, nil
+		}
+		var length int64 = 100000
+		tfile, cleanFile := testhelpers.TempFile(t, length)
+		defer cleanFile()
+
+		first := testArchive(t, mover, tfile, 0, length, "", nil)
+		defer testRemove(t, mover, first.UUID(), nil)
+		md, err := mover.ReadMetadata(first.UUID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if md.KeyID != "a" {
+			t.Fatalf("unexpected metadata: %+v", md)
+		}
+
+		// Rotate to a new key; old objects can still be restored.
+		writeKeyring(t, keyring, "a", "b")
+		second := testArchive(t, mover, tfile, 0, length, "", nil)
+		defer testRemove(t, mover, second.UUID(), nil)
+		testRestore(t, mover, 0, length, first.UUID(), nil)
+		testRestore(t, mover, 0, length, second.UUID(), nil)
+
+		from, to, err := mover.Rekey(first.UUID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from != "a" || to != "b" {
+			t.Fatalf("rekey: got %s -> %s, expected a -> b", from, to)
+		}
+		if md, err = mover.ReadMetadata(first.UUID()); err != nil {
+			t.Fatal(err)
+		}
+		if md.KeyID != "b" || md.Path != "project/a" {
+			t.Fatalf("unexpected metadata after rekey: %+v", md)
+		}
+		from, to, err = mover.Rekey(second.UUID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from != to {
+			t.Fatalf("rekey of current object: got %s -> %s", from, to)
+		}
+
+		// Once rekeyed, the old key is no longer needed.
+		writeKeyring(t, keyring, "b")
+		testRestore(t, mover, 0, length, first.UUID(), nil)
+	})
+}
+
+func TestS3EncryptionNoKeyring(t *testing.T) {
+	keyDir, cleanKeys := testhelpers.TempDir(t)
+	defer cleanKeys()
+	keyring := filepath.Join(keyDir, "keyring")
+	writeKeyring(t, keyring, "a")
+
+	var kr *dmio.Keyring
+	withKeyring := func(cfg *archiveConfig) *archiveConfig {
+		var err error
+		if kr, err = dmio.OpenKeyring(keyring); err != nil {
+			t.Fatal(err)
+		}
+		cfg.keyring = kr
+		return cfg
+	}
+	WithS3Mover(t, withKeyring, func(t *testing.T, mover *Mover) {
+		var length int64 = 100000
+		tfile, cleanFile := testhelpers.TempFile(t, length)
+		defer cleanFile()
+
+		action := testArchive(t, mover, tfile, 0, length, "", nil)
+		defer testRemove(t, mover, action.UUID(), nil)
+
+		// Without the keyring the object can't be read.
+		mover.cfg.keyring = nil
+		testRestoreFail(t, mover, 0, length, action.UUID(), nil)
+		if _, _, err := mover.Rekey(action.UUID()); err == nil {
+			t.Fatal("expected rekey to fail without a keyring")
+		}
+		mover.cfg.keyring = kr
+		testRestore(t, mover, 0, length, action.UUID(), nil)
+	})
+}
+
 func TestS3ArchiveMaxSize(t *testing.T) {
 	WithS3Mover(t, nil, func(t *testing.T, mover *Mover) {
 		var length int64 = 1000000
@@ -0,0 +1,144 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+
+	"github.com/intel-hpdd/lemur/dmplugin"
+	"github.com/intel-hpdd/lemur/dmplugin/dmio"
+	"github.com/intel-hpdd/lemur/pkg/checksum"
+	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+// discardAt is an io.WriterAt that discards what is written to it.
+type discardAt struct{}
+
+func (discardAt) WriteAt(p []byte, off int64) (int, error) {
+	return len(p), nil
+}
+
+// Verify fulfills a Verify request. It downloads and decodes all of an
+// object's data, and compares its checksum with the one recorded for the
+// file, if there is one. Decoding detects objects whose compressed or
+// encrypted data is damaged even when there is no checksum.
+func (m *Mover) Verify(action dmplugin.Action) error {
+	debug.Printf("%s id:%d verify %s %x", m.name, action.ID(), action.UUID(), action.Hash())
+	rate.Mark(1)
+
+	start := time.Now()
+	if action.UUID() == "" {
+		return errors.Errorf("Missing file_id on action %d", action.ID())
+	}
+	bucket, srcObj, err := m.fileIDtoBucketPath(action.UUID())
+	if err != nil {
+		return errors.Wrap(err, "fileIDtoBucketPath failed")
+	}
+	obj, err := m.s3Svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(srcObj),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "s3.GetObject() of %s failed", srcObj)
+	}
+	defer obj.Body.Close()
+
+	codec, dataKey, err := m.objectEncoding(srcObj, obj.Metadata)
+	if err != nil {
+		return err
+	}
+	var sm *dmio.SparseMap
+	if encoded, ok := obj.Metadata[sparseKey]; ok {
+		if sm, err = dmio.ParseSparseMap(aws.StringValue(encoded)); err != nil {
+			return errors.Wrapf(err, "%s: bad sparse map", srcObj)
+		}
+	}
+
+	var body io.Reader = obj.Body
+	if codec != nil || dataKey != nil {
+		zr, err := dmio.NewDecoder(obj.Body, codec, dataKey)
+		if err != nil {
+			return errors.Wrapf(err, "%s: create decoder failed", srcObj)
+		}
+		defer zr.Close()
+		body = zr
+	}
+
+	// The checksum is of the file's data, including any holes, with
+	// the algorithm of the recorded checksum. Objects uploaded in
+	// resumable parts have the combined checksum of their parts.
+	chunkSize, err := objectChunkSize(srcObj, obj.Metadata)
+	if err != nil {
+		return err
+	}
+	alg := checksum.Algorithm(action.Hash())
+	var cw checksum.Writer
+	if chunkSize > 0 {
+		cw, err = checksum.NewChunkedHashWriter(ioutil.Discard, chunkSize, alg)
+	} else {
+		cw, err = checksum.NewHashWriter(ioutil.Discard, alg)
+	}
+	if err != nil {
+		return err
+	}
+	var w io.Writer = cw
+	var sw *dmio.SparseWriter
+	if sm != nil {
+		sw = dmio.NewSparseWriter(discardAt{}, sm, 0)
+		sw.Logical = cw
+		w = sw
+	}
+	progressFunc := func(offset, length int64) error {
+		return action.Update(offset, length, action.Length())
+	}
+	progressWriter := dmio.NewProgressWriter(w, updateInterval, progressFunc)
+	defer progressWriter.StopUpdates()
+
+	n, err := io.Copy(progressWriter, body)
+	if err != nil {
+		return errors.Wrapf(err, "verify of %s failed", srcObj)
+	}
+	if sw != nil {
+		if err := sw.Flush(); err != nil {
+			return err
+		}
+		n = sm.Size
+	}
+
+	if len(action.Hash()) > 0 && !bytes.Equal(action.Hash(), cw.Sum()) {
+		alert.Warnf("%s: original checksum doesn't match object: %s != %s", srcObj, checksum.Format(action.Hash()), checksum.Format(cw.Sum()))
+		return errors.Wrap(dmplugin.ErrChecksumMismatch, srcObj)
+	}
+
+	debug.Printf("%s id:%d Verified %d bytes in %v of %s %x", m.name, action.ID(), n,
+		time.Since(start),
+		srcObj,
+		cw.Sum())
+	action.SetActualLength(n)
+	return nil
+}
+
+// objectChunkSize returns the part size recorded for an object uploaded in
+// resumable parts, or 0 if it wasn't.
+func objectChunkSize(key string, metadata map[string]*string) (int64, error) {
+	value, ok := metadata[chunkKey]
+	if !ok {
+		return 0, nil
+	}
+	chunkSize, err := strconv.ParseInt(aws.StringValue(value), 10, 64)
+	if err != nil || chunkSize <= 0 {
+		return 0, errors.Errorf("%s: invalid chunk size %q", key, aws.StringValue(value))
+	}
+	return chunkSize, nil
+}
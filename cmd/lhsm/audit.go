@@ -0,0 +1,202 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	cli "gopkg.in/urfave/cli.v1"
+
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/llapi"
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/agent/fileid"
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/config"
+	"github.com/intel-hpdd/lemur/dmplugin"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+func init() {
+	commands = append(commands, cli.Command{
+		Name:      "audit",
+		Usage:     "Compare the archived files in a Lustre tree with the objects in their archive",
+		ArgsUsage: "path [path...]",
+		Description: "Reports objects that no file refers to (orphans), archived files whose\n" +
+			"   object is missing (dangling), and objects whose size doesn't match their file.\n" +
+			"   Orphans are only meaningful if the paths cover every file archived to the archive.",
+		Action: auditAction,
+		Flags: []cli.Flag{
+			cli.UintFlag{
+				Name:  "id, i",
+				Usage: "Numeric ID of archive backend",
+			},
+			cli.StringFlag{
+				Name:  "plugin, p",
+				Usage: "Data mover plugin for the archive (e.g. lhsm-plugin-posix)",
+			},
+			cli.StringFlag{
+				Name:  "plugin-dir",
+				Value: config.DefaultPluginDir,
+				Usage: "Directory containing the plugin binaries",
+			},
+			cli.StringFlag{
+				Name:  "config-dir",
+				Value: config.DefaultConfigDir,
+				Usage: "Directory containing the plugin configuration",
+			},
+			cli.DurationFlag{
+				Name:  "min-age",
+				Value: 24 * time.Hour,
+				Usage: "Ignore orphans newer than this, which may belong to archives in progress",
+			},
+			cli.BoolFlag{
+				Name:  "delete-orphans",
+				Usage: "Remove orphaned objects from the archive",
+			},
+		},
+	})
+}
+
+type auditReport struct {
+	files    int
+	orphans  []*dmplugin.ObjectInfo
+	dangling int
+	mismatch int
+}
+
+func auditAction(c *cli.Context) error {
+	logContext(c)
+	paths := c.Args()
+	if len(paths) < 1 {
+		return errors.New("audit requires at least 1 path")
+	}
+	archiveID := uint32(c.Uint("id"))
+	if archiveID == 0 {
+		return errors.New("archive id required")
+	}
+	if c.String("plugin") == "" {
+		return errors.New("plugin required")
+	}
+
+	root, err := fs.MountRoot(paths[0])
+	if err != nil {
+		return errors.Wrapf(err, "%s: can't find filesystem root", paths[0])
+	}
+	plugin := &dmplugin.OfflinePlugin{
+		Path:       filepath.Join(c.String("plugin-dir"), c.String("plugin")),
+		ConfigDir:  c.String("config-dir"),
+		Mountpoint: root.Path(),
+		ArchiveID:  archiveID,
+	}
+
+	objects := make(map[string]*dmplugin.ObjectInfo)
+	err = plugin.List(func(oi *dmplugin.ObjectInfo) error {
+		objects[oi.ID] = oi
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "list archive failed")
+	}
+	debug.Printf("archive %d has %d objects", archiveID, len(objects))
+
+	report := &auditReport{}
+	referenced := make(map[string]bool)
+	for _, p := range paths {
+		err := filepath.Walk(p, func(name string, fi os.FileInfo, err error) error {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+				return nil
+			}
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			auditFile(report, objects, referenced, archiveID, name, fi)
+			return nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "%s: walk failed", p)
+		}
+	}
+
+	minAge := c.Duration("min-age")
+	for id, oi := range objects {
+		if !referenced[id] && time.Since(oi.ModTime) >= minAge {
+			report.orphans = append(report.orphans, oi)
+		}
+	}
+	sort.Slice(report.orphans, func(i, j int) bool {
+		return report.orphans[i].ID < report.orphans[j].ID
+	})
+	for _, oi := range report.orphans {
+		fmt.Printf("orphan %s size:%d mtime:%s\n", oi.ID, oi.Size, oi.ModTime.Format(time.RFC3339))
+	}
+
+	fmt.Printf("%d files, %d objects: %d orphans, %d dangling, %d size mismatches\n",
+		report.files, len(objects), len(report.orphans), report.dangling, report.mismatch)
+
+	problems := report.dangling + report.mismatch
+	if c.Bool("delete-orphans") && len(report.orphans) > 0 {
+		var ids []string
+		for _, oi := range report.orphans {
+			ids = append(ids, oi.ID)
+		}
+		err := plugin.Remove(ids, func(result *dmplugin.RemoveResult) {
+			if result.Error != "" {
+				fmt.Printf("remove %s failed: %s\n", result.ID, result.Error)
+				problems++
+				return
+			}
+			fmt.Printf("removed %s\n", result.ID)
+		})
+		if err != nil {
+			return errors.Wrap(err, "remove orphans failed")
+		}
+	} else {
+		problems += len(report.orphans)
+	}
+
+	if problems > 0 {
+		return errors.Errorf("audit found %d problems", problems)
+	}
+	return nil
+}
+
+// auditFile checks that an archived file's object exists and is the
+// expected size.
+func auditFile(report *auditReport, objects map[string]*dmplugin.ObjectInfo, referenced map[string]bool, archiveID uint32, name string, fi os.FileInfo) {
+	state, archive, err := llapi.GetHsmFileStatus(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return
+	}
+	if !state.HasFlag(llapi.HsmFileArchived) || archive != archiveID {
+		return
+	}
+	report.files++
+
+	uuid, err := fileid.UUID.Get(name)
+	if err != nil || len(uuid) == 0 {
+		fmt.Printf("dangling %s: no file id\n", name)
+		report.dangling++
+		return
+	}
+	id := string(uuid)
+	referenced[id] = true
+
+	oi, ok := objects[id]
+	if !ok {
+		fmt.Printf("dangling %s %s\n", name, id)
+		report.dangling++
+		return
+	}
+	if !oi.Encoded && oi.Size != fi.Size() {
+		fmt.Printf("mismatch %s %s file:%d object:%d\n", name, id, fi.Size(), oi.Size)
+		report.mismatch++
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	cli "gopkg.in/urfave/cli.v1"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/config"
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/policy"
+	"github.com/intel-hpdd/lemur/pkg/checksum"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+// catalogFlag selects the agent catalog that files imported from an
+// existing archive copy are recorded in.
+var catalogFlag = cli.StringFlag{
+	Name:  "catalog",
+	Value: config.DefaultCatalogDir,
+	Usage: "Agent gc catalog to record the imported files in, if it exists",
+}
+
+// recordImport records a released file that refers to an existing archive
+// copy in the agent's catalog, so the agent's gc keeps the copy while the
+// file still uses it, after the file it was made from is deleted. Nothing
+// is recorded if the catalog doesn't exist, as when gc isn't enabled on
+// this node.
+func recordImport(dir string, fid *lustre.Fid, archiveID uint, uuid, hash, url string) error {
+	if dir == "" || uuid == "" {
+		return nil
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		debug.Printf("%s: no catalog, not recording %s", dir, fid)
+		return nil
+	}
+	sum, err := checksum.Parse(hash)
+	if err != nil {
+		return errors.Wrap(err, "decode hash failed")
+	}
+	catalog, err := policy.NewCatalog(dir)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(catalog.Put(fid, &policy.CatalogEntry{
+		ArchiveID: archiveID,
+		UUID:      uuid,
+		URL:       url,
+		Hash:      sum,
+		Imported:  true,
+	}), "record in catalog failed")
+}
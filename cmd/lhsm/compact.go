@@ -0,0 +1,80 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	cli "gopkg.in/urfave/cli.v1"
+
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/config"
+	"github.com/intel-hpdd/lemur/dmplugin"
+)
+
+func init() {
+	commands = append(commands, cli.Command{
+		Name:      "compact",
+		Usage:     "Reclaim the space of removed files in an archive's containers",
+		ArgsUsage: "mountpoint",
+		Description: "Archives that aggregate small files store them in containers, and removing\n" +
+			"   a file only records that it was removed. Compaction frees the space of the\n" +
+			"   removed files' data, without changing the IDs of the files that remain.",
+		Action: compactAction,
+		Flags: []cli.Flag{
+			cli.UintFlag{
+				Name:  "id, i",
+				Usage: "Numeric ID of archive backend",
+			},
+			cli.StringFlag{
+				Name:  "plugin, p",
+				Usage: "Data mover plugin for the archive (e.g. lhsm-plugin-posix)",
+			},
+			cli.StringFlag{
+				Name:  "plugin-dir",
+				Value: config.DefaultPluginDir,
+				Usage: "Directory containing the plugin binaries",
+			},
+			cli.StringFlag{
+				Name:  "config-dir",
+				Value: config.DefaultConfigDir,
+				Usage: "Directory containing the plugin configuration",
+			},
+		},
+	})
+}
+
+func compactAction(c *cli.Context) error {
+	logContext(c)
+	if len(c.Args()) != 1 {
+		return errors.New("compact requires a Lustre mountpoint")
+	}
+	archiveID := uint32(c.Uint("id"))
+	if archiveID == 0 {
+		return errors.New("archive id required")
+	}
+	if c.String("plugin") == "" {
+		return errors.New("plugin required")
+	}
+
+	root, err := fs.MountRoot(c.Args()[0])
+	if err != nil {
+		return errors.Wrapf(err, "%s: can't find filesystem root", c.Args()[0])
+	}
+	plugin := &dmplugin.OfflinePlugin{
+		Path:       filepath.Join(c.String("plugin-dir"), c.String("plugin")),
+		ConfigDir:  c.String("config-dir"),
+		Mountpoint: root.Path(),
+		ArchiveID:  archiveID,
+	}
+
+	result, err := plugin.Compact()
+	fmt.Printf("%d containers: %d compacted, %s reclaimed\n",
+		result.Containers, result.Compacted, humanize.IBytes(uint64(result.Reclaimed)))
+	return errors.Wrap(err, "compact failed")
+}
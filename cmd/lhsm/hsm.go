@@ -160,7 +160,7 @@ func init() {
 				},
 				cli.StringFlag{
 					Name:  "hash",
-					Usage: "Checksum hash value",
+					Usage: "Checksum hash value, in hex prefixed with its algorithm (e.g. sha256:) if it is not SHA1",
 				},
 				cli.StringFlag{
 					Name:  "uid",
@@ -206,6 +206,7 @@ func init() {
 					Name:  "pool",
 					Usage: "Set the start OST Pool name",
 				},
+				catalogFlag,
 			},
 		},
 		{
@@ -226,6 +227,7 @@ func init() {
 					Name:  "pool",
 					Usage: "Set the start OST Pool name",
 				},
+				catalogFlag,
 			},
 		},
 		{
@@ -246,6 +248,7 @@ func init() {
 					Name:  "pool",
 					Usage: "Set the start OST Pool name",
 				},
+				catalogFlag,
 			},
 		},
 	}
@@ -283,7 +286,7 @@ func getPathStatus(c *cli.Context, filePath string) (string, error) {
 	if !c.Bool("hide-path") {
 		fmt.Fprintf(&buf, "%s ", filePath)
 	}
-	fmt.Fprintf(&buf, hsm.FileStatusString(s, !c.Bool("long")))
+	buf.WriteString(hsm.FileStatusString(s, !c.Bool("long")))
 
 	if s.Exists() && c.Bool("action") {
 		a, err := hsm.GetFileAction(filePath)
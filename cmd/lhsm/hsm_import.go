@@ -163,7 +163,7 @@ func hsmImportAction(c *cli.Context) error {
 	layout.PoolName = c.String("pool")
 
 	debug.Printf("%v, %v, %v, %v", archive, uuid, hash, args[0])
-	_, err = hsm.Import(args[0], archive, fi, layout)
+	fid, err := hsm.Import(args[0], archive, fi, layout)
 	if err != nil {
 		return errors.Wrap(err, "Import failed")
 	}
@@ -176,10 +176,10 @@ func hsmImportAction(c *cli.Context) error {
 		fileid.Hash.Set(args[0], []byte(hash))
 	}
 
-	return nil
+	return recordImport(c.String("catalog"), fid, archive, uuid, hash, "")
 }
 
-func clone(srcPath, targetPath string, stripeCount, stripeSize int, poolName string, requiredState llapi.HsmStateFlag) error {
+func clone(srcPath, targetPath string, stripeCount, stripeSize int, poolName string, requiredState llapi.HsmStateFlag, catalogDir string) error {
 	srcStat, err := os.Stat(srcPath)
 	if err != nil {
 		return errors.Wrap(err, srcPath)
@@ -228,7 +228,7 @@ func clone(srcPath, targetPath string, stripeCount, stripeSize int, poolName str
 	}
 
 	//debug.Printf("%v, %v, %v, %v", archive, uuid, hash, srcPath)
-	_, err = hsm.Import(targetPath, uint(archive), srcStat, layout)
+	fid, err := hsm.Import(targetPath, uint(archive), srcStat, layout)
 	if err != nil {
 		return errors.Wrap(err, "Import failed")
 	}
@@ -242,7 +242,9 @@ func clone(srcPath, targetPath string, stripeCount, stripeSize int, poolName str
 	if err == nil && len(hash) > 0 {
 		fileid.Hash.Set(targetPath, hash)
 	}
-	return nil
+
+	url, _ := fileid.URL.Get(srcPath)
+	return recordImport(catalogDir, fid, uint(archive), string(uuid), string(hash), string(url))
 }
 
 func hsmCloneAction(c *cli.Context) error {
@@ -252,7 +254,7 @@ func hsmCloneAction(c *cli.Context) error {
 		return errors.New("HSM clone requires source and destination argument")
 	}
 
-	return clone(args[0], args[1], c.Int("stripe_count"), c.Int("stripe_size"), c.String("pool"), llapi.HsmFileArchived)
+	return clone(args[0], args[1], c.Int("stripe_count"), c.Int("stripe_size"), c.String("pool"), llapi.HsmFileArchived, c.String("catalog"))
 }
 
 // tempName returns a tempname based on path provided
@@ -266,7 +268,7 @@ func hsmRestripeAction(c *cli.Context) error {
 		return errors.New("Can only restripe one file at a time.")
 	}
 	tempFile := tempName(args[0])
-	err := clone(args[0], tempFile, c.Int("stripe_count"), c.Int("stripe_size"), c.String("pool"), llapi.HsmFileReleased)
+	err := clone(args[0], tempFile, c.Int("stripe_count"), c.Int("stripe_size"), c.String("pool"), llapi.HsmFileReleased, c.String("catalog"))
 	if err != nil {
 		os.Remove(tempFile)
 		return errors.Wrap(err, "Unable to restripe")
@@ -0,0 +1,563 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	cli "gopkg.in/urfave/cli.v1"
+
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/llapi"
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/agent/fileid"
+	"github.com/intel-hpdd/lemur/dmplugin"
+	"github.com/intel-hpdd/lemur/pkg/checksum"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+const (
+	formatJSONL = "jsonl"
+	formatCSV   = "csv"
+
+	conflictSkip    = "skip"
+	conflictReplace = "replace"
+	conflictError   = "error"
+)
+
+func init() {
+	formatFlag := cli.StringFlag{
+		Name:  "format, f",
+		Usage: "Manifest format, jsonl or csv (default: jsonl, or csv for a .csv file)",
+	}
+	commands = append(commands, cli.Command{
+		Name:  "manifest",
+		Usage: "Export and import the HSM state of a tree of files",
+		Subcommands: []cli.Command{
+			{
+				Name:      "export",
+				Usage:     "Write a record for each HSM-managed file in a directory tree",
+				ArgsUsage: "dir",
+				Action:    manifestExportAction,
+				Flags: []cli.Flag{
+					formatFlag,
+					cli.StringFlag{
+						Name:  "output, o",
+						Value: "-",
+						Usage: "Manifest file to write",
+					},
+				},
+			},
+			{
+				Name:      "import",
+				Usage:     "Create released files from the archived files in a manifest",
+				ArgsUsage: "manifest dir",
+				Description: "Paths in the manifest are relative to dir. Records for files that\n" +
+					"   have no archive copy are skipped. Existing files that already refer to the\n" +
+					"   record's archive copy are never replaced, as removing them would let the\n" +
+					"   agent's garbage collector remove the copy.",
+				Action: manifestImportAction,
+				Flags: []cli.Flag{
+					formatFlag,
+					cli.IntFlag{
+						Name:  "threads, t",
+						Value: 8,
+						Usage: "Number of files to import in parallel",
+					},
+					cli.StringFlag{
+						Name:  "conflict",
+						Value: conflictSkip,
+						Usage: "What to do when a file exists: skip, replace or error",
+					},
+					cli.BoolFlag{
+						Name:  "dry-run, n",
+						Usage: "Print the files that would be created",
+					},
+					catalogFlag,
+				},
+			},
+		},
+	})
+}
+
+// manifestRecord is the HSM state and attributes of one file.
+type manifestRecord struct {
+	Path        string    `json:"path"` // Relative to the exported directory
+	Fid         string    `json:"fid"`
+	ArchiveID   uint32    `json:"archive_id"`
+	Flags       []string  `json:"flags"`
+	UUID        string    `json:"uuid,omitempty"`
+	Hash        string    `json:"hash,omitempty"` // As stored in the xattr (see checksum.Format)
+	URL         string    `json:"url,omitempty"`
+	Size        int64     `json:"size"`
+	UID         uint32    `json:"uid"`
+	GID         uint32    `json:"gid"`
+	Mode        uint32    `json:"mode"`
+	ATime       time.Time `json:"atime"`
+	MTime       time.Time `json:"mtime"`
+	CTime       time.Time `json:"ctime"`
+	StripeCount int       `json:"stripe_count"`
+	StripeSize  int       `json:"stripe_size"`
+	Pool        string    `json:"pool,omitempty"`
+}
+
+// csvHeader is the first row of a CSV manifest.
+var csvHeader = []string{
+	"path", "fid", "archive_id", "flags", "uuid", "hash", "url", "size",
+	"uid", "gid", "mode", "atime", "mtime", "ctime",
+	"stripe_count", "stripe_size", "pool",
+}
+
+func (r *manifestRecord) hasFlag(flag llapi.HsmStateFlag) bool {
+	for _, f := range r.Flags {
+		if f == flag.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *manifestRecord) csvRow() []string {
+	return []string{
+		r.Path, r.Fid, strconv.FormatUint(uint64(r.ArchiveID), 10),
+		strings.Join(r.Flags, ";"), r.UUID, r.Hash, r.URL,
+		strconv.FormatInt(r.Size, 10),
+		strconv.FormatUint(uint64(r.UID), 10),
+		strconv.FormatUint(uint64(r.GID), 10),
+		strconv.FormatUint(uint64(r.Mode), 8),
+		r.ATime.Format(time.RFC3339Nano),
+		r.MTime.Format(time.RFC3339Nano),
+		r.CTime.Format(time.RFC3339Nano),
+		strconv.Itoa(r.StripeCount), strconv.Itoa(r.StripeSize), r.Pool,
+	}
+}
+
+func parseCSVRecord(row []string) (*manifestRecord, error) {
+	if len(row) != len(csvHeader) {
+		return nil, errors.Errorf("expected %d fields, got %d", len(csvHeader), len(row))
+	}
+	r := &manifestRecord{
+		Path: row[0],
+		Fid:  row[1],
+		UUID: row[4],
+		Hash: row[5],
+		URL:  row[6],
+		Pool: row[16],
+	}
+	if row[3] != "" {
+		r.Flags = strings.Split(row[3], ";")
+	}
+
+	var err error
+	parseUint := func(s string, base, bits int) uint64 {
+		var v uint64
+		if err == nil {
+			v, err = strconv.ParseUint(s, base, bits)
+		}
+		return v
+	}
+	parseInt := func(s string) int64 {
+		var v int64
+		if err == nil {
+			v, err = strconv.ParseInt(s, 10, 64)
+		}
+		return v
+	}
+	parseTime := func(s string) time.Time {
+		var v time.Time
+		if err == nil {
+			v, err = time.Parse(time.RFC3339Nano, s)
+		}
+		return v
+	}
+	r.ArchiveID = uint32(parseUint(row[2], 10, 32))
+	r.Size = parseInt(row[7])
+	r.UID = uint32(parseUint(row[8], 10, 32))
+	r.GID = uint32(parseUint(row[9], 10, 32))
+	r.Mode = uint32(parseUint(row[10], 8, 32))
+	r.ATime = parseTime(row[11])
+	r.MTime = parseTime(row[12])
+	r.CTime = parseTime(row[13])
+	r.StripeCount = int(parseInt(row[14]))
+	r.StripeSize = int(parseInt(row[15]))
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: bad field", r.Path)
+	}
+	return r, nil
+}
+
+// manifestFormat returns the format given on the command line, or the one
+// implied by the manifest file's name.
+func manifestFormat(c *cli.Context, name string) (string, error) {
+	switch format := c.String("format"); format {
+	case formatJSONL, formatCSV:
+		return format, nil
+	case "":
+		if strings.HasSuffix(name, ".csv") {
+			return formatCSV, nil
+		}
+		return formatJSONL, nil
+	default:
+		return "", errors.Errorf("unknown manifest format %q", format)
+	}
+}
+
+func manifestExportAction(c *cli.Context) error {
+	logContext(c)
+	if len(c.Args()) != 1 {
+		return errors.New("export requires a directory")
+	}
+	dir := c.Args()[0]
+	name := c.String("output")
+	format, err := manifestFormat(c, name)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if name != "-" {
+		f, err := os.Create(name)
+		if err != nil {
+			return errors.Wrap(err, "create manifest failed")
+		}
+		defer f.Close()
+		out = f
+	}
+	buf := bufio.NewWriter(out)
+
+	var write func(*manifestRecord) error
+	var flush func() error
+	switch format {
+	case formatCSV:
+		w := csv.NewWriter(buf)
+		if err := w.Write(csvHeader); err != nil {
+			return errors.Wrap(err, "write manifest failed")
+		}
+		write = func(r *manifestRecord) error { return w.Write(r.csvRow()) }
+		flush = func() error {
+			w.Flush()
+			return w.Error()
+		}
+	default:
+		enc := json.NewEncoder(buf)
+		write = func(r *manifestRecord) error { return enc.Encode(r) }
+		flush = func() error { return nil }
+	}
+
+	var count int
+	err = filepath.Walk(dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		r, err := newManifestRecord(dir, name, fi)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			return nil
+		}
+		if r == nil {
+			return nil
+		}
+		count++
+		return errors.Wrap(write(r), "write manifest failed")
+	})
+	if err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return errors.Wrap(err, "write manifest failed")
+	}
+	if err := buf.Flush(); err != nil {
+		return errors.Wrap(err, "write manifest failed")
+	}
+	debug.Printf("exported %d files from %s", count, dir)
+	return nil
+}
+
+// newManifestRecord returns the record for a file, or nil if the file is
+// not managed by HSM.
+func newManifestRecord(dir, name string, fi os.FileInfo) (*manifestRecord, error) {
+	state, archiveID, err := llapi.GetHsmFileStatus(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "get hsm status failed")
+	}
+	if !state.HasFlag(llapi.HsmFileExists) {
+		return nil, nil
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, errors.New("no stat data")
+	}
+	rel, err := filepath.Rel(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	fid, err := fs.LookupFid(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "lookup fid failed")
+	}
+	layout, err := llapi.FileDataLayout(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "get layout failed")
+	}
+
+	flags := state.Flags()
+	sort.Strings(flags)
+	r := &manifestRecord{
+		Path:        rel,
+		Fid:         fid.String(),
+		ArchiveID:   archiveID,
+		Flags:       flags,
+		Size:        st.Size,
+		UID:         st.Uid,
+		GID:         st.Gid,
+		Mode:        st.Mode,
+		ATime:       time.Unix(st.Atim.Sec, st.Atim.Nsec),
+		MTime:       time.Unix(st.Mtim.Sec, st.Mtim.Nsec),
+		CTime:       time.Unix(st.Ctim.Sec, st.Ctim.Nsec),
+		StripeCount: layout.StripeCount,
+		StripeSize:  layout.StripeSize,
+		Pool:        layout.PoolName,
+	}
+	if buf, err := fileid.UUID.Get(name); err == nil {
+		r.UUID = string(buf)
+	}
+	if buf, err := fileid.Hash.Get(name); err == nil {
+		r.Hash = string(buf)
+	}
+	if buf, err := fileid.URL.Get(name); err == nil {
+		r.URL = string(buf)
+	}
+	return r, nil
+}
+
+// readManifest calls fn for each record in the manifest.
+func readManifest(in io.Reader, format string, fn func(*manifestRecord)) error {
+	rdr := bufio.NewReader(in)
+	if format == formatCSV {
+		cr := csv.NewReader(rdr)
+		cr.FieldsPerRecord = len(csvHeader)
+		if _, err := cr.Read(); err != nil {
+			return errors.Wrap(err, "read manifest header failed")
+		}
+		for {
+			row, err := cr.Read()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return errors.Wrap(err, "read manifest failed")
+			}
+			r, err := parseCSVRecord(row)
+			if err != nil {
+				return err
+			}
+			fn(r)
+		}
+	}
+
+	dec := json.NewDecoder(rdr)
+	for {
+		var r manifestRecord
+		err := dec.Decode(&r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "read manifest failed")
+		}
+		fn(&r)
+	}
+}
+
+type importCounts struct {
+	sync.Mutex
+	created, skipped, exists, failed int
+}
+
+func (ic *importCounts) add(count *int) {
+	ic.Lock()
+	*count++
+	ic.Unlock()
+}
+
+func manifestImportAction(c *cli.Context) error {
+	logContext(c)
+	if len(c.Args()) != 2 {
+		return errors.New("import requires a manifest and a directory")
+	}
+	name, dir := c.Args()[0], c.Args()[1]
+	format, err := manifestFormat(c, name)
+	if err != nil {
+		return err
+	}
+	conflict := c.String("conflict")
+	switch conflict {
+	case conflictSkip, conflictReplace, conflictError:
+	default:
+		return errors.Errorf("unknown conflict action %q", conflict)
+	}
+	threads := c.Int("threads")
+	if threads < 1 {
+		threads = 1
+	}
+
+	var in io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return errors.Wrap(err, "open manifest failed")
+		}
+		defer f.Close()
+		in = f
+	}
+
+	counts := &importCounts{}
+	records := make(chan *manifestRecord, threads)
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range records {
+				importRecord(counts, r, dir, conflict, c.String("catalog"), c.Bool("dry-run"))
+			}
+		}()
+	}
+
+	err = readManifest(in, format, func(r *manifestRecord) {
+		records <- r
+	})
+	close(records)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d files created, %d not archived, %d already exist, %d failed\n",
+		counts.created, counts.skipped, counts.exists, counts.failed)
+	if counts.failed > 0 {
+		return errors.Errorf("import failed for %d files", counts.failed)
+	}
+	return nil
+}
+
+// importRecord creates a released file for an archived record.
+func importRecord(counts *importCounts, r *manifestRecord, dir, conflict, catalogDir string, dryRun bool) {
+	name := filepath.Join(dir, r.Path)
+	if !r.hasFlag(llapi.HsmFileArchived) || r.UUID == "" || r.ArchiveID == 0 {
+		debug.Printf("%s: not archived, skipping", name)
+		counts.add(&counts.skipped)
+		return
+	}
+
+	if _, err := os.Lstat(name); err == nil {
+		switch conflict {
+		case conflictSkip:
+			debug.Printf("%s: exists, skipping", name)
+			counts.add(&counts.exists)
+			return
+		case conflictError:
+			fmt.Fprintf(os.Stderr, "%s: already exists\n", name)
+			counts.add(&counts.failed)
+			return
+		case conflictReplace:
+			if refersToRecord(name, r) {
+				fmt.Fprintf(os.Stderr, "%s: already refers to archive:%d %s, not replaced\n", name, r.ArchiveID, r.UUID)
+				counts.add(&counts.exists)
+				return
+			}
+			if dryRun {
+				break
+			}
+			if err := os.Remove(name); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+				counts.add(&counts.failed)
+				return
+			}
+		}
+	}
+
+	if dryRun {
+		fmt.Printf("would create %s from archive:%d %s\n", name, r.ArchiveID, r.UUID)
+		counts.add(&counts.created)
+		return
+	}
+	if err := importFile(name, r, catalogDir); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		counts.add(&counts.failed)
+		return
+	}
+	counts.add(&counts.created)
+}
+
+// refersToRecord returns true if the existing file at name refers to the
+// record's archive copy, or may do as its UUID matches but its archive
+// can't be read or isn't set. Such a file isn't replaced: removing it would have the
+// agent's gc remove the copy that the new file is to refer to.
+func refersToRecord(name string, r *manifestRecord) bool {
+	uuid, err := fileid.UUID.Get(name)
+	if err != nil || string(uuid) != r.UUID {
+		return false
+	}
+	_, archive, err := llapi.GetHsmFileStatus(name)
+	return err != nil || archive == 0 || archive == r.ArchiveID
+}
+
+func importFile(name string, r *manifestRecord, catalogDir string) error {
+	hash, err := checksum.Parse(r.Hash)
+	if err != nil {
+		return errors.Wrap(err, "decode hash failed")
+	}
+	md := &dmplugin.ObjectMetadata{
+		UUID:  r.UUID,
+		URL:   r.URL,
+		Hash:  hash,
+		UID:   r.UID,
+		GID:   r.GID,
+		Mode:  r.Mode,
+		Size:  r.Size,
+		ATime: r.ATime,
+		MTime: r.MTime,
+		Layout: &dmplugin.ObjectLayout{
+			StripeCount: r.StripeCount,
+			StripeSize:  r.StripeSize,
+			PoolName:    r.Pool,
+		},
+	}
+	if err := rebuildFile(name, uint(r.ArchiveID), md, catalogDir); err != nil {
+		return err
+	}
+
+	// Import leaves the file archived and released, so only the policy
+	// flags need to be restored.
+	var mask uint64
+	for _, flag := range []llapi.HsmStateFlag{llapi.HsmFileNoRelease, llapi.HsmFileNoArchive} {
+		if r.hasFlag(flag) {
+			mask |= uint64(flag)
+		}
+	}
+	if mask != 0 {
+		if err := llapi.SetHsmFileStatus(name, mask, 0, r.ArchiveID); err != nil {
+			return errors.Wrap(err, "set hsm flags failed")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/agent/fileid"
+)
+
+func TestImportRecordReplace(t *testing.T) {
+	fileid.EnableTestMode()
+	defer fileid.DisableTestMode()
+
+	dir, err := ioutil.TempDir("", "manifest-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &manifestRecord{
+		Path:      "a",
+		ArchiveID: 1,
+		Flags:     []string{"archived", "exists", "released"},
+		UUID:      "copy",
+	}
+	name := filepath.Join(dir, r.Path)
+	if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file that already refers to the record's copy is kept.
+	fileid.UUID.Set(name, []byte(r.UUID))
+	counts := &importCounts{}
+	importRecord(counts, r, dir, conflictReplace, "", false)
+	if counts.exists != 1 || counts.created+counts.failed != 0 {
+		t.Fatalf("unexpected counts: %+v", counts)
+	}
+	if _, err := os.Stat(name); err != nil {
+		t.Fatalf("file referring to the record's copy was replaced: %v", err)
+	}
+
+	// Any other file is replaced.
+	fileid.UUID.Set(name, []byte("other"))
+	counts = &importCounts{}
+	importRecord(counts, r, dir, conflictReplace, "", true)
+	if counts.created != 1 || counts.exists != 0 {
+		t.Fatalf("unexpected counts: %+v", counts)
+	}
+}
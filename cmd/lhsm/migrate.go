@@ -0,0 +1,79 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	cli "gopkg.in/urfave/cli.v1"
+
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/config"
+	"github.com/intel-hpdd/lemur/dmplugin"
+)
+
+func init() {
+	commands = append(commands, cli.Command{
+		Name:      "migrate",
+		Usage:     "Move an archive's objects to their places under its current layout",
+		ArgsUsage: "mountpoint",
+		Description: "Objects written under an archive's older layouts are still found, by trying\n" +
+			"   each of the layouts recorded in its roots. Migration moves them to where the\n" +
+			"   current layout places them, without changing their IDs, so only the current\n" +
+			"   layout needs to be tried. The archive should not be in use while it runs.",
+		Action: migrateAction,
+		Flags: []cli.Flag{
+			cli.UintFlag{
+				Name:  "id, i",
+				Usage: "Numeric ID of archive backend",
+			},
+			cli.StringFlag{
+				Name:  "plugin, p",
+				Usage: "Data mover plugin for the archive (e.g. lhsm-plugin-posix)",
+			},
+			cli.StringFlag{
+				Name:  "plugin-dir",
+				Value: config.DefaultPluginDir,
+				Usage: "Directory containing the plugin binaries",
+			},
+			cli.StringFlag{
+				Name:  "config-dir",
+				Value: config.DefaultConfigDir,
+				Usage: "Directory containing the plugin configuration",
+			},
+		},
+	})
+}
+
+func migrateAction(c *cli.Context) error {
+	logContext(c)
+	if len(c.Args()) != 1 {
+		return errors.New("migrate requires a Lustre mountpoint")
+	}
+	archiveID := uint32(c.Uint("id"))
+	if archiveID == 0 {
+		return errors.New("archive id required")
+	}
+	if c.String("plugin") == "" {
+		return errors.New("plugin required")
+	}
+
+	root, err := fs.MountRoot(c.Args()[0])
+	if err != nil {
+		return errors.Wrapf(err, "%s: can't find filesystem root", c.Args()[0])
+	}
+	plugin := &dmplugin.OfflinePlugin{
+		Path:       filepath.Join(c.String("plugin-dir"), c.String("plugin")),
+		ConfigDir:  c.String("config-dir"),
+		Mountpoint: root.Path(),
+		ArchiveID:  archiveID,
+	}
+
+	result, err := plugin.Migrate()
+	fmt.Printf("%d objects: %d moved to layout %s\n", result.Objects, result.Moved, result.Layout)
+	return errors.Wrap(err, "migrate failed")
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	cli "gopkg.in/urfave/cli.v1"
+
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/hsm"
+	"github.com/intel-hpdd/go-lustre/llapi"
+	"github.com/intel-hpdd/go-lustre/pkg/xattr"
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/agent/fileid"
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/config"
+	"github.com/intel-hpdd/lemur/dmplugin"
+	"github.com/intel-hpdd/lemur/pkg/checksum"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+func init() {
+	commands = append(commands, cli.Command{
+		Name:      "rebuild",
+		Usage:     "Recreate released files from the metadata stored in an archive",
+		ArgsUsage: "mountpoint",
+		Description: "Imports a released stub for each object in the archive that has stored\n" +
+			"   metadata, at the object's original path. Paths that already exist are skipped.\n" +
+			"   If several objects were archived from the same path the newest is used.",
+		Action: rebuildAction,
+		Flags: []cli.Flag{
+			cli.UintFlag{
+				Name:  "id, i",
+				Usage: "Numeric ID of archive backend",
+			},
+			cli.StringFlag{
+				Name:  "plugin, p",
+				Usage: "Data mover plugin for the archive (e.g. lhsm-plugin-posix)",
+			},
+			cli.StringFlag{
+				Name:  "plugin-dir",
+				Value: config.DefaultPluginDir,
+				Usage: "Directory containing the plugin binaries",
+			},
+			cli.StringFlag{
+				Name:  "config-dir",
+				Value: config.DefaultConfigDir,
+				Usage: "Directory containing the plugin configuration",
+			},
+			cli.BoolFlag{
+				Name:  "dry-run, n",
+				Usage: "Print the files that would be created",
+			},
+			catalogFlag,
+		},
+	})
+}
+
+func rebuildAction(c *cli.Context) error {
+	logContext(c)
+	if len(c.Args()) != 1 {
+		return errors.New("rebuild requires a Lustre mountpoint")
+	}
+	archiveID := uint32(c.Uint("id"))
+	if archiveID == 0 {
+		return errors.New("archive id required")
+	}
+	if c.String("plugin") == "" {
+		return errors.New("plugin required")
+	}
+
+	root, err := fs.MountRoot(c.Args()[0])
+	if err != nil {
+		return errors.Wrapf(err, "%s: can't find filesystem root", c.Args()[0])
+	}
+	plugin := &dmplugin.OfflinePlugin{
+		Path:       filepath.Join(c.String("plugin-dir"), c.String("plugin")),
+		ConfigDir:  c.String("config-dir"),
+		Mountpoint: root.Path(),
+		ArchiveID:  archiveID,
+	}
+
+	var objects, missing int
+	latest := make(map[string]*dmplugin.ObjectMetadata)
+	err = plugin.ListMetadata(func(oi *dmplugin.ObjectInfo) error {
+		objects++
+		md := oi.Metadata
+		if md == nil || md.Path == "" {
+			missing++
+			return nil
+		}
+		if prev, ok := latest[md.Path]; !ok || md.MTime.After(prev.MTime) {
+			latest[md.Path] = md
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "list archive failed")
+	}
+	debug.Printf("archive %d has %d objects, %d without metadata", archiveID, objects, missing)
+
+	var created, exists, failed int
+	for _, md := range latest {
+		name := filepath.Join(root.Path(), md.Path)
+		if _, err := os.Lstat(name); err == nil {
+			debug.Printf("%s: exists, skipping %s", name, md.UUID)
+			exists++
+			continue
+		}
+		if c.Bool("dry-run") {
+			fmt.Printf("would create %s from %s\n", name, md.UUID)
+			created++
+			continue
+		}
+		if err := rebuildFile(name, uint(archiveID), md, c.String("catalog")); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("created %s from %s\n", name, md.UUID)
+		created++
+	}
+
+	fmt.Printf("%d objects, %d without metadata: %d files created, %d already exist, %d failed\n",
+		objects, missing, created, exists, failed)
+	if failed > 0 {
+		return errors.Errorf("rebuild failed for %d files", failed)
+	}
+	return nil
+}
+
+// rebuildFile imports a released file at name with the attributes saved in
+// the object metadata, and records it in the agent catalog in catalogDir.
+func rebuildFile(name string, archiveID uint, md *dmplugin.ObjectMetadata, catalogDir string) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return errors.Wrap(err, "create parent failed")
+	}
+
+	fi := &myFileInfo{name: name}
+	stat := &fi.stat
+	stat.Uid = md.UID
+	stat.Gid = md.GID
+	stat.Mode = md.Mode
+	stat.Size = md.Size
+	stat.Atim.Sec = md.ATime.Unix()
+	stat.Atim.Nsec = int64(md.ATime.Nanosecond())
+	stat.Mtim.Sec = md.MTime.Unix()
+	stat.Mtim.Nsec = int64(md.MTime.Nanosecond())
+
+	layout := llapi.DefaultDataLayout()
+	if md.Layout != nil {
+		layout.StripeCount = md.Layout.StripeCount
+		layout.StripeSize = md.Layout.StripeSize
+		layout.PoolName = md.Layout.PoolName
+	}
+
+	fid, err := hsm.Import(name, archiveID, fi, layout)
+	if err != nil {
+		return errors.Wrap(err, "import failed")
+	}
+
+	if err := fileid.UUID.Set(name, []byte(md.UUID)); err != nil {
+		return errors.Wrap(err, "set uuid failed")
+	}
+	if len(md.Hash) > 0 {
+		if err := fileid.Hash.Set(name, []byte(checksum.Format(md.Hash))); err != nil {
+			return errors.Wrap(err, "set hash failed")
+		}
+	}
+	if md.URL != "" {
+		if err := fileid.URL.Set(name, []byte(md.URL)); err != nil {
+			return errors.Wrap(err, "set url failed")
+		}
+	}
+	for attr, value := range md.Xattrs {
+		if err := xattr.Lsetxattr(name, attr, value, 0); err != nil {
+			return errors.Wrapf(err, "set xattr %s failed", attr)
+		}
+	}
+	return recordImport(catalogDir, fid, archiveID, md.UUID, checksum.Format(md.Hash), md.URL)
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	cli "gopkg.in/urfave/cli.v1"
+
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/config"
+	"github.com/intel-hpdd/lemur/dmplugin"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+func init() {
+	commands = append(commands, cli.Command{
+		Name:      "rekey",
+		Usage:     "Rewrap the data keys of an archive's encrypted objects with its current key",
+		ArgsUsage: "mountpoint",
+		Description: "Only the wrapped key stored with each object is rewritten, so the object\n" +
+			"   data isn't copied. Once every object has been rekeyed, old keys can be removed\n" +
+			"   from the keyring.",
+		Action: rekeyAction,
+		Flags: []cli.Flag{
+			cli.UintFlag{
+				Name:  "id, i",
+				Usage: "Numeric ID of archive backend",
+			},
+			cli.StringFlag{
+				Name:  "plugin, p",
+				Usage: "Data mover plugin for the archive (e.g. lhsm-plugin-posix)",
+			},
+			cli.StringFlag{
+				Name:  "plugin-dir",
+				Value: config.DefaultPluginDir,
+				Usage: "Directory containing the plugin binaries",
+			},
+			cli.StringFlag{
+				Name:  "config-dir",
+				Value: config.DefaultConfigDir,
+				Usage: "Directory containing the plugin configuration",
+			},
+		},
+	})
+}
+
+func rekeyAction(c *cli.Context) error {
+	logContext(c)
+	if len(c.Args()) != 1 {
+		return errors.New("rekey requires a Lustre mountpoint")
+	}
+	archiveID := uint32(c.Uint("id"))
+	if archiveID == 0 {
+		return errors.New("archive id required")
+	}
+	if c.String("plugin") == "" {
+		return errors.New("plugin required")
+	}
+
+	root, err := fs.MountRoot(c.Args()[0])
+	if err != nil {
+		return errors.Wrapf(err, "%s: can't find filesystem root", c.Args()[0])
+	}
+	plugin := &dmplugin.OfflinePlugin{
+		Path:       filepath.Join(c.String("plugin-dir"), c.String("plugin")),
+		ConfigDir:  c.String("config-dir"),
+		Mountpoint: root.Path(),
+		ArchiveID:  archiveID,
+	}
+
+	var ids []string
+	err = plugin.List(func(oi *dmplugin.ObjectInfo) error {
+		if oi.Encoded {
+			ids = append(ids, oi.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "list archive failed")
+	}
+	debug.Printf("archive %d has %d encoded objects", archiveID, len(ids))
+	if len(ids) == 0 {
+		fmt.Println("no encoded objects")
+		return nil
+	}
+
+	var rekeyed, current, plain, failed int
+	err = plugin.Rekey(ids, func(result *dmplugin.RekeyResult) {
+		switch {
+		case result.Error != "":
+			fmt.Printf("rekey %s failed: %s\n", result.ID, result.Error)
+			failed++
+		case result.From == "":
+			plain++
+		case result.From == result.To:
+			current++
+		default:
+			fmt.Printf("rekeyed %s %s -> %s\n", result.ID, result.From, result.To)
+			rekeyed++
+		}
+	})
+	if err != nil {
+		return errors.Wrap(err, "rekey failed")
+	}
+
+	fmt.Printf("%d objects: %d rekeyed, %d already current, %d not encrypted, %d failed\n",
+		len(ids), rekeyed, current, plain, failed)
+	if failed > 0 {
+		return errors.Errorf("rekey failed for %d objects", failed)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	cli "gopkg.in/urfave/cli.v1"
+
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/llapi"
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/agent/fileid"
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/config"
+	"github.com/intel-hpdd/lemur/dmplugin"
+	"github.com/intel-hpdd/lemur/pkg/checksum"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+func init() {
+	commands = append(commands, cli.Command{
+		Name:      "verify",
+		Usage:     "Compare the archived objects of files in a Lustre tree with their recorded checksums",
+		ArgsUsage: "path [path...]",
+		Description: "Each archived file's object is read in full from the archive, and its\n" +
+			"   checksum compared with the one recorded in the file's trusted.lhsm_hash\n" +
+			"   attribute. Objects of files without a checksum are only checked to be readable.",
+		Action: verifyAction,
+		Flags: []cli.Flag{
+			cli.UintFlag{
+				Name:  "id, i",
+				Usage: "Numeric ID of archive backend",
+			},
+			cli.StringFlag{
+				Name:  "plugin, p",
+				Usage: "Data mover plugin for the archive (e.g. lhsm-plugin-posix)",
+			},
+			cli.StringFlag{
+				Name:  "plugin-dir",
+				Value: config.DefaultPluginDir,
+				Usage: "Directory containing the plugin binaries",
+			},
+			cli.StringFlag{
+				Name:  "config-dir",
+				Value: config.DefaultConfigDir,
+				Usage: "Directory containing the plugin configuration",
+			},
+		},
+	})
+}
+
+func verifyAction(c *cli.Context) error {
+	logContext(c)
+	paths := c.Args()
+	if len(paths) < 1 {
+		return errors.New("verify requires at least 1 path")
+	}
+	archiveID := uint32(c.Uint("id"))
+	if archiveID == 0 {
+		return errors.New("archive id required")
+	}
+	if c.String("plugin") == "" {
+		return errors.New("plugin required")
+	}
+
+	root, err := fs.MountRoot(paths[0])
+	if err != nil {
+		return errors.Wrapf(err, "%s: can't find filesystem root", paths[0])
+	}
+	plugin := &dmplugin.OfflinePlugin{
+		Path:       filepath.Join(c.String("plugin-dir"), c.String("plugin")),
+		ConfigDir:  c.String("config-dir"),
+		Mountpoint: root.Path(),
+		ArchiveID:  archiveID,
+	}
+
+	var reqs []*dmplugin.VerifyRequest
+	files := make(map[string][]string)
+	var failed int
+	for _, p := range paths {
+		err := filepath.Walk(p, func(name string, fi os.FileInfo, err error) error {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+				return nil
+			}
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			req, err := verifyRequest(archiveID, name)
+			if err != nil {
+				fmt.Printf("verify %s failed: %v\n", name, err)
+				failed++
+			}
+			if req == nil {
+				return nil
+			}
+			if _, ok := files[req.ID]; !ok {
+				reqs = append(reqs, req)
+			}
+			files[req.ID] = append(files[req.ID], name)
+			return nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "%s: walk failed", p)
+		}
+	}
+	debug.Printf("verifying %d objects of archive %d", len(reqs), archiveID)
+
+	var verified, mismatched int
+	err = plugin.Verify(reqs, func(result *dmplugin.VerifyResult) {
+		for _, name := range files[result.ID] {
+			switch {
+			case result.Error != "":
+				fmt.Printf("verify %s %s failed: %s\n", name, result.ID, result.Error)
+				failed++
+			case result.Mismatch:
+				fmt.Printf("mismatch %s %s\n", name, result.ID)
+				mismatched++
+			default:
+				verified++
+			}
+		}
+	})
+	if err != nil {
+		return errors.Wrap(err, "verify failed")
+	}
+
+	fmt.Printf("%d files: %d verified, %d checksum mismatches, %d failed\n",
+		verified+mismatched+failed, verified, mismatched, failed)
+	if problems := mismatched + failed; problems > 0 {
+		return errors.Errorf("verify found %d problems", problems)
+	}
+	return nil
+}
+
+// verifyRequest returns the request to verify the object of a file
+// archived to the archive, or nil if it isn't.
+func verifyRequest(archiveID uint32, name string) (*dmplugin.VerifyRequest, error) {
+	state, archive, err := llapi.GetHsmFileStatus(name)
+	if err != nil {
+		return nil, err
+	}
+	if !state.HasFlag(llapi.HsmFileArchived) || archive != archiveID {
+		return nil, nil
+	}
+
+	uuid, err := fileid.UUID.Get(name)
+	if err != nil || len(uuid) == 0 {
+		return nil, errors.New("no file id")
+	}
+	req := &dmplugin.VerifyRequest{ID: string(uuid)}
+	if buf, err := fileid.Hash.Get(name); err == nil && len(buf) > 0 {
+		if req.Hash, err = checksum.Parse(string(buf)); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
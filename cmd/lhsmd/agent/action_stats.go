@@ -5,7 +5,10 @@
 package agent
 
 import (
+	"bytes"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,14 +18,21 @@ import (
 	"github.com/dustin/go-humanize"
 	"github.com/rcrowley/go-metrics"
 
+	pb "github.com/intel-hpdd/lemur/pdm"
 	"github.com/intel-hpdd/logging/audit"
 	"github.com/intel-hpdd/logging/debug"
 )
 
 // ActionStats is a synchronized container for ArchiveStats instances
 type ActionStats struct {
+	// Running totals across all archives, first for 64-bit alignment
+	completed int64
+	failed    int64
+	latency   int64
+
 	sync.Mutex
-	stats map[int]*ArchiveStats
+	stats     map[int]*ArchiveStats
+	endpoints *Endpoints
 }
 
 // ArchiveStats is a per-archive container of statistics for that backend
@@ -30,8 +40,22 @@ type ArchiveStats struct {
 	changes     uint64
 	queueLength metrics.Counter
 	completed   metrics.Timer
+	ops         map[pb.Command]*OpStats
+}
+
+// OpStats is a per-operation container of statistics for an archive
+type OpStats struct {
+	sync.Mutex
+	prefix     string
+	succeeded  metrics.Counter
+	failed     metrics.Counter
+	errors     map[int]metrics.Counter
+	bytes      metrics.Histogram
+	throughput metrics.Meter
 }
 
+var statsCommands = []pb.Command{pb.Command_ARCHIVE, pb.Command_RESTORE, pb.Command_REMOVE, pb.Command_VERIFY}
+
 // NewActionStats initializes a new ActionStats container
 func NewActionStats() *ActionStats {
 	return &ActionStats{
@@ -45,11 +69,31 @@ func (as *ActionStats) update() {
 		changes := atomic.LoadUint64(&archive.changes)
 		if changes != 0 {
 			atomic.AddUint64(&archive.changes, -changes)
-			audit.Logf("archive:%d %s", k, archive)
+			audit.Log(as.status(k))
 		}
 	}
 }
 
+// status returns the stats line of an archive, with the capabilities its
+// mover registered with.
+func (as *ActionStats) status(archive int) string {
+	return fmt.Sprintf("archive:%d %s %s", archive, as.capabilities(archive), as.GetIndex(archive))
+}
+
+// RegisterArchive marks an archive's stats as changed, so the next stats
+// line reports the capabilities of the mover that just registered for it,
+// even before it has handled any actions.
+func (as *ActionStats) RegisterArchive(archive int) {
+	atomic.AddUint64(&as.GetIndex(archive).changes, 1)
+}
+
+func (as *ActionStats) capabilities(archive int) *Capabilities {
+	if as.endpoints == nil {
+		return nil
+	}
+	return as.endpoints.Capabilities(uint32(archive))
+}
+
 func (as *ActionStats) run(ctx context.Context) {
 	for {
 		select {
@@ -75,12 +119,31 @@ func (as *ActionStats) StartAction(a *Action) {
 	atomic.AddUint64(&s.changes, 1)
 }
 
-// CompleteAction updates various stats when an action is complete
-func (as *ActionStats) CompleteAction(a *Action, rc int) {
+// CompleteAction updates various stats when an action is complete. The
+// length is the number of bytes moved by the action, as reported in its
+// final status, and rc is the errno it completed with.
+func (as *ActionStats) CompleteAction(a *Action, length int64, rc int) {
 	s := as.GetIndex(int(a.aih.ArchiveID()))
 	s.queueLength.Dec(1)
 	s.completed.UpdateSince(a.start)
+	if op, ok := s.ops[actionCommand(a.aih)]; ok {
+		op.complete(length, rc)
+	}
 	atomic.AddUint64(&s.changes, 1)
+
+	atomic.AddInt64(&as.completed, 1)
+	atomic.AddInt64(&as.latency, int64(time.Since(a.start)))
+	if rc != 0 {
+		atomic.AddInt64(&as.failed, 1)
+	}
+}
+
+// Totals returns the number of actions completed and failed, and their
+// total latency, across all archives since the agent started.
+func (as *ActionStats) Totals() (completed, failed int64, latency time.Duration) {
+	return atomic.LoadInt64(&as.completed),
+		atomic.LoadInt64(&as.failed),
+		time.Duration(atomic.LoadInt64(&as.latency))
 }
 
 // GetIndex returns the *ArchiveStats corresponding to the supplied archive
@@ -93,9 +156,13 @@ func (as *ActionStats) GetIndex(i int) *ArchiveStats {
 		s = &ArchiveStats{
 			queueLength: metrics.NewCounter(),
 			completed:   metrics.NewTimer(),
+			ops:         make(map[pb.Command]*OpStats),
 		}
 		metrics.Register(fmt.Sprintf("archive%dCompleted", i), s.completed)
 		metrics.Register(fmt.Sprintf("archive%dQueueLength", i), s.queueLength)
+		for _, cmd := range statsCommands {
+			s.ops[cmd] = newOpStats(fmt.Sprintf("archive%d%s", i, opName(cmd)))
+		}
 		as.stats[i] = s
 	}
 	return s
@@ -112,7 +179,100 @@ func (as *ActionStats) Archives() (v []int) {
 	return
 }
 
+// opName returns a metric name component for the command, e.g. "Archive"
+func opName(cmd pb.Command) string {
+	name := strings.ToLower(cmd.String())
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+func newOpStats(prefix string) *OpStats {
+	s := &OpStats{
+		prefix:     prefix,
+		succeeded:  metrics.NewCounter(),
+		failed:     metrics.NewCounter(),
+		errors:     make(map[int]metrics.Counter),
+		bytes:      metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015)),
+		throughput: metrics.NewMeter(),
+	}
+	metrics.Register(prefix+"Succeeded", s.succeeded)
+	metrics.Register(prefix+"Failed", s.failed)
+	metrics.Register(prefix+"Bytes", s.bytes)
+	metrics.Register(prefix+"Throughput", s.throughput)
+	return s
+}
+
+func (s *OpStats) complete(length int64, rc int) {
+	if rc != 0 {
+		s.failed.Inc(1)
+		s.errno(rc).Inc(1)
+		return
+	}
+	// Movers that don't report an actual length echo back the requested
+	// extent, which may be "to EOF".
+	if length < 0 {
+		length = 0
+	}
+	s.succeeded.Inc(1)
+	s.bytes.Update(length)
+	s.throughput.Mark(length)
+}
+
+// errno returns the counter for failures with the given errno, creating
+// and registering it on first use.
+func (s *OpStats) errno(rc int) metrics.Counter {
+	s.Lock()
+	defer s.Unlock()
+	c, ok := s.errors[rc]
+	if !ok {
+		c = metrics.NewCounter()
+		name := fmt.Sprintf("%sErrno%d", s.prefix, rc)
+		if rc < 0 {
+			name = fmt.Sprintf("%sErrnoUnknown", s.prefix)
+		}
+		metrics.Register(name, c)
+		s.errors[rc] = c
+	}
+	return c
+}
+
+func (s *OpStats) String() string {
+	s.Lock()
+	var errnos []int
+	for rc := range s.errors {
+		errnos = append(errnos, rc)
+	}
+	sort.Ints(errnos)
+	var errs []string
+	for _, rc := range errnos {
+		errs = append(errs, fmt.Sprintf("%d:%d", rc, s.errors[rc].Count()))
+	}
+	s.Unlock()
+
+	str := fmt.Sprintf("ok:%v fail:%v bytes:%v %v/s",
+		humanize.Comma(s.succeeded.Count()),
+		humanize.Comma(s.failed.Count()),
+		humanize.Bytes(uint64(s.bytes.Sum())),
+		humanize.Bytes(uint64(s.throughput.Rate1())))
+	if len(errs) > 0 {
+		str += " errno:" + strings.Join(errs, ",")
+	}
+	return str
+}
+
 func (s *ArchiveStats) String() string {
+	var buf bytes.Buffer
+	buf.WriteString(s.completedString())
+	for _, cmd := range statsCommands {
+		op := s.ops[cmd]
+		if op.succeeded.Count()+op.failed.Count() == 0 {
+			continue
+		}
+		fmt.Fprintf(&buf, " %s[%s]", strings.ToLower(cmd.String()), op)
+	}
+	return buf.String()
+}
+
+func (s *ArchiveStats) completedString() string {
 	ps := s.completed.Percentiles([]float64{0.5, .75, 0.95, 0.99, 0.999})
 	return fmt.Sprintf("total:%v queue:%v %v/%v/%v min:%v max:%v mean:%v median:%v 75%%:%v 95%%:%v 99%%:%v 99.9%%:%v",
 		humanize.Comma(s.completed.Count()),
@@ -0,0 +1,59 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package agent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOpStats(t *testing.T) {
+	s := newOpStats("testArchive")
+
+	s.complete(1024, 0)
+	s.complete(-1, 0)
+	s.complete(0, 5)
+	s.complete(0, 5)
+	s.complete(0, -1)
+
+	if s.succeeded.Count() != 2 {
+		t.Errorf("expected 2 successes, got %d", s.succeeded.Count())
+	}
+	if s.failed.Count() != 3 {
+		t.Errorf("expected 3 failures, got %d", s.failed.Count())
+	}
+	if s.errors[5].Count() != 2 || s.errors[-1].Count() != 1 {
+		t.Errorf("unexpected errno counts: %s", s)
+	}
+	if s.bytes.Sum() != 1024 {
+		t.Errorf("expected 1024 bytes, got %d", s.bytes.Sum())
+	}
+	if s.throughput.Count() != 1024 {
+		t.Errorf("expected 1024 bytes of throughput, got %d", s.throughput.Count())
+	}
+	if !strings.Contains(s.String(), "errno:-1:1,5:2") {
+		t.Errorf("errno breakdown missing from %q", s)
+	}
+}
+
+func TestActionStatsCapabilities(t *testing.T) {
+	as := NewActionStats()
+	as.endpoints = NewEndpoints()
+	as.endpoints.SetCapabilities(7, &Capabilities{
+		ProtocolVersion: 1,
+		MoverName:       "test",
+		Features:        []string{"partial_restore"},
+	})
+
+	// A newly registered archive is reported by the next stats line.
+	as.RegisterArchive(7)
+	if changes := as.GetIndex(7).changes; changes != 1 {
+		t.Errorf("expected 1 change after registration, got %d", changes)
+	}
+	if status := as.status(7); !strings.HasPrefix(status, "archive:7 mover:test/unknown") ||
+		!strings.Contains(status, "features:partial_restore") {
+		t.Errorf("capabilities missing from %q", status)
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package agent
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/logging/audit"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+const (
+	defaultAdaptiveInterval        = 10 // seconds
+	defaultAdaptiveMaxErrorPercent = 10
+
+	// Completion latency this many times the recent baseline is treated
+	// as a sign that the movers are overloaded.
+	latencyBackoffFactor = 2
+)
+
+type (
+	// throttle limits the number of actions in flight. Unlike a buffered
+	// channel, its limit can be changed while it is in use.
+	throttle struct {
+		mu      sync.Mutex
+		cond    *sync.Cond
+		limit   int
+		count   int
+		waiting int
+	}
+
+	// adaptiveSample is a snapshot of the agent's load over one interval.
+	adaptiveSample struct {
+		handlers  int
+		busy      int // Handlers processing an action
+		waiting   int // Handlers waiting for an in-flight slot
+		inFlight  int
+		limit     int
+		completed int64 // Actions completed during the interval
+		failed    int64
+		latency   time.Duration // Mean completion latency for the interval
+	}
+
+	// adaptiveController periodically resizes the agent's handler pool
+	// and in-flight window, within the configured bounds, based on how
+	// busy the handlers are and how quickly and reliably the movers are
+	// completing actions.
+	adaptiveController struct {
+		agent        *HsmAgent
+		interval     time.Duration
+		minHandlers  int
+		maxHandlers  int
+		minInFlight  int
+		maxInFlight  int
+		maxErrorRate float64
+
+		baseline      time.Duration
+		lastCompleted int64
+		lastFailed    int64
+		lastLatency   time.Duration
+
+		handlersGauge metrics.Gauge
+		limitGauge    metrics.Gauge
+		adjustments   metrics.Counter
+	}
+)
+
+func newThrottle(limit int) *throttle {
+	t := &throttle{limit: limit}
+	t.cond = sync.NewCond(&t.mu)
+	return t
+}
+
+// Acquire blocks until a slot is available and then takes it.
+func (t *throttle) Acquire() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.waiting++
+	for t.count >= t.limit {
+		t.cond.Wait()
+	}
+	t.waiting--
+	t.count++
+}
+
+// Release returns a slot taken by Acquire.
+func (t *throttle) Release() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.count--
+	t.cond.Broadcast()
+}
+
+// SetLimit changes the number of slots. Lowering the limit does not affect
+// slots that are already taken.
+func (t *throttle) SetLimit(limit int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.limit = limit
+	t.cond.Broadcast()
+}
+
+// Limit returns the current number of slots.
+func (t *throttle) Limit() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.limit
+}
+
+// Waiting returns the number of callers blocked in Acquire.
+func (t *throttle) Waiting() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.waiting
+}
+
+func clamp(n, lo, hi int) int {
+	if n < lo {
+		return lo
+	}
+	if n > hi {
+		return hi
+	}
+	return n
+}
+
+func newAdaptiveController(ct *HsmAgent) *adaptiveController {
+	cfg := ct.config.Adaptive
+	c := &adaptiveController{
+		agent:         ct,
+		interval:      time.Duration(cfg.Interval) * time.Second,
+		minHandlers:   cfg.MinHandlers,
+		maxHandlers:   cfg.MaxHandlers,
+		minInFlight:   cfg.MinInFlight,
+		maxInFlight:   cfg.MaxInFlight,
+		maxErrorRate:  float64(cfg.MaxErrorPercent) / 100,
+		handlersGauge: metrics.NewGauge(),
+		limitGauge:    metrics.NewGauge(),
+		adjustments:   metrics.NewCounter(),
+	}
+
+	if c.interval <= 0 {
+		c.interval = defaultAdaptiveInterval * time.Second
+	}
+	if c.minHandlers <= 0 {
+		c.minHandlers = 1
+	}
+	if c.maxHandlers <= 0 {
+		c.maxHandlers = ct.config.Processes * 4
+	}
+	if c.maxHandlers < c.minHandlers {
+		c.maxHandlers = c.minHandlers
+	}
+	if c.minInFlight <= 0 {
+		c.minInFlight = c.minHandlers
+	}
+	if c.maxInFlight <= 0 {
+		c.maxInFlight = c.maxHandlers * 10
+	}
+	if c.maxInFlight < c.minInFlight {
+		c.maxInFlight = c.minInFlight
+	}
+	if c.maxErrorRate <= 0 {
+		c.maxErrorRate = defaultAdaptiveMaxErrorPercent / 100.0
+	}
+
+	metrics.Register("adaptiveHandlers", c.handlersGauge)
+	metrics.Register("adaptiveInFlightLimit", c.limitGauge)
+	metrics.Register("adaptiveAdjustments", c.adjustments)
+	metrics.Register("adaptiveInFlight", metrics.NewFunctionalGauge(func() int64 {
+		return int64(ct.InFlight())
+	}))
+
+	return c
+}
+
+func (c *adaptiveController) String() string {
+	return fmt.Sprintf("handlers:%d-%d in-flight:%d-%d interval:%v max error rate:%v",
+		c.minHandlers, c.maxHandlers, c.minInFlight, c.maxInFlight, c.interval, c.maxErrorRate)
+}
+
+func (c *adaptiveController) run(ctx context.Context) {
+	audit.Logf("adaptive handler control enabled: %s", c)
+	c.lastCompleted, c.lastFailed, c.lastLatency = c.agent.stats.Totals()
+	c.apply(c.agent.Handlers(), c.agent.rpcsInFlight.Limit(), "initial bounds")
+	for {
+		select {
+		case <-ctx.Done():
+			debug.Print("Shutting down adaptive controller")
+			return
+		case <-time.After(c.interval):
+			handlers, limit, reason := c.decide(c.sample())
+			c.apply(handlers, limit, reason)
+		}
+	}
+}
+
+func (c *adaptiveController) sample() *adaptiveSample {
+	completed, failed, latency := c.agent.stats.Totals()
+	s := &adaptiveSample{
+		handlers:  c.agent.Handlers(),
+		busy:      int(atomic.LoadInt32(&c.agent.busyHandlers)),
+		waiting:   c.agent.rpcsInFlight.Waiting(),
+		inFlight:  c.agent.InFlight(),
+		limit:     c.agent.rpcsInFlight.Limit(),
+		completed: completed - c.lastCompleted,
+		failed:    failed - c.lastFailed,
+	}
+	if s.completed > 0 {
+		s.latency = (latency - c.lastLatency) / time.Duration(s.completed)
+	}
+	c.lastCompleted, c.lastFailed, c.lastLatency = completed, failed, latency
+	return s
+}
+
+// decide returns the new handler count and in-flight limit for a sample,
+// along with the reason for any change.
+func (c *adaptiveController) decide(s *adaptiveSample) (int, int, string) {
+	handlers, limit := s.handlers, s.limit
+
+	var errorRate float64
+	if s.completed > 0 {
+		errorRate = float64(s.failed) / float64(s.completed)
+	}
+
+	switch {
+	case s.completed > 0 && errorRate > c.maxErrorRate:
+		limit -= maxInt(1, limit/4)
+		handlers--
+		return clamp(handlers, c.minHandlers, c.maxHandlers),
+			clamp(limit, c.minInFlight, c.maxInFlight),
+			fmt.Sprintf("error rate %.2f", errorRate)
+	case s.completed > 0 && c.baseline > 0 && s.latency > latencyBackoffFactor*c.baseline:
+		limit -= maxInt(1, limit/4)
+		return handlers, clamp(limit, c.minInFlight, c.maxInFlight),
+			fmt.Sprintf("latency %v over baseline %v", s.latency, c.baseline)
+	}
+
+	if s.completed > 0 {
+		// Only healthy intervals contribute to the baseline
+		if c.baseline == 0 {
+			c.baseline = s.latency
+		} else {
+			c.baseline = (4*c.baseline + s.latency) / 5
+		}
+	}
+
+	var reason string
+	switch {
+	case s.waiting > 0 || s.inFlight >= s.limit:
+		// Handlers are blocked on the window, so more handlers
+		// won't help until it opens up.
+		limit += maxInt(1, limit/4)
+		reason = "in-flight window full"
+	case s.busy >= s.handlers:
+		handlers++
+		reason = "all handlers busy"
+	case s.busy == 0 && s.inFlight < s.limit/4:
+		handlers--
+		limit -= maxInt(1, limit/10)
+		reason = "idle"
+	}
+
+	return clamp(handlers, c.minHandlers, c.maxHandlers),
+		clamp(limit, c.minInFlight, c.maxInFlight),
+		reason
+}
+
+func (c *adaptiveController) apply(handlers, limit int, reason string) {
+	handlers = clamp(handlers, c.minHandlers, c.maxHandlers)
+	limit = clamp(limit, c.minInFlight, c.maxInFlight)
+
+	oldHandlers := c.agent.Handlers()
+	oldLimit := c.agent.rpcsInFlight.Limit()
+	if handlers != oldHandlers || limit != oldLimit {
+		audit.Logf("adaptive: handlers %d -> %d, in-flight limit %d -> %d (%s)",
+			oldHandlers, handlers, oldLimit, limit, reason)
+		c.adjustments.Inc(1)
+	}
+
+	for n := oldHandlers; n < handlers; n++ {
+		c.agent.addHandler()
+	}
+	for n := oldHandlers; n > handlers; n-- {
+		c.agent.removeHandler()
+	}
+	c.agent.rpcsInFlight.SetLimit(limit)
+
+	c.handlersGauge.Update(int64(handlers))
+	c.limitGauge.Update(int64(limit))
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func testController() *adaptiveController {
+	return &adaptiveController{
+		minHandlers:  2,
+		maxHandlers:  8,
+		minInFlight:  4,
+		maxInFlight:  100,
+		maxErrorRate: 0.1,
+	}
+}
+
+func TestAdaptiveDecide(t *testing.T) {
+	tests := []struct {
+		name     string
+		baseline time.Duration
+		sample   adaptiveSample
+		handlers int
+		limit    int
+	}{
+		{
+			name:     "window full",
+			sample:   adaptiveSample{handlers: 4, busy: 4, waiting: 2, inFlight: 40, limit: 40, completed: 10, latency: time.Second},
+			handlers: 4,
+			limit:    50,
+		},
+		{
+			name:     "handlers busy",
+			sample:   adaptiveSample{handlers: 4, busy: 4, inFlight: 20, limit: 40, completed: 10, latency: time.Second},
+			handlers: 5,
+			limit:    40,
+		},
+		{
+			name:     "idle",
+			sample:   adaptiveSample{handlers: 4, limit: 40},
+			handlers: 3,
+			limit:    36,
+		},
+		{
+			name:     "errors",
+			sample:   adaptiveSample{handlers: 4, busy: 4, waiting: 2, inFlight: 40, limit: 40, completed: 10, failed: 5, latency: time.Second},
+			handlers: 3,
+			limit:    30,
+		},
+		{
+			name:     "slow movers",
+			baseline: time.Second,
+			sample:   adaptiveSample{handlers: 4, busy: 4, waiting: 2, inFlight: 40, limit: 40, completed: 10, latency: 5 * time.Second},
+			handlers: 4,
+			limit:    30,
+		},
+		{
+			name:     "bounded",
+			sample:   adaptiveSample{handlers: 8, busy: 8, waiting: 8, inFlight: 100, limit: 100, completed: 10, latency: time.Second},
+			handlers: 8,
+			limit:    100,
+		},
+	}
+
+	for _, tc := range tests {
+		c := testController()
+		c.baseline = tc.baseline
+		handlers, limit, reason := c.decide(&tc.sample)
+		if handlers != tc.handlers || limit != tc.limit {
+			t.Errorf("%s: expected %d handlers/%d limit, got %d/%d (%s)",
+				tc.name, tc.handlers, tc.limit, handlers, limit, reason)
+		}
+	}
+}
+
+func TestThrottleSetLimit(t *testing.T) {
+	th := newThrottle(1)
+	th.Acquire()
+
+	acquired := make(chan struct{})
+	go func() {
+		th.Acquire()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("acquired slot beyond limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if th.Waiting() != 1 {
+		t.Fatalf("expected 1 waiter, got %d", th.Waiting())
+	}
+
+	th.SetLimit(2)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("raising the limit did not release waiter")
+	}
+}
@@ -20,7 +20,9 @@ package agent
 
 import (
 	"fmt"
+	"path"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -28,27 +30,44 @@ import (
 	"golang.org/x/net/context"
 	"golang.org/x/sys/unix"
 
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/policy"
 	"github.com/intel-hpdd/lemur/pkg/fsroot"
 	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/audit"
 	"github.com/intel-hpdd/logging/debug"
 	"github.com/intel-hpdd/go-lustre/fs"
 	"github.com/intel-hpdd/go-lustre/hsm"
 	"github.com/intel-hpdd/go-lustre/llapi"
 )
 
+const (
+	// hsmFlagRetry is HP_FLAG_RETRY from lustre_user.h. Ending an action
+	// with this flag set asks the coordinator to reschedule the request.
+	hsmFlagRetry = 0x02
+
+	drainReportInterval = 10 * time.Second
+)
+
 type (
 	// HsmAgent for a single filesytem and a collection of backends.
 	HsmAgent struct {
 		config        *Config
 		client        fsroot.Client
 		stats         *ActionStats
+		catalog       *policy.Catalog // Archive locations of files, for gc
 		wg            sync.WaitGroup
 		Endpoints     *Endpoints
 		mu            sync.Mutex // Protect the agent
 		actionSource  hsm.ActionSource
 		monitor       *PluginMonitor
 		cancelFunc    context.CancelFunc
-		rpcsInFlight  chan struct{} // Buffered channel to throttle rpcs in flight
+		rpcsInFlight  *throttle       // Limits the number of rpcs in flight
+		handlers      []chan struct{} // Quit channels for running handlers
+		nextHandler   int
+		busyHandlers  int32 // Handlers currently processing an action
+		inFlight      map[ActionID]*Action
+		stopOnce      sync.Once
+		stopping      chan struct{} // Closed when the agent should begin draining
 		startComplete chan struct{} // Closed when agent startup is completed
 		stopComplete  chan struct{} // Closed when agent shutdown is completed
 	}
@@ -65,7 +84,9 @@ func New(cfg *Config, client fsroot.Client, as hsm.ActionSource) (*HsmAgent, err
 	ct := &HsmAgent{
 		config:        cfg,
 		client:        client,
-		rpcsInFlight:  make(chan struct{}, cfg.Processes*10),
+		rpcsInFlight:  newThrottle(cfg.Processes * 10),
+		inFlight:      make(map[ActionID]*Action),
+		stopping:      make(chan struct{}),
 		stats:         NewActionStats(),
 		monitor:       NewMonitor(),
 		actionSource:  as,
@@ -73,6 +94,15 @@ func New(cfg *Config, client fsroot.Client, as hsm.ActionSource) (*HsmAgent, err
 		startComplete: make(chan struct{}),
 		stopComplete:  make(chan struct{}),
 	}
+	ct.stats.endpoints = ct.Endpoints
+
+	if cfg.GC.Enabled {
+		catalog, err := policy.NewCatalog(path.Join(cfg.GC.StateDir, "catalog"))
+		if err != nil {
+			return nil, err
+		}
+		ct.catalog = catalog
+	}
 
 	return ct, nil
 }
@@ -84,22 +114,32 @@ func (ct *HsmAgent) Start(ctx context.Context) error {
 	ct.mu.Unlock()
 	ct.stats.Start(ctx)
 
-	if t, ok := transports[ct.config.Transport.Type]; ok {
-		if err := t.Init(ct.config, ct); err != nil {
-			return errors.Wrapf(err, "transport %q initialize failed", ct.config.Transport.Type)
-		}
-	} else {
+	t, ok := transports[ct.config.Transport.Type]
+	if !ok {
 		return errors.Errorf("unknown transport type in configuration: %s", ct.config.Transport.Type)
 	}
+	if err := t.Init(ct.config, ct); err != nil {
+		return errors.Wrapf(err, "transport %q initialize failed", ct.config.Transport.Type)
+	}
 
-	if err := ct.actionSource.Start(ctx); err != nil {
+	// The action source gets its own context so that intake can be
+	// stopped independently of the rest of the agent while draining.
+	intakeCtx, stopIntake := context.WithCancel(ctx)
+	defer stopIntake()
+	if err := ct.actionSource.Start(intakeCtx); err != nil {
 		return errors.Wrap(err, "initializing HSM agent connection")
 	}
 
 	for i := 0; i < ct.config.Processes; i++ {
-		ct.addHandler(fmt.Sprintf("handler-%d", i))
+		ct.addHandler()
 	}
 
+	stopAdaptive := func() {}
+	if ct.config.Adaptive.Enabled {
+		stopAdaptive = background(ctx, newAdaptiveController(ct).run)
+	}
+	defer stopAdaptive()
+
 	ct.monitor.Start(ctx)
 	for _, pluginConf := range ct.config.Plugins() {
 		err := ct.monitor.StartPlugin(pluginConf)
@@ -107,19 +147,174 @@ func (ct *HsmAgent) Start(ctx context.Context) error {
 			return errors.Wrapf(err, "creating plugin %q", pluginConf.Name)
 		}
 	}
+
+	stopPolicy := func() {}
+	if ct.config.Policy.Enabled {
+		svc, err := policy.New(ct.config.Policy, ct.Root())
+		if err != nil {
+			return errors.Wrap(err, "creating policy service")
+		}
+		stopPolicy = background(ctx, svc.Run)
+	}
+	defer stopPolicy()
+
+	stopRelease := func() {}
+	if ct.config.Release.Enabled {
+		svc, err := policy.NewRelease(ct.config.Release, ct.Root())
+		if err != nil {
+			return errors.Wrap(err, "creating release service")
+		}
+		stopRelease = background(ctx, svc.Run)
+	}
+	defer stopRelease()
+
+	stopGC := func() {}
+	if ct.config.GC.Enabled {
+		svc, err := policy.NewGC(ct.config.GC, ct.catalog, ct)
+		if err != nil {
+			return errors.Wrap(err, "creating gc service")
+		}
+		stopGC = background(ctx, svc.Run)
+	}
+	defer stopGC()
+
+	stopScrub := func() {}
+	if ct.config.Scrub.Enabled {
+		svc, err := policy.NewScrub(ct.config.Scrub, ct.Root(), ct)
+		if err != nil {
+			return errors.Wrap(err, "creating scrub service")
+		}
+		stopScrub = background(ctx, svc.Run)
+	}
+	defer stopScrub()
 	close(ct.startComplete)
+
+	select {
+	case <-ct.stopping:
+	case <-ctx.Done():
+	}
+
+	// Stop submitting new work before draining.
+	stopPolicy()
+	stopRelease()
+	stopGC()
+	stopScrub()
+
+	// Handlers must not be added once the drain has started.
+	stopAdaptive()
+
+	ct.drain(time.Duration(ct.config.DrainTimeout) * time.Second)
+	stopIntake()
 	ct.wg.Wait()
+	// A handler may have been blocked waiting for an rpc slot while
+	// the drain was in progress.
+	ct.requeueInFlight()
+
+	if err := ct.monitor.StopPlugins(time.Duration(PluginStopTimeout) * time.Second); err != nil {
+		alert.Warnf("stopping plugins: %v", err)
+	}
+	t.Shutdown()
+	ct.cancelFunc()
 	close(ct.stopComplete)
 	return nil
 }
 
-// Stop shuts down all backend data movers and kills the agent
+// background runs fn in a new goroutine. The returned function cancels
+// fn's context and waits for it to return; it may be called more than once.
+func background(ctx context.Context, fn func(context.Context)) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		fn(ctx)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// Stop stops accepting new actions, waits for in-flight actions to drain,
+// then shuts down all backend data movers and the agent.
 func (ct *HsmAgent) Stop() {
+	ct.stopOnce.Do(func() {
+		audit.Logf("stopping agent, draining %d actions in flight", ct.InFlight())
+		close(ct.stopping)
+	})
+	<-ct.stopComplete
+}
+
+// InFlight returns the number of actions currently being handled by movers.
+func (ct *HsmAgent) InFlight() int {
 	ct.mu.Lock()
-	ct.cancelFunc()
+	defer ct.mu.Unlock()
+	return len(ct.inFlight)
+}
+
+func (ct *HsmAgent) draining() bool {
+	select {
+	case <-ct.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// drain waits up to timeout for in-flight actions to complete. Any actions
+// remaining after that are ended with a retryable error so the coordinator
+// can reschedule them.
+func (ct *HsmAgent) drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	lastReport := time.Now()
+	for n := ct.InFlight(); n > 0; n = ct.InFlight() {
+		if time.Now().After(deadline) {
+			audit.Logf("drain timed out after %v with %d actions in flight", timeout, n)
+			break
+		}
+		if time.Since(lastReport) >= drainReportInterval {
+			audit.Logf("draining: %d actions in flight", n)
+			lastReport = time.Now()
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	ct.requeueInFlight()
+}
+
+func (ct *HsmAgent) requeueInFlight() {
+	ct.mu.Lock()
+	var actions []*Action
+	for _, action := range ct.inFlight {
+		actions = append(actions, action)
+	}
 	ct.mu.Unlock()
-	transports[ct.config.Transport.Type].Shutdown()
-	<-ct.stopComplete
+
+	for _, action := range actions {
+		if err := action.Requeue(); err != nil {
+			alert.Warnf("id:%d requeue failed: %v", action.id, err)
+		}
+	}
+}
+
+// trackAction reserves an rpc slot for the action, blocking until one is
+// available.
+func (ct *HsmAgent) trackAction(action *Action) {
+	ct.rpcsInFlight.Acquire()
+	ct.mu.Lock()
+	ct.inFlight[action.id] = action
+	ct.mu.Unlock()
+}
+
+// untrackAction releases the action's rpc slot. It returns false if the
+// action was already released, in which case the caller must not End it.
+func (ct *HsmAgent) untrackAction(action *Action) bool {
+	ct.mu.Lock()
+	_, ok := ct.inFlight[action.id]
+	delete(ct.inFlight, action.id)
+	ct.mu.Unlock()
+	if ok {
+		ct.rpcsInFlight.Release()
+	}
+	return ok
 }
 
 // StartWaitFor will wait for Agent to startup with time out of n.
@@ -133,6 +328,14 @@ func (ct *HsmAgent) StartWaitFor(n time.Duration) error {
 
 }
 
+// RegisterCapabilities records the capabilities a mover reported when it
+// registered for an archive.
+func (ct *HsmAgent) RegisterCapabilities(archive uint32, caps *Capabilities) {
+	ct.Endpoints.SetCapabilities(archive, caps)
+	ct.stats.RegisterArchive(int(archive))
+	audit.Logf("archive:%d registered %s", archive, caps)
+}
+
 // Root returns a fs.RootDir representing the Lustre filesystem root
 func (ct *HsmAgent) Root() fs.RootDir {
 	return ct.client.Root()
@@ -147,47 +350,112 @@ func (ct *HsmAgent) newAction(aih hsm.ActionHandle) *Action {
 	}
 }
 
-func (ct *HsmAgent) handleActions(tag string) {
-	for ai := range ct.actionSource.Actions() {
-		debug.Printf("%s: incoming: %s", tag, ai)
-		// AFAICT, this is how the copytool is expected to handle cancels.
-		if ai.Action() == llapi.HsmActionCancel {
-			ai.FailImmediately(int(unix.ENOSYS))
-			// TODO: send out of band cancel message to the mover
-			continue
-		}
-		aih, err := ai.Begin(0, false)
-		if err != nil {
-			alert.Warnf("%s: begin failed: %v: %s", tag, err, ai)
-			ai.FailImmediately(int(unix.EIO))
-			continue
-		}
-		action := ct.newAction(aih)
-		ct.rpcsInFlight <- struct{}{}
-		ct.stats.StartAction(action)
-		action.Prepare()
-		if e, ok := ct.Endpoints.Get(uint32(aih.ArchiveID())); ok {
-			debug.Printf("%s: id:%d new %s %x %v", tag, action.id,
-				action.aih.Action(),
-				action.aih.Cookie(),
-				action.aih.Fid())
-			e.Send(action)
-		} else {
-			alert.Warnf("no handler for archive %d", aih.ArchiveID())
-			action.Fail(-1)
-			ct.stats.CompleteAction(action, -1)
+func (ct *HsmAgent) handleActions(tag string, quit <-chan struct{}) {
+	for {
+		select {
+		case <-quit:
+			debug.Printf("%s: stopping", tag)
+			return
+		case ai, ok := <-ct.actionSource.Actions():
+			if !ok {
+				return
+			}
+			atomic.AddInt32(&ct.busyHandlers, 1)
+			ct.handleAction(tag, ai)
+			atomic.AddInt32(&ct.busyHandlers, -1)
 		}
 	}
 }
 
-func (ct *HsmAgent) addHandler(tag string) {
+func (ct *HsmAgent) handleAction(tag string, ai hsm.ActionRequest) {
+	debug.Printf("%s: incoming: %s", tag, ai)
+	// AFAICT, this is how the copytool is expected to handle cancels.
+	if ai.Action() == llapi.HsmActionCancel {
+		ai.FailImmediately(int(unix.ENOSYS))
+		// TODO: send out of band cancel message to the mover
+		return
+	}
+	if ct.draining() {
+		debug.Printf("%s: draining, requeue: %s", tag, ai)
+		requeueRequest(ai)
+		return
+	}
+	caps := ct.Endpoints.Capabilities(uint32(ai.ArchiveID()))
+	if !caps.Supports(hsm2Command(ai.Action())) {
+		alert.Warnf("%s: archive %d mover does not support %s: %s", tag, ai.ArchiveID(), ai.Action(), ai)
+		ai.FailImmediately(int(unix.EOPNOTSUPP))
+		return
+	}
+	aih, err := ai.Begin(0, false)
+	if err != nil {
+		alert.Warnf("%s: begin failed: %v: %s", tag, err, ai)
+		ai.FailImmediately(int(unix.EIO))
+		return
+	}
+	action := ct.newAction(aih)
+	ct.trackAction(action)
+	ct.stats.StartAction(action)
+	action.Prepare()
+	if e, ok := ct.Endpoints.Get(uint32(aih.ArchiveID())); ok {
+		debug.Printf("%s: id:%d new %s %x %v", tag, action.id,
+			action.aih.Action(),
+			action.aih.Cookie(),
+			action.aih.Fid())
+		e.Send(action)
+	} else {
+		alert.Warnf("no handler for archive %d", aih.ArchiveID())
+		action.Fail(-1)
+	}
+}
+
+// requeueRequest returns a request to the coordinator without starting it.
+func requeueRequest(ai hsm.ActionRequest) {
+	aih, err := ai.Begin(0, true)
+	if err != nil {
+		debug.Printf("requeue begin failed: %v: %s", err, ai)
+		return
+	}
+	if err := aih.End(0, 0, hsmFlagRetry, int(unix.EAGAIN)); err != nil {
+		debug.Printf("requeue end failed: %v: %s", err, ai)
+	}
+}
+
+func (ct *HsmAgent) addHandler() {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	quit := make(chan struct{})
+	ct.handlers = append(ct.handlers, quit)
+	ct.nextHandler++
+	tag := fmt.Sprintf("handler-%d", ct.nextHandler-1)
+
 	ct.wg.Add(1)
 	go func() {
-		ct.handleActions(tag)
+		ct.handleActions(tag, quit)
 		ct.wg.Done()
 	}()
 }
 
+// removeHandler stops the most recently added handler once it has finished
+// with its current action.
+func (ct *HsmAgent) removeHandler() {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if len(ct.handlers) == 0 {
+		return
+	}
+	close(ct.handlers[len(ct.handlers)-1])
+	ct.handlers = ct.handlers[:len(ct.handlers)-1]
+}
+
+// Handlers returns the number of running action handlers.
+func (ct *HsmAgent) Handlers() int {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return len(ct.handlers)
+}
+
 var transports = map[string]Transport{}
 
 // RegisterTransport registers the transport in the list of known transports
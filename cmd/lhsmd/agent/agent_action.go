@@ -5,16 +5,18 @@
 package agent
 
 import (
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 
 	"github.com/intel-hpdd/lemur/cmd/lhsmd/agent/fileid"
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/policy"
 	pb "github.com/intel-hpdd/lemur/pdm"
+	"github.com/intel-hpdd/lemur/pkg/checksum"
 	"github.com/intel-hpdd/logging/alert"
 	"github.com/intel-hpdd/logging/audit"
 	"github.com/intel-hpdd/logging/debug"
@@ -75,6 +77,20 @@ func hsm2Command(a llapi.HsmAction) (c pb.Command) {
 	return
 }
 
+// commandHandle is implemented by the handles of actions the agent
+// generates itself, whose command may have no HSM action.
+type commandHandle interface {
+	Command() pb.Command
+}
+
+// actionCommand returns the command of the action.
+func actionCommand(aih hsm.ActionHandle) pb.Command {
+	if ch, ok := aih.(commandHandle); ok {
+		return ch.Command()
+	}
+	return hsm2Command(aih.Action())
+}
+
 // Handle returns the raw hsm.ActionHandle (temporary function until queue
 // transport is updated)
 func (action *Action) Handle() hsm.ActionHandle {
@@ -123,6 +139,9 @@ func (action *Action) Prepare() error {
 		switch action.aih.Action() {
 		case llapi.HsmActionRestore, llapi.HsmActionRemove:
 			uuid, err := fileid.UUID.GetByFid(action.agent.Root(), action.aih.Fid())
+			if err != nil && action.prepareFromCatalog() {
+				break
+			}
 			if err != nil {
 				alert.Warnf("Error reading UUID: %v (%v)", err, action)
 			} else {
@@ -133,11 +152,11 @@ func (action *Action) Prepare() error {
 			if err != nil {
 				debug.Printf("Error reading Hash: %v (%v)", err, action)
 			}
-			hash := make([]byte, hex.DecodedLen(len(buf)))
-			_, err = hex.Decode(hash, buf)
-			action.Hash = hash
-			if err != nil {
-				debug.Printf("Error decoding Hash: %v (%v)", err, action)
+			if len(buf) > 0 {
+				action.Hash, err = checksum.Parse(string(buf))
+				if err != nil {
+					debug.Printf("Error decoding Hash: %v (%v)", err, action)
+				}
 			}
 
 			url, err := fileid.URL.GetByFid(action.agent.Root(), action.aih.Fid())
@@ -152,11 +171,56 @@ func (action *Action) Prepare() error {
 	return nil
 }
 
+// prepareFromCatalog sets the archive location of a file being removed
+// after it was deleted, when its fileid attributes can no longer be read.
+// It returns false if the file isn't in the catalog.
+func (action *Action) prepareFromCatalog() bool {
+	if action.agent.catalog == nil || action.aih.Action() != llapi.HsmActionRemove {
+		return false
+	}
+	e, err := action.agent.catalog.Get(action.aih.Fid())
+	if err != nil {
+		return false
+	}
+	debug.Printf("found fileID in catalog: %s (%v)", e.UUID, action)
+	action.UUID = e.UUID
+	action.Hash = e.Hash
+	action.URL = e.URL
+	return true
+}
+
+// updateCatalog records the archive location of a newly archived file,
+// and forgets the location of a removed one.
+func (action *Action) updateCatalog(status *pb.ActionStatus) {
+	catalog := action.agent.catalog
+	if catalog == nil || status.Error != 0 {
+		return
+	}
+	var err error
+	switch action.aih.Action() {
+	case llapi.HsmActionArchive:
+		if status.Uuid == "" {
+			return
+		}
+		err = catalog.Put(action.aih.Fid(), &policy.CatalogEntry{
+			ArchiveID: action.aih.ArchiveID(),
+			UUID:      status.Uuid,
+			URL:       status.Url,
+			Hash:      status.Hash,
+		})
+	case llapi.HsmActionRemove:
+		err = catalog.Delete(action.aih.Fid())
+	}
+	if err != nil {
+		alert.Warnf("id:%d catalog update failed: %v", action.id, err)
+	}
+}
+
 // AsMessage returns the protobuf version of an Action.
 func (action *Action) AsMessage() *pb.ActionItem {
 	msg := &pb.ActionItem{
 		Id:          uint64(action.id),
-		Op:          hsm2Command(action.aih.Action()),
+		Op:          actionCommand(action.aih),
 		PrimaryPath: fs.FidRelativePath(action.aih.Fid()),
 		Offset:      action.aih.Offset(),
 		Length:      action.aih.Length(),
@@ -193,24 +257,27 @@ func (action *Action) Update(status *pb.ActionStatus) (bool, error) {
 		duration := time.Since(action.start)
 		debug.Printf("id:%d completed status: %v in %v", status.Id, status.Error, duration)
 
+		if !action.agent.untrackAction(action) {
+			debug.Printf("id:%d already ended, ignoring completion", status.Id)
+			return true, nil
+		}
 		if status.Uuid != "" {
 			fileid.UUID.UpdateByFid(action.agent.Root(), action.aih.Fid(), []byte(status.Uuid))
 		}
 		if status.Hash != nil {
-			buf := make([]byte, hex.EncodedLen(len(status.Hash)))
-			hex.Encode(buf, status.Hash)
+			buf := []byte(checksum.Format(status.Hash))
 			fileid.Hash.UpdateByFid(action.agent.Root(), action.aih.Fid(), buf)
 		}
 		if status.Url != "" {
 			fileid.URL.UpdateByFid(action.agent.Root(), action.aih.Fid(), []byte(status.Url))
 		}
-		action.agent.stats.CompleteAction(action, int(status.Error))
+		action.agent.stats.CompleteAction(action, status.Length, int(status.Error))
 		err := action.aih.End(status.Offset, status.Length, 0, int(status.Error))
 		if err != nil {
 			audit.Logf("id:%d completion failed: %v", status.Id, err)
 			return true, err // Completed, but Failed. Internal HSM state is not updated
 		}
-		<-action.agent.rpcsInFlight
+		action.updateCatalog(status)
 		if action.aih.Action() == llapi.HsmActionArchive && action.agent.config.Snapshots.Enabled && status.Uuid != "" {
 			createSnapshot(action.agent.Root(), action.aih.ArchiveID(), action.aih.Fid(), []byte(status.Uuid))
 		}
@@ -219,13 +286,14 @@ func (action *Action) Update(status *pb.ActionStatus) (bool, error) {
 	err := action.aih.Progress(status.Offset, status.Length, action.aih.Length(), 0)
 	if err != nil {
 		debug.Printf("id:%d progress update failed: %v", status.Id, err)
-		action.agent.stats.CompleteAction(action, -1)
+		if !action.agent.untrackAction(action) {
+			return false, err
+		}
+		action.agent.stats.CompleteAction(action, 0, -1)
 		if err2 := action.aih.End(0, 0, 0, -1); err2 != nil {
-			<-action.agent.rpcsInFlight
 			debug.Printf("id:%d completion after error failed: %v", status.Id, err2)
 			return false, fmt.Errorf("err: %s/err2: %s", err, err2)
 		}
-		<-action.agent.rpcsInFlight
 		return false, err // Incomplete Failed Action
 	}
 
@@ -235,12 +303,26 @@ func (action *Action) Update(status *pb.ActionStatus) (bool, error) {
 // Fail signals that the action has failed
 func (action *Action) Fail(rc int) error {
 	audit.Logf("id:%d fail %x %v: %v", action.id, action.aih.Cookie(), action.aih.Fid(), rc)
-	action.agent.stats.CompleteAction(action, rc)
-	err := action.aih.End(0, 0, 0, rc)
+	return action.end(0, rc)
+}
+
+// Requeue ends the action with a retryable error so that the coordinator
+// will reschedule it. This is used for actions that could not be completed
+// before the agent shut down.
+func (action *Action) Requeue() error {
+	audit.Logf("id:%d requeue %x %v", action.id, action.aih.Cookie(), action.aih.Fid())
+	return action.end(hsmFlagRetry, int(unix.EAGAIN))
+}
+
+func (action *Action) end(flags, rc int) error {
+	if !action.agent.untrackAction(action) {
+		debug.Printf("id:%d already ended", action.id)
+		return nil
+	}
+	action.agent.stats.CompleteAction(action, 0, rc)
+	err := action.aih.End(0, 0, flags, rc)
 	if err != nil {
 		audit.Logf("id:%d fail after fail %x: %v", action.id, action.aih.Cookie(), err)
 	}
-	<-action.agent.rpcsInFlight
 	return errors.Wrap(err, "end action failed")
-
 }
@@ -10,8 +10,12 @@ import (
 
 	"github.com/intel-hpdd/lemur/cmd/lhsmd/agent"
 	_ "github.com/intel-hpdd/lemur/cmd/lhsmd/transport/grpc"
+	pb "github.com/intel-hpdd/lemur/pdm"
 	"github.com/intel-hpdd/lemur/pkg/fsroot"
+	"github.com/intel-hpdd/go-lustre"
 	"github.com/intel-hpdd/go-lustre/hsm"
+	"github.com/intel-hpdd/go-lustre/llapi"
+	"golang.org/x/sys/unix"
 
 	"golang.org/x/net/context"
 )
@@ -36,3 +40,88 @@ func TestAgentStartStop(t *testing.T) {
 
 	ta.Stop()
 }
+
+type testEndpoint struct {
+	actions chan *agent.Action
+}
+
+func (ep *testEndpoint) Send(action *agent.Action) {
+	ep.actions <- action
+}
+
+func startDrainAgent(t *testing.T, drainTimeout int) (*agent.HsmAgent, *hsm.TestSource, *testEndpoint) {
+	cfg := agent.DefaultConfig()
+	cfg.Transport.SocketDir = "/tmp"
+	cfg.DrainTimeout = drainTimeout
+	as := hsm.NewTestSource()
+	ta, err := agent.New(cfg, fsroot.Test(cfg.AgentMountpoint()), as)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep := &testEndpoint{actions: make(chan *agent.Action, 1)}
+	if _, err := ta.Endpoints.Add(1, ep); err != nil {
+		t.Fatal(err)
+	}
+
+	go ta.Start(context.Background())
+	if err := ta.StartWaitFor(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	return ta, as, ep
+}
+
+func TestAgentDrainCompletes(t *testing.T) {
+	ta, as, ep := startDrainAgent(t, 30)
+
+	req := hsm.NewTestRequest(1, llapi.HsmActionArchive, &lustre.Fid{}, nil)
+	as.Inject(req)
+	action := <-ep.actions
+
+	stopped := make(chan struct{})
+	go func() {
+		ta.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		t.Fatal("agent stopped with an action in flight")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	go action.Update(&pb.ActionStatus{Id: uint64(action.ID()), Completed: true})
+	update := <-req.ProgressUpdates()
+	if !update.Complete || update.Errval != 0 {
+		t.Fatalf("unexpected completion: %s errval: %d", update, update.Errval)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent did not stop after in-flight action completed")
+	}
+}
+
+func TestAgentDrainTimeout(t *testing.T) {
+	ta, as, ep := startDrainAgent(t, 1)
+
+	req := hsm.NewTestRequest(1, llapi.HsmActionArchive, &lustre.Fid{}, nil)
+	as.Inject(req)
+	<-ep.actions
+
+	stopped := make(chan struct{})
+	go func() {
+		ta.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case update := <-req.ProgressUpdates():
+		if !update.Complete || update.Errval != int(unix.EAGAIN) || update.Flags&0x02 == 0 {
+			t.Fatalf("expected retryable completion, got: %s errval: %d flags: %x", update, update.Errval, update.Flags)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight action was not ended after drain timeout")
+	}
+	<-stopped
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package agent
+
+import (
+	"fmt"
+	"strings"
+
+	pb "github.com/intel-hpdd/lemur/pdm"
+)
+
+// Capabilities describes what a data mover reported about itself when it
+// registered with the agent.
+type Capabilities struct {
+	ProtocolVersion uint32
+	MoverName       string
+	MoverVersion    string
+	Commands        []pb.Command
+	Features        []string
+}
+
+// NewCapabilities returns the Capabilities advertised in an Endpoint
+// registration.
+func NewCapabilities(e *pb.Endpoint) *Capabilities {
+	return &Capabilities{
+		ProtocolVersion: e.ProtocolVersion,
+		MoverName:       e.MoverName,
+		MoverVersion:    e.MoverVersion,
+		Commands:        e.Commands,
+		Features:        e.Features,
+	}
+}
+
+// Legacy returns true if the mover predates capability negotiation.
+func (c *Capabilities) Legacy() bool {
+	return c == nil || c.ProtocolVersion == 0
+}
+
+// Supports returns true if the mover is able to handle the command. Legacy
+// movers did not report their commands, so they are assumed to support all
+// of them.
+func (c *Capabilities) Supports(cmd pb.Command) bool {
+	if c.Legacy() {
+		return true
+	}
+	for _, supported := range c.Commands {
+		if supported == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// HasFeature returns true if the mover reported support for the named
+// optional feature.
+func (c *Capabilities) HasFeature(feature string) bool {
+	if c == nil {
+		return false
+	}
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Capabilities) String() string {
+	if c == nil {
+		return "mover:unregistered"
+	}
+	if c.Legacy() {
+		return "mover:legacy protocol:0"
+	}
+
+	var commands []string
+	for _, cmd := range c.Commands {
+		commands = append(commands, cmd.String())
+	}
+	features := "none"
+	if len(c.Features) > 0 {
+		features = strings.Join(c.Features, ",")
+	}
+	version := c.MoverVersion
+	if version == "" {
+		version = "unknown"
+	}
+
+	return fmt.Sprintf("mover:%s/%s protocol:%d commands:%s features:%s",
+		c.MoverName, version, c.ProtocolVersion,
+		strings.Join(commands, ","), features)
+}
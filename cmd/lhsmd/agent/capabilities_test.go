@@ -0,0 +1,71 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package agent
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "github.com/intel-hpdd/lemur/pdm"
+)
+
+func TestCapabilitiesSupports(t *testing.T) {
+	var unregistered *Capabilities
+	legacy := NewCapabilities(&pb.Endpoint{Archive: 1})
+	current := NewCapabilities(&pb.Endpoint{
+		Archive:         1,
+		ProtocolVersion: 1,
+		Commands:        []pb.Command{pb.Command_ARCHIVE, pb.Command_REMOVE},
+		Features:        []string{"checksums"},
+	})
+
+	for _, cmd := range []pb.Command{pb.Command_ARCHIVE, pb.Command_RESTORE, pb.Command_REMOVE} {
+		if !unregistered.Supports(cmd) {
+			t.Errorf("unregistered mover should support %s", cmd)
+		}
+		if !legacy.Supports(cmd) {
+			t.Errorf("legacy mover should support %s", cmd)
+		}
+	}
+
+	if !current.Supports(pb.Command_ARCHIVE) || !current.Supports(pb.Command_REMOVE) {
+		t.Errorf("%s should support ARCHIVE and REMOVE", current)
+	}
+	if current.Supports(pb.Command_RESTORE) {
+		t.Errorf("%s should not support RESTORE", current)
+	}
+	if !current.HasFeature("checksums") || current.HasFeature("cancel") {
+		t.Errorf("unexpected features: %s", current)
+	}
+	if legacy.HasFeature("checksums") {
+		t.Errorf("legacy mover should not report features")
+	}
+}
+
+func TestCapabilitiesRoundTrip(t *testing.T) {
+	sent := &pb.Endpoint{
+		FsUrl:           "lustre",
+		Archive:         2,
+		ProtocolVersion: 1,
+		Commands:        []pb.Command{pb.Command_ARCHIVE, pb.Command_RESTORE},
+		MoverName:       "lhsm-plugin-posix",
+		MoverVersion:    "1.0",
+		Features:        []string{"checksums"},
+	}
+	buf, err := proto.Marshal(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got pb.Endpoint
+	if err := proto.Unmarshal(buf, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(NewCapabilities(sent), NewCapabilities(&got)) {
+		t.Fatalf("expected %s, got %s", NewCapabilities(sent), NewCapabilities(&got))
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/intel-hpdd/lemur/cmd/lhsmd/config"
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/policy"
 	"github.com/intel-hpdd/logging/alert"
 	"github.com/intel-hpdd/logging/debug"
 	"github.com/intel-hpdd/go-lustre/fs/spec"
@@ -46,6 +47,16 @@ type (
 		Enabled bool `hcl:"enabled"`
 	}
 
+	adaptiveConfig struct {
+		Enabled         bool `hcl:"enabled" json:"enabled"`
+		MinHandlers     int  `hcl:"min_handlers" json:"min_handlers"`
+		MaxHandlers     int  `hcl:"max_handlers" json:"max_handlers"`
+		MinInFlight     int  `hcl:"min_in_flight" json:"min_in_flight"`
+		MaxInFlight     int  `hcl:"max_in_flight" json:"max_in_flight"`
+		Interval        int  `hcl:"interval" json:"interval"`
+		MaxErrorPercent int  `hcl:"max_error_percent" json:"max_error_percent"`
+	}
+
 	clientMountOptions []string
 
 	// Config represents HSM Agent configuration
@@ -56,13 +67,21 @@ type (
 
 		Processes int `hcl:"handler_count" json:"handler_count"`
 
+		DrainTimeout int `hcl:"drain_timeout" json:"drain_timeout"`
+
+		Adaptive *adaptiveConfig `hcl:"adaptive" json:"adaptive"`
+
 		InfluxDB *influxConfig `hcl:"influxdb" json:"influxdb"`
 
 		EnabledPlugins []string `hcl:"enabled_plugins" json:"enabled_plugins"`
 		PluginDir      string   `hcl:"plugin_dir" json:"plugin_dir"`
 
-		Snapshots *snapshotConfig  `hcl:"snapshots" json:"snapshots"`
-		Transport *transportConfig `hcl:"transport" json:"transport"`
+		Snapshots *snapshotConfig       `hcl:"snapshots" json:"snapshots"`
+		Policy    *policy.Config        `hcl:"policy" json:"policy"`
+		Release   *policy.ReleaseConfig `hcl:"release" json:"release"`
+		GC        *policy.GCConfig      `hcl:"gc" json:"gc"`
+		Scrub     *policy.ScrubConfig   `hcl:"scrub" json:"scrub"`
+		Transport *transportConfig      `hcl:"transport" json:"transport"`
 	}
 )
 
@@ -133,6 +152,44 @@ func (c *snapshotConfig) Merge(other *snapshotConfig) *snapshotConfig {
 	return result
 }
 
+func (c *adaptiveConfig) Merge(other *adaptiveConfig) *adaptiveConfig {
+	result := new(adaptiveConfig)
+
+	result.Enabled = other.Enabled
+
+	result.MinHandlers = c.MinHandlers
+	if other.MinHandlers > 0 {
+		result.MinHandlers = other.MinHandlers
+	}
+
+	result.MaxHandlers = c.MaxHandlers
+	if other.MaxHandlers > 0 {
+		result.MaxHandlers = other.MaxHandlers
+	}
+
+	result.MinInFlight = c.MinInFlight
+	if other.MinInFlight > 0 {
+		result.MinInFlight = other.MinInFlight
+	}
+
+	result.MaxInFlight = c.MaxInFlight
+	if other.MaxInFlight > 0 {
+		result.MaxInFlight = other.MaxInFlight
+	}
+
+	result.Interval = c.Interval
+	if other.Interval > 0 {
+		result.Interval = other.Interval
+	}
+
+	result.MaxErrorPercent = c.MaxErrorPercent
+	if other.MaxErrorPercent > 0 {
+		result.MaxErrorPercent = other.MaxErrorPercent
+	}
+
+	return result
+}
+
 func init() {
 	flag.StringVar(&optConfigPath, "config", config.DefaultConfigPath, "Path to agent config")
 
@@ -206,6 +263,16 @@ func (c *Config) Merge(other *Config) *Config {
 		result.Processes = other.Processes
 	}
 
+	result.DrainTimeout = c.DrainTimeout
+	if other.DrainTimeout > 0 {
+		result.DrainTimeout = other.DrainTimeout
+	}
+
+	result.Adaptive = c.Adaptive
+	if other.Adaptive != nil {
+		result.Adaptive = result.Adaptive.Merge(other.Adaptive)
+	}
+
 	result.InfluxDB = c.InfluxDB
 	if other.InfluxDB != nil {
 		result.InfluxDB = result.InfluxDB.Merge(other.InfluxDB)
@@ -226,6 +293,26 @@ func (c *Config) Merge(other *Config) *Config {
 		result.Snapshots = result.Snapshots.Merge(other.Snapshots)
 	}
 
+	result.Policy = c.Policy
+	if other.Policy != nil {
+		result.Policy = result.Policy.Merge(other.Policy)
+	}
+
+	result.Release = c.Release
+	if other.Release != nil {
+		result.Release = result.Release.Merge(other.Release)
+	}
+
+	result.GC = c.GC
+	if other.GC != nil {
+		result.GC = result.GC.Merge(other.GC)
+	}
+
+	result.Scrub = c.Scrub
+	if other.Scrub != nil {
+		result.Scrub = result.Scrub.Merge(other.Scrub)
+	}
+
 	result.Transport = c.Transport
 	if other.Transport != nil {
 		result.Transport = result.Transport.Merge(other.Transport)
@@ -241,6 +328,26 @@ func DefaultConfig() *Config {
 	cfg.ClientMountOptions = config.DefaultClientMountOptions
 	cfg.PluginDir = config.DefaultPluginDir
 	cfg.Processes = runtime.NumCPU()
+	cfg.DrainTimeout = config.DefaultDrainTimeout
+	cfg.Policy = &policy.Config{
+		StateDir:  config.DefaultPolicyStateDir,
+		Interval:  config.DefaultPolicyInterval,
+		BatchSize: config.DefaultPolicyBatchSize,
+	}
+	cfg.Release = &policy.ReleaseConfig{
+		Interval:  config.DefaultReleaseInterval,
+		BatchSize: config.DefaultPolicyBatchSize,
+	}
+	cfg.GC = &policy.GCConfig{
+		StateDir:    config.DefaultPolicyStateDir,
+		GracePeriod: config.DefaultGCGracePeriod,
+		Interval:    config.DefaultGCInterval,
+	}
+	cfg.Scrub = &policy.ScrubConfig{
+		StateDir:  config.DefaultPolicyStateDir,
+		Interval:  config.DefaultScrubInterval,
+		Bandwidth: config.DefaultScrubBandwidth,
+	}
 	cfg.Transport = &transportConfig{
 		Type:      config.DefaultTransport,
 		SocketDir: config.DefaultTransportSocketDir,
@@ -251,8 +358,13 @@ func DefaultConfig() *Config {
 // NewConfig initializes a new Config struct with zero values
 func NewConfig() *Config {
 	return &Config{
+		Adaptive:           &adaptiveConfig{},
 		InfluxDB:           &influxConfig{},
 		Snapshots:          &snapshotConfig{},
+		Policy:             &policy.Config{},
+		Release:            &policy.ReleaseConfig{},
+		GC:                 &policy.GCConfig{},
+		Scrub:              &policy.ScrubConfig{},
 		Transport:          &transportConfig{},
 		EnabledPlugins:     []string{},
 		ClientMountOptions: clientMountOptions{},
@@ -332,5 +444,34 @@ func ConfigInitMust() *Config {
 		}
 	}
 
+	if cfg.Policy.Enabled {
+		if err := cfg.Policy.CheckValid(); err != nil {
+			alert.Abort(errors.Wrap(err, "Invalid configuration"))
+		}
+	}
+
+	if cfg.Release.Enabled {
+		if err := cfg.Release.CheckValid(); err != nil {
+			alert.Abort(errors.Wrap(err, "Invalid configuration"))
+		}
+	}
+
+	if cfg.GC.Enabled {
+		if err := cfg.GC.CheckValid(); err != nil {
+			alert.Abort(errors.Wrap(err, "Invalid configuration"))
+		}
+		// Each changelog user is cleared independently, so the garbage
+		// collector can't share one with the policy service.
+		if cfg.Policy.Enabled && cfg.GC.ChangelogUser == cfg.Policy.ChangelogUser {
+			alert.Abort(errors.New("Invalid configuration: gc and policy must use different changelog users"))
+		}
+	}
+
+	if cfg.Scrub.Enabled {
+		if err := cfg.Scrub.CheckValid(); err != nil {
+			alert.Abort(errors.Wrap(err, "Invalid configuration"))
+		}
+	}
+
 	return cfg
 }
@@ -13,6 +13,7 @@ import (
 	"testing"
 
 	"github.com/intel-hpdd/lemur/cmd/lhsmd/config"
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/policy"
 	"github.com/intel-hpdd/go-lustre/fs/spec"
 )
 
@@ -68,7 +69,9 @@ func TestLoadConfig(t *testing.T) {
 		ClientMountOptions: []string{
 			"user_xattr",
 		},
-		Processes: runtime.NumCPU(),
+		Processes:    runtime.NumCPU(),
+		DrainTimeout: config.DefaultDrainTimeout,
+		Adaptive:     &adaptiveConfig{},
 		InfluxDB: &influxConfig{
 			URL: "http://172.17.0.4:8086",
 			DB:  "lhsmd",
@@ -79,6 +82,25 @@ func TestLoadConfig(t *testing.T) {
 		Snapshots: &snapshotConfig{
 			Enabled: false,
 		},
+		Policy: &policy.Config{
+			StateDir:  config.DefaultPolicyStateDir,
+			Interval:  config.DefaultPolicyInterval,
+			BatchSize: config.DefaultPolicyBatchSize,
+		},
+		Release: &policy.ReleaseConfig{
+			Interval:  config.DefaultReleaseInterval,
+			BatchSize: config.DefaultPolicyBatchSize,
+		},
+		GC: &policy.GCConfig{
+			StateDir:    config.DefaultPolicyStateDir,
+			GracePeriod: config.DefaultGCGracePeriod,
+			Interval:    config.DefaultGCInterval,
+		},
+		Scrub: &policy.ScrubConfig{
+			StateDir:  config.DefaultPolicyStateDir,
+			Interval:  config.DefaultScrubInterval,
+			Bandwidth: config.DefaultScrubBandwidth,
+		},
 		PluginDir: "/go/bin",
 		Transport: &transportConfig{
 			Type:      "grpc",
@@ -109,7 +131,9 @@ func TestMergedConfig(t *testing.T) {
 		ClientMountOptions: []string{
 			"user_xattr",
 		},
-		Processes: runtime.NumCPU(),
+		Processes:    runtime.NumCPU(),
+		DrainTimeout: config.DefaultDrainTimeout,
+		Adaptive:     &adaptiveConfig{},
 		InfluxDB: &influxConfig{
 			URL: "http://172.17.0.4:8086",
 			DB:  "lhsmd",
@@ -121,6 +145,25 @@ func TestMergedConfig(t *testing.T) {
 		Snapshots: &snapshotConfig{
 			Enabled: false,
 		},
+		Policy: &policy.Config{
+			StateDir:  config.DefaultPolicyStateDir,
+			Interval:  config.DefaultPolicyInterval,
+			BatchSize: config.DefaultPolicyBatchSize,
+		},
+		Release: &policy.ReleaseConfig{
+			Interval:  config.DefaultReleaseInterval,
+			BatchSize: config.DefaultPolicyBatchSize,
+		},
+		GC: &policy.GCConfig{
+			StateDir:    config.DefaultPolicyStateDir,
+			GracePeriod: config.DefaultGCGracePeriod,
+			Interval:    config.DefaultGCInterval,
+		},
+		Scrub: &policy.ScrubConfig{
+			StateDir:  config.DefaultPolicyStateDir,
+			Interval:  config.DefaultScrubInterval,
+			Bandwidth: config.DefaultScrubBandwidth,
+		},
 		Transport: &transportConfig{
 			Type:      "grpc",
 			SocketDir: "/var/run/lhsmd",
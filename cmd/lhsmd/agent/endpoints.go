@@ -17,9 +17,10 @@ type (
 	// Endpoints represents a collection of Endpoints and their handles
 	Endpoints struct {
 		sync.Mutex
-		nextHandle int64
-		endpoints  map[uint32]Endpoint
-		handles    map[Handle]uint32
+		nextHandle   int64
+		endpoints    map[uint32]Endpoint
+		handles      map[Handle]uint32
+		capabilities map[uint32]*Capabilities
 	}
 
 	// Endpoint defines an interface for HSM backends
@@ -31,8 +32,9 @@ type (
 // NewEndpoints returns a new *Endpoints instance
 func NewEndpoints() *Endpoints {
 	return &Endpoints{
-		endpoints: make(map[uint32]Endpoint),
-		handles:   make(map[Handle]uint32),
+		endpoints:    make(map[uint32]Endpoint),
+		handles:      make(map[Handle]uint32),
+		capabilities: make(map[uint32]*Capabilities),
 	}
 }
 
@@ -104,6 +106,24 @@ func (all *Endpoints) NewHandle(a uint32) (*Handle, error) {
 
 }
 
+// SetCapabilities records the capabilities reported by the mover for an
+// archive. They replace any reported by a previous registration.
+func (all *Endpoints) SetCapabilities(a uint32, c *Capabilities) {
+	all.Lock()
+	defer all.Unlock()
+
+	all.capabilities[a] = c
+}
+
+// Capabilities returns the capabilities reported by the mover for an
+// archive, or nil if none have been reported.
+func (all *Endpoints) Capabilities(a uint32) *Capabilities {
+	all.Lock()
+	defer all.Unlock()
+
+	return all.capabilities[a]
+}
+
 // RemoveHandle removes the given handle from the collection of handles
 func (all *Endpoints) RemoveHandle(h *Handle) {
 	all.Lock()
@@ -124,6 +144,7 @@ func (all *Endpoints) Remove(h *Handle) Endpoint {
 	if e, ok := all.get(a); ok {
 		delete(all.handles, *h)
 		delete(all.endpoints, a)
+		delete(all.capabilities, a)
 		return e
 	}
 
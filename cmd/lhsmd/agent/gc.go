@@ -0,0 +1,137 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/llapi"
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/policy"
+	pb "github.com/intel-hpdd/lemur/pdm"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+// agentHandle is an hsm.ActionHandle for an action that the agent
+// generates itself, rather than one sent by the coordinator. It is used to
+// remove the archive copies of files that no longer exist, and to verify
+// archive copies.
+type agentHandle struct {
+	tag       string
+	cmd       pb.Command
+	fid       *lustre.Fid
+	archiveID uint
+	data      []byte
+
+	once   sync.Once
+	done   chan struct{}
+	errval int
+}
+
+func newAgentHandle(tag string, cmd pb.Command, fid *lustre.Fid, archiveID uint, data []byte) *agentHandle {
+	return &agentHandle{
+		tag:       tag,
+		cmd:       cmd,
+		fid:       fid,
+		archiveID: archiveID,
+		data:      data,
+		done:      make(chan struct{}),
+	}
+}
+
+func (h *agentHandle) Progress(offset, length, totalLength int64, flags int) error {
+	return nil
+}
+
+func (h *agentHandle) End(offset, length int64, flags int, errval int) error {
+	h.once.Do(func() {
+		h.errval = errval
+		close(h.done)
+	})
+	return nil
+}
+
+// Action returns the HSM action of the command. Commands the coordinator
+// doesn't have, such as VERIFY, have none.
+func (h *agentHandle) Action() llapi.HsmAction {
+	if h.cmd == pb.Command_REMOVE {
+		return llapi.HsmActionRemove
+	}
+	return llapi.HsmActionNone
+}
+
+func (h *agentHandle) Command() pb.Command { return h.cmd }
+func (h *agentHandle) Fid() *lustre.Fid    { return h.fid }
+func (h *agentHandle) Cookie() uint64      { return 0 }
+func (h *agentHandle) Offset() int64       { return 0 }
+func (h *agentHandle) ArchiveID() uint     { return h.archiveID }
+func (h *agentHandle) Length() int64       { return 0 }
+func (h *agentHandle) Data() []byte        { return h.data }
+
+func (h *agentHandle) DataFid() (*lustre.Fid, error) {
+	return nil, errors.Errorf("%s has no data fid", h.cmd)
+}
+
+func (h *agentHandle) Fd() (int, error) {
+	return -1, errors.Errorf("%s has no file descriptor", h.cmd)
+}
+
+func (h *agentHandle) String() string {
+	return fmt.Sprintf("%s %s %v archive:%d", h.tag, h.cmd, h.fid, h.archiveID)
+}
+
+// RemoveArchived sends a REMOVE for the archive copy of a deleted file to
+// the archive's mover, and waits for it to complete.
+func (ct *HsmAgent) RemoveArchived(ctx context.Context, fid *lustre.Fid, e *policy.CatalogEntry) error {
+	h, err := ct.sendArchived(ctx, "gc", pb.Command_REMOVE, fid, e)
+	if err != nil {
+		return err
+	}
+	if h.errval != 0 {
+		return errors.Errorf("mover returned %d", h.errval)
+	}
+	return nil
+}
+
+// sendArchived sends an action for the archive copy of a file to the
+// archive's mover, and waits for it to complete.
+func (ct *HsmAgent) sendArchived(ctx context.Context, tag string, cmd pb.Command, fid *lustre.Fid, e *policy.CatalogEntry) (*agentHandle, error) {
+	if ct.draining() {
+		return nil, errors.New("agent is stopping")
+	}
+	if !ct.Endpoints.Capabilities(uint32(e.ArchiveID)).Supports(cmd) {
+		return nil, errors.Wrapf(policy.ErrNotSupported, "archive %d mover does not support %s", e.ArchiveID, cmd)
+	}
+	ep, ok := ct.Endpoints.Get(uint32(e.ArchiveID))
+	if !ok {
+		return nil, errors.Errorf("no handler for archive %d", e.ArchiveID)
+	}
+
+	data, err := json.Marshal(&ActionData{FileID: []byte(e.UUID)})
+	if err != nil {
+		return nil, errors.Wrap(err, "encode action data failed")
+	}
+	h := newAgentHandle(tag, cmd, fid, e.ArchiveID, data)
+	action := ct.newAction(h)
+	ct.trackAction(action)
+	ct.stats.StartAction(action)
+	action.Prepare()
+	action.Hash = e.Hash
+	action.URL = e.URL
+	debug.Printf("%s: id:%d new %s", tag, action.id, h)
+	ep.Send(action)
+
+	select {
+	case <-h.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return h, nil
+}
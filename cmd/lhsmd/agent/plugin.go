@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
@@ -31,6 +32,10 @@ var backoff = []time.Duration{
 }
 var maxBackoff = len(backoff) - 1
 
+// PluginStopTimeout is the time, in seconds, to wait for plugins to exit
+// after they have been asked to stop.
+const PluginStopTimeout = 10
+
 type (
 	// PluginConfig represents configuration for a single plugin
 	PluginConfig struct {
@@ -50,6 +55,7 @@ type (
 	PluginMonitor struct {
 		processChan      ppChan
 		processStateChan psChan
+		stopChan         chan chan struct{}
 	}
 
 	pluginProcess struct {
@@ -115,11 +121,23 @@ func NewMonitor() *PluginMonitor {
 	return &PluginMonitor{
 		processChan:      make(ppChan),
 		processStateChan: make(psChan),
+		stopChan:         make(chan chan struct{}, 1),
 	}
 }
 
 func (m *PluginMonitor) run(ctx context.Context) {
-	processMap := make(map[int]*PluginConfig)
+	processMap := make(map[int]*pluginProcess)
+	// Once stopping, plugins are not restarted and stopped is closed
+	// when the last one has exited.
+	var stopping bool
+	var stopped chan struct{}
+
+	var notifyStopped = func() {
+		if len(processMap) == 0 && stopped != nil {
+			close(stopped)
+			stopped = nil
+		}
+	}
 
 	var waitForCmd = func(cmd *exec.Cmd) {
 		debug.Printf("Waiting for %s (%d) to exit", cmd.Path, cmd.Process.Pid)
@@ -135,16 +153,33 @@ func (m *PluginMonitor) run(ctx context.Context) {
 	for {
 		select {
 		case p := <-m.processChan:
-			processMap[p.cmd.Process.Pid] = p.plugin
+			processMap[p.cmd.Process.Pid] = p
 			go waitForCmd(p.cmd)
+			if stopping {
+				// A restart raced with the stop request
+				p.stop()
+			}
+		case done := <-m.stopChan:
+			stopping = true
+			stopped = done
+			for _, p := range processMap {
+				p.stop()
+			}
+			notifyStopped()
 		case s := <-m.processStateChan:
-			cfg, found := processMap[s.ps.Pid()]
+			p, found := processMap[s.ps.Pid()]
 			if !found {
 				debug.Printf("Received disp of unknown pid: %d", s.ps.Pid())
 				break
 			}
 
 			delete(processMap, s.ps.Pid())
+			cfg := p.plugin
+			if stopping {
+				audit.Logf("Process %d for %s exited: %s", s.ps.Pid(), cfg.Name, s.ps)
+				notifyStopped()
+				break
+			}
 			audit.Logf("Process %d for %s died: %s", s.ps.Pid(), cfg.Name, s.ps)
 			if cfg.RestartOnFailure {
 				delay := cfg.RestartDelay()
@@ -174,6 +209,26 @@ func (m *PluginMonitor) Start(ctx context.Context) {
 	go m.run(ctx)
 }
 
+// StopPlugins asks all running plugins to exit and waits up to timeout for
+// them to do so. Plugins are not restarted once this has been called.
+func (m *PluginMonitor) StopPlugins(timeout time.Duration) error {
+	done := make(chan struct{})
+	m.stopChan <- done
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return errors.Errorf("plugins did not exit after %v", timeout)
+	}
+}
+
+func (p *pluginProcess) stop() {
+	audit.Logf("Stopping %s (PID: %d)", p.plugin.Name, p.cmd.Process.Pid)
+	if err := p.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		debug.Printf("signal %d failed: %v", p.cmd.Process.Pid, err)
+	}
+}
+
 // StartPlugin starts the plugin and monitors it
 func (m *PluginMonitor) StartPlugin(cfg *PluginConfig) error {
 	debug.Printf("Starting %s for %s", cfg.BinPath, cfg.Name)
@@ -0,0 +1,33 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package agent
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/policy"
+	pb "github.com/intel-hpdd/lemur/pdm"
+)
+
+// VerifyArchived sends a VERIFY for the archive copy of a file to the
+// archive's mover, and waits for it to complete. If the copy doesn't match
+// the file's checksum the error is policy.ErrChecksumMismatch.
+func (ct *HsmAgent) VerifyArchived(ctx context.Context, fid *lustre.Fid, e *policy.CatalogEntry) error {
+	h, err := ct.sendArchived(ctx, "scrub", pb.Command_VERIFY, fid, e)
+	if err != nil {
+		return err
+	}
+	switch h.errval {
+	case 0:
+		return nil
+	case int(unix.EBADMSG):
+		return policy.ErrChecksumMismatch
+	default:
+		return errors.Errorf("mover returned %d", h.errval)
+	}
+}
@@ -25,6 +25,15 @@ const (
 	// a Lustre client mountpoint to be used by the plugin
 	PluginMountpointEnvVar = "LHSMD_CLIENT_MOUNTPOINT"
 
+	// PluginCommandEnvVar is the environment variable used to run a
+	// plugin outside of the agent, to perform a maintenance command on
+	// one of its archives
+	PluginCommandEnvVar = "LHSMD_PLUGIN_COMMAND"
+
+	// PluginArchiveEnvVar is the environment variable containing the
+	// archive id that PluginCommandEnvVar applies to
+	PluginArchiveEnvVar = "LHSMD_PLUGIN_ARCHIVE"
+
 	// DefaultTransport is the default agent<->plugin transport
 	DefaultTransport = "grpc"
 
@@ -36,6 +45,46 @@ const (
 
 	// DefaultPluginDir is the default location for plugin binaries
 	DefaultPluginDir = "/usr/libexec/lhsmd"
+
+	// DefaultDrainTimeout is the default time, in seconds, that the agent
+	// waits for in-flight actions to complete when shutting down
+	DefaultDrainTimeout = 60
+
+	// DefaultPolicyStateDir is where the policy service keeps its
+	// changelog position and pending files
+	DefaultPolicyStateDir = "/var/lib/lhsmd"
+
+	// DefaultCatalogDir is where the garbage collector keeps the
+	// archive locations of files when its state_dir is the default
+	DefaultCatalogDir = DefaultPolicyStateDir + "/catalog"
+
+	// DefaultPolicyInterval is the default time, in seconds, between
+	// policy evaluation passes
+	DefaultPolicyInterval = 60
+
+	// DefaultPolicyBatchSize is the default maximum number of files
+	// submitted in a single archive request
+	DefaultPolicyBatchSize = 100
+
+	// DefaultReleaseInterval is the default time, in seconds, between
+	// checks of filesystem usage by the release service
+	DefaultReleaseInterval = 300
+
+	// DefaultGCGracePeriod is the default time to wait after a file is
+	// deleted before its archive copies are removed
+	DefaultGCGracePeriod = "24h"
+
+	// DefaultGCInterval is the default time, in seconds, between scans
+	// of the garbage collector's queue
+	DefaultGCInterval = 60
+
+	// DefaultScrubInterval is the default time, in seconds, between the
+	// starts of scrub passes
+	DefaultScrubInterval = 7 * 24 * 60 * 60
+
+	// DefaultScrubBandwidth is the default limit on the rate archive
+	// copies are read by the scrubber, in bytes per second
+	DefaultScrubBandwidth = "100MB"
 )
 
 // DefaultClientMountOptions is the default set of Lustre client
@@ -0,0 +1,200 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+
+	"github.com/intel-hpdd/go-lustre"
+)
+
+type (
+	// CatalogEntry records where a file was archived, so that the copy
+	// can still be found once the file has been removed from the
+	// filesystem along with its fileid xattrs.
+	CatalogEntry struct {
+		ArchiveID uint   `json:"archive_id"`
+		UUID      string `json:"uuid"`
+		URL       string `json:"url,omitempty"`
+		Hash      []byte `json:"hash,omitempty"`
+
+		// Imported is set for a released file created from an
+		// existing archive copy, by lhsm clone, manifest import or
+		// rebuild, rather than archived by a mover. Movers don't
+		// count such files as references to the copy.
+		Imported bool `json:"imported,omitempty"`
+	}
+
+	// Catalog is a persistent map of fids to CatalogEntries. Each entry
+	// is stored in its own file, grouped into directories by sequence.
+	// The catalog also records the files that refer to each archive
+	// copy, as several files can share one.
+	Catalog struct {
+		dir string
+	}
+
+	// reference is a file's reference to an archive copy. The
+	// reference of a deleted file is kept while other files still
+	// refer to the copy, so the copy's removal can be completed when
+	// the last of them is deleted.
+	reference struct {
+		Imported bool `json:"imported,omitempty"`
+		Deleted  bool `json:"deleted,omitempty"`
+	}
+)
+
+// refsDir is the directory of the catalog that holds the references to
+// archive copies, one directory per copy.
+const refsDir = "refs"
+
+// NewCatalog returns a Catalog stored in dir.
+func NewCatalog(dir string) (*Catalog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "create catalog dir failed")
+	}
+	return &Catalog{dir: dir}, nil
+}
+
+func (c *Catalog) entryPath(fid *lustre.Fid) string {
+	return path.Join(c.dir, fmt.Sprintf("%#x", fid.Seq), fmt.Sprintf("%#x:%#x", fid.Oid, fid.Ver))
+}
+
+// copyDir returns the directory of the references to an archive copy.
+func (c *Catalog) copyDir(e *CatalogEntry) string {
+	return path.Join(c.dir, refsDir, fmt.Sprint(e.ArchiveID), url.PathEscape(e.UUID))
+}
+
+// Put adds or replaces the entry for fid, and records the file's
+// reference to its archive copy.
+func (c *Catalog) Put(fid *lustre.Fid, e *CatalogEntry) error {
+	old, err := c.Get(fid)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "encode catalog entry failed")
+	}
+	p := c.entryPath(fid)
+	if err := os.MkdirAll(path.Dir(p), 0700); err != nil {
+		return errors.Wrap(err, "create catalog dir failed")
+	}
+	if err := writeFileAtomic(p, data); err != nil {
+		return err
+	}
+	if old != nil && (old.ArchiveID != e.ArchiveID || old.UUID != e.UUID) {
+		if err := c.dropReference(fid, old); err != nil {
+			return err
+		}
+	}
+	return c.putReference(fid, e, &reference{Imported: e.Imported})
+}
+
+func (c *Catalog) putReference(fid *lustre.Fid, e *CatalogEntry, ref *reference) error {
+	data, err := json.Marshal(ref)
+	if err != nil {
+		return errors.Wrap(err, "encode catalog reference failed")
+	}
+	dir := c.copyDir(e)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "create catalog dir failed")
+	}
+	return writeFileAtomic(path.Join(dir, fid.String()), data)
+}
+
+// dropReference removes a file's reference to an archive copy, and the
+// copy's directory once it has none.
+func (c *Catalog) dropReference(fid *lustre.Fid, e *CatalogEntry) error {
+	dir := c.copyDir(e)
+	err := os.Remove(path.Join(dir, fid.String()))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove catalog reference failed")
+	}
+	// Fails if other files still refer to the copy.
+	os.Remove(dir)
+	return nil
+}
+
+// references returns the references to the archive copy of an entry, by
+// fid. Copies archived before references were recorded have none.
+func (c *Catalog) references(e *CatalogEntry) (map[lustre.Fid]*reference, error) {
+	dir := c.copyDir(e)
+	names, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "read catalog references failed")
+	}
+	refs := make(map[lustre.Fid]*reference)
+	for _, fi := range names {
+		// Skips the temporary files of references being written.
+		fid, err := lustre.ParseFid(fi.Name())
+		if err != nil || fid.String() != fi.Name() {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(dir, fi.Name()))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, errors.Wrap(err, "read catalog reference failed")
+		}
+		var ref reference
+		if err := json.Unmarshal(data, &ref); err != nil {
+			return nil, errors.Wrapf(err, "%s: decode catalog reference failed", fid)
+		}
+		refs[*fid] = &ref
+	}
+	return refs, nil
+}
+
+// release forgets a deleted file whose archive copy is still referred to
+// by other files. Its reference is kept, marked as deleted.
+func (c *Catalog) release(fid *lustre.Fid, e *CatalogEntry) error {
+	if err := c.putReference(fid, e, &reference{Imported: e.Imported, Deleted: true}); err != nil {
+		return err
+	}
+	err := os.Remove(c.entryPath(fid))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove catalog entry failed")
+	}
+	return nil
+}
+
+// Get returns the entry for fid. If there is no entry the error satisfies
+// os.IsNotExist.
+func (c *Catalog) Get(fid *lustre.Fid) (*CatalogEntry, error) {
+	data, err := ioutil.ReadFile(c.entryPath(fid))
+	if err != nil {
+		return nil, err
+	}
+	var e CatalogEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, errors.Wrapf(err, "%s: decode catalog entry failed", fid)
+	}
+	return &e, nil
+}
+
+// Delete removes the entry for fid and its reference to its archive copy,
+// if there is one.
+func (c *Catalog) Delete(fid *lustre.Fid) error {
+	e, err := c.Get(fid)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	err = os.Remove(c.entryPath(fid))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove catalog entry failed")
+	}
+	return c.dropReference(fid, e)
+}
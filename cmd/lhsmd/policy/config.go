@@ -0,0 +1,436 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package policy
+
+import (
+	"os/user"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+)
+
+type (
+	// Config is the configuration for the policy service
+	Config struct {
+		Enabled       bool     `hcl:"enabled" json:"enabled"`
+		MDTs          []string `hcl:"mdts" json:"mdts,omitempty"`
+		ChangelogUser string   `hcl:"changelog_user" json:"changelog_user"`
+		StateDir      string   `hcl:"state_dir" json:"state_dir"`
+		Interval      int      `hcl:"interval" json:"interval"`
+		BatchSize     int      `hcl:"batch_size" json:"batch_size"`
+		Rules         RuleSet  `hcl:"rule" json:"rule,omitempty"`
+	}
+
+	// RuleConfig describes a set of files and the archive they should
+	// be copied to. All of the configured criteria must match.
+	RuleConfig struct {
+		Name      string   `hcl:",key" json:"name"`
+		ArchiveID int      `hcl:"archive_id" json:"archive_id"`
+		Paths     []string `hcl:"paths" json:"paths"`
+		MinAge    string   `hcl:"min_age" json:"min_age"`
+		MinSize   string   `hcl:"min_size" json:"min_size"`
+		MaxSize   string   `hcl:"max_size" json:"max_size"`
+		Owners    []string `hcl:"owners" json:"owners"`
+		Pools     []string `hcl:"pools" json:"pools"`
+	}
+
+	// RuleSet is an ordered list of rules. The first rule that matches
+	// a file is the one applied to it.
+	RuleSet []*RuleConfig
+
+	// ReleaseConfig is the configuration for the release service
+	ReleaseConfig struct {
+		Enabled     bool                `hcl:"enabled" json:"enabled"`
+		DryRun      bool                `hcl:"dry_run" json:"dry_run"`
+		Interval    int                 `hcl:"interval" json:"interval"`
+		BatchSize   int                 `hcl:"batch_size" json:"batch_size"`
+		Paths       []string            `hcl:"paths" json:"paths,omitempty"`
+		Exclude     []string            `hcl:"exclude" json:"exclude,omitempty"`
+		MinAge      string              `hcl:"min_age" json:"min_age"`
+		MinSize     string              `hcl:"min_size" json:"min_size"`
+		SizeWeight  int                 `hcl:"size_weight" json:"size_weight"`
+		PathWeights []*PathWeightConfig `hcl:"path_weight" json:"path_weight,omitempty"`
+		Targets     []*TargetConfig     `hcl:"target" json:"target,omitempty"`
+	}
+
+	// PathWeightConfig scales the release priority of files matching a
+	// path pattern, as a percentage.
+	PathWeightConfig struct {
+		Pattern string `hcl:",key" json:"pattern"`
+		Weight  int    `hcl:"weight" json:"weight"`
+	}
+
+	// TargetConfig defines the watermarks for the whole filesystem, or
+	// for an OST pool.
+	TargetConfig struct {
+		Name          string `hcl:",key" json:"name"`
+		Pool          string `hcl:"pool" json:"pool"`
+		HighWatermark int    `hcl:"high_watermark" json:"high_watermark"`
+		LowWatermark  int    `hcl:"low_watermark" json:"low_watermark"`
+	}
+
+	// GCConfig is the configuration for the archive garbage collector
+	GCConfig struct {
+		Enabled       bool     `hcl:"enabled" json:"enabled"`
+		MDTs          []string `hcl:"mdts" json:"mdts,omitempty"`
+		ChangelogUser string   `hcl:"changelog_user" json:"changelog_user"`
+		StateDir      string   `hcl:"state_dir" json:"state_dir"`
+		GracePeriod   string   `hcl:"grace_period" json:"grace_period"`
+		Interval      int      `hcl:"interval" json:"interval"`
+	}
+
+	// ScrubConfig is the configuration for the archive scrubber
+	ScrubConfig struct {
+		Enabled   bool     `hcl:"enabled" json:"enabled"`
+		StateDir  string   `hcl:"state_dir" json:"state_dir"`
+		Interval  int      `hcl:"interval" json:"interval"`
+		Paths     []string `hcl:"paths" json:"paths,omitempty"`
+		Rate      int      `hcl:"files_per_second" json:"files_per_second"`
+		Bandwidth string   `hcl:"bandwidth" json:"bandwidth"`
+	}
+)
+
+// Merge combines the supplied configuration's values with this one's
+func (c *Config) Merge(other *Config) *Config {
+	result := new(Config)
+
+	result.Enabled = other.Enabled
+
+	result.MDTs = c.MDTs
+	if len(other.MDTs) > 0 {
+		result.MDTs = other.MDTs
+	}
+
+	result.ChangelogUser = c.ChangelogUser
+	if other.ChangelogUser != "" {
+		result.ChangelogUser = other.ChangelogUser
+	}
+
+	result.StateDir = c.StateDir
+	if other.StateDir != "" {
+		result.StateDir = other.StateDir
+	}
+
+	result.Interval = c.Interval
+	if other.Interval > 0 {
+		result.Interval = other.Interval
+	}
+
+	result.BatchSize = c.BatchSize
+	if other.BatchSize > 0 {
+		result.BatchSize = other.BatchSize
+	}
+
+	result.Rules = c.Rules.Merge(other.Rules)
+
+	return result
+}
+
+// Merge returns other if it is not empty, otherwise it returns rs.
+func (rs RuleSet) Merge(other RuleSet) RuleSet {
+	if len(other) > 0 {
+		return other
+	}
+	return rs
+}
+
+// CheckValid returns an error if the configuration is not usable.
+func (c *Config) CheckValid() error {
+	if len(c.MDTs) == 0 {
+		return errors.New("policy: no mdts specified")
+	}
+	if c.ChangelogUser == "" {
+		return errors.New("policy: no changelog_user specified")
+	}
+	if c.StateDir == "" {
+		return errors.New("policy: no state_dir specified")
+	}
+	if len(c.Rules) == 0 {
+		return errors.New("policy: no rules defined")
+	}
+	for _, rc := range c.Rules {
+		if _, err := newRule(rc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Merge combines the supplied configuration's values with this one's
+func (c *ReleaseConfig) Merge(other *ReleaseConfig) *ReleaseConfig {
+	result := new(ReleaseConfig)
+
+	result.Enabled = other.Enabled
+	result.DryRun = other.DryRun
+
+	result.Interval = c.Interval
+	if other.Interval > 0 {
+		result.Interval = other.Interval
+	}
+
+	result.BatchSize = c.BatchSize
+	if other.BatchSize > 0 {
+		result.BatchSize = other.BatchSize
+	}
+
+	result.Paths = c.Paths
+	if len(other.Paths) > 0 {
+		result.Paths = other.Paths
+	}
+
+	result.Exclude = c.Exclude
+	if len(other.Exclude) > 0 {
+		result.Exclude = other.Exclude
+	}
+
+	result.MinAge = c.MinAge
+	if other.MinAge != "" {
+		result.MinAge = other.MinAge
+	}
+
+	result.MinSize = c.MinSize
+	if other.MinSize != "" {
+		result.MinSize = other.MinSize
+	}
+
+	result.SizeWeight = c.SizeWeight
+	if other.SizeWeight > 0 {
+		result.SizeWeight = other.SizeWeight
+	}
+
+	result.PathWeights = c.PathWeights
+	if len(other.PathWeights) > 0 {
+		result.PathWeights = other.PathWeights
+	}
+
+	result.Targets = c.Targets
+	if len(other.Targets) > 0 {
+		result.Targets = other.Targets
+	}
+
+	return result
+}
+
+// CheckValid returns an error if the configuration is not usable.
+func (c *ReleaseConfig) CheckValid() error {
+	if len(c.Targets) == 0 {
+		return errors.New("release: no targets defined")
+	}
+	for _, t := range c.Targets {
+		if t.HighWatermark <= 0 || t.HighWatermark > 100 {
+			return errors.Errorf("release: target %q: high_watermark must be between 1 and 100", t.Name)
+		}
+		if t.LowWatermark < 0 || t.LowWatermark >= t.HighWatermark {
+			return errors.Errorf("release: target %q: low_watermark must be less than high_watermark", t.Name)
+		}
+	}
+	for _, p := range append(append([]string{}, c.Paths...), c.Exclude...) {
+		if !path.IsAbs(p) {
+			return errors.Errorf("release: path %q must be absolute", p)
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return errors.Wrapf(err, "release: bad path %q", p)
+		}
+	}
+	for _, pw := range c.PathWeights {
+		if _, err := path.Match(pw.Pattern, ""); err != nil {
+			return errors.Wrapf(err, "release: bad path_weight %q", pw.Pattern)
+		}
+		if pw.Weight < 0 {
+			return errors.Errorf("release: path_weight %q: weight must not be negative", pw.Pattern)
+		}
+	}
+	if c.MinAge != "" {
+		if _, err := time.ParseDuration(c.MinAge); err != nil {
+			return errors.Wrap(err, "release: bad min_age")
+		}
+	}
+	if _, err := parseSize(c.MinSize); err != nil {
+		return errors.Wrap(err, "release: bad min_size")
+	}
+	return nil
+}
+
+// Merge combines the supplied configuration's values with this one's
+func (c *GCConfig) Merge(other *GCConfig) *GCConfig {
+	result := new(GCConfig)
+
+	result.Enabled = other.Enabled
+
+	result.MDTs = c.MDTs
+	if len(other.MDTs) > 0 {
+		result.MDTs = other.MDTs
+	}
+
+	result.ChangelogUser = c.ChangelogUser
+	if other.ChangelogUser != "" {
+		result.ChangelogUser = other.ChangelogUser
+	}
+
+	result.StateDir = c.StateDir
+	if other.StateDir != "" {
+		result.StateDir = other.StateDir
+	}
+
+	result.GracePeriod = c.GracePeriod
+	if other.GracePeriod != "" {
+		result.GracePeriod = other.GracePeriod
+	}
+
+	result.Interval = c.Interval
+	if other.Interval > 0 {
+		result.Interval = other.Interval
+	}
+
+	return result
+}
+
+// CheckValid returns an error if the configuration is not usable.
+func (c *GCConfig) CheckValid() error {
+	if len(c.MDTs) == 0 {
+		return errors.New("gc: no mdts specified")
+	}
+	if c.ChangelogUser == "" {
+		return errors.New("gc: no changelog_user specified")
+	}
+	if c.StateDir == "" {
+		return errors.New("gc: no state_dir specified")
+	}
+	if c.GracePeriod != "" {
+		if d, err := time.ParseDuration(c.GracePeriod); err != nil || d < 0 {
+			return errors.Errorf("gc: bad grace_period %q", c.GracePeriod)
+		}
+	}
+	return nil
+}
+
+// Merge combines the supplied configuration's values with this one's
+func (c *ScrubConfig) Merge(other *ScrubConfig) *ScrubConfig {
+	result := new(ScrubConfig)
+
+	result.Enabled = other.Enabled
+
+	result.StateDir = c.StateDir
+	if other.StateDir != "" {
+		result.StateDir = other.StateDir
+	}
+
+	result.Interval = c.Interval
+	if other.Interval > 0 {
+		result.Interval = other.Interval
+	}
+
+	result.Paths = c.Paths
+	if len(other.Paths) > 0 {
+		result.Paths = other.Paths
+	}
+
+	result.Rate = c.Rate
+	if other.Rate > 0 {
+		result.Rate = other.Rate
+	}
+
+	result.Bandwidth = c.Bandwidth
+	if other.Bandwidth != "" {
+		result.Bandwidth = other.Bandwidth
+	}
+
+	return result
+}
+
+// CheckValid returns an error if the configuration is not usable.
+func (c *ScrubConfig) CheckValid() error {
+	if c.StateDir == "" {
+		return errors.New("scrub: no state_dir specified")
+	}
+	for _, p := range c.Paths {
+		if !path.IsAbs(p) {
+			return errors.Errorf("scrub: path %q must be absolute", p)
+		}
+	}
+	if c.Rate < 0 {
+		return errors.New("scrub: files_per_second must not be negative")
+	}
+	if _, err := parseSize(c.Bandwidth); err != nil {
+		return errors.Wrap(err, "scrub: bad bandwidth")
+	}
+	return nil
+}
+
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := humanize.ParseBytes(s)
+	if err != nil {
+		return 0, err
+	}
+	return int64(n), nil
+}
+
+func lookupOwner(owner string) (uint32, error) {
+	if uid, err := strconv.ParseUint(owner, 10, 32); err == nil {
+		return uint32(uid), nil
+	}
+	u, err := user.Lookup(owner)
+	if err != nil {
+		return 0, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return 0, errors.Wrapf(err, "user %s has non-numeric uid %q", owner, u.Uid)
+	}
+	return uint32(uid), nil
+}
+
+// newRule validates a rule configuration and converts it into the form
+// used for matching.
+func newRule(rc *RuleConfig) (*rule, error) {
+	r := &rule{
+		name:      rc.Name,
+		archiveID: uint(rc.ArchiveID),
+		paths:     rc.Paths,
+		pools:     rc.Pools,
+	}
+	if rc.ArchiveID <= 0 {
+		return nil, errors.Errorf("rule %q: archive_id must be set", rc.Name)
+	}
+	for _, p := range rc.Paths {
+		if !path.IsAbs(p) {
+			return nil, errors.Errorf("rule %q: path %q must be absolute", rc.Name, p)
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, errors.Wrapf(err, "rule %q: bad path %q", rc.Name, p)
+		}
+	}
+
+	var err error
+	if rc.MinAge != "" {
+		if r.minAge, err = time.ParseDuration(rc.MinAge); err != nil {
+			return nil, errors.Wrapf(err, "rule %q: bad min_age", rc.Name)
+		}
+	}
+	if r.minSize, err = parseSize(rc.MinSize); err != nil {
+		return nil, errors.Wrapf(err, "rule %q: bad min_size", rc.Name)
+	}
+	if r.maxSize, err = parseSize(rc.MaxSize); err != nil {
+		return nil, errors.Wrapf(err, "rule %q: bad max_size", rc.Name)
+	}
+	if r.maxSize > 0 && r.maxSize < r.minSize {
+		return nil, errors.Errorf("rule %q: max_size is less than min_size", rc.Name)
+	}
+	for _, owner := range rc.Owners {
+		uid, err := lookupOwner(owner)
+		if err != nil {
+			return nil, errors.Wrapf(err, "rule %q: unknown owner %q", rc.Name, owner)
+		}
+		r.owners = append(r.owners, uid)
+	}
+
+	return r, nil
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package policy
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre/changelog"
+	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+// pollInterval is how long to wait before reopening a changelog that
+// has no new records.
+const pollInterval = time.Second
+
+// follower reads the changelogs of a set of MDTs and passes each record
+// to a consumer. Records are only cleared by checkpoint, after the
+// consumer has saved everything it needs from them.
+type follower struct {
+	mdts       []string
+	user       string
+	openHandle func(mdt string) changelog.Handle
+	consume    func(mdt string, r changelog.Record)
+
+	mu      sync.Mutex
+	indexes map[string]int64 // Last record consumed from each MDT
+	cleared map[string]int64 // Last record cleared on each MDT
+}
+
+func newFollower(mdts []string, user string, openHandle func(string) changelog.Handle, consume func(string, changelog.Record)) *follower {
+	return &follower{
+		mdts:       mdts,
+		user:       user,
+		openHandle: openHandle,
+		consume:    consume,
+		indexes:    make(map[string]int64),
+		cleared:    make(map[string]int64),
+	}
+}
+
+// restore sets the positions to resume reading from, which are also
+// assumed to have been cleared already.
+func (f *follower) restore(indexes map[string]int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for mdt, index := range indexes {
+		f.indexes[mdt] = index
+		f.cleared[mdt] = index
+	}
+}
+
+// Indexes returns the last record consumed from each MDT.
+func (f *follower) Indexes() map[string]int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	indexes := make(map[string]int64)
+	for mdt, index := range f.indexes {
+		indexes[mdt] = index
+	}
+	return indexes
+}
+
+// run follows the changelogs until the context is cancelled.
+func (f *follower) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, mdt := range f.mdts {
+		wg.Add(1)
+		go func(mdt string) {
+			f.follow(ctx, mdt)
+			wg.Done()
+		}(mdt)
+	}
+	wg.Wait()
+}
+
+func (f *follower) follow(ctx context.Context, mdt string) {
+	h := f.openHandle(mdt)
+	for {
+		if err := f.read(ctx, h, mdt); err != nil {
+			alert.Warnf("%s: %v", mdt, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// read consumes all of the currently available records.
+func (f *follower) read(ctx context.Context, h changelog.Handle, mdt string) error {
+	f.mu.Lock()
+	start := f.indexes[mdt] + 1
+	f.mu.Unlock()
+
+	if err := h.OpenAt(start, false); err != nil {
+		return errors.Wrap(err, "open changelog failed")
+	}
+	defer h.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		r, err := h.NextRecord()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "read changelog failed")
+		}
+
+		// The index is only advanced once the record has been consumed,
+		// so that a checkpoint never covers a record it hasn't seen.
+		f.consume(mdt, r)
+		f.mu.Lock()
+		if r.Index() > f.indexes[mdt] {
+			f.indexes[mdt] = r.Index()
+		}
+		f.mu.Unlock()
+	}
+}
+
+// checkpoint calls save with the current changelog positions and then, if
+// it succeeds, clears the records up to those positions.
+func (f *follower) checkpoint(save func(indexes map[string]int64) error) error {
+	indexes := f.Indexes()
+	if err := save(indexes); err != nil {
+		return err
+	}
+
+	for mdt, index := range indexes {
+		f.mu.Lock()
+		cleared := f.cleared[mdt]
+		f.mu.Unlock()
+		if index <= cleared {
+			continue
+		}
+		if err := f.openHandle(mdt).Clear(f.user, index); err != nil {
+			alert.Warnf("%s: clear changelog to %d failed: %v", mdt, index, err)
+			continue
+		}
+		debug.Printf("%s: cleared changelog for %s to %d", mdt, f.user, index)
+		f.mu.Lock()
+		f.cleared[mdt] = index
+		f.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package policy
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/changelog"
+	"github.com/intel-hpdd/go-lustre/llapi"
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/config"
+	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/audit"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+type (
+	// Remover removes the archive copy of a file that no longer exists
+	// in the filesystem.
+	Remover interface {
+		RemoveArchived(ctx context.Context, fid *lustre.Fid, e *CatalogEntry) error
+	}
+
+	// GCService removes the archive copies of files that have been
+	// deleted from the filesystem without being removed from the
+	// archive first. Deleted files are found in the changelog and their
+	// archive copies are removed once a grace period has passed.
+	GCService struct {
+		cfg       *GCConfig
+		catalog   *Catalog
+		remover   Remover
+		grace     time.Duration
+		interval  time.Duration
+		stateFile string
+		follower  *follower
+
+		mu    sync.Mutex
+		queue map[lustre.Fid]*deletion
+	}
+
+	// deletion is an archive copy waiting to be removed.
+	deletion struct {
+		Due   time.Time     `json:"due"`
+		Entry *CatalogEntry `json:"entry"`
+	}
+
+	gcState struct {
+		Indexes map[string]int64     `json:"indexes"`
+		Queue   map[string]*deletion `json:"queue"`
+	}
+)
+
+// NewGC returns a GCService that looks up deleted files in catalog and
+// removes their archive copies with remover.
+func NewGC(cfg *GCConfig, catalog *Catalog, remover Remover) (*GCService, error) {
+	return newGCService(cfg, catalog, remover, changelog.CreateHandle)
+}
+
+func newGCService(cfg *GCConfig, catalog *Catalog, remover Remover, openHandle func(string) changelog.Handle) (*GCService, error) {
+	if err := cfg.CheckValid(); err != nil {
+		return nil, err
+	}
+
+	s := &GCService{
+		cfg:       cfg,
+		catalog:   catalog,
+		remover:   remover,
+		interval:  time.Duration(cfg.Interval) * time.Second,
+		stateFile: path.Join(cfg.StateDir, "gc.state"),
+		queue:     make(map[lustre.Fid]*deletion),
+	}
+	s.follower = newFollower(cfg.MDTs, cfg.ChangelogUser, openHandle, s.consume)
+	if s.interval <= 0 {
+		s.interval = config.DefaultGCInterval * time.Second
+	}
+	grace := cfg.GracePeriod
+	if grace == "" {
+		grace = config.DefaultGCGracePeriod
+	}
+	s.grace, _ = time.ParseDuration(grace)
+
+	if err := os.MkdirAll(cfg.StateDir, 0700); err != nil {
+		return nil, errors.Wrap(err, "create state dir failed")
+	}
+	st := &gcState{}
+	if err := loadJSON(s.stateFile, st); err != nil {
+		return nil, err
+	}
+	s.follower.restore(st.Indexes)
+	for fidStr, d := range st.Queue {
+		fid, err := lustre.ParseFid(fidStr)
+		if err != nil || d.Entry == nil {
+			alert.Warnf("gc: ignoring bad entry %q in %s", fidStr, s.stateFile)
+			continue
+		}
+		s.queue[*fid] = d
+	}
+
+	return s, nil
+}
+
+func (s *GCService) String() string {
+	return fmt.Sprintf("mdts:%v grace:%v interval:%v", s.cfg.MDTs, s.grace, s.interval)
+}
+
+// Run follows the changelogs and removes archive copies until the
+// context is cancelled.
+func (s *GCService) Run(ctx context.Context) {
+	audit.Logf("gc: starting %s, %d deletions queued", s, s.Queued())
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		s.follower.run(ctx)
+		wg.Done()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			if err := s.checkpoint(); err != nil {
+				alert.Warnf("gc: %v", err)
+			}
+			debug.Print("gc: stopped")
+			return
+		case <-time.After(s.interval):
+			s.collect(ctx, time.Now())
+			if err := s.checkpoint(); err != nil {
+				alert.Warnf("gc: %v", err)
+			}
+		}
+	}
+}
+
+// Queued returns the number of archive copies waiting to be removed.
+func (s *GCService) Queued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue)
+}
+
+// consume queues the removal of the archive copy of a file whose last
+// link has been removed.
+func (s *GCService) consume(mdt string, r changelog.Record) {
+	var last, hsm bool
+	switch r.TypeCode() {
+	case llapi.OpUnlink:
+		last, hsm = r.IsLastUnlink()
+	case llapi.OpRename:
+		// A rename over an existing file removes the target.
+		last, hsm = r.IsLastRename()
+	}
+	fid := r.TargetFid()
+	if !last || !hsm || fid == nil || fid.IsZero() {
+		return
+	}
+
+	e, err := s.catalog.Get(fid)
+	if err != nil {
+		if os.IsNotExist(err) {
+			alert.Warnf("gc: %s: deleted file has no catalog entry, its archive copy must be removed manually", fid)
+		} else {
+			alert.Warnf("gc: %s: %v", fid, err)
+		}
+		return
+	}
+
+	debug.Printf("gc: %s: queued removal of archive:%d %s", fid, e.ArchiveID, e.UUID)
+	s.mu.Lock()
+	s.queue[*fid] = &deletion{Due: r.Time().Add(s.grace), Entry: e}
+	s.mu.Unlock()
+}
+
+// collect removes the archive copies whose grace period has passed.
+// Failed removals are retried on the next pass.
+func (s *GCService) collect(ctx context.Context, now time.Time) {
+	s.mu.Lock()
+	work := make(map[lustre.Fid]*deletion)
+	for fid, d := range s.queue {
+		if !d.Due.After(now) {
+			work[fid] = d
+		}
+	}
+	s.mu.Unlock()
+
+	for fid, d := range work {
+		if ctx.Err() != nil {
+			return
+		}
+		fid := fid
+		if err := s.remove(ctx, &fid, d.Entry); err != nil {
+			alert.Warnf("gc: %s: remove archive:%d %s failed: %v", &fid, d.Entry.ArchiveID, d.Entry.UUID, err)
+			continue
+		}
+		s.mu.Lock()
+		delete(s.queue, fid)
+		s.mu.Unlock()
+	}
+}
+
+// remove removes the archive copy of a deleted file, unless other files
+// still refer to it, as clones and imported files share the copy of the
+// file they were made from. The copy is then only removed once the last
+// of them is deleted, with a removal for each of the deleted files that
+// were archived by the mover, as movers that deduplicate count those.
+func (s *GCService) remove(ctx context.Context, fid *lustre.Fid, e *CatalogEntry) error {
+	refs, err := s.catalog.references(e)
+	if err != nil {
+		return err
+	}
+	var live int
+	var owed []lustre.Fid
+	for other, ref := range refs {
+		switch {
+		case other == *fid:
+		case !ref.Deleted:
+			live++
+		case !ref.Imported:
+			owed = append(owed, other)
+		}
+	}
+	if live > 0 {
+		audit.Logf("gc: %s: archive:%d %s is still used by %d files, not removed", fid, e.ArchiveID, e.UUID, live)
+		return s.catalog.release(fid, e)
+	}
+
+	// An imported file's own removal is only needed if no archived
+	// file's is, as for a copy archived before it was cataloged.
+	if !e.Imported || len(owed) == 0 {
+		owed = append(owed, *fid)
+	}
+	for i := range owed {
+		if err := s.remover.RemoveArchived(ctx, &owed[i], e); err != nil {
+			return err
+		}
+		if owed[i] != *fid {
+			if err := s.catalog.dropReference(&owed[i], e); err != nil {
+				return err
+			}
+		}
+	}
+	audit.Logf("gc: %s: removed archive:%d %s", fid, e.ArchiveID, e.UUID)
+	if err := s.catalog.Delete(fid); err != nil {
+		alert.Warnf("gc: %s: %v", fid, err)
+	}
+	// Removes the references of deleted imported files.
+	for other, ref := range refs {
+		if other != *fid && ref.Deleted {
+			other := other
+			if err := s.catalog.dropReference(&other, e); err != nil {
+				alert.Warnf("gc: %s: %v", &other, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkpoint saves the current state and then clears the changelog
+// records that it covers.
+func (s *GCService) checkpoint() error {
+	return s.follower.checkpoint(func(indexes map[string]int64) error {
+		st := &gcState{
+			Indexes: indexes,
+			Queue:   make(map[string]*deletion),
+		}
+		s.mu.Lock()
+		for fid, d := range s.queue {
+			st.Queue[fid.String()] = d
+		}
+		s.mu.Unlock()
+		return saveJSON(s.stateFile, st)
+	})
+}
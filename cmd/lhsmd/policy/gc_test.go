@@ -0,0 +1,248 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package policy
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/changelog"
+	"github.com/intel-hpdd/go-lustre/llapi"
+)
+
+type (
+	testGCRecord struct {
+		testRecord
+		hsm bool
+	}
+
+	testRemover struct {
+		fail    bool
+		removed []string
+		fids    []lustre.Fid
+	}
+)
+
+func (r *testGCRecord) IsLastUnlink() (bool, bool) { return true, r.hsm }
+
+func (t *testRemover) RemoveArchived(ctx context.Context, fid *lustre.Fid, e *CatalogEntry) error {
+	if t.fail {
+		return errors.New("mover unavailable")
+	}
+	t.removed = append(t.removed, e.UUID)
+	t.fids = append(t.fids, *fid)
+	return nil
+}
+
+func TestCatalog(t *testing.T) {
+	td, err := ioutil.TempDir("", "catalog-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	c, err := NewCatalog(path.Join(td, "catalog"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fid := &lustre.Fid{Seq: 0x200000401, Oid: 0x1, Ver: 0}
+	e := &CatalogEntry{ArchiveID: 2, UUID: "abc", URL: "posix://abc", Hash: []byte{1, 2}}
+	if err := c.Put(fid, e); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Get(fid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, e) {
+		t.Fatalf("expected %+v, got %+v", e, got)
+	}
+
+	if err := c.Delete(fid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(fid); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error, got %v", err)
+	}
+	if err := c.Delete(fid); err != nil {
+		t.Fatalf("deleting a missing entry failed: %v", err)
+	}
+}
+
+func TestGCCollect(t *testing.T) {
+	td, err := ioutil.TempDir("", "gc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	c, err := NewCatalog(path.Join(td, "catalog"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	fids := []*lustre.Fid{
+		{Seq: 1, Oid: 1},
+		{Seq: 1, Oid: 2},
+		{Seq: 1, Oid: 3},
+	}
+	c.Put(fids[0], &CatalogEntry{ArchiveID: 1, UUID: "archived"})
+	c.Put(fids[2], &CatalogEntry{ArchiveID: 1, UUID: "not-hsm"})
+
+	h := &testHandle{}
+	for i, fid := range fids {
+		h.records = append(h.records, &testGCRecord{
+			testRecord: testRecord{index: int64(i + 1), rType: llapi.OpUnlink, fid: fid, time: now},
+			hsm:        i != 2,
+		})
+	}
+
+	cfg := &GCConfig{
+		MDTs:          []string{"lustre-MDT0000"},
+		ChangelogUser: "cl2",
+		StateDir:      td,
+		GracePeriod:   "1h",
+	}
+	remover := &testRemover{fail: true}
+	newHandle := func(string) changelog.Handle { return h }
+	s, err := newGCService(cfg, c, remover, newHandle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.follower.read(context.Background(), h, "lustre-MDT0000"); err != nil {
+		t.Fatal(err)
+	}
+	// Only the archived file with a catalog entry can be collected.
+	if s.Queued() != 1 {
+		t.Fatalf("expected 1 queued deletion, got %d", s.Queued())
+	}
+
+	s.collect(context.Background(), now)
+	if len(remover.removed) != 0 {
+		t.Fatalf("removed before grace period: %v", remover.removed)
+	}
+
+	// Failed removals are kept, and survive a restart.
+	s.collect(context.Background(), now.Add(2*time.Hour))
+	if err := s.checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if h.cleared != 3 {
+		t.Fatalf("expected changelog cleared to 3, got %d", h.cleared)
+	}
+	s, err = newGCService(cfg, c, remover, newHandle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Queued() != 1 {
+		t.Fatalf("expected 1 queued deletion after restart, got %d", s.Queued())
+	}
+
+	remover.fail = false
+	s.collect(context.Background(), now.Add(2*time.Hour))
+	if !reflect.DeepEqual(remover.removed, []string{"archived"}) {
+		t.Fatalf("unexpected removals: %v", remover.removed)
+	}
+	if s.Queued() != 0 {
+		t.Fatalf("expected no queued deletions, got %d", s.Queued())
+	}
+	if _, err := c.Get(fids[0]); !os.IsNotExist(err) {
+		t.Fatalf("catalog entry not deleted: %v", err)
+	}
+}
+
+func TestGCSharedCopies(t *testing.T) {
+	td, err := ioutil.TempDir("", "gc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	c, err := NewCatalog(path.Join(td, "catalog"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := &lustre.Fid{Seq: 1, Oid: 1}
+	clone := &lustre.Fid{Seq: 1, Oid: 2}
+	first := &lustre.Fid{Seq: 1, Oid: 3}
+	second := &lustre.Fid{Seq: 1, Oid: 4}
+	entries := map[*lustre.Fid]*CatalogEntry{
+		// A clone shares the copy of the file it was made from.
+		original: {ArchiveID: 1, UUID: "shared"},
+		clone:    {ArchiveID: 1, UUID: "shared", Imported: true},
+		// Identical files archived to a deduplicating mover.
+		first:  {ArchiveID: 1, UUID: "dedup"},
+		second: {ArchiveID: 1, UUID: "dedup"},
+	}
+	for fid, e := range entries {
+		if err := c.Put(fid, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &GCConfig{
+		MDTs:          []string{"lustre-MDT0000"},
+		ChangelogUser: "cl2",
+		StateDir:      td,
+	}
+	remover := &testRemover{}
+	newHandle := func(string) changelog.Handle { return &testHandle{} }
+	s, err := newGCService(cfg, c, remover, newHandle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	deleteFiles := func(fids ...*lustre.Fid) {
+		for _, fid := range fids {
+			s.queue[*fid] = &deletion{Due: now, Entry: entries[fid]}
+		}
+		s.collect(context.Background(), now)
+		if s.Queued() != 0 {
+			t.Fatalf("expected no queued deletions, got %d", s.Queued())
+		}
+	}
+
+	// Copies still used by other files are kept.
+	deleteFiles(original, first)
+	if len(remover.removed) != 0 {
+		t.Fatalf("removed copies still in use: %v", remover.removed)
+	}
+	for _, fid := range []*lustre.Fid{original, first} {
+		if _, err := c.Get(fid); !os.IsNotExist(err) {
+			t.Fatalf("%s: catalog entry not deleted: %v", fid, err)
+		}
+	}
+
+	// Deleting the last file removes the copy once for each archived
+	// file, so the mover's own reference count reaches zero.
+	deleteFiles(clone, second)
+	counts := make(map[string]int)
+	for _, uuid := range remover.removed {
+		counts[uuid]++
+	}
+	if counts["shared"] != 1 || counts["dedup"] != 2 {
+		t.Fatalf("unexpected removals: %v", remover.removed)
+	}
+	for i, uuid := range remover.removed {
+		if uuid == "shared" && remover.fids[i] != *original {
+			t.Fatalf("shared copy removed for %s, expected %s", &remover.fids[i], original)
+		}
+	}
+	refs, err := ioutil.ReadDir(path.Join(td, "catalog", refsDir, "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 0 {
+		t.Fatalf("references left after removal: %v", refs)
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package policy
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/hsm"
+	"github.com/intel-hpdd/go-lustre/llapi"
+	"github.com/intel-hpdd/go-lustre/status"
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/agent/fileid"
+	"github.com/intel-hpdd/lemur/pkg/checksum"
+)
+
+type (
+	// fileSystem is the set of filesystem operations used by the
+	// policy service.
+	fileSystem interface {
+		Stat(*lustre.Fid) (*fileInfo, error)
+		RequestArchive(uint, []*lustre.Fid) error
+	}
+
+	// releaseFS is the set of filesystem operations used by the
+	// release service.
+	releaseFS interface {
+		Usage(pool string) (*usage, error)
+		Walk(dirs []string, fn func(*fileInfo)) error
+		RequestRelease(paths []string) error
+	}
+
+	lustreFS struct {
+		root fs.RootDir
+	}
+)
+
+// errNotRegular is returned by Stat for files that can't be archived.
+var errNotRegular = errors.New("not a regular file")
+
+// Lustre exports client device statistics in sysfs on newer releases and
+// procfs on older ones.
+var oscStatDirs = []string{"/sys/fs/lustre/osc", "/proc/fs/lustre/osc"}
+
+func (l *lustreFS) Stat(fid *lustre.Fid) (*fileInfo, error) {
+	fi, err := fs.StatFid(l.root, fid)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, errNotRegular
+	}
+
+	name, err := status.FidPathname(l.root, fid, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "fid2path failed")
+	}
+
+	return statFile(fs.FidPath(l.root, fid), name, fi)
+}
+
+// statFile collects the attributes of the file at p, which is named name
+// relative to the filesystem root.
+func statFile(p, name string, fi os.FileInfo) (*fileInfo, error) {
+	s, err := hsm.GetFileStatus(p)
+	if err != nil {
+		return nil, errors.Wrap(err, "get hsm status failed")
+	}
+
+	info := &fileInfo{
+		Path:      name,
+		Size:      fi.Size(),
+		ModTime:   fi.ModTime(),
+		ATime:     fi.ModTime(),
+		Archived:  s.Archived(),
+		Dirty:     s.Dirty(),
+		Released:  s.Released(),
+		NoArchive: s.NoArchive(),
+		NoRelease: s.NoRelease(),
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		info.UID = st.Uid
+		info.ATime = time.Unix(st.Atim.Unix())
+	}
+	if layout, err := llapi.FileDataLayout(p); err == nil {
+		info.Pool = layout.PoolName
+	}
+
+	return info, nil
+}
+
+func (l *lustreFS) RequestArchive(archiveID uint, fids []*lustre.Fid) error {
+	return hsm.RequestArchive(l.root, archiveID, fids)
+}
+
+// Walk calls fn for each regular file below the directories, which are
+// relative to the filesystem root. Files that can't be read are skipped.
+func (l *lustreFS) Walk(dirs []string, fn func(*fileInfo)) error {
+	for _, dir := range dirs {
+		err := filepath.Walk(l.root.Join(dir), func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				// Files may be removed during the walk.
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			info, err := statFile(p, strings.TrimPrefix(p, l.root.Path()), fi)
+			if err != nil {
+				return nil
+			}
+			fn(info)
+			return nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "walk %s failed", dir)
+		}
+	}
+	return nil
+}
+
+// WalkArchived calls fn for each file below the directories, which are
+// relative to the filesystem root, that has an archive copy. It stops if
+// fn returns an error. Files that can't be read are skipped.
+func (l *lustreFS) WalkArchived(dirs []string, fn func(*archivedFile) error) error {
+	for _, dir := range dirs {
+		err := filepath.Walk(l.root.Join(dir), func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				// Files may be removed during the walk.
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			f, err := archivedFileAt(p, fi)
+			if err != nil || f == nil {
+				return nil
+			}
+			f.Path = strings.TrimPrefix(p, l.root.Path())
+			return fn(f)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "walk %s failed", dir)
+		}
+	}
+	return nil
+}
+
+// archivedFileAt returns the archive copy of the file at p, or nil if it
+// hasn't been archived.
+func archivedFileAt(p string, fi os.FileInfo) (*archivedFile, error) {
+	state, archiveID, err := llapi.GetHsmFileStatus(p)
+	if err != nil {
+		return nil, errors.Wrap(err, "get hsm status failed")
+	}
+	if !state.HasFlag(llapi.HsmFileArchived) {
+		return nil, nil
+	}
+	uuid, err := fileid.UUID.Get(p)
+	if err != nil || len(uuid) == 0 {
+		return nil, errors.Errorf("%s: no file id", p)
+	}
+	fid, err := fs.LookupFid(p)
+	if err != nil {
+		return nil, errors.Wrap(err, "lookup fid failed")
+	}
+
+	e := &CatalogEntry{ArchiveID: uint(archiveID), UUID: string(uuid)}
+	if buf, err := fileid.Hash.Get(p); err == nil && len(buf) > 0 {
+		if e.Hash, err = checksum.Parse(string(buf)); err != nil {
+			return nil, errors.Wrap(err, p)
+		}
+	}
+	if url, err := fileid.URL.Get(p); err == nil {
+		e.URL = string(url)
+	}
+	return &archivedFile{Fid: fid, Size: fi.Size(), Entry: e}, nil
+}
+
+func (l *lustreFS) RequestRelease(paths []string) error {
+	var fids []*lustre.Fid
+	for _, p := range paths {
+		fid, err := fs.LookupFid(l.root.Join(p))
+		if err != nil {
+			// Removed since it was selected
+			continue
+		}
+		fids = append(fids, fid)
+	}
+	if len(fids) == 0 {
+		return nil
+	}
+	return hsm.RequestRelease(l.root, 0, fids)
+}
+
+// Usage returns the space used in the filesystem, or in an OST pool if
+// pool is not empty.
+func (l *lustreFS) Usage(pool string) (*usage, error) {
+	if pool == "" {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(l.root.Path(), &st); err != nil {
+			return nil, errors.Wrap(err, "statfs failed")
+		}
+		return &usage{
+			Used:  (st.Blocks - st.Bfree) * uint64(st.Bsize),
+			Avail: st.Bavail * uint64(st.Bsize),
+		}, nil
+	}
+
+	lov, err := status.LovName(l.root.Path())
+	if err != nil {
+		return nil, errors.Wrap(err, "get lov name failed")
+	}
+	data, err := ioutil.ReadFile(path.Join("/proc/fs/lustre/lov", lov, "pools", pool))
+	if err != nil {
+		return nil, errors.Wrapf(err, "read pool %s failed", pool)
+	}
+	// The OSC devices share the instance suffix of the LOV device.
+	instance := lov[strings.LastIndex(lov, "-")+1:]
+
+	u := &usage{}
+	for _, uuid := range strings.Fields(string(data)) {
+		ost := strings.TrimSuffix(uuid, "_UUID")
+		ostUsage, err := oscUsage(ost + "-osc-" + instance)
+		if err != nil {
+			return nil, err
+		}
+		u.Used += ostUsage.Used
+		u.Avail += ostUsage.Avail
+	}
+	return u, nil
+}
+
+func oscUsage(osc string) (*usage, error) {
+	read := func(dir, name string) (uint64, error) {
+		data, err := ioutil.ReadFile(path.Join(dir, osc, name))
+		if err != nil {
+			return 0, err
+		}
+		return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	}
+
+	var lastErr error
+	for _, dir := range oscStatDirs {
+		total, err := read(dir, "kbytestotal")
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		free, err := read(dir, "kbytesfree")
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: read free space failed", osc)
+		}
+		avail, err := read(dir, "kbytesavail")
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: read available space failed", osc)
+		}
+		return &usage{Used: (total - free) * 1024, Avail: avail * 1024}, nil
+	}
+	return nil, errors.Wrapf(lastErr, "%s: read usage failed", osc)
+}
@@ -0,0 +1,296 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+/*
+Package policy implements an automatic archive policy for lhsmd. It follows
+the changelogs of the filesystem's MDTs for files that have been created or
+modified, evaluates them against a list of configured rules, and submits
+archive requests for those that match.
+
+Files are tracked in a pending set until they either match a rule and are
+old enough to be archived, or no longer need archiving. The pending set and
+the position in each changelog are saved in a state file before any
+changelog records are cleared, so that no changes are lost if lhsmd is
+restarted.
+
+The package also implements a release service, which frees space when the
+filesystem or an OST pool rises above a high watermark by releasing the
+least recently accessed archived files until usage falls below a low
+watermark, and a garbage collector, which removes the archive copies of
+files that have been deleted from the filesystem.
+*/
+package policy
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/changelog"
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/llapi"
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/config"
+	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/audit"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+type (
+	// Service applies the archive policy to files reported in the
+	// changelog.
+	Service struct {
+		cfg       *Config
+		fs        fileSystem
+		rules     []*rule
+		interval  time.Duration
+		batchSize int
+		stateFile string
+		follower  *follower
+
+		mu      sync.Mutex
+		pending map[lustre.Fid]*candidate
+	}
+
+	candidate struct {
+		due time.Time // Earliest time to evaluate the file
+		gen uint64    // Incremented each time the file changes
+	}
+)
+
+// New returns a Service for the filesystem mounted at root.
+func New(cfg *Config, root fs.RootDir) (*Service, error) {
+	return newService(cfg, &lustreFS{root: root}, changelog.CreateHandle)
+}
+
+func newService(cfg *Config, fsys fileSystem, openHandle func(string) changelog.Handle) (*Service, error) {
+	if err := cfg.CheckValid(); err != nil {
+		return nil, err
+	}
+
+	s := &Service{
+		cfg:       cfg,
+		fs:        fsys,
+		interval:  time.Duration(cfg.Interval) * time.Second,
+		batchSize: cfg.BatchSize,
+		stateFile: path.Join(cfg.StateDir, "policy.state"),
+		pending:   make(map[lustre.Fid]*candidate),
+	}
+	s.follower = newFollower(cfg.MDTs, cfg.ChangelogUser, openHandle, s.consume)
+	if s.interval <= 0 {
+		s.interval = config.DefaultPolicyInterval * time.Second
+	}
+	if s.batchSize <= 0 {
+		s.batchSize = config.DefaultPolicyBatchSize
+	}
+	for _, rc := range cfg.Rules {
+		r, err := newRule(rc)
+		if err != nil {
+			return nil, err
+		}
+		s.rules = append(s.rules, r)
+	}
+
+	if err := os.MkdirAll(cfg.StateDir, 0700); err != nil {
+		return nil, errors.Wrap(err, "create state dir failed")
+	}
+	st, err := loadState(s.stateFile)
+	if err != nil {
+		return nil, err
+	}
+	s.follower.restore(st.Indexes)
+	for fidStr, due := range st.Pending {
+		fid, err := lustre.ParseFid(fidStr)
+		if err != nil {
+			alert.Warnf("policy: ignoring bad fid %q in %s", fidStr, s.stateFile)
+			continue
+		}
+		s.pending[*fid] = &candidate{due: due}
+	}
+
+	return s, nil
+}
+
+func (s *Service) String() string {
+	return fmt.Sprintf("mdts:%v rules:%d interval:%v batch:%d",
+		s.cfg.MDTs, len(s.rules), s.interval, s.batchSize)
+}
+
+// Run follows the changelogs and applies the policy until the context
+// is cancelled.
+func (s *Service) Run(ctx context.Context) {
+	audit.Logf("policy: starting %s, %d files pending", s, s.Pending())
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		s.follower.run(ctx)
+		wg.Done()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			if err := s.checkpoint(); err != nil {
+				alert.Warnf("policy: %v", err)
+			}
+			debug.Print("policy: stopped")
+			return
+		case <-time.After(s.interval):
+			s.evaluate(time.Now())
+			if err := s.checkpoint(); err != nil {
+				alert.Warnf("policy: %v", err)
+			}
+		}
+	}
+}
+
+// Pending returns the number of files waiting to be evaluated.
+func (s *Service) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// consume adds or removes the record's file from the pending set.
+func (s *Service) consume(mdt string, r changelog.Record) {
+	fid := r.TargetFid()
+	if fid == nil || fid.IsZero() {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.TypeCode() {
+	case llapi.OpCreate, llapi.OpClose, llapi.OpMtime, llapi.OpTrunc:
+		c, ok := s.pending[*fid]
+		if !ok {
+			c = &candidate{}
+			s.pending[*fid] = c
+		}
+		c.due = r.Time()
+		c.gen++
+	case llapi.OpUnlink:
+		if last, _ := r.IsLastUnlink(); last {
+			delete(s.pending, *fid)
+		}
+	}
+}
+
+// matchRule returns the first rule that applies to the file, or nil.
+func (s *Service) matchRule(fi *fileInfo) *rule {
+	for _, r := range s.rules {
+		if r.Match(fi) {
+			return r
+		}
+	}
+	return nil
+}
+
+// evaluate checks the pending files that are due and submits archive
+// requests for those that match a rule.
+func (s *Service) evaluate(now time.Time) {
+	type due struct {
+		fid lustre.Fid
+		gen uint64
+	}
+
+	s.mu.Lock()
+	var work []due
+	gens := make(map[lustre.Fid]uint64)
+	for fid, c := range s.pending {
+		if !c.due.After(now) {
+			work = append(work, due{fid, c.gen})
+			gens[fid] = c.gen
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(map[lustre.Fid]uint64)
+	later := make(map[lustre.Fid]time.Time)
+	batches := make(map[uint][]*lustre.Fid)
+
+	for _, w := range work {
+		fid := w.fid
+		fi, err := s.fs.Stat(&fid)
+		if err != nil {
+			if os.IsNotExist(err) || err == errNotRegular {
+				done[fid] = w.gen
+			} else {
+				alert.Warnf("policy: %s: %v", &fid, err)
+			}
+			continue
+		}
+		if !fi.NeedsArchive() {
+			done[fid] = w.gen
+			continue
+		}
+		r := s.matchRule(fi)
+		if r == nil {
+			done[fid] = w.gen
+			continue
+		}
+		if eligible := r.Eligible(fi); eligible.After(now) {
+			later[fid] = eligible
+			continue
+		}
+		debug.Printf("policy: %s matched %s", fi.Path, r)
+		batches[r.archiveID] = append(batches[r.archiveID], &fid)
+	}
+
+	for archiveID, fids := range batches {
+		for len(fids) > 0 {
+			n := s.batchSize
+			if n > len(fids) {
+				n = len(fids)
+			}
+			batch := fids[:n]
+			fids = fids[n:]
+			if err := s.fs.RequestArchive(archiveID, batch); err != nil {
+				alert.Warnf("policy: archive:%d request for %d files failed: %v", archiveID, len(batch), err)
+				continue
+			}
+			audit.Logf("policy: archive:%d requested %d files", archiveID, len(batch))
+			for _, fid := range batch {
+				done[*fid] = gens[*fid]
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for fid, gen := range done {
+		// The file may have changed again while it was being evaluated.
+		if c, ok := s.pending[fid]; ok && c.gen == gen {
+			delete(s.pending, fid)
+		}
+	}
+	for fid, eligible := range later {
+		if c, ok := s.pending[fid]; ok && c.gen == gens[fid] {
+			c.due = eligible
+		}
+	}
+}
+
+// checkpoint saves the current state and then clears the changelog
+// records that it covers.
+func (s *Service) checkpoint() error {
+	return s.follower.checkpoint(func(indexes map[string]int64) error {
+		st := newState()
+		st.Indexes = indexes
+		s.mu.Lock()
+		for fid, c := range s.pending {
+			st.Pending[fid.String()] = c.due
+		}
+		s.mu.Unlock()
+		return st.save(s.stateFile)
+	})
+}
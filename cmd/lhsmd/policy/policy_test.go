@@ -0,0 +1,275 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package policy
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/hcl"
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/changelog"
+	"github.com/intel-hpdd/go-lustre/llapi"
+)
+
+type (
+	testRecord struct {
+		changelog.Record
+		index int64
+		rType uint
+		fid   *lustre.Fid
+		time  time.Time
+	}
+
+	testHandle struct {
+		records []changelog.Record
+		next    int
+		cleared int64
+	}
+
+	testFS struct {
+		files    map[lustre.Fid]*fileInfo
+		requests map[uint][]string
+	}
+)
+
+func (r *testRecord) Index() int64               { return r.index }
+func (r *testRecord) TypeCode() uint             { return r.rType }
+func (r *testRecord) TargetFid() *lustre.Fid     { return r.fid }
+func (r *testRecord) Time() time.Time            { return r.time }
+func (r *testRecord) IsLastUnlink() (bool, bool) { return r.rType == llapi.OpUnlink, false }
+
+func (h *testHandle) Open(follow bool) error { return h.OpenAt(1, follow) }
+func (h *testHandle) OpenAt(start int64, follow bool) error {
+	for h.next = 0; h.next < len(h.records); h.next++ {
+		if h.records[h.next].Index() >= start {
+			break
+		}
+	}
+	return nil
+}
+func (h *testHandle) Close() error { return nil }
+func (h *testHandle) NextRecord() (changelog.Record, error) {
+	if h.next >= len(h.records) {
+		return nil, io.EOF
+	}
+	h.next++
+	return h.records[h.next-1], nil
+}
+func (h *testHandle) Clear(token string, endRec int64) error {
+	h.cleared = endRec
+	return nil
+}
+func (h *testHandle) String() string { return "test" }
+
+func (t *testFS) Stat(fid *lustre.Fid) (*fileInfo, error) {
+	fi, ok := t.files[*fid]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return fi, nil
+}
+
+func (t *testFS) RequestArchive(archiveID uint, fids []*lustre.Fid) error {
+	for _, fid := range fids {
+		t.requests[archiveID] = append(t.requests[archiveID], t.files[*fid].Path)
+	}
+	return nil
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"/project/*", "/project/a", true},
+		{"/project/*", "/project/a/b", false},
+		{"/project/**", "/project/a/b", true},
+		{"/project/**/*.dat", "/project/a/b/c.dat", true},
+		{"/project/**/*.dat", "/project/c.dat", true},
+		{"/project/**/*.dat", "/project/a/c.txt", false},
+		{"/scratch/**", "/project/a", false},
+	}
+
+	for _, tc := range tests {
+		if got := matchGlob(tc.pattern, tc.name); got != tc.match {
+			t.Errorf("matchGlob(%q, %q) = %v, expected %v", tc.pattern, tc.name, got, tc.match)
+		}
+	}
+}
+
+func TestRuleMatch(t *testing.T) {
+	r, err := newRule(&RuleConfig{
+		Name:      "big",
+		ArchiveID: 1,
+		Paths:     []string{"/project/**"},
+		MinSize:   "1MiB",
+		Owners:    []string{"1000"},
+		Pools:     []string{"flash"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi := &fileInfo{Path: "project/a/b", Size: 1 << 20, UID: 1000, Pool: "flash"}
+	if !r.Match(fi) {
+		t.Fatalf("%s did not match %+v", r, fi)
+	}
+
+	for _, mod := range []func(*fileInfo){
+		func(fi *fileInfo) { fi.Path = "scratch/a" },
+		func(fi *fileInfo) { fi.Size = 1024 },
+		func(fi *fileInfo) { fi.UID = 0 },
+		func(fi *fileInfo) { fi.Pool = "" },
+	} {
+		other := *fi
+		mod(&other)
+		if r.Match(&other) {
+			t.Errorf("%s unexpectedly matched %+v", r, other)
+		}
+	}
+}
+
+func TestConfigDecode(t *testing.T) {
+	var cfg Config
+	err := hcl.Decode(&cfg, `
+enabled = true
+mdts = ["lustre-MDT0000"]
+changelog_user = "cl1"
+state_dir = "/tmp"
+
+rule "old" {
+	archive_id = 2
+	paths = ["/project/**"]
+	min_age = "24h"
+	max_size = "10GiB"
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.CheckValid(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := RuleSet{
+		{
+			Name:      "old",
+			ArchiveID: 2,
+			Paths:     []string{"/project/**"},
+			MinAge:    "24h",
+			MaxSize:   "10GiB",
+		},
+	}
+	if !reflect.DeepEqual(cfg.Rules, expected) {
+		t.Fatalf("expected %+v, got %+v", expected[0], cfg.Rules[0])
+	}
+
+	cfg.Rules[0].MinAge = "a day"
+	if err := cfg.CheckValid(); err == nil {
+		t.Fatal("expected error for bad min_age")
+	}
+}
+
+func TestServiceEvaluate(t *testing.T) {
+	td, err := ioutil.TempDir("", "policy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	now := time.Now()
+	fids := []*lustre.Fid{
+		{Seq: 1, Oid: 1},
+		{Seq: 1, Oid: 2},
+		{Seq: 1, Oid: 3},
+		{Seq: 1, Oid: 4},
+		{Seq: 1, Oid: 5},
+	}
+	fsys := &testFS{
+		files: map[lustre.Fid]*fileInfo{
+			*fids[0]: {Path: "project/old", ModTime: now.Add(-48 * time.Hour)},
+			*fids[1]: {Path: "project/new", ModTime: now},
+			*fids[2]: {Path: "project/done", ModTime: now.Add(-48 * time.Hour), Archived: true},
+			*fids[3]: {Path: "scratch/tmp", ModTime: now.Add(-48 * time.Hour)},
+			*fids[4]: {Path: "project/gone", ModTime: now.Add(-48 * time.Hour)},
+		},
+		requests: make(map[uint][]string),
+	}
+	h := &testHandle{}
+	for i, fid := range fids {
+		h.records = append(h.records, &testRecord{
+			index: int64(i + 1),
+			rType: llapi.OpClose,
+			fid:   fid,
+			time:  now.Add(-time.Minute),
+		})
+	}
+	h.records = append(h.records, &testRecord{index: 6, rType: llapi.OpUnlink, fid: fids[4]})
+
+	cfg := &Config{
+		MDTs:          []string{"lustre-MDT0000"},
+		ChangelogUser: "cl1",
+		StateDir:      td,
+		Rules: RuleSet{
+			{Name: "project", ArchiveID: 3, Paths: []string{"/project/**"}, MinAge: "24h"},
+		},
+	}
+	newHandle := func(string) changelog.Handle { return h }
+	s, err := newService(cfg, fsys, newHandle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.follower.read(context.Background(), h, "lustre-MDT0000"); err != nil {
+		t.Fatal(err)
+	}
+	s.evaluate(now)
+
+	if got := fsys.requests[3]; !reflect.DeepEqual(got, []string{"project/old"}) {
+		t.Fatalf("unexpected archive requests: %v", got)
+	}
+	// Only the file that is too new should still be pending.
+	if s.Pending() != 1 {
+		t.Fatalf("expected 1 pending file, got %d", s.Pending())
+	}
+	if due := s.pending[*fids[1]].due; !due.Equal(now.Add(24 * time.Hour)) {
+		t.Fatalf("expected file due at %v, got %v", now.Add(24*time.Hour), due)
+	}
+
+	if err := s.checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if h.cleared != 6 {
+		t.Fatalf("expected changelog cleared to 6, got %d", h.cleared)
+	}
+
+	// A restarted service picks up where the last one left off.
+	s, err = newService(cfg, fsys, newHandle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Pending() != 1 || s.follower.Indexes()["lustre-MDT0000"] != 6 {
+		t.Fatalf("state not restored: %d pending, index %d", s.Pending(), s.follower.Indexes()["lustre-MDT0000"])
+	}
+
+	s.evaluate(now.Add(25 * time.Hour))
+	got := fsys.requests[3]
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, []string{"project/new", "project/old"}) {
+		t.Fatalf("unexpected archive requests: %v", got)
+	}
+	if s.Pending() != 0 {
+		t.Fatalf("expected no pending files, got %d", s.Pending())
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package policy
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/config"
+	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/audit"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+type (
+	// ReleaseService releases archived files when the filesystem, or
+	// an OST pool, is filling up.
+	ReleaseService struct {
+		cfg       *ReleaseConfig
+		fs        releaseFS
+		interval  time.Duration
+		batchSize int
+		paths     []string
+		minAge    time.Duration
+		minSize   int64
+	}
+
+	usage struct {
+		Used  uint64
+		Avail uint64
+	}
+
+	// releasePass is the outcome of a release pass for a target.
+	releasePass struct {
+		target   *TargetConfig
+		usage    *usage
+		need     uint64 // Bytes to be released to reach the low watermark
+		freed    uint64
+		selected []*fileInfo
+	}
+)
+
+// Percent returns the used space as a percentage of the usable space.
+func (u *usage) Percent() float64 {
+	if u.Used+u.Avail == 0 {
+		return 0
+	}
+	return float64(u.Used) * 100 / float64(u.Used+u.Avail)
+}
+
+// NewRelease returns a ReleaseService for the filesystem mounted at root.
+func NewRelease(cfg *ReleaseConfig, root fs.RootDir) (*ReleaseService, error) {
+	return newReleaseService(cfg, &lustreFS{root: root})
+}
+
+func newReleaseService(cfg *ReleaseConfig, fsys releaseFS) (*ReleaseService, error) {
+	if err := cfg.CheckValid(); err != nil {
+		return nil, err
+	}
+
+	s := &ReleaseService{
+		cfg:       cfg,
+		fs:        fsys,
+		interval:  time.Duration(cfg.Interval) * time.Second,
+		batchSize: cfg.BatchSize,
+		paths:     cfg.Paths,
+	}
+	if s.interval <= 0 {
+		s.interval = config.DefaultReleaseInterval * time.Second
+	}
+	if s.batchSize <= 0 {
+		s.batchSize = config.DefaultPolicyBatchSize
+	}
+	if len(s.paths) == 0 {
+		s.paths = []string{"/"}
+	}
+	if cfg.MinAge != "" {
+		s.minAge, _ = time.ParseDuration(cfg.MinAge)
+	}
+	s.minSize, _ = parseSize(cfg.MinSize)
+
+	return s, nil
+}
+
+func (s *ReleaseService) String() string {
+	var targets []string
+	for _, t := range s.cfg.Targets {
+		targets = append(targets, fmt.Sprintf("%s:%d-%d%%", t.Name, t.LowWatermark, t.HighWatermark))
+	}
+	return fmt.Sprintf("targets:%v paths:%v interval:%v dry run:%v",
+		targets, s.paths, s.interval, s.cfg.DryRun)
+}
+
+// Run checks the targets' usage and releases files until the context is
+// cancelled.
+func (s *ReleaseService) Run(ctx context.Context) {
+	audit.Logf("release: starting %s", s)
+	for {
+		s.check(time.Now())
+		select {
+		case <-ctx.Done():
+			debug.Print("release: stopped")
+			return
+		case <-time.After(s.interval):
+		}
+	}
+}
+
+// check runs a release pass for each target that is above its high
+// watermark.
+func (s *ReleaseService) check(now time.Time) {
+	for _, t := range s.cfg.Targets {
+		u, err := s.fs.Usage(t.Pool)
+		if err != nil {
+			alert.Warnf("release: %s: %v", t.Name, err)
+			continue
+		}
+		debug.Printf("release: %s: %.1f%% used", t.Name, u.Percent())
+		if u.Percent() < float64(t.HighWatermark) {
+			continue
+		}
+
+		pass, err := s.plan(t, u, now)
+		if err != nil {
+			alert.Warnf("release: %s: %v", t.Name, err)
+			continue
+		}
+		if s.cfg.DryRun {
+			s.report(pass)
+			continue
+		}
+		s.release(pass)
+	}
+}
+
+// plan selects the files to release to bring the target down to its low
+// watermark.
+func (s *ReleaseService) plan(t *TargetConfig, u *usage, now time.Time) (*releasePass, error) {
+	pass := &releasePass{target: t, usage: u}
+	low := uint64(float64(u.Used+u.Avail) * float64(t.LowWatermark) / 100)
+	if u.Used <= low {
+		return pass, nil
+	}
+	pass.need = u.Used - low
+
+	type candidate struct {
+		fi    *fileInfo
+		score float64
+	}
+	var candidates []candidate
+	err := s.fs.Walk(s.paths, func(fi *fileInfo) {
+		if !s.eligible(t, fi, now) {
+			return
+		}
+		candidates = append(candidates, candidate{fi, s.score(fi, now)})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+	for _, c := range candidates {
+		if pass.freed >= pass.need {
+			break
+		}
+		pass.selected = append(pass.selected, c.fi)
+		pass.freed += uint64(c.fi.Size)
+	}
+	return pass, nil
+}
+
+func (s *ReleaseService) eligible(t *TargetConfig, fi *fileInfo, now time.Time) bool {
+	if !fi.CanRelease() || fi.Size == 0 || fi.Size < s.minSize {
+		return false
+	}
+	if t.Pool != "" && fi.Pool != t.Pool {
+		return false
+	}
+	if now.Sub(fi.ATime) < s.minAge {
+		return false
+	}
+	return !matchAny(s.cfg.Exclude, fi.Path)
+}
+
+// score returns the release priority of a file. Files that were accessed
+// longest ago are released first, scaled by size_weight percent per GiB
+// and by the first matching path_weight.
+func (s *ReleaseService) score(fi *fileInfo, now time.Time) float64 {
+	score := now.Sub(fi.ATime).Seconds()
+	if score < 1 {
+		score = 1
+	}
+	score *= 1 + float64(s.cfg.SizeWeight)/100*float64(fi.Size)/(1<<30)
+	for _, pw := range s.cfg.PathWeights {
+		if matchAny([]string{pw.Pattern}, fi.Path) {
+			score *= float64(pw.Weight) / 100
+			break
+		}
+	}
+	return score
+}
+
+func (s *ReleaseService) report(pass *releasePass) {
+	t := pass.target
+	audit.Logf("release: %s: dry run: %.1f%% used (high:%d%% low:%d%%), need %s, would release %d files (%s)",
+		t.Name, pass.usage.Percent(), t.HighWatermark, t.LowWatermark,
+		humanize.IBytes(pass.need), len(pass.selected), humanize.IBytes(pass.freed))
+	for _, fi := range pass.selected {
+		audit.Logf("release: %s: dry run: %s %s accessed %s",
+			t.Name, fi.Path, humanize.IBytes(uint64(fi.Size)), fi.ATime.Format(time.RFC3339))
+	}
+	if pass.freed < pass.need {
+		alert.Warnf("release: %s: only %s of %s can be released",
+			t.Name, humanize.IBytes(pass.freed), humanize.IBytes(pass.need))
+	}
+}
+
+func (s *ReleaseService) release(pass *releasePass) {
+	t := pass.target
+	audit.Logf("release: %s: %.1f%% used (high:%d%% low:%d%%), releasing %d files (%s)",
+		t.Name, pass.usage.Percent(), t.HighWatermark, t.LowWatermark,
+		len(pass.selected), humanize.IBytes(pass.freed))
+
+	files := pass.selected
+	for len(files) > 0 {
+		n := s.batchSize
+		if n > len(files) {
+			n = len(files)
+		}
+		var paths []string
+		for _, fi := range files[:n] {
+			paths = append(paths, fi.Path)
+		}
+		files = files[n:]
+		if err := s.fs.RequestRelease(paths); err != nil {
+			alert.Warnf("release: %s: request for %d files failed: %v", t.Name, len(paths), err)
+		}
+	}
+	if pass.freed < pass.need {
+		alert.Warnf("release: %s: only %s of %s can be released",
+			t.Name, humanize.IBytes(pass.freed), humanize.IBytes(pass.need))
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package policy
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testReleaseFS struct {
+	usage    map[string]*usage
+	files    []*fileInfo
+	released []string
+}
+
+func (t *testReleaseFS) Usage(pool string) (*usage, error) {
+	return t.usage[pool], nil
+}
+
+func (t *testReleaseFS) Walk(dirs []string, fn func(*fileInfo)) error {
+	for _, fi := range t.files {
+		fn(fi)
+	}
+	return nil
+}
+
+func (t *testReleaseFS) RequestRelease(paths []string) error {
+	t.released = append(t.released, paths...)
+	return nil
+}
+
+func TestReleaseWatermarks(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	const gib = 1 << 30
+
+	fsys := &testReleaseFS{
+		usage: map[string]*usage{
+			"":      {Used: 95 * gib, Avail: 5 * gib},
+			"flash": {Used: 50 * gib, Avail: 50 * gib},
+		},
+		files: []*fileInfo{
+			{Path: "/project/old", Size: 10 * gib, ATime: now.Add(-30 * day), Archived: true},
+			{Path: "/project/older", Size: 10 * gib, ATime: now.Add(-60 * day), Archived: true},
+			{Path: "/project/dirty", Size: 10 * gib, ATime: now.Add(-90 * day), Archived: true, Dirty: true},
+			{Path: "/project/new", Size: 10 * gib, ATime: now.Add(-time.Minute), Archived: true},
+			{Path: "/project/keep/a", Size: 10 * gib, ATime: now.Add(-90 * day), Archived: true},
+			{Path: "/project/unarchived", Size: 10 * gib, ATime: now.Add(-90 * day)},
+			{Path: "/scratch/recent", Size: 10 * gib, ATime: now.Add(-20 * day), Archived: true},
+		},
+	}
+	cfg := &ReleaseConfig{
+		MinAge:      "1h",
+		Exclude:     []string{"/project/keep/**"},
+		PathWeights: []*PathWeightConfig{{Pattern: "/scratch/**", Weight: 400}},
+		Targets: []*TargetConfig{
+			{Name: "fs", HighWatermark: 90, LowWatermark: 70},
+			{Name: "flash", Pool: "flash", HighWatermark: 90, LowWatermark: 70},
+		},
+	}
+
+	s, err := newReleaseService(cfg, fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 25GiB must be released. The scratch file is weighted ahead of the
+	// project files, which are released least recently accessed first.
+	pass, err := s.plan(cfg.Targets[0], fsys.usage[""], now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pass.need != 25*gib {
+		t.Fatalf("expected to need 25GiB, got %d", pass.need)
+	}
+
+	cfg.DryRun = true
+	s.check(now)
+	if len(fsys.released) != 0 {
+		t.Fatalf("dry run released files: %v", fsys.released)
+	}
+
+	cfg.DryRun = false
+	s.check(now)
+	expected := []string{"/scratch/recent", "/project/older", "/project/old"}
+	if !reflect.DeepEqual(fsys.released, expected) {
+		t.Fatalf("expected %v to be released, got %v", expected, fsys.released)
+	}
+}
+
+func TestReleaseConfigValid(t *testing.T) {
+	cfg := &ReleaseConfig{
+		Targets: []*TargetConfig{{Name: "fs", HighWatermark: 80, LowWatermark: 90}},
+	}
+	if err := cfg.CheckValid(); err == nil {
+		t.Fatal("expected error for low_watermark above high_watermark")
+	}
+}
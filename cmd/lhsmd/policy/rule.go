@@ -0,0 +1,145 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package policy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+type (
+	// fileInfo is the subset of a file's attributes that rules are
+	// evaluated against.
+	fileInfo struct {
+		Path    string // Relative to the filesystem root
+		Size    int64
+		UID     uint32
+		ModTime time.Time
+		ATime   time.Time
+		Pool    string
+
+		Archived  bool
+		Dirty     bool
+		Released  bool
+		NoArchive bool
+		NoRelease bool
+	}
+
+	rule struct {
+		name      string
+		archiveID uint
+		paths     []string
+		minAge    time.Duration
+		minSize   int64
+		maxSize   int64
+		owners    []uint32
+		pools     []string
+	}
+)
+
+// CanRelease returns true if the file's data is safely in the archive and
+// may be removed from the filesystem.
+func (fi *fileInfo) CanRelease() bool {
+	return fi.Archived && !fi.Dirty && !fi.Released && !fi.NoRelease
+}
+
+// NeedsArchive returns true if the file has no up to date copy in the
+// archive and is allowed to be archived.
+func (fi *fileInfo) NeedsArchive() bool {
+	if fi.NoArchive || fi.Released {
+		return false
+	}
+	return !fi.Archived || fi.Dirty
+}
+
+func (r *rule) String() string {
+	return fmt.Sprintf("rule:%s archive:%d", r.name, r.archiveID)
+}
+
+// Match returns true if the file matches all of the rule's criteria
+// other than age.
+func (r *rule) Match(fi *fileInfo) bool {
+	if len(r.paths) > 0 && !matchAny(r.paths, fi.Path) {
+		return false
+	}
+	if fi.Size < r.minSize {
+		return false
+	}
+	if r.maxSize > 0 && fi.Size > r.maxSize {
+		return false
+	}
+	if len(r.owners) > 0 && !containsUID(r.owners, fi.UID) {
+		return false
+	}
+	if len(r.pools) > 0 && !containsString(r.pools, fi.Pool) {
+		return false
+	}
+	return true
+}
+
+// Eligible returns the time at which the file will be old enough for the
+// rule to apply.
+func (r *rule) Eligible(fi *fileInfo) time.Time {
+	return fi.ModTime.Add(r.minAge)
+}
+
+// matchAny returns true if name matches one of the glob patterns.
+func matchAny(patterns []string, name string) bool {
+	name = path.Clean("/" + name)
+	for _, p := range patterns {
+		if matchGlob(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches name against a path.Match pattern, where a "**"
+// component also matches any number of directories. A pattern ending in
+// "/**" matches everything below that directory.
+func matchGlob(pattern, name string) bool {
+	return matchParts(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchParts(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(name); i >= 0; i-- {
+				if matchParts(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+func containsUID(uids []uint32, uid uint32) bool {
+	for _, u := range uids {
+		if u == uid {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
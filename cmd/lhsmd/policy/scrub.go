@@ -0,0 +1,243 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package policy
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	"github.com/rcrowley/go-metrics"
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/config"
+	"github.com/intel-hpdd/lemur/pkg/checksum"
+	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/audit"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+var (
+	// ErrChecksumMismatch is returned by a Verifier when an archive copy
+	// doesn't match the checksum recorded for its file.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+
+	// ErrNotSupported is returned (possibly wrapped) when an archive's
+	// mover doesn't support an action the agent generates.
+	ErrNotSupported = errors.New("operation not supported")
+)
+
+type (
+	// Verifier compares the archive copy of a file with the file's
+	// recorded checksum.
+	Verifier interface {
+		VerifyArchived(ctx context.Context, fid *lustre.Fid, e *CatalogEntry) error
+	}
+
+	// scrubFS is the set of filesystem operations used by the scrub
+	// service.
+	scrubFS interface {
+		WalkArchived(dirs []string, fn func(*archivedFile) error) error
+	}
+
+	// archivedFile is a file with an archive copy.
+	archivedFile struct {
+		Path  string
+		Fid   *lustre.Fid
+		Size  int64
+		Entry *CatalogEntry
+	}
+
+	// ScrubService periodically reads the archive copies of archived
+	// files and compares them with the checksums recorded when they
+	// were archived, so that damaged copies are found before they are
+	// needed. The rate copies are read at is limited, so a pass can run
+	// alongside normal archive traffic.
+	ScrubService struct {
+		cfg       *ScrubConfig
+		fs        scrubFS
+		verifier  Verifier
+		interval  time.Duration
+		paths     []string
+		rate      int
+		bandwidth int64
+		stateFile string
+		now       func() time.Time
+
+		verified   metrics.Counter
+		mismatched metrics.Counter
+		failed     metrics.Counter
+		bytes      metrics.Counter
+	}
+
+	scrubState struct {
+		LastPass time.Time `json:"last_pass"`
+	}
+
+	// scrubPass is the outcome of a scrub pass.
+	scrubPass struct {
+		files      int64
+		bytes      int64
+		verified   int
+		mismatched int
+		failed     int
+		skipped    int
+	}
+)
+
+// NewScrub returns a ScrubService that verifies the archive copies of the
+// files in the filesystem mounted at root with verifier.
+func NewScrub(cfg *ScrubConfig, root fs.RootDir, verifier Verifier) (*ScrubService, error) {
+	return newScrubService(cfg, &lustreFS{root: root}, verifier)
+}
+
+func newScrubService(cfg *ScrubConfig, fsys scrubFS, verifier Verifier) (*ScrubService, error) {
+	if err := cfg.CheckValid(); err != nil {
+		return nil, err
+	}
+
+	s := &ScrubService{
+		cfg:        cfg,
+		fs:         fsys,
+		verifier:   verifier,
+		interval:   time.Duration(cfg.Interval) * time.Second,
+		paths:      cfg.Paths,
+		rate:       cfg.Rate,
+		stateFile:  path.Join(cfg.StateDir, "scrub.state"),
+		now:        time.Now,
+		verified:   metrics.GetOrRegisterCounter("scrubVerified", nil),
+		mismatched: metrics.GetOrRegisterCounter("scrubMismatched", nil),
+		failed:     metrics.GetOrRegisterCounter("scrubFailed", nil),
+		bytes:      metrics.GetOrRegisterCounter("scrubBytes", nil),
+	}
+	if s.interval <= 0 {
+		s.interval = config.DefaultScrubInterval * time.Second
+	}
+	if len(s.paths) == 0 {
+		s.paths = []string{"/"}
+	}
+	s.bandwidth, _ = parseSize(cfg.Bandwidth)
+
+	if err := os.MkdirAll(cfg.StateDir, 0700); err != nil {
+		return nil, errors.Wrap(err, "create state dir failed")
+	}
+	return s, nil
+}
+
+func (s *ScrubService) String() string {
+	bandwidth := "unlimited"
+	if s.bandwidth > 0 {
+		bandwidth = humanize.Bytes(uint64(s.bandwidth)) + "/s"
+	}
+	return fmt.Sprintf("paths:%v interval:%v files/s:%d bandwidth:%s", s.paths, s.interval, s.rate, bandwidth)
+}
+
+// Run starts a scrub pass whenever the interval has passed since the start
+// of the last one, until the context is cancelled. The time of the last
+// complete pass is saved, so restarting the agent doesn't start a new one.
+func (s *ScrubService) Run(ctx context.Context) {
+	st := &scrubState{}
+	if err := loadJSON(s.stateFile, st); err != nil {
+		alert.Warnf("scrub: %v", err)
+	}
+	audit.Logf("scrub: starting %s, last pass %v", s, st.LastPass)
+
+	for {
+		wait := st.LastPass.Add(s.interval).Sub(s.now())
+		if wait < 0 {
+			wait = 0
+		}
+		select {
+		case <-ctx.Done():
+			debug.Print("scrub: stopped")
+			return
+		case <-time.After(wait):
+		}
+
+		start := s.now()
+		pass, err := s.scrub(ctx)
+		if ctx.Err() != nil {
+			// The pass is started again from the beginning.
+			continue
+		}
+		if err != nil {
+			alert.Warnf("scrub: %v", err)
+		}
+		audit.Logf("scrub: pass completed in %v: %d files, %s: %d verified, %d mismatched, %d failed, %d skipped",
+			s.now().Sub(start), pass.files, humanize.Bytes(uint64(pass.bytes)),
+			pass.verified, pass.mismatched, pass.failed, pass.skipped)
+
+		st.LastPass = start
+		if err := saveJSON(s.stateFile, st); err != nil {
+			alert.Warnf("scrub: %v", err)
+		}
+	}
+}
+
+// scrub verifies the archive copy of each archived file below the
+// configured paths, at no more than the configured rates.
+func (s *ScrubService) scrub(ctx context.Context) (*scrubPass, error) {
+	pass := &scrubPass{}
+	start := s.now()
+	err := s.fs.WalkArchived(s.paths, func(f *archivedFile) error {
+		if wait := s.delay(s.now().Sub(start), pass.files, pass.bytes); wait > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(wait):
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		pass.files++
+		pass.bytes += f.Size
+
+		err := s.verifier.VerifyArchived(ctx, f.Fid, f.Entry)
+		switch {
+		case err == nil:
+			pass.verified++
+			s.verified.Inc(1)
+			s.bytes.Inc(f.Size)
+		case err == ErrChecksumMismatch:
+			pass.mismatched++
+			s.mismatched.Inc(1)
+			audit.Logf("scrub: %s: %s: archive:%d %s does not match checksum %s",
+				f.Path, f.Fid, f.Entry.ArchiveID, f.Entry.UUID, checksum.Format(f.Entry.Hash))
+		case errors.Cause(err) == ErrNotSupported:
+			pass.skipped++
+			debug.Printf("scrub: %s: %v", f.Path, err)
+		case ctx.Err() != nil:
+			return ctx.Err()
+		default:
+			pass.failed++
+			s.failed.Inc(1)
+			alert.Warnf("scrub: %s: %s: verify archive:%d %s failed: %v",
+				f.Path, f.Fid, f.Entry.ArchiveID, f.Entry.UUID, err)
+		}
+		return nil
+	})
+	return pass, err
+}
+
+// delay returns how long to wait before verifying the next file, so that
+// the files and bytes verified since the start of the pass don't exceed
+// the configured rates.
+func (s *ScrubService) delay(elapsed time.Duration, files, bytes int64) time.Duration {
+	var want time.Duration
+	if s.rate > 0 {
+		want = time.Duration(files) * time.Second / time.Duration(s.rate)
+	}
+	if s.bandwidth > 0 {
+		if d := time.Duration(float64(bytes) / float64(s.bandwidth) * float64(time.Second)); d > want {
+			want = d
+		}
+	}
+	return want - elapsed
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package policy
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/intel-hpdd/go-lustre"
+)
+
+type (
+	testScrubFS struct {
+		files []*archivedFile
+	}
+
+	testVerifier struct {
+		results  map[string]error
+		verified []string
+	}
+)
+
+func (t *testScrubFS) WalkArchived(dirs []string, fn func(*archivedFile) error) error {
+	for _, f := range t.files {
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *testVerifier) VerifyArchived(ctx context.Context, fid *lustre.Fid, e *CatalogEntry) error {
+	t.verified = append(t.verified, e.UUID)
+	return t.results[e.UUID]
+}
+
+func TestScrubPass(t *testing.T) {
+	td, err := ioutil.TempDir("", "scrub-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	fsys := &testScrubFS{}
+	for i, id := range []string{"good", "bad", "unsupported", "unreadable"} {
+		fsys.files = append(fsys.files, &archivedFile{
+			Path:  "/project/" + id,
+			Fid:   &lustre.Fid{Seq: 0x200000401, Oid: uint32(i + 1)},
+			Size:  100,
+			Entry: &CatalogEntry{ArchiveID: 1, UUID: id, Hash: []byte{1, 2}},
+		})
+	}
+	verifier := &testVerifier{results: map[string]error{
+		"bad":         ErrChecksumMismatch,
+		"unsupported": errors.Wrap(ErrNotSupported, "archive 1"),
+		"unreadable":  errors.New("mover returned 5"),
+	}}
+
+	s, err := newScrubService(&ScrubConfig{StateDir: td}, fsys, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified := s.verified.Count()
+	pass, err := s.scrub(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &scrubPass{files: 4, bytes: 400, verified: 1, mismatched: 1, failed: 1, skipped: 1}
+	if !reflect.DeepEqual(pass, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, pass)
+	}
+	if got := s.verified.Count() - verified; got != 1 {
+		t.Fatalf("expected verified count to increase by 1, got %d", got)
+	}
+
+	// A cancelled pass stops before the next file.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	verifier.verified = nil
+	if _, err := s.scrub(ctx); errors.Cause(err) != context.Canceled {
+		t.Fatalf("expected cancelled error, got %v", err)
+	}
+	if len(verifier.verified) != 0 {
+		t.Fatalf("expected no files verified, got %v", verifier.verified)
+	}
+}
+
+func TestScrubDelay(t *testing.T) {
+	s := &ScrubService{rate: 10, bandwidth: 1 << 20}
+
+	for _, tc := range []struct {
+		elapsed time.Duration
+		files   int64
+		bytes   int64
+		want    time.Duration
+	}{
+		{0, 0, 0, 0},
+		{0, 5, 0, 500 * time.Millisecond},
+		{time.Second, 5, 0, -500 * time.Millisecond},
+		{0, 1, 4 << 20, 4 * time.Second},
+		{time.Second, 20, 1 << 20, time.Second},
+	} {
+		if got := s.delay(tc.elapsed, tc.files, tc.bytes); got != tc.want {
+			t.Errorf("delay(%v, %d, %d): expected %v, got %v", tc.elapsed, tc.files, tc.bytes, tc.want, got)
+		}
+	}
+
+	unlimited := &ScrubService{}
+	if got := unlimited.delay(0, 1000, 1<<40); got != 0 {
+		t.Errorf("expected no delay without limits, got %v", got)
+	}
+}
+
+func TestScrubConfigValid(t *testing.T) {
+	for _, tc := range []struct {
+		cfg   *ScrubConfig
+		valid bool
+	}{
+		{&ScrubConfig{StateDir: "/var/lib/lhsmd", Bandwidth: "50MB", Rate: 100}, true},
+		{&ScrubConfig{StateDir: "/var/lib/lhsmd", Paths: []string{"/project"}}, true},
+		{&ScrubConfig{}, false},
+		{&ScrubConfig{StateDir: "/var/lib/lhsmd", Paths: []string{"project"}}, false},
+		{&ScrubConfig{StateDir: "/var/lib/lhsmd", Bandwidth: "fast"}, false},
+		{&ScrubConfig{StateDir: "/var/lib/lhsmd", Rate: -1}, false},
+	} {
+		err := tc.cfg.CheckValid()
+		if tc.valid && err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc.cfg, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%+v: expected an error", tc.cfg)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package policy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// state is the part of the service's progress that must survive a
+// restart. Changelog records are only cleared once the pending files they
+// produced have been saved here.
+type state struct {
+	// Indexes is the last changelog record consumed from each MDT
+	Indexes map[string]int64 `json:"indexes"`
+
+	// Pending maps a fid to the time it is next due for evaluation
+	Pending map[string]time.Time `json:"pending"`
+}
+
+func newState() *state {
+	return &state{
+		Indexes: make(map[string]int64),
+		Pending: make(map[string]time.Time),
+	}
+}
+
+// loadState reads the state file, returning an empty state if it doesn't
+// exist yet.
+func loadState(fileName string) (*state, error) {
+	st := newState()
+	if err := loadJSON(fileName, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// save atomically replaces the state file.
+func (st *state) save(fileName string) error {
+	return saveJSON(fileName, st)
+}
+
+// loadJSON decodes a state file into v, leaving v unchanged if the file
+// doesn't exist.
+func loadJSON(fileName string, v interface{}) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "read state failed")
+	}
+	return errors.Wrapf(json.Unmarshal(data, v), "%s: decode state failed", fileName)
+}
+
+// saveJSON atomically replaces a state file with the encoding of v.
+func saveJSON(fileName string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "encode state failed")
+	}
+	return writeFileAtomic(fileName, data)
+}
+
+// writeFileAtomic replaces the file's contents, so that after a crash the
+// file contains either the old or the new data.
+func writeFileAtomic(fileName string, data []byte) error {
+	tmp, err := ioutil.TempFile(path.Dir(fileName), path.Base(fileName)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "create state failed")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "write state failed")
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "sync state failed")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "close state failed")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), fileName), "rename state failed")
+}
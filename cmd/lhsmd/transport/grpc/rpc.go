@@ -132,6 +132,7 @@ func (s *dmRPCServer) Register(context context.Context, e *pb.Endpoint) (*pb.Han
 			return nil, err
 		}
 	}
+	s.agent.RegisterCapabilities(e.Archive, agent.NewCapabilities(e))
 	return &pb.Handle{Id: uint64(*handle)}, nil
 
 }
@@ -0,0 +1,299 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dmplugin
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+// Operations recorded in checkpoints.
+const (
+	CheckpointArchive = "archive"
+	CheckpointRestore = "restore"
+)
+
+// llIocDataVersion is LL_IOC_DATA_VERSION, _IOR('f', 218, struct
+// ioc_data_version), which returns the data version of a Lustre file.
+const llIocDataVersion = 0x801066da
+
+type (
+	// Checkpoint records the progress of an archive or restore, so that
+	// a retry of the action for the same file and data version can
+	// continue where it stopped instead of starting again.
+	Checkpoint struct {
+		Op      string `json:"op"`
+		File    string `json:"file"`    // FID, or path if it has none
+		Version string `json:"version"` // Data version of the file
+		Offset  int64  `json:"offset"`  // Extent of the action
+		Length  int64  `json:"length"`
+
+		// ObjectID is the id of the object being written or read.
+		ObjectID string `json:"object_id"`
+
+		// Done is the number of bytes copied, and Hash the state of
+		// the checksum of those bytes. Checksum is the algorithm of
+		// Hash and of the chunk checksums; checkpoints without one
+		// are SHA1.
+		Done     int64  `json:"done"`
+		Hash     []byte `json:"hash,omitempty"`
+		Checksum string `json:"checksum,omitempty"`
+
+		// Chunks maps the index of each chunk that has been copied
+		// by a parallel copy of ChunkSize chunks to its checksum.
+		Chunks    map[int][]byte `json:"chunks,omitempty"`
+		ChunkSize int64          `json:"chunk_size,omitempty"`
+
+		// UploadID and Parts record an S3 multipart upload.
+		UploadID string           `json:"upload_id,omitempty"`
+		Parts    []CheckpointPart `json:"parts,omitempty"`
+
+		Updated time.Time `json:"updated"`
+
+		name string
+	}
+
+	// CheckpointPart is a completed part of a multipart upload, and
+	// Sum the checksum of its data.
+	CheckpointPart struct {
+		Number int64  `json:"number"`
+		ETag   string `json:"etag"`
+		Size   int64  `json:"size"`
+		Sum    []byte `json:"sum,omitempty"`
+	}
+
+	// CheckpointStore saves checkpoints in a local state directory. A
+	// nil *CheckpointStore is valid and saves nothing.
+	CheckpointStore struct {
+		dir string
+
+		// Discard, if set, is called for each checkpoint that is
+		// dropped without being completed, so the mover can remove
+		// the partial object.
+		Discard func(*Checkpoint) error
+	}
+)
+
+// OpenCheckpointStore returns a store that saves checkpoints in dir,
+// creating it if necessary.
+func OpenCheckpointStore(dir string) (*CheckpointStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "%s: create state directory failed", dir)
+	}
+	return &CheckpointStore{dir: dir}, nil
+}
+
+// FileVersion returns the data version of a file. For Lustre files it
+// includes the version maintained by Lustre, which changes whenever the
+// file's data does. The size and modification time are included for
+// files on other filesystems.
+func FileVersion(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", errors.Wrapf(err, "%s: open failed", name)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", errors.Wrapf(err, "%s: stat failed", name)
+	}
+	version := fmt.Sprintf("%d:%d", fi.Size(), fi.ModTime().UnixNano())
+
+	var dv struct {
+		version       uint64
+		layoutVersion uint32
+		flags         uint32
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), llIocDataVersion, uintptr(unsafe.Pointer(&dv)))
+	if errno == 0 {
+		version = strconv.FormatUint(dv.version, 10) + ":" + version
+	}
+	return version, nil
+}
+
+// fileIdentity returns the FID of the file if its path is an open by FID
+// path, as action paths are, and otherwise its absolute path.
+func fileIdentity(name string) string {
+	if fid, err := lustre.ParseFid(path.Base(name)); err == nil {
+		return fid.String()
+	}
+	if abs, err := filepath.Abs(name); err == nil {
+		return abs
+	}
+	return name
+}
+
+// checkpointPrefix returns the start of the names of the checkpoints of a
+// file.
+func checkpointPrefix(file string) string {
+	sum := sha1.Sum([]byte(file))
+	return hex.EncodeToString(sum[:])
+}
+
+// Load returns the checkpoint of an operation on the action's file with
+// the given version, or a new checkpoint if there is none. A checkpoint
+// for a different version of the file is discarded. Load returns nil if s
+// is nil.
+func (s *CheckpointStore) Load(op string, action Action, version string) (*Checkpoint, error) {
+	if s == nil {
+		return nil, nil
+	}
+	file := fileIdentity(action.PrimaryPath())
+	cp := &Checkpoint{
+		Op:      op,
+		File:    file,
+		Version: version,
+		Offset:  action.Offset(),
+		Length:  action.Length(),
+		name: fmt.Sprintf("%s-%s-%d-%d.json", checkpointPrefix(file), op,
+			action.Offset(), action.Length()),
+	}
+
+	data, err := ioutil.ReadFile(path.Join(s.dir, cp.name))
+	if os.IsNotExist(err) {
+		return cp, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "%s: read checkpoint failed", cp.name)
+	}
+	var saved Checkpoint
+	if err := json.Unmarshal(data, &saved); err != nil {
+		alert.Warnf("%s: discarding unreadable checkpoint: %v", cp.name, err)
+		return cp, s.remove(cp.name)
+	}
+	saved.name = cp.name
+	if saved.Version != version || saved.File != file {
+		debug.Printf("%s: discarding checkpoint of version %s, file is now %s", cp.name, saved.Version, version)
+		return cp, s.discard(&saved)
+	}
+	debug.Printf("%s: resuming %s of %s from %d", cp.name, op, saved.ObjectID, saved.Done)
+	return &saved, nil
+}
+
+// Save records the checkpoint. It is written to a temporary file and
+// renamed into place, so a crash leaves either the old or the new
+// checkpoint.
+func (s *CheckpointStore) Save(cp *Checkpoint) error {
+	if s == nil || cp == nil {
+		return nil
+	}
+	cp.Updated = time.Now()
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return errors.Wrap(err, "encode checkpoint failed")
+	}
+	tmp, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return errors.Wrap(err, "create checkpoint failed")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "%s: write checkpoint failed", cp.name)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "%s: sync checkpoint failed", cp.name)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "%s: write checkpoint failed", cp.name)
+	}
+	err = os.Rename(tmp.Name(), path.Join(s.dir, cp.name))
+	return errors.Wrapf(err, "%s: save checkpoint failed", cp.name)
+}
+
+// Remove deletes the checkpoint of a completed operation.
+func (s *CheckpointStore) Remove(cp *Checkpoint) error {
+	if s == nil || cp == nil {
+		return nil
+	}
+	return s.remove(cp.name)
+}
+
+// Sweep discards checkpoints that haven't been updated for maxAge. The
+// agent doesn't tell movers about cancelled actions, which are never
+// retried, so their checkpoints are removed once they are old enough.
+func (s *CheckpointStore) Sweep(maxAge time.Duration) error {
+	if s == nil {
+		return nil
+	}
+	names, err := filepath.Glob(path.Join(s.dir, "*.json"))
+	if err != nil {
+		return errors.Wrap(err, "find checkpoints failed")
+	}
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return errors.Wrapf(err, "%s: read checkpoint failed", name)
+		}
+		var cp Checkpoint
+		if err := json.Unmarshal(data, &cp); err != nil {
+			alert.Warnf("%s: discarding unreadable checkpoint: %v", name, err)
+			if err := s.remove(path.Base(name)); err != nil {
+				return err
+			}
+			continue
+		}
+		if time.Since(cp.Updated) < maxAge {
+			continue
+		}
+		cp.name = path.Base(name)
+		debug.Printf("%s: discarding %s of %s last updated %v", cp.name, cp.Op, cp.ObjectID, cp.Updated)
+		if err := s.discard(&cp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SweepEvery sweeps the store every interval for as long as the mover
+// runs, so the checkpoints of actions cancelled after it started are
+// discarded too. Failures are warned about under the mover's name.
+func (s *CheckpointStore) SweepEvery(name string, interval, maxAge time.Duration) {
+	if s == nil {
+		return
+	}
+	for {
+		if err := s.Sweep(maxAge); err != nil {
+			alert.Warnf("%s: remove old checkpoints failed: %v", name, err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// discard removes a checkpoint that won't be completed, after giving the
+// mover a chance to clean up after it.
+func (s *CheckpointStore) discard(cp *Checkpoint) error {
+	if s.Discard != nil {
+		if err := s.Discard(cp); err != nil {
+			alert.Warnf("%s: clean up %s of %s failed: %v", cp.name, cp.Op, cp.ObjectID, err)
+		}
+	}
+	return s.remove(cp.name)
+}
+
+func (s *CheckpointStore) remove(name string) error {
+	err := os.Remove(path.Join(s.dir, name))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "%s: remove checkpoint failed", name)
+	}
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"os"
+	"strconv"
 
 	"github.com/hashicorp/hcl"
 	"github.com/pkg/errors"
@@ -20,6 +21,8 @@ type pluginConfig struct {
 	AgentAddress string
 	ClientRoot   string
 	ConfigDir    string
+	Command      string // Offline maintenance command, if any
+	ArchiveID    uint32 // Archive the offline command applies to
 }
 
 // LoadConfig reads this plugin's config file and decodes it into the passed
@@ -72,9 +75,19 @@ func getAgentEnvSetting(name string) (value string) {
 // message if any of the env variables are not seet.
 func mustInitConfig() *pluginConfig {
 	pc := &pluginConfig{
-		AgentAddress: getAgentEnvSetting(config.AgentConnEnvVar),
-		ClientRoot:   getAgentEnvSetting(config.PluginMountpointEnvVar),
-		ConfigDir:    getAgentEnvSetting(config.ConfigDirEnvVar),
+		ClientRoot: getAgentEnvSetting(config.PluginMountpointEnvVar),
+		ConfigDir:  getAgentEnvSetting(config.ConfigDirEnvVar),
+		Command:    os.Getenv(config.PluginCommandEnvVar),
 	}
+	if pc.Command == "" {
+		pc.AgentAddress = getAgentEnvSetting(config.AgentConnEnvVar)
+		return pc
+	}
+
+	id, err := strconv.ParseUint(getAgentEnvSetting(config.PluginArchiveEnvVar), 10, 32)
+	if err != nil {
+		alert.Abort(errors.Wrapf(err, "invalid %s", config.PluginArchiveEnvVar))
+	}
+	pc.ArchiveID = uint32(id)
 	return pc
 }
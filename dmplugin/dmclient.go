@@ -9,6 +9,7 @@ import (
 	"io"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -30,6 +31,7 @@ type (
 		mover     Mover
 		config    *Config
 		actions   map[pb.Command]ActionHandler
+		pending   sync.WaitGroup
 	}
 
 	// Config defines configuration for a DatamMoverClient
@@ -42,6 +44,7 @@ type (
 	// Action is a data movement action
 	dmAction struct {
 		status       chan *pb.ActionStatus
+		pending      *sync.WaitGroup
 		item         *pb.ActionItem
 		actualLength *int64
 		uuid         string
@@ -94,6 +97,13 @@ type (
 		Start()
 	}
 
+	// Stopper defines an interface for data movers that defer the
+	// completion of actions, to finish them when the action stream
+	// ends
+	Stopper interface {
+		Stop()
+	}
+
 	// Archiver defines an interface for data movers capable of
 	// fulfilling Archive requests
 	Archiver interface {
@@ -111,14 +121,104 @@ type (
 	Remover interface {
 		Remove(Action) error
 	}
+
+	// Verifier defines an interface for data movers capable of
+	// fulfilling Verify requests, which re-read an archived object and
+	// compare its checksum with the one recorded when it was archived.
+	Verifier interface {
+		Verify(Action) error
+	}
+
+	// Lister defines an interface for data movers that can enumerate
+	// the objects stored in their archive
+	Lister interface {
+		List(fn func(*ObjectInfo) error) error
+	}
+
+	// Rekeyer defines an interface for data movers that encrypt
+	// objects, to rewrap an object's data key with the current key. It
+	// returns the ids of the object's old and new keys, which are empty
+	// if the object isn't encrypted.
+	Rekeyer interface {
+		Rekey(id string) (from, to string, err error)
+	}
+
+	// Compacter defines an interface for data movers that pack the data
+	// of several files into one object, to reclaim the space of the
+	// data of files that were removed. The result is never nil.
+	Compacter interface {
+		Compact() (*CompactResult, error)
+	}
+
+	// Migrater defines an interface for data movers whose objects can be
+	// arranged in several layouts, to move the objects written under
+	// older layouts to their places under the current one. The result
+	// is never nil.
+	Migrater interface {
+		Migrate() (*MigrateResult, error)
+	}
+
+	// ObjectInfo describes an object stored in an archive
+	ObjectInfo struct {
+		// ID is the file id recorded for the object when it was archived
+		ID      string    `json:"id"`
+		Size    int64     `json:"size"`
+		ModTime time.Time `json:"mtime"`
+
+		// Encoded is true if the object's data is transformed (e.g.
+		// compressed), so its size isn't the size of the file.
+		Encoded bool `json:"encoded,omitempty"`
+
+		// Metadata is the object's stored metadata, if it was requested
+		// and the mover stores it.
+		Metadata *ObjectMetadata `json:"metadata,omitempty"`
+	}
+
+	// FeatureReporter defines an interface for data movers that
+	// support optional protocol features
+	FeatureReporter interface {
+		Features() []string
+	}
+
+	// Finisher defines an interface for actions that a mover can
+	// finish itself, after its handler has returned ErrDeferred
+	Finisher interface {
+		Finish(err error)
+	}
 )
 
 type key int
 
+// ErrChecksumMismatch is returned (possibly wrapped) by Verify when an
+// object's data doesn't match its recorded checksum. It is reported to the
+// agent as EBADMSG.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ErrDeferred is returned by a mover's handler when it will finish the
+// action itself later, through the action's Finisher interface. The
+// handler is then free to start another action.
+var ErrDeferred = errors.New("action deferred")
+
 var handleKey key
 
 const (
 	defaultNumThreads = 4
+
+	// ProtocolVersion is the version of the agent protocol implemented
+	// by this package. It is sent to the agent when a mover registers.
+	ProtocolVersion = 1
+
+	// FeaturePartialRestore indicates the mover can restore a subset
+	// of a file's extents.
+	FeaturePartialRestore = "partial_restore"
+
+	// FeatureChecksums indicates the mover records and verifies file
+	// checksums.
+	FeatureChecksums = "checksums"
+
+	// FeatureList indicates the mover can list the objects in its
+	// archive.
+	FeatureList = "list"
 )
 
 func withHandle(ctx context.Context, handle *pb.Handle) context.Context {
@@ -146,6 +246,7 @@ func (a *dmAction) Update(offset, length, max int64) error {
 
 // Finish finalizes the action.
 func (a *dmAction) Finish(err error) {
+	defer a.pending.Done()
 	if err != nil {
 		a.fail(err)
 	} else {
@@ -172,6 +273,9 @@ func (a *dmAction) complete() error {
 }
 
 func getErrno(err error) int32 {
+	if errors.Cause(err) == ErrChecksumMismatch {
+		return int32(syscall.EBADMSG)
+	}
 	if errno, ok := err.(syscall.Errno); ok {
 		return int32(errno)
 	}
@@ -268,6 +372,9 @@ func NewMover(plugin *Plugin, cli pb.DataMoverClient, config *Config) *DataMover
 	if remover, ok := config.Mover.(Remover); ok {
 		actions[pb.Command_REMOVE] = remover.Remove
 	}
+	if verifier, ok := config.Mover.(Verifier); ok {
+		actions[pb.Command_VERIFY] = verifier.Verify
+	}
 
 	return &DataMoverClient{
 		plugin:    plugin,
@@ -309,14 +416,26 @@ func (dm *DataMoverClient) Run(ctx context.Context) {
 
 	wg.Wait()
 	debug.Printf("Shutting down Data Mover")
+
+	// Deferred actions must be finished before their status can no
+	// longer be sent.
+	if stopper, ok := dm.config.Mover.(Stopper); ok {
+		stopper.Stop()
+	}
+	dm.pending.Wait()
 	close(dm.status)
 }
 
 func (dm *DataMoverClient) registerEndpoint(ctx context.Context) (*pb.Handle, error) {
 
 	handle, err := dm.rpcClient.Register(ctx, &pb.Endpoint{
-		FsUrl:   dm.plugin.FsName(),
-		Archive: dm.config.ArchiveID,
+		FsUrl:           dm.plugin.FsName(),
+		Archive:         dm.config.ArchiveID,
+		ProtocolVersion: ProtocolVersion,
+		Commands:        dm.commands(),
+		MoverName:       dm.plugin.name,
+		MoverVersion:    dm.plugin.version,
+		Features:        dm.features(),
 	})
 	if err != nil {
 		return nil, err
@@ -325,6 +444,29 @@ func (dm *DataMoverClient) registerEndpoint(ctx context.Context) (*pb.Handle, er
 	return handle, nil
 }
 
+// commands returns the commands this mover has handlers for.
+func (dm *DataMoverClient) commands() []pb.Command {
+	var commands []pb.Command
+	for _, op := range []pb.Command{pb.Command_ARCHIVE, pb.Command_RESTORE, pb.Command_REMOVE, pb.Command_VERIFY} {
+		if _, ok := dm.actions[op]; ok {
+			commands = append(commands, op)
+		}
+	}
+	return commands
+}
+
+// features returns the optional features reported by the mover.
+func (dm *DataMoverClient) features() []string {
+	var features []string
+	if fr, ok := dm.mover.(FeatureReporter); ok {
+		features = append(features, fr.Features()...)
+	}
+	if _, ok := dm.mover.(Lister); ok {
+		features = append(features, FeatureList)
+	}
+	return features
+}
+
 func (dm *DataMoverClient) processActions(ctx context.Context) chan *pb.ActionItem {
 	actions := make(chan *pb.ActionItem)
 
@@ -398,14 +540,21 @@ func (dm *DataMoverClient) getActionHandler(op pb.Command) (ActionHandler, error
 func (dm *DataMoverClient) handler(name string, actions chan *pb.ActionItem) {
 	for item := range actions {
 		action := &dmAction{
-			status: dm.status,
-			item:   item,
+			status:  dm.status,
+			pending: &dm.pending,
+			item:    item,
 		}
+		// The action is pending until it is finished, by this handler
+		// or later by the mover if the handler defers it.
+		dm.pending.Add(1)
 
 		actionFn, err := dm.getActionHandler(item.Op)
 		if err == nil {
 			err = actionFn(action)
 		}
+		if errors.Cause(err) == ErrDeferred {
+			continue
+		}
 		// debug.Printf("completed (action: %v) %v ", action, ret)
 		action.Finish(err)
 	}
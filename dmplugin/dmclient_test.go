@@ -0,0 +1,122 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dmplugin
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	pb "github.com/intel-hpdd/lemur/pdm"
+	"github.com/intel-hpdd/lemur/pkg/fsroot"
+)
+
+// testAgent is an agent that sends a fixed list of actions and collects
+// their status.
+type testAgent struct {
+	items  []*pb.ActionItem
+	status chan *pb.ActionStatus
+}
+
+func (a *testAgent) Register(ctx context.Context, in *pb.Endpoint, opts ...grpc.CallOption) (*pb.Handle, error) {
+	return &pb.Handle{Id: 1}, nil
+}
+
+func (a *testAgent) GetActions(ctx context.Context, in *pb.Handle, opts ...grpc.CallOption) (pb.DataMover_GetActionsClient, error) {
+	return &testActionStream{items: a.items}, nil
+}
+
+func (a *testAgent) StatusStream(ctx context.Context, opts ...grpc.CallOption) (pb.DataMover_StatusStreamClient, error) {
+	return &testStatusStream{status: a.status}, nil
+}
+
+type testActionStream struct {
+	grpc.ClientStream
+	items []*pb.ActionItem
+}
+
+func (s *testActionStream) Recv() (*pb.ActionItem, error) {
+	if len(s.items) == 0 {
+		return nil, io.EOF
+	}
+	item := s.items[0]
+	s.items = s.items[1:]
+	return item, nil
+}
+
+type testStatusStream struct {
+	grpc.ClientStream
+	status chan *pb.ActionStatus
+}
+
+func (s *testStatusStream) Send(status *pb.ActionStatus) error {
+	s.status <- status
+	return nil
+}
+
+func (s *testStatusStream) CloseAndRecv() (*pb.Empty, error) {
+	return &pb.Empty{}, nil
+}
+
+// deferringMover defers its archives, and finishes them some time after
+// the action stream has ended.
+type deferringMover struct {
+	sync.Mutex
+	deferred []Action
+}
+
+func (m *deferringMover) Start() {}
+
+func (m *deferringMover) Archive(action Action) error {
+	m.Lock()
+	m.deferred = append(m.deferred, action)
+	m.Unlock()
+	return ErrDeferred
+}
+
+func (m *deferringMover) Stop() {
+	m.Lock()
+	deferred := m.deferred
+	m.Unlock()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		for _, action := range deferred {
+			action.(Finisher).Finish(nil)
+		}
+	}()
+}
+
+func TestDeferredActionsFinishedAfterStreamEnds(t *testing.T) {
+	agent := &testAgent{status: make(chan *pb.ActionStatus, 10)}
+	for i := 1; i <= 3; i++ {
+		agent.items = append(agent.items, &pb.ActionItem{Id: uint64(i), Op: pb.Command_ARCHIVE})
+	}
+	plugin := &Plugin{name: "test", fsClient: fsroot.Test("/tmp")}
+	mover := &deferringMover{}
+	dm := NewMover(plugin, agent, &Config{Mover: mover, NumThreads: 2, ArchiveID: 1})
+
+	// Run waits for the deferred actions, so their status is sent
+	// rather than sent on a closed channel.
+	dm.Run(context.Background())
+	finished := make(map[uint64]bool)
+	for range agent.items {
+		select {
+		case status := <-agent.status:
+			if !status.Completed || status.Error != 0 {
+				t.Fatalf("unexpected status: %v", status)
+			}
+			finished[status.Id] = true
+		case <-time.After(10 * time.Second):
+			t.Fatalf("only %d of %d actions finished", len(finished), len(agent.items))
+		}
+	}
+	if len(finished) != len(agent.items) {
+		t.Fatalf("unexpected actions finished: %v", finished)
+	}
+}
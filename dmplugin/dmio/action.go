@@ -23,6 +23,14 @@ type (
 		io.Writer
 	}
 
+	truncater interface {
+		Truncate(int64) error
+	}
+
+	syncer interface {
+		Sync() error
+	}
+
 	// ActionReader wraps an io.SectionReader and also implements
 	// io.Closer by closing the embedded io.Closer.
 	ActionReader struct {
@@ -34,6 +42,7 @@ type (
 	// also implements io.Closer by closing the embedded io.Closer.
 	BufferedActionReader struct {
 		br     *bufio.Reader
+		ar     *ActionReader
 		closer io.Closer
 	}
 
@@ -43,7 +52,11 @@ type (
 		baseOffset int64
 		wwa        writerWriterAt
 		statter    statter
+		truncater  truncater
+		seeker     io.Seeker
+		syncer     syncer
 		closer     io.Closer
+		file       *os.File
 	}
 )
 
@@ -72,6 +85,20 @@ func (bar *BufferedActionReader) Read(p []byte) (int, error) {
 	return bar.br.Read(p)
 }
 
+// Seek calls the embedded ActionReader's Seek() and discards the buffered
+// data.
+func (bar *BufferedActionReader) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekCurrent {
+		offset -= int64(bar.br.Buffered())
+	}
+	pos, err := bar.ar.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	bar.br.Reset(bar.ar)
+	return pos, nil
+}
+
 // Close calls the embedded io.Closer's Close()
 func (aw *ActionWriter) Close() error {
 	return aw.closer.Close()
@@ -88,11 +115,47 @@ func (aw *ActionWriter) Write(p []byte) (int, error) {
 	return aw.wwa.Write(p)
 }
 
+// Seek sets the offset of the next Write, relative to the base offset.
+func (aw *ActionWriter) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekStart {
+		offset += aw.baseOffset
+	}
+	pos, err := aw.seeker.Seek(offset, whence)
+	return pos - aw.baseOffset, err
+}
+
+// Sync calls the embedded syncer's Sync(), so the data written is
+// durable.
+func (aw *ActionWriter) Sync() error {
+	return aw.syncer.Sync()
+}
+
 // Stat calls the embedded statter's Stat().
 func (aw *ActionWriter) Stat() (os.FileInfo, error) {
 	return aw.statter.Stat()
 }
 
+// File returns the file being written, for copies that bypass the
+// writer, such as with direct I/O or CopyRange. Its offsets aren't
+// adjusted by the base offset.
+func (aw *ActionWriter) File() *os.File {
+	return aw.file
+}
+
+// Extend grows the file so that it is at least size bytes long past the
+// base offset, without writing any data, so that a restored file can end
+// with a hole.
+func (aw *ActionWriter) Extend(size int64) error {
+	fi, err := aw.statter.Stat()
+	if err != nil {
+		return errors.Wrap(err, "stat failed")
+	}
+	if fi.Size() >= aw.baseOffset+size {
+		return nil
+	}
+	return errors.Wrap(aw.truncater.Truncate(aw.baseOffset+size), "extend failed")
+}
+
 // ActualLength returns the length embedded in the action if it is not
 // Inf (i.e. when it's an extent). Otherwise, interpret it as EOF
 // and stat the actual file to determine the length on disk.
@@ -115,13 +178,20 @@ func ActualLength(action dmplugin.Action, fp statter) (int64, error) {
 // NewBufferedActionReader returns a *BufferedActionReader for the supplied
 // action.
 func NewBufferedActionReader(action dmplugin.Action) (*BufferedActionReader, int64, error) {
+	return NewBufferedActionReaderSize(action, BufferSize)
+}
+
+// NewBufferedActionReaderSize returns a *BufferedActionReader for the
+// supplied action, whose buffer is size bytes.
+func NewBufferedActionReaderSize(action dmplugin.Action, size int) (*BufferedActionReader, int64, error) {
 	ar, length, err := NewActionReader(action)
 	if err != nil {
 		return nil, 0, errors.Wrapf(err, "Failed to create ActionReader from %s", action)
 	}
 
 	return &BufferedActionReader{
-		br:     bufio.NewReaderSize(ar, BufferSize),
+		br:     bufio.NewReaderSize(ar, size),
+		ar:     ar,
 		closer: ar,
 	}, length, nil
 }
@@ -158,6 +228,10 @@ func NewActionWriter(action dmplugin.Action) (*ActionWriter, error) {
 		baseOffset: int64(action.Offset()),
 		wwa:        dst,
 		statter:    dst,
+		truncater:  dst,
+		seeker:     dst,
+		syncer:     dst,
 		closer:     dst,
+		file:       dst,
 	}, nil
 }
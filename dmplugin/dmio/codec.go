@@ -0,0 +1,220 @@
+package dmio
+
+import (
+	"compress/gzip"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"github.com/pkg/errors"
+
+	"github.com/intel-hpdd/lemur/pkg/zipcheck"
+	"github.com/intel-hpdd/logging/debug"
+)
+
+// Names of the available codecs, as recorded in object metadata.
+const (
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+	CodecLZ4  = "lz4"
+)
+
+// autoThreshold is the estimated size reduction, as a percentage, above
+// which automatic compression compresses a file.
+const autoThreshold = 30.0
+
+type (
+	// Codec compresses the data written to an archive, and
+	// decompresses it again on restore.
+	Codec interface {
+		// Name identifies the codec in object metadata.
+		Name() string
+		NewWriter(w io.Writer) (io.WriteCloser, error)
+		NewReader(r io.Reader) (io.ReadCloser, error)
+	}
+
+	// Compression is an archive's compression setting.
+	Compression struct {
+		Codec Codec // nil if compression is disabled
+		Auto  bool  // Only compress files that appear compressible
+	}
+
+	gzipCodec struct{ level int }
+	zstdCodec struct{ level int }
+	lz4Codec  struct{ level int }
+
+	// writerResetter and readerResetter are implemented by the writers
+	// and readers of codecs that can be reset to compress or decompress
+	// another stream, so a framed object needs only one per stream.
+	writerResetter interface {
+		io.WriteCloser
+		Reset(w io.Writer)
+	}
+	readerResetter interface {
+		io.ReadCloser
+		Reset(r io.Reader) error
+	}
+
+	zstdReader struct{ *zstd.Decoder }
+	lz4Writer  struct {
+		*lz4.Writer
+		level int
+	}
+	lz4Reader struct{ *lz4.Reader }
+)
+
+// ParseCompression parses an archive's compression setting, which is
+// "off", a codec name with an optional level such as "zstd:3", or "auto"
+// optionally followed by a codec, as in "auto:lz4". For compatibility
+// "on" means gzip, and plain "auto" uses gzip.
+func ParseCompression(s string) (*Compression, error) {
+	var c Compression
+	switch {
+	case s == "" || s == "off":
+		return &c, nil
+	case s == "on":
+		s = CodecGzip
+	case s == "auto":
+		c.Auto = true
+		s = CodecGzip
+	case strings.HasPrefix(s, "auto:"):
+		c.Auto = true
+		s = strings.TrimPrefix(s, "auto:")
+	}
+
+	codec, err := NewCodec(s)
+	if err != nil {
+		return nil, err
+	}
+	c.Codec = codec
+	return &c, nil
+}
+
+func (c *Compression) String() string {
+	switch {
+	case c.Codec == nil:
+		return "off"
+	case c.Auto:
+		return "auto:" + c.Codec.Name()
+	default:
+		return c.Codec.Name()
+	}
+}
+
+// Select returns the codec to compress the named file with, or nil if it
+// should not be compressed.
+func (c *Compression) Select(name string) (Codec, error) {
+	if c == nil || c.Codec == nil {
+		return nil, nil
+	}
+	if !c.Auto {
+		return c.Codec, nil
+	}
+	reduction, err := zipcheck.AnalyzeFile(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "AnalyzeFile failed")
+	}
+	if reduction <= autoThreshold {
+		return nil, nil
+	}
+	debug.Printf("%s %s estimate %0.1f%% reduction", c.Codec.Name(), name, reduction)
+	return c.Codec, nil
+}
+
+// NewCodec returns the codec named by spec, which may include a
+// compression level after a colon.
+func NewCodec(spec string) (Codec, error) {
+	name, level := spec, 0
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		var err error
+		name = spec[:i]
+		level, err = strconv.Atoi(spec[i+1:])
+		if err != nil {
+			return nil, errors.Errorf("invalid compression level in %q", spec)
+		}
+	}
+
+	switch name {
+	case CodecGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		} else if level < gzip.BestSpeed || level > gzip.BestCompression {
+			return nil, errors.Errorf("gzip level %d out of range", level)
+		}
+		return &gzipCodec{level}, nil
+	case CodecZstd:
+		if level < 0 || level > 22 {
+			return nil, errors.Errorf("zstd level %d out of range", level)
+		}
+		return &zstdCodec{level}, nil
+	case CodecLZ4:
+		if level < 0 || level > 9 {
+			return nil, errors.Errorf("lz4 level %d out of range", level)
+		}
+		return &lz4Codec{level}, nil
+	default:
+		return nil, errors.Errorf("unknown compression codec %q", name)
+	}
+}
+
+func (c *gzipCodec) Name() string { return CodecGzip }
+
+func (c *gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, c.level)
+}
+
+func (c *gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func (c *zstdCodec) Name() string { return CodecZstd }
+
+func (c *zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	var opts []zstd.EOption
+	if c.level > 0 {
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.level)))
+	}
+	return zstd.NewWriter(w, opts...)
+}
+
+func (c *zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	dec, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return zstdReader{dec}, nil
+}
+
+func (r zstdReader) Close() error {
+	r.Decoder.Close()
+	return nil
+}
+
+func (c *lz4Codec) Name() string { return CodecLZ4 }
+
+func (c *lz4Codec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	zw := &lz4Writer{lz4.NewWriter(w), c.level}
+	zw.Header.CompressionLevel = c.level
+	return zw, nil
+}
+
+// Reset keeps the writer's compression level, which lz4's Reset clears.
+func (w *lz4Writer) Reset(dst io.Writer) {
+	w.Writer.Reset(dst)
+	w.Header.CompressionLevel = w.level
+}
+
+func (c *lz4Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return lz4Reader{lz4.NewReader(r)}, nil
+}
+
+func (r lz4Reader) Close() error {
+	return nil
+}
+
+func (r lz4Reader) Reset(src io.Reader) error {
+	r.Reader.Reset(src)
+	return nil
+}
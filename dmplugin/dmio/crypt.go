@@ -0,0 +1,411 @@
+package dmio
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/hcl"
+	"github.com/pkg/errors"
+
+	"github.com/intel-hpdd/logging/alert"
+)
+
+// Archived data is encrypted with AES-256-GCM. Each object has its own
+// random data key, which is stored with the object wrapped (encrypted) by
+// one of the keys in the archive's keyring. Rotating the keyring's current
+// key therefore only requires the data keys to be rewrapped, not the data
+// to be rewritten.
+//
+// The data is encrypted in chunks so that it can be streamed. The stream
+// starts with a header of encMagic and the chunk size, followed by the
+// sealed chunks. Each chunk's nonce is its sequence number, with a flag
+// set in the last chunk so that a truncated stream is detected.
+const (
+	keySize      = 32
+	encMagic     = "LHSMGCM1"
+	encChunkSize = 64 * 1024
+	encHeaderLen = len(encMagic) + 4
+)
+
+type (
+	// Keyring holds the keys used to wrap the data keys of encrypted
+	// objects. It is loaded from a file, which is reloaded when it
+	// changes so the current key can be rotated without a restart.
+	Keyring struct {
+		path string
+
+		mu      sync.Mutex
+		modTime time.Time
+		current string
+		keys    map[string][]byte
+	}
+
+	// keyringFile is the format of a keyring file:
+	//
+	//   current = "2018-06"
+	//   key "2018-06" {
+	//       secret = "<32 bytes, base64 encoded>"
+	//   }
+	keyringFile struct {
+		Current string        `hcl:"current"`
+		Keys    []*keyringKey `hcl:"key"`
+	}
+
+	keyringKey struct {
+		ID     string `hcl:",key"`
+		Secret string `hcl:"secret"`
+	}
+
+	// WrappedKey is an object's data key, encrypted with the keyring
+	// key identified by KeyID.
+	WrappedKey struct {
+		KeyID   string
+		Wrapped []byte
+	}
+
+	encryptWriter struct {
+		aead  cipher.AEAD
+		dst   io.Writer
+		buf   []byte
+		seq   uint64
+		wrote bool
+	}
+
+	decryptReader struct {
+		aead cipher.AEAD
+		src  *bufio.Reader
+		buf  []byte
+		out  []byte
+		seq  uint64
+		done bool
+	}
+)
+
+// OpenKeyring loads a keyring file. The file must not be accessible by
+// group or others.
+func OpenKeyring(path string) (*Keyring, error) {
+	k := &Keyring{path: path}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// load reads the keyring file if it has changed since it was last read.
+// If the file can't be read the previously loaded keys remain in use.
+func (k *Keyring) load() error {
+	fi, err := os.Stat(k.path)
+	if err != nil {
+		return errors.Wrap(err, "stat keyring failed")
+	}
+	if fi.ModTime().Equal(k.modTime) && k.keys != nil {
+		return nil
+	}
+	if fi.Mode().Perm()&077 != 0 {
+		return errors.Errorf("%s: keyring must not be accessible by group or others", k.path)
+	}
+
+	data, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		return errors.Wrap(err, "read keyring failed")
+	}
+	var kf keyringFile
+	if err := hcl.Decode(&kf, string(data)); err != nil {
+		return errors.Wrapf(err, "%s: decode keyring failed", k.path)
+	}
+
+	keys := make(map[string][]byte)
+	for _, key := range kf.Keys {
+		if key.ID == "" || strings.ContainsAny(key.ID, ": ") {
+			return errors.Errorf("%s: invalid key id %q", k.path, key.ID)
+		}
+		secret, err := base64.StdEncoding.DecodeString(key.Secret)
+		if err != nil || len(secret) != keySize {
+			return errors.Errorf("%s: key %s must be %d bytes, base64 encoded", k.path, key.ID, keySize)
+		}
+		keys[key.ID] = secret
+	}
+	if _, ok := keys[kf.Current]; !ok {
+		return errors.Errorf("%s: current key %q is not in the keyring", k.path, kf.Current)
+	}
+
+	k.modTime = fi.ModTime()
+	k.current = kf.Current
+	k.keys = keys
+	return nil
+}
+
+// key returns the named key, or the current key if id is empty.
+func (k *Keyring) key(id string) (string, []byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.load(); err != nil {
+		if k.keys == nil {
+			return "", nil, err
+		}
+		alert.Warnf("%s: using previously loaded keys: %v", k.path, err)
+	}
+	if id == "" {
+		id = k.current
+	}
+	key, ok := k.keys[id]
+	if !ok {
+		return "", nil, errors.Errorf("key %q is not in keyring %s", id, k.path)
+	}
+	return id, key, nil
+}
+
+// CurrentID returns the id of the key new data keys are wrapped with.
+func (k *Keyring) CurrentID() (string, error) {
+	id, _, err := k.key("")
+	return id, err
+}
+
+// NewDataKey returns a random data key, and the key wrapped with the
+// current keyring key.
+func (k *Keyring) NewDataKey() ([]byte, *WrappedKey, error) {
+	dataKey := make([]byte, keySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, errors.Wrap(err, "generate key failed")
+	}
+	wk, err := k.wrap(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dataKey, wk, nil
+}
+
+func (k *Keyring) wrap(dataKey []byte) (*WrappedKey, error) {
+	id, key, err := k.key("")
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "generate nonce failed")
+	}
+	return &WrappedKey{
+		KeyID:   id,
+		Wrapped: aead.Seal(nonce, nonce, dataKey, []byte(id)),
+	}, nil
+}
+
+// Unwrap decrypts a wrapped data key.
+func (k *Keyring) Unwrap(wk *WrappedKey) ([]byte, error) {
+	_, key, err := k.key(wk.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wk.Wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+	nonce, sealed := wk.Wrapped[:aead.NonceSize()], wk.Wrapped[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, sealed, []byte(wk.KeyID))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unwrap with key %s failed", wk.KeyID)
+	}
+	return dataKey, nil
+}
+
+// Rewrap returns the data key wrapped with the current keyring key, and
+// false if it was already wrapped with the current key.
+func (k *Keyring) Rewrap(wk *WrappedKey) (*WrappedKey, bool, error) {
+	current, err := k.CurrentID()
+	if err != nil {
+		return nil, false, err
+	}
+	if wk.KeyID == current {
+		return wk, false, nil
+	}
+	dataKey, err := k.Unwrap(wk)
+	if err != nil {
+		return nil, false, err
+	}
+	nwk, err := k.wrap(dataKey)
+	if err != nil {
+		return nil, false, err
+	}
+	return nwk, true, nil
+}
+
+// String encodes the wrapped key for storing with an object.
+func (wk *WrappedKey) String() string {
+	return wk.KeyID + ":" + base64.StdEncoding.EncodeToString(wk.Wrapped)
+}
+
+// ParseWrappedKey decodes a wrapped key stored with an object.
+func ParseWrappedKey(s string) (*WrappedKey, error) {
+	i := strings.LastIndexByte(s, ':')
+	if i < 1 {
+		return nil, errors.Errorf("invalid wrapped key %q", s)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(s[i+1:])
+	if err != nil {
+		return nil, errors.Wrap(err, "decode wrapped key failed")
+	}
+	return &WrappedKey{KeyID: s[:i], Wrapped: wrapped}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "create cipher failed")
+	}
+	aead, err := cipher.NewGCM(block)
+	return aead, errors.Wrap(err, "create GCM failed")
+}
+
+func chunkNonce(aead cipher.AEAD, seq uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, seq)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// NewEncryptWriter returns a writer that encrypts the data written to it
+// with the data key, and writes it to w. Close must be called to write the
+// final chunk; it does not close w.
+func NewEncryptWriter(w io.Writer, dataKey []byte) (io.WriteCloser, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		aead: aead,
+		dst:  w,
+		buf:  make([]byte, 0, encChunkSize),
+	}, nil
+}
+
+func (e *encryptWriter) writeHeader() error {
+	if e.wrote {
+		return nil
+	}
+	hdr := make([]byte, encHeaderLen)
+	copy(hdr, encMagic)
+	binary.BigEndian.PutUint32(hdr[len(encMagic):], encChunkSize)
+	_, err := e.dst.Write(hdr)
+	e.wrote = true
+	return err
+}
+
+func (e *encryptWriter) flush(last bool) error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	sealed := e.aead.Seal(nil, chunkNonce(e.aead, e.seq, last), e.buf, nil)
+	e.seq++
+	e.buf = e.buf[:0]
+	_, err := e.dst.Write(sealed)
+	return err
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		// A full chunk is only written once there is more data, as the
+		// last chunk must be marked.
+		if len(e.buf) == encChunkSize {
+			if err := e.flush(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(e.buf[len(e.buf):encChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (e *encryptWriter) Close() error {
+	return e.flush(true)
+}
+
+// NewDecryptReader returns a reader that decrypts the data read from r
+// with the data key. Reads fail if the data has been modified or
+// truncated.
+func NewDecryptReader(r io.Reader, dataKey []byte) (io.Reader, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	src := bufio.NewReader(r)
+	hdr := make([]byte, encHeaderLen)
+	if _, err := io.ReadFull(src, hdr); err != nil {
+		return nil, errors.Wrap(err, "read encryption header failed")
+	}
+	if string(hdr[:len(encMagic)]) != encMagic {
+		return nil, errors.New("data is not encrypted")
+	}
+	chunkSize := binary.BigEndian.Uint32(hdr[len(encMagic):])
+	if chunkSize == 0 || chunkSize > 16*1024*1024 {
+		return nil, errors.Errorf("invalid encryption chunk size %d", chunkSize)
+	}
+	return &decryptReader{
+		aead: aead,
+		src:  src,
+		buf:  make([]byte, int(chunkSize)+aead.Overhead()),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// next decrypts the next chunk.
+func (d *decryptReader) next() error {
+	n, err := io.ReadFull(d.src, d.buf)
+	last := false
+	switch err {
+	case nil:
+		if _, err := d.src.Peek(1); err == io.EOF {
+			last = true
+		}
+	case io.ErrUnexpectedEOF:
+		last = true
+	case io.EOF:
+		return errors.New("encrypted data is truncated")
+	default:
+		return err
+	}
+
+	out, err := d.aead.Open(d.buf[:0], chunkNonce(d.aead, d.seq, last), d.buf[:n], nil)
+	if err != nil {
+		return errors.Wrapf(err, "decrypt chunk %d failed", d.seq)
+	}
+	d.seq++
+	d.out = out
+	d.done = last
+	return nil
+}
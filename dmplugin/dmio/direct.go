@@ -0,0 +1,341 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dmio
+
+import (
+	"io"
+	"math"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/intel-hpdd/lemur/dmplugin"
+)
+
+// Alignment is the alignment of the buffers, offsets and lengths of direct
+// I/O. It is the logical block size of most devices and filesystems.
+const Alignment = 4096
+
+// ErrDirectUnsupported is returned when a file can't be read or written
+// with direct I/O, because its filesystem doesn't support it or the copy
+// doesn't start at an aligned offset. The caller should use buffered I/O
+// instead.
+var ErrDirectUnsupported = errors.New("direct I/O not supported")
+
+type (
+	// DirectReader reads a section of a file with O_DIRECT, so the data
+	// doesn't fill the page cache. Data is read a buffer at a time at
+	// aligned offsets, and if the filesystem rejects a read, the rest of
+	// the section is read through the page cache.
+	DirectReader struct {
+		file   *os.File
+		direct bool
+		base   int64
+		end    int64
+		pos    int64
+		buf    []byte
+		data   []byte
+	}
+
+	// DirectWriter writes to a file sequentially with O_DIRECT, starting
+	// at the file's current offset, which must be aligned. Data is
+	// collected in an aligned buffer and written a buffer at a time. The
+	// unaligned tail left when the writer is closed is written through
+	// the page cache, with the file's own descriptor.
+	DirectWriter struct {
+		file   *os.File
+		direct *os.File
+		pos    int64
+		buf    []byte
+		n      int
+	}
+)
+
+// AlignedBuffer returns a buffer of size bytes whose address is a multiple
+// of Alignment.
+func AlignedBuffer(size int) []byte {
+	buf := make([]byte, size+Alignment)
+	var off int
+	if r := int(uintptr(unsafe.Pointer(&buf[0])) & (Alignment - 1)); r != 0 {
+		off = Alignment - r
+	}
+	return buf[off : off+size : off+size]
+}
+
+// alignSize returns size rounded up to a multiple of Alignment.
+func alignSize(size int) int {
+	if size < Alignment {
+		return Alignment
+	}
+	return (size + Alignment - 1) &^ (Alignment - 1)
+}
+
+// openDirect opens a file with O_DIRECT, and returns ErrDirectUnsupported
+// if its filesystem doesn't support it.
+func openDirect(name string, flag int) (*os.File, error) {
+	f, err := os.OpenFile(name, flag|syscall.O_DIRECT, 0)
+	if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.EINVAL {
+		return nil, ErrDirectUnsupported
+	}
+	return f, err
+}
+
+// NewDirectReader returns a *DirectReader of length bytes of the named
+// file, starting at offset off. A negative length reads to the end of the
+// file. bufSize is rounded up to a multiple of Alignment.
+func NewDirectReader(name string, off, length int64, bufSize int) (*DirectReader, error) {
+	f, err := openDirect(name, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	return newDirectReader(f, off, length, bufSize), nil
+}
+
+func newDirectReader(f *os.File, off, length int64, bufSize int) *DirectReader {
+	end := int64(math.MaxInt64)
+	if length >= 0 {
+		end = off + length
+	}
+	return &DirectReader{
+		file:   f,
+		direct: true,
+		base:   off,
+		end:    end,
+		pos:    off,
+		buf:    AlignedBuffer(alignSize(bufSize)),
+	}
+}
+
+// NewDirectActionReader returns a *DirectReader of the action's extent,
+// and the extent's length.
+func NewDirectActionReader(action dmplugin.Action, bufSize int) (*DirectReader, int64, error) {
+	f, err := openDirect(action.PrimaryPath(), os.O_RDONLY)
+	if err == ErrDirectUnsupported {
+		return nil, 0, err
+	} else if err != nil {
+		return nil, 0, errors.Wrapf(err, "Failed to open %s for read", action.PrimaryPath())
+	}
+
+	length, err := ActualLength(action, f)
+	if err != nil {
+		f.Close()
+		return nil, 0, errors.Wrapf(err, "Could not determine extent length for %s", action)
+	}
+	return newDirectReader(f, int64(action.Offset()), length, bufSize), length, nil
+}
+
+// fill reads the buffer from the aligned offset at or before the current
+// position, and returns false at the end of the file.
+func (r *DirectReader) fill() (bool, error) {
+	aligned := r.pos
+	if r.direct {
+		aligned = r.pos &^ (Alignment - 1)
+	}
+	n, err := pread(r.file, r.buf, aligned)
+	if err == syscall.EINVAL && r.direct {
+		// Reopen the file without O_DIRECT and read the rest
+		// through the page cache.
+		f, err := os.Open(r.file.Name())
+		if err != nil {
+			return false, err
+		}
+		r.file.Close()
+		r.file = f
+		r.direct = false
+		return r.fill()
+	}
+	if err != nil {
+		return false, err
+	}
+	if int64(n) <= r.pos-aligned {
+		return false, nil
+	}
+	r.data = r.buf[r.pos-aligned : n]
+	if left := r.end - r.pos; int64(len(r.data)) > left {
+		r.data = r.data[:left]
+	}
+	return true, nil
+}
+
+// Read reads the next data of the section.
+func (r *DirectReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		if r.pos >= r.end {
+			return 0, io.EOF
+		}
+		more, err := r.fill()
+		if err != nil {
+			return 0, err
+		}
+		if !more {
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	r.pos += int64(n)
+	return n, nil
+}
+
+// Seek sets the position of the next Read, relative to the start of the
+// section, and discards the buffered data.
+func (r *DirectReader) Seek(offset int64, whence int) (int64, error) {
+	pos := r.pos
+	switch whence {
+	case io.SeekStart:
+		pos = r.base + offset
+	case io.SeekCurrent:
+		pos += offset
+	case io.SeekEnd:
+		if r.end == math.MaxInt64 {
+			return 0, errors.New("seek from the end of a section of unknown length")
+		}
+		pos = r.end + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if pos < r.base {
+		return 0, errors.New("negative position")
+	}
+	r.pos = pos
+	r.data = nil
+	return r.pos - r.base, nil
+}
+
+// Direct returns true until a read has fallen back to the page cache.
+func (r *DirectReader) Direct() bool {
+	return r.direct
+}
+
+// Close closes the file.
+func (r *DirectReader) Close() error {
+	return r.file.Close()
+}
+
+// NewDirectWriter returns a *DirectWriter that writes to f from its
+// current offset. The file is reopened with O_DIRECT by name, and f is
+// left open. bufSize is rounded up to a multiple of Alignment.
+func NewDirectWriter(f *os.File, bufSize int) (*DirectWriter, error) {
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: seek failed", f.Name())
+	}
+	if pos&(Alignment-1) != 0 {
+		return nil, ErrDirectUnsupported
+	}
+	direct, err := openDirect(f.Name(), os.O_WRONLY)
+	if err != nil {
+		return nil, err
+	}
+	return &DirectWriter{
+		file:   f,
+		direct: direct,
+		pos:    pos,
+		buf:    AlignedBuffer(alignSize(bufSize)),
+	}, nil
+}
+
+// Write buffers p, and writes the buffer each time it is full.
+func (w *DirectWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := copy(w.buf[w.n:], p)
+		w.n += n
+		p = p[n:]
+		written += n
+		if w.n == len(w.buf) {
+			if err := w.flush(w.n); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush writes the first n bytes of the buffer, which must be a multiple
+// of Alignment unless the writer has fallen back to the page cache, and
+// moves the rest to the start of the buffer.
+func (w *DirectWriter) flush(n int) error {
+	f := w.file
+	if w.direct != nil {
+		f = w.direct
+	}
+	err := pwriteFull(f, w.buf[:n], w.pos)
+	if err == syscall.EINVAL && w.direct != nil {
+		// Write the rest through the page cache.
+		w.direct.Close()
+		w.direct = nil
+		err = pwriteFull(w.file, w.buf[:n], w.pos)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "%s: write failed", w.file.Name())
+	}
+	w.pos += int64(n)
+	w.n = copy(w.buf, w.buf[n:w.n])
+	return nil
+}
+
+// Close writes the buffered data, with the unaligned tail written through
+// the page cache, and leaves the file's offset at the end of the data
+// written. It doesn't close the file.
+func (w *DirectWriter) Close() error {
+	if w.buf == nil {
+		return nil
+	}
+	if aligned := w.n &^ (Alignment - 1); aligned > 0 {
+		if err := w.flush(aligned); err != nil {
+			return err
+		}
+	}
+	if w.direct != nil {
+		w.direct.Close()
+		w.direct = nil
+	}
+	if w.n > 0 {
+		if err := w.flush(w.n); err != nil {
+			return err
+		}
+	}
+	w.buf = nil
+	_, err := w.file.Seek(w.pos, io.SeekStart)
+	return errors.Wrapf(err, "%s: seek failed", w.file.Name())
+}
+
+// pread reads from f at off with a single system call, as a short read of
+// a file opened with O_DIRECT can't be continued at the unaligned offset
+// where it stopped.
+func pread(f *os.File, p []byte, off int64) (int, error) {
+	for {
+		n, err := unix.Pread(int(f.Fd()), p, off)
+		if err != syscall.EINTR {
+			if n < 0 {
+				n = 0
+			}
+			return n, err
+		}
+	}
+}
+
+// pwriteFull writes all of p to f at off.
+func pwriteFull(f *os.File, p []byte, off int64) error {
+	for len(p) > 0 {
+		n, err := unix.Pwrite(int(f.Fd()), p, off)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		p = p[n:]
+		off += int64(n)
+	}
+	return nil
+}
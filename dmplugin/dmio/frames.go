@@ -0,0 +1,300 @@
+package dmio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// A framed object is compressed in independent frames of FrameSize bytes
+// of uncompressed data, so that it can be read from any offset without
+// decompressing the data before it. The frames are followed by an index of
+// their compressed sizes, and a footer of the frame size, the uncompressed
+// size and frameMagic.
+const (
+	frameMagic     = "LHSMFRM1"
+	frameFooterLen = 4 + 8 + len(frameMagic)
+)
+
+// FrameSize is the amount of uncompressed data in each frame of a framed
+// object.
+var FrameSize = 4 * 1024 * 1024
+
+type (
+	frameWriter struct {
+		w         io.Writer
+		codec     Codec
+		zw        io.WriteCloser // Reused for each frame if resettable
+		frameSize int
+		buf       []byte
+		zbuf      bytes.Buffer
+		sizes     []uint32
+		total     int64
+		closed    bool
+	}
+
+	// FrameReader reads the uncompressed data of a framed object. It
+	// implements io.ReadSeeker and io.ReaderAt, but is not safe for
+	// concurrent use as it caches the last frame read.
+	FrameReader struct {
+		r         io.ReaderAt
+		codec     Codec
+		zr        io.ReadCloser // Reused for each frame if resettable
+		frameSize int64
+		size      int64
+		offsets   []int64 // Compressed offset of each frame, and the index
+		pos       int64
+
+		frame int // Index of the frame in data, or -1
+		data  []byte
+	}
+)
+
+// NewFrameWriter returns a writer that compresses the data written to it
+// with the codec in frames of frameSize bytes. Close writes the last frame
+// and the index, but does not close w.
+func NewFrameWriter(w io.Writer, codec Codec, frameSize int) io.WriteCloser {
+	return &frameWriter{
+		w:         w,
+		codec:     codec,
+		frameSize: frameSize,
+		buf:       make([]byte, 0, frameSize),
+	}
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := f.frameSize - len(f.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		f.buf = append(f.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(f.buf) == f.frameSize {
+			if err := f.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// encoder returns a writer that compresses a frame into zbuf, resetting
+// the stream's writer if the codec allows.
+func (f *frameWriter) encoder() (io.WriteCloser, error) {
+	if zw, ok := f.zw.(writerResetter); ok {
+		zw.Reset(&f.zbuf)
+		return zw, nil
+	}
+	zw, err := f.codec.NewWriter(&f.zbuf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s NewWriter failed", f.codec.Name())
+	}
+	f.zw = zw
+	return zw, nil
+}
+
+func (f *frameWriter) flush() error {
+	f.zbuf.Reset()
+	zw, err := f.encoder()
+	if err != nil {
+		return err
+	}
+	if _, err := zw.Write(f.buf); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if _, err := f.w.Write(f.zbuf.Bytes()); err != nil {
+		return err
+	}
+	f.sizes = append(f.sizes, uint32(f.zbuf.Len()))
+	f.total += int64(len(f.buf))
+	f.buf = f.buf[:0]
+	return nil
+}
+
+func (f *frameWriter) Close() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	if len(f.buf) > 0 {
+		if err := f.flush(); err != nil {
+			return err
+		}
+	}
+
+	trailer := make([]byte, 4*len(f.sizes)+frameFooterLen)
+	for i, size := range f.sizes {
+		binary.BigEndian.PutUint32(trailer[4*i:], size)
+	}
+	footer := trailer[4*len(f.sizes):]
+	binary.BigEndian.PutUint32(footer, uint32(f.frameSize))
+	binary.BigEndian.PutUint64(footer[4:], uint64(f.total))
+	copy(footer[12:], frameMagic)
+	_, err := f.w.Write(trailer)
+	return err
+}
+
+// NewFrameReader returns a reader for the framed object of the given
+// compressed size read from r.
+func NewFrameReader(r io.ReaderAt, size int64, codec Codec) (*FrameReader, error) {
+	if size < int64(frameFooterLen) {
+		return nil, errors.New("framed object is truncated")
+	}
+	footer := make([]byte, frameFooterLen)
+	if _, err := r.ReadAt(footer, size-int64(frameFooterLen)); err != nil {
+		return nil, errors.Wrap(err, "read footer failed")
+	}
+	if string(footer[12:]) != frameMagic {
+		return nil, errors.New("not a framed object")
+	}
+	fr := &FrameReader{
+		r:         r,
+		codec:     codec,
+		frameSize: int64(binary.BigEndian.Uint32(footer)),
+		size:      int64(binary.BigEndian.Uint64(footer[4:])),
+		frame:     -1,
+	}
+	if fr.frameSize == 0 {
+		return nil, errors.New("framed object has invalid frame size")
+	}
+
+	frames := (fr.size + fr.frameSize - 1) / fr.frameSize
+	indexOffset := size - int64(frameFooterLen) - 4*frames
+	if indexOffset < 0 {
+		return nil, errors.New("framed object is truncated")
+	}
+	index := make([]byte, 4*frames)
+	if _, err := r.ReadAt(index, indexOffset); err != nil {
+		return nil, errors.Wrap(err, "read index failed")
+	}
+	var offset int64
+	for i := int64(0); i < frames; i++ {
+		fr.offsets = append(fr.offsets, offset)
+		offset += int64(binary.BigEndian.Uint32(index[4*i:]))
+	}
+	if offset != indexOffset {
+		return nil, errors.Errorf("framed object index doesn't match its size: %d != %d", offset, indexOffset)
+	}
+	fr.offsets = append(fr.offsets, offset)
+	return fr, nil
+}
+
+// Size returns the uncompressed size of the object.
+func (fr *FrameReader) Size() int64 {
+	return fr.size
+}
+
+// load decompresses the i'th frame.
+func (fr *FrameReader) load(i int) error {
+	if fr.frame == i {
+		return nil
+	}
+	fr.frame = -1
+	sr := io.NewSectionReader(fr.r, fr.offsets[i], fr.offsets[i+1]-fr.offsets[i])
+	zr, err := fr.decoder(sr)
+	if err != nil {
+		return errors.Wrapf(err, "frame %d", i)
+	}
+
+	buf := bytes.NewBuffer(fr.data[:0])
+	if _, err := buf.ReadFrom(zr); err != nil {
+		return errors.Wrapf(err, "frame %d: decompress failed", i)
+	}
+	fr.data = buf.Bytes()
+
+	expected := fr.frameSize
+	if end := int64(i+1) * fr.frameSize; end > fr.size {
+		expected -= end - fr.size
+	}
+	if int64(len(fr.data)) != expected {
+		return errors.Errorf("frame %d: decompressed %d bytes, expected %d", i, len(fr.data), expected)
+	}
+	fr.frame = i
+	return nil
+}
+
+// decoder returns a reader that decompresses the frame read from sr,
+// resetting the stream's reader if the codec allows.
+func (fr *FrameReader) decoder(sr io.Reader) (io.Reader, error) {
+	if zr, ok := fr.zr.(readerResetter); ok {
+		return zr, errors.Wrap(zr.Reset(sr), "reset failed")
+	}
+	if fr.zr != nil {
+		fr.zr.Close()
+	}
+	zr, err := fr.codec.NewReader(sr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s NewReader failed", fr.codec.Name())
+	}
+	fr.zr = zr
+	return zr, nil
+}
+
+// ReadAt reads uncompressed data starting at off.
+func (fr *FrameReader) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) {
+		if off >= fr.size {
+			return n, io.EOF
+		}
+		i := int(off / fr.frameSize)
+		if err := fr.load(i); err != nil {
+			return n, err
+		}
+		c := copy(p[n:], fr.data[off-int64(i)*fr.frameSize:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
+
+func (fr *FrameReader) Read(p []byte) (int, error) {
+	if fr.pos >= fr.size {
+		return 0, io.EOF
+	}
+	if remaining := fr.size - fr.pos; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := fr.ReadAt(p, fr.pos)
+	fr.pos += int64(n)
+	return n, err
+}
+
+// Seek sets the offset in the uncompressed data for the next Read.
+func (fr *FrameReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += fr.pos
+	case io.SeekEnd:
+		offset += fr.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	fr.pos = offset
+	return offset, nil
+}
+
+// Close releases the decompressed frame and the stream's reader. It does
+// not close the underlying reader.
+func (fr *FrameReader) Close() error {
+	fr.data = nil
+	fr.frame = -1
+	if fr.zr == nil {
+		return nil
+	}
+	err := fr.zr.Close()
+	fr.zr = nil
+	return err
+}
@@ -47,6 +47,13 @@ type (
 
 		dst io.WriterAt
 	}
+
+	// ProgressCounter periodically invokes the supplied callback to
+	// provide progress updates of data that is copied without passing
+	// through a reader or writer, such as by CopyRange.
+	ProgressCounter struct {
+		progressUpdater
+	}
 )
 
 // startUpdates creates a goroutine to periodically call the supplied
@@ -186,3 +193,16 @@ func NewProgressWriterAt(dst io.WriterAt, updateEvery time.Duration, f progressF
 
 	return w
 }
+
+// Add adds n bytes to the count of bytes copied.
+func (c *ProgressCounter) Add(n int64) {
+	atomic.AddInt64(&c.bytesCopied, n)
+}
+
+// NewProgressCounter returns a new *ProgressCounter
+func NewProgressCounter(updateEvery time.Duration, f progressFunc) *ProgressCounter {
+	c := &ProgressCounter{}
+	c.startUpdates(updateEvery, f)
+
+	return c
+}
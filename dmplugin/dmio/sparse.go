@@ -0,0 +1,425 @@
+package dmio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Whence values for lseek(2) that find the data and holes in a sparse
+// file. They aren't defined by the syscall packages.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// minHole is the size of the smallest hole that is skipped when a sparse
+// file is archived. Smaller holes are archived as data.
+const minHole = 64 * 1024
+
+// A sparse map is stored at the start of an object's data as sparseMagic,
+// the logical size and the number of extents, followed by the offset and
+// length of each extent.
+const sparseMagic = "LHSMSPR1"
+
+var zeros = make([]byte, 64*1024)
+
+type (
+	// Extent is a range of data in a sparse file.
+	Extent struct {
+		Offset int64
+		Length int64
+	}
+
+	// SparseMap describes the data in a sparse file. The extent offsets
+	// are relative to the start of the archived data, and the data of
+	// the extents is stored packed together without the holes.
+	SparseMap struct {
+		Size    int64 // Logical size, including holes
+		Extents []Extent
+	}
+
+	// SparseReader reads the packed data of a sparse file's extents.
+	SparseReader struct {
+		// Logical, if set, receives the logical data read, including
+		// the zeros of the holes, so that the file's checksum can be
+		// calculated. Reads must be sequential.
+		Logical io.Writer
+
+		r       io.ReaderAt
+		base    int64
+		sm      *SparseMap
+		pos     int64 // Packed offset
+		logical int64 // Logical offset written to Logical
+	}
+
+	// SparseWriter writes packed data to the logical offsets of a
+	// sparse file's extents, leaving the holes unwritten.
+	SparseWriter struct {
+		// Logical, if set, receives the logical data written,
+		// including the zeros of the holes, so that the file's
+		// checksum can be calculated. Writes must be sequential.
+		Logical io.Writer
+
+		w       io.WriterAt
+		origin  int64
+		sm      *SparseMap
+		pos     int64 // Packed offset for Write
+		logical int64 // Logical offset written to Logical
+	}
+)
+
+// FindSparseMap returns the map of the data in the length bytes of f
+// starting at offset, or nil if there are no holes worth skipping.
+func FindSparseMap(f *os.File, offset, length int64) (*SparseMap, error) {
+	sm := &SparseMap{Size: length}
+	end := offset + length
+	fd := int(f.Fd())
+	for pos := offset; pos < end; {
+		data, err := unix.Seek(fd, pos, seekData)
+		if err == unix.ENXIO {
+			break // The rest of the file is a hole
+		} else if err == unix.EINVAL {
+			return nil, nil // Holes aren't supported
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "%s: seek data failed", f.Name())
+		}
+		if data >= end {
+			break
+		}
+		hole, err := unix.Seek(fd, data, seekHole)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: seek hole failed", f.Name())
+		}
+		if hole > end {
+			hole = end
+		}
+		sm.add(data-offset, hole-data)
+		pos = hole
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrapf(err, "%s: seek failed", f.Name())
+	}
+
+	if sm.DataSize() == length {
+		return nil, nil
+	}
+	return sm, nil
+}
+
+// add appends an extent, merging it with the previous extent if the hole
+// between them is small.
+func (sm *SparseMap) add(offset, length int64) {
+	if n := len(sm.Extents); n > 0 {
+		last := &sm.Extents[n-1]
+		if offset-(last.Offset+last.Length) < minHole {
+			last.Length = offset + length - last.Offset
+			return
+		}
+	}
+	sm.Extents = append(sm.Extents, Extent{offset, length})
+}
+
+// DataSize returns the size of the packed data.
+func (sm *SparseMap) DataSize() int64 {
+	var size int64
+	for _, e := range sm.Extents {
+		size += e.Length
+	}
+	return size
+}
+
+// PackedOffset returns the offset in the packed data of the first data at
+// or after the logical offset.
+func (sm *SparseMap) PackedOffset(offset int64) int64 {
+	var packed int64
+	for _, e := range sm.Extents {
+		if offset < e.Offset {
+			break
+		}
+		if offset < e.Offset+e.Length {
+			return packed + offset - e.Offset
+		}
+		packed += e.Length
+	}
+	return packed
+}
+
+// locate returns the index of the extent that contains the packed offset,
+// and the logical offset of that data.
+func (sm *SparseMap) locate(packed int64) (int, int64) {
+	for i, e := range sm.Extents {
+		if packed < e.Length {
+			return i, e.Offset + packed
+		}
+		packed -= e.Length
+	}
+	return len(sm.Extents), sm.Size
+}
+
+// String encodes the map as the logical size followed by the offset and
+// length of each extent, as in "1048576:0+4096,65536+8192".
+func (sm *SparseMap) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d:", sm.Size)
+	for i, e := range sm.Extents {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%d+%d", e.Offset, e.Length)
+	}
+	return b.String()
+}
+
+// ParseSparseMap parses a map encoded by String.
+func ParseSparseMap(s string) (*SparseMap, error) {
+	fields := strings.SplitN(s, ":", 2)
+	if len(fields) != 2 {
+		return nil, errors.Errorf("invalid sparse map %q", s)
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, errors.Errorf("invalid sparse map size %q", fields[0])
+	}
+	sm := &SparseMap{Size: size}
+	if fields[1] == "" {
+		return sm, nil
+	}
+	for _, extent := range strings.Split(fields[1], ",") {
+		var e Extent
+		if _, err := fmt.Sscanf(extent, "%d+%d", &e.Offset, &e.Length); err != nil {
+			return nil, errors.Errorf("invalid sparse map extent %q", extent)
+		}
+		sm.Extents = append(sm.Extents, e)
+	}
+	return sm, sm.check()
+}
+
+// check returns an error if the extents are out of order or outside the
+// logical size.
+func (sm *SparseMap) check() error {
+	var end int64
+	for _, e := range sm.Extents {
+		if e.Offset < end || e.Length <= 0 {
+			return errors.Errorf("invalid sparse map extent %d+%d", e.Offset, e.Length)
+		}
+		end = e.Offset + e.Length
+	}
+	if end > sm.Size {
+		return errors.Errorf("sparse map extents end at %d, beyond size %d", end, sm.Size)
+	}
+	return nil
+}
+
+// MarshalBinary encodes the map as it is stored at the start of an
+// object's data.
+func (sm *SparseMap) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, len(sparseMagic)+16+16*len(sm.Extents))
+	copy(buf, sparseMagic)
+	p := buf[len(sparseMagic):]
+	binary.BigEndian.PutUint64(p, uint64(sm.Size))
+	binary.BigEndian.PutUint64(p[8:], uint64(len(sm.Extents)))
+	p = p[16:]
+	for _, e := range sm.Extents {
+		binary.BigEndian.PutUint64(p, uint64(e.Offset))
+		binary.BigEndian.PutUint64(p[8:], uint64(e.Length))
+		p = p[16:]
+	}
+	return buf, nil
+}
+
+// ReadSparseMap reads a map encoded by MarshalBinary, and returns it and
+// the number of bytes read.
+func ReadSparseMap(r io.Reader) (*SparseMap, int64, error) {
+	header := make([]byte, len(sparseMagic)+16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, 0, errors.Wrap(err, "read sparse map failed")
+	}
+	if string(header[:len(sparseMagic)]) != sparseMagic {
+		return nil, 0, errors.New("invalid sparse map")
+	}
+	p := header[len(sparseMagic):]
+	sm := &SparseMap{Size: int64(binary.BigEndian.Uint64(p))}
+	count := binary.BigEndian.Uint64(p[8:])
+	if count > uint64(sm.Size) {
+		return nil, 0, errors.Errorf("invalid sparse map extent count %d", count)
+	}
+	for i := uint64(0); i < count; i++ {
+		if _, err := io.ReadFull(r, p); err != nil {
+			return nil, 0, errors.Wrap(err, "read sparse map failed")
+		}
+		sm.Extents = append(sm.Extents, Extent{
+			Offset: int64(binary.BigEndian.Uint64(p)),
+			Length: int64(binary.BigEndian.Uint64(p[8:])),
+		})
+	}
+	return sm, int64(len(header)) + 16*int64(count), sm.check()
+}
+
+// writeZeros writes n zeros to w.
+func writeZeros(w io.Writer, n int64) error {
+	for n > 0 {
+		p := zeros
+		if int64(len(p)) > n {
+			p = p[:n]
+		}
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+		n -= int64(len(p))
+	}
+	return nil
+}
+
+// writeLogical writes the zeros of any hole between the logical offset
+// *written and offset, and then p, to w, and updates *written. It does
+// nothing if w is nil.
+func writeLogical(w io.Writer, written *int64, offset int64, p []byte) error {
+	if w == nil {
+		return nil
+	}
+	if offset > *written {
+		if err := writeZeros(w, offset-*written); err != nil {
+			return err
+		}
+		*written = offset
+	}
+	if len(p) > 0 {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+		*written += int64(len(p))
+	}
+	return nil
+}
+
+// NewSparseReader returns a reader of the packed data of the extents in
+// the map, read from r with the extent offsets relative to base.
+func NewSparseReader(r io.ReaderAt, base int64, sm *SparseMap) *SparseReader {
+	return &SparseReader{r: r, base: base, sm: sm}
+}
+
+func (sr *SparseReader) Read(p []byte) (int, error) {
+	i, logical := sr.sm.locate(sr.pos)
+	if i == len(sr.sm.Extents) {
+		if err := sr.logicalTo(sr.sm.Size, nil); err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	e := sr.sm.Extents[i]
+	if remaining := e.Offset + e.Length - logical; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := sr.r.ReadAt(p, sr.base+logical)
+	if n > 0 {
+		sr.pos += int64(n)
+		if lerr := sr.logicalTo(logical, p[:n]); lerr != nil {
+			return n, lerr
+		}
+	}
+	if err == io.EOF {
+		if n < len(p) {
+			err = io.ErrUnexpectedEOF
+		} else {
+			err = nil
+		}
+	}
+	return n, err
+}
+
+func (sr *SparseReader) logicalTo(offset int64, p []byte) error {
+	return writeLogical(sr.Logical, &sr.logical, offset, p)
+}
+
+// Seek sets the packed offset of the next Read.
+func (sr *SparseReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += sr.pos
+	case io.SeekEnd:
+		offset += sr.sm.DataSize()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	sr.pos = offset
+	return offset, nil
+}
+
+// NewSparseWriter returns a writer of the packed data of the extents in
+// the map, which writes each extent's data to w at its logical offset less
+// origin.
+func NewSparseWriter(w io.WriterAt, sm *SparseMap, origin int64) *SparseWriter {
+	return &SparseWriter{w: w, sm: sm, origin: origin}
+}
+
+// WriteAt writes packed data at the packed offset. It is safe for
+// concurrent use if Logical is nil.
+func (sw *SparseWriter) WriteAt(p []byte, off int64) (int, error) {
+	var written int
+	for len(p) > 0 {
+		i, logical := sw.sm.locate(off)
+		if i == len(sw.sm.Extents) {
+			return written, errors.New("write beyond the end of the sparse data")
+		}
+		e := sw.sm.Extents[i]
+		chunk := p
+		if remaining := e.Offset + e.Length - logical; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		n, err := sw.w.WriteAt(chunk, logical-sw.origin)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if err := sw.logicalTo(logical, chunk); err != nil {
+			return written, err
+		}
+		p = p[n:]
+		off += int64(n)
+	}
+	return written, nil
+}
+
+// Write writes packed data at the current packed offset.
+func (sw *SparseWriter) Write(p []byte) (int, error) {
+	n, err := sw.WriteAt(p, sw.pos)
+	sw.pos += int64(n)
+	return n, err
+}
+
+// Seek sets the packed offset of the next Write.
+func (sw *SparseWriter) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += sw.pos
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	sw.pos = offset
+	return offset, nil
+}
+
+// Flush writes the zeros of the hole at the end of the data, if any, to
+// sw.Logical.
+func (sw *SparseWriter) Flush() error {
+	return sw.logicalTo(sw.sm.Size, nil)
+}
+
+func (sw *SparseWriter) logicalTo(offset int64, p []byte) error {
+	return writeLogical(sw.Logical, &sw.logical, offset, p)
+}
@@ -0,0 +1,109 @@
+package dmio
+
+import "io"
+
+type (
+	// encoder is the chain of writers that compress and encrypt an
+	// object's data.
+	encoder struct {
+		io.Writer
+		writers []io.WriteCloser // Closed from last to first
+		closed  bool
+	}
+
+	// decoder is the chain of readers that decrypt and decompress an
+	// object's data.
+	decoder struct {
+		io.Reader
+		closers []io.Closer
+	}
+)
+
+// NewEncoder returns a writer that compresses the data written to it with
+// the codec, and encrypts it with the data key, before writing it to w.
+// Either transform is skipped if its codec or key is nil. Close flushes
+// the transforms but does not close w, and may be called more than once.
+func NewEncoder(w io.Writer, codec Codec, dataKey []byte) (io.WriteCloser, error) {
+	e := &encoder{Writer: w}
+	if dataKey != nil {
+		ew, err := NewEncryptWriter(e.Writer, dataKey)
+		if err != nil {
+			return nil, err
+		}
+		e.writers = append(e.writers, ew)
+		e.Writer = ew
+	}
+	if codec != nil {
+		zw, err := codec.NewWriter(e.Writer)
+		if err != nil {
+			return nil, err
+		}
+		e.writers = append(e.writers, zw)
+		e.Writer = zw
+	}
+	return e, nil
+}
+
+func (e *encoder) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	var err error
+	for i := len(e.writers) - 1; i >= 0; i-- {
+		if cerr := e.writers[i].Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// NewDecoder returns a reader that reverses NewEncoder, decrypting the
+// data read from r and then decompressing it. Close does not close r.
+func NewDecoder(r io.Reader, codec Codec, dataKey []byte) (io.ReadCloser, error) {
+	d := &decoder{Reader: r}
+	if dataKey != nil {
+		dr, err := NewDecryptReader(d.Reader, dataKey)
+		if err != nil {
+			return nil, err
+		}
+		d.Reader = dr
+	}
+	if codec != nil {
+		zr, err := codec.NewReader(d.Reader)
+		if err != nil {
+			return nil, err
+		}
+		d.closers = append(d.closers, zr)
+		d.Reader = zr
+	}
+	return d, nil
+}
+
+func (d *decoder) Close() error {
+	var err error
+	for _, c := range d.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// EncodeReader returns a reader of the data read from r, encoded as by
+// NewEncoder. The data is encoded in a separate goroutine, which exits
+// when all of the data has been read or the reader is closed.
+func EncodeReader(r io.Reader, codec Codec, dataKey []byte) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		enc, err := NewEncoder(pw, codec, dataKey)
+		if err == nil {
+			_, err = io.Copy(enc, r)
+			if cerr := enc.Close(); err == nil {
+				err = cerr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
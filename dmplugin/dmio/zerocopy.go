@@ -0,0 +1,143 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dmio
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// copyRangeChunk is the most copied by each call of
+	// copy_file_range, so progress is reported as the copy proceeds.
+	copyRangeChunk = 64 * 1024 * 1024
+
+	// pipeSize is the capacity requested for the pipe data is spliced
+	// through.
+	pipeSize = 1024 * 1024
+
+	spliceMove = 0x1 // SPLICE_F_MOVE
+	spliceMore = 0x4 // SPLICE_F_MORE
+)
+
+// ErrZeroCopyUnsupported is returned by CopyRange when the files can't be
+// copied between within the kernel. The caller should copy the data
+// itself.
+var ErrZeroCopyUnsupported = errors.New("zero-copy not supported")
+
+// CopyRange copies up to length bytes from src at srcOff to dst at dstOff
+// without passing the data through user space: with copy_file_range if
+// the filesystems support it, or else by splicing it through a pipe. The
+// copy stops early at the end of src. progress, if not nil, is called
+// with the number of bytes copied by each call. ErrZeroCopyUnsupported is
+// returned if neither can be used, in which case nothing was copied.
+func CopyRange(dst *os.File, dstOff int64, src *os.File, srcOff, length int64, progress func(int64)) (int64, error) {
+	if progress == nil {
+		progress = func(int64) {}
+	}
+	n, err := copyFileRange(dst, dstOff, src, srcOff, length, progress)
+	if err == ErrZeroCopyUnsupported {
+		return splice(dst, dstOff, src, srcOff, length, progress)
+	}
+	return n, err
+}
+
+// unsupported returns true if errno means that a system call can't copy
+// between the files at all.
+func unsupported(errno syscall.Errno) bool {
+	switch errno {
+	case syscall.ENOSYS, syscall.EXDEV, syscall.EINVAL, syscall.EOPNOTSUPP, syscall.EBADF:
+		return true
+	}
+	return false
+}
+
+func copyFileRange(dst *os.File, dstOff int64, src *os.File, srcOff, length int64, progress func(int64)) (int64, error) {
+	trap := sysCopyFileRange
+	if trap < 0 {
+		return 0, ErrZeroCopyUnsupported
+	}
+	var copied int64
+	for copied < length {
+		chunk := length - copied
+		if chunk > copyRangeChunk {
+			chunk = copyRangeChunk
+		}
+		r, _, errno := unix.Syscall6(uintptr(trap),
+			src.Fd(), uintptr(unsafe.Pointer(&srcOff)),
+			dst.Fd(), uintptr(unsafe.Pointer(&dstOff)),
+			uintptr(chunk), 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			if copied == 0 && unsupported(errno) {
+				return 0, ErrZeroCopyUnsupported
+			}
+			return copied, errors.Wrap(errno, "copy_file_range failed")
+		}
+		if r == 0 {
+			break
+		}
+		copied += int64(r)
+		progress(int64(r))
+	}
+	return copied, nil
+}
+
+func splice(dst *os.File, dstOff int64, src *os.File, srcOff, length int64, progress func(int64)) (int64, error) {
+	p := make([]int, 2)
+	if err := unix.Pipe2(p, unix.O_CLOEXEC); err != nil {
+		return 0, errors.Wrap(err, "create pipe failed")
+	}
+	defer unix.Close(p[0])
+	defer unix.Close(p[1])
+	size := pipeSize
+	if _, _, errno := unix.Syscall(unix.SYS_FCNTL, uintptr(p[1]), unix.F_SETPIPE_SZ, uintptr(size)); errno != 0 {
+		// The default capacity of a pipe.
+		size = 64 * 1024
+	}
+
+	var copied int64
+	for copied < length {
+		chunk := length - copied
+		if chunk > int64(size) {
+			chunk = int64(size)
+		}
+		n, err := unix.Splice(int(src.Fd()), &srcOff, p[1], nil, int(chunk), spliceMove|spliceMore)
+		if err == syscall.EINTR {
+			continue
+		}
+		if errno, ok := err.(syscall.Errno); ok && copied == 0 && unsupported(errno) {
+			return 0, ErrZeroCopyUnsupported
+		}
+		if err != nil {
+			return copied, errors.Wrap(err, "splice from file failed")
+		}
+		if n == 0 {
+			break
+		}
+		for left := n; left > 0; {
+			m, err := unix.Splice(p[0], nil, int(dst.Fd()), &dstOff, int(left), spliceMove|spliceMore)
+			if err == syscall.EINTR {
+				continue
+			}
+			if errno, ok := err.(syscall.Errno); ok && copied == 0 && left == n && unsupported(errno) {
+				return 0, ErrZeroCopyUnsupported
+			}
+			if err != nil {
+				return copied, errors.Wrap(err, "splice to file failed")
+			}
+			left -= m
+		}
+		copied += n
+		progress(n)
+	}
+	return copied, nil
+}
@@ -0,0 +1,8 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dmio
+
+// sysCopyFileRange is the number of the copy_file_range system call.
+const sysCopyFileRange = 326
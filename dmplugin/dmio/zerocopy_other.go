@@ -0,0 +1,12 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !amd64 && !arm64 && !ppc64le
+// +build !amd64,!arm64,!ppc64le
+
+package dmio
+
+// copy_file_range isn't used on other architectures, and data is spliced
+// instead.
+const sysCopyFileRange = -1
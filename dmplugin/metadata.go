@@ -0,0 +1,174 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dmplugin
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/intel-hpdd/go-lustre"
+	"github.com/intel-hpdd/go-lustre/fs"
+	"github.com/intel-hpdd/go-lustre/llapi"
+	"github.com/intel-hpdd/go-lustre/status"
+)
+
+type (
+	// ObjectMetadata describes the file an archive object was copied
+	// from. Movers can store it alongside each object so that the
+	// filesystem namespace can be rebuilt from the archive if the
+	// filesystem's metadata is lost.
+	ObjectMetadata struct {
+		Path   string            `json:"path"` // Relative to the filesystem root
+		Fid    string            `json:"fid"`
+		UUID   string            `json:"uuid"`
+		URL    string            `json:"url,omitempty"`
+		Hash   []byte            `json:"hash,omitempty"`
+		Codec  string            `json:"codec,omitempty"`  // Compression codec, if any
+		KeyID  string            `json:"key_id,omitempty"` // Keyring key, if encrypted
+		UID    uint32            `json:"uid"`
+		GID    uint32            `json:"gid"`
+		Mode   uint32            `json:"mode"`
+		Size   int64             `json:"size"`
+		ATime  time.Time         `json:"atime"`
+		MTime  time.Time         `json:"mtime"`
+		CTime  time.Time         `json:"ctime"`
+		Layout *ObjectLayout     `json:"layout,omitempty"`
+		Xattrs map[string][]byte `json:"xattrs,omitempty"`
+	}
+
+	// ObjectLayout is the striping of the file an object was copied from.
+	ObjectLayout struct {
+		StripeCount int    `json:"stripe_count"`
+		StripeSize  int    `json:"stripe_size"`
+		PoolName    string `json:"pool,omitempty"`
+	}
+
+	// MetadataReader defines an interface for data movers that store an
+	// ObjectMetadata with each object
+	MetadataReader interface {
+		ReadMetadata(id string) (*ObjectMetadata, error)
+	}
+)
+
+// metadataXattrs are the prefixes of the extended attributes saved in an
+// ObjectMetadata. Lustre's own attributes are recreated when the file is
+// imported, and the fileid attributes are saved in their own fields.
+var metadataXattrs = []string{"user.", "security.", "system.posix_acl_"}
+
+// NewObjectMetadata returns the metadata of the file being archived by the
+// action. The caller must fill in the UUID, Hash and URL once the object
+// has been written.
+func NewObjectMetadata(action Action) (*ObjectMetadata, error) {
+	name := action.PrimaryPath()
+	fi, err := os.Lstat(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "stat failed")
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, errors.Errorf("%s: no stat data", name)
+	}
+
+	fid, err := lustre.ParseFid(path.Base(name))
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: not a fid path", name)
+	}
+	p, err := FilePath(action)
+	if err != nil {
+		return nil, err
+	}
+
+	md := &ObjectMetadata{
+		Path:  p,
+		Fid:   fid.String(),
+		UID:   st.Uid,
+		GID:   st.Gid,
+		Mode:  st.Mode,
+		Size:  st.Size,
+		ATime: time.Unix(st.Atim.Sec, st.Atim.Nsec),
+		MTime: time.Unix(st.Mtim.Sec, st.Mtim.Nsec),
+		CTime: time.Unix(st.Ctim.Sec, st.Ctim.Nsec),
+	}
+
+	layout, err := llapi.FileDataLayout(name)
+	if err != nil {
+		return nil, errors.Wrap(err, "get layout failed")
+	}
+	md.Layout = &ObjectLayout{
+		StripeCount: layout.StripeCount,
+		StripeSize:  layout.StripeSize,
+		PoolName:    layout.PoolName,
+	}
+
+	if md.Xattrs, err = readXattrs(name); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// FilePath returns the path, relative to the filesystem root, of the file
+// the action is for.
+func FilePath(action Action) (string, error) {
+	name := action.PrimaryPath()
+	fid, err := lustre.ParseFid(path.Base(name))
+	if err != nil {
+		return "", errors.Wrapf(err, "%s: not a fid path", name)
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", errors.Wrap(err, "resolve path failed")
+	}
+	root, err := fs.MountRoot(abs)
+	if err != nil {
+		return "", errors.Wrap(err, "find filesystem root failed")
+	}
+	p, err := status.FidPathname(root, fid, 0)
+	if err != nil {
+		return "", errors.Wrapf(err, "%s: fid2path failed", fid)
+	}
+	return p, nil
+}
+
+func readXattrs(name string) (map[string][]byte, error) {
+	buf := make([]byte, 64*1024)
+	sz, err := unix.Listxattr(name, buf)
+	if err != nil {
+		return nil, errors.Wrap(err, "list xattrs failed")
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, attr := range bytes.Split(buf[:sz], []byte{0}) {
+		attrName := string(attr)
+		if !hasAnyPrefix(attrName, metadataXattrs) {
+			continue
+		}
+		sz, err := unix.Getxattr(name, attrName, buf)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get xattr %s failed", attrName)
+		}
+		xattrs[attrName] = append([]byte(nil), buf[:sz]...)
+	}
+	if len(xattrs) == 0 {
+		return nil, nil
+	}
+	return xattrs, nil
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
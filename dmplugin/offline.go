@@ -0,0 +1,436 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package dmplugin
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/intel-hpdd/lemur/cmd/lhsmd/config"
+	pb "github.com/intel-hpdd/lemur/pdm"
+	"github.com/intel-hpdd/logging/alert"
+)
+
+// A plugin can be run outside of the agent to perform maintenance
+// commands on one of its archives. The command and archive are passed in
+// the environment, and the results are written to stdout as a stream of
+// JSON objects.
+const (
+	// CommandList writes an ObjectInfo for each object in the archive.
+	CommandList = "list"
+
+	// CommandMetadata is CommandList with each object's stored
+	// ObjectMetadata included.
+	CommandMetadata = "metadata"
+
+	// CommandRemove removes the objects whose ids are read from stdin,
+	// one per line, and writes a RemoveResult for each.
+	CommandRemove = "remove"
+
+	// CommandRekey rewraps the data keys of the encrypted objects whose
+	// ids are read from stdin with the current key, and writes a
+	// RekeyResult for each.
+	CommandRekey = "rekey"
+
+	// CommandVerify compares the objects of the VerifyRequests read from
+	// stdin, one JSON object per line, with their recorded checksums, and
+	// writes a VerifyResult for each.
+	CommandVerify = "verify"
+
+	// CommandCompact reclaims the space of removed data in the archive,
+	// and writes a CompactResult.
+	CommandCompact = "compact"
+
+	// CommandMigrate moves the objects in the archive that were written
+	// under older layouts to their places under the current layout, and
+	// writes a MigrateResult.
+	CommandMigrate = "migrate"
+)
+
+type (
+	// RemoveResult is the outcome of removing an object with
+	// CommandRemove.
+	RemoveResult struct {
+		ID    string `json:"id"`
+		Error string `json:"error,omitempty"`
+	}
+
+	// RekeyResult is the outcome of rekeying an object with
+	// CommandRekey. From and To are the ids of the object's old and new
+	// keys, which are the same if it was already using the current key,
+	// and empty if it isn't encrypted.
+	RekeyResult struct {
+		ID    string `json:"id"`
+		From  string `json:"from,omitempty"`
+		To    string `json:"to,omitempty"`
+		Error string `json:"error,omitempty"`
+	}
+
+	// VerifyRequest identifies an object to be verified with
+	// CommandVerify, and the checksum recorded for it when it was
+	// archived.
+	VerifyRequest struct {
+		ID   string `json:"id"`
+		Hash []byte `json:"hash"`
+	}
+
+	// VerifyResult is the outcome of verifying an object with
+	// CommandVerify. Mismatch is true if the object was read but its
+	// checksum differs, and Error is set if it couldn't be verified.
+	VerifyResult struct {
+		ID       string `json:"id"`
+		Mismatch bool   `json:"mismatch,omitempty"`
+		Error    string `json:"error,omitempty"`
+	}
+
+	// CompactResult is the outcome of compacting an archive with
+	// CommandCompact. Containers is the number of objects that hold the
+	// data of several files, Compacted the number of them that had data
+	// removed, and Reclaimed the number of bytes of space freed.
+	CompactResult struct {
+		Containers int    `json:"containers"`
+		Compacted  int    `json:"compacted"`
+		Reclaimed  int64  `json:"reclaimed"`
+		Error      string `json:"error,omitempty"`
+	}
+
+	// MigrateResult is the outcome of migrating an archive with
+	// CommandMigrate. Objects is the number of objects in the archive,
+	// Moved the number of them that were moved, and Layout the layout
+	// they were moved to.
+	MigrateResult struct {
+		Objects int    `json:"objects"`
+		Moved   int    `json:"moved"`
+		Layout  string `json:"layout"`
+		Error   string `json:"error,omitempty"`
+	}
+
+	// OfflinePlugin runs a plugin binary outside of the agent to perform
+	// maintenance commands on one of its archives.
+	OfflinePlugin struct {
+		Path       string // Path to the plugin binary
+		ConfigDir  string // Directory containing the plugin's config file
+		Mountpoint string // Lustre client mountpoint
+		ArchiveID  uint32
+	}
+
+	// offlineAction is an Action for a command that isn't sent by the
+	// agent, so has no status updates.
+	offlineAction struct {
+		*dmAction
+	}
+)
+
+func (a *offlineAction) Update(offset, length, max int64) error {
+	return nil
+}
+
+func (a *Plugin) runOffline(in io.Reader, out io.Writer) error {
+	var mover Mover
+	for _, dm := range a.movers {
+		if dm.config.ArchiveID == a.config.ArchiveID {
+			mover = dm.config.Mover
+		}
+	}
+	if mover == nil {
+		return errors.Errorf("archive %d is not configured", a.config.ArchiveID)
+	}
+
+	switch a.config.Command {
+	case CommandList:
+		return listObjects(mover, out)
+	case CommandMetadata:
+		return listMetadata(mover, out)
+	case CommandRemove:
+		return removeObjects(mover, in, out)
+	case CommandRekey:
+		return rekeyObjects(mover, in, out)
+	case CommandVerify:
+		return verifyObjects(mover, in, out)
+	case CommandCompact:
+		return compactArchive(mover, out)
+	case CommandMigrate:
+		return migrateArchive(mover, out)
+	default:
+		return errors.Errorf("unknown command %q", a.config.Command)
+	}
+}
+
+func listObjects(mover Mover, out io.Writer) error {
+	lister, ok := mover.(Lister)
+	if !ok {
+		return errors.New("mover does not support listing objects")
+	}
+	enc := json.NewEncoder(out)
+	return lister.List(func(oi *ObjectInfo) error {
+		return enc.Encode(oi)
+	})
+}
+
+func listMetadata(mover Mover, out io.Writer) error {
+	lister, ok := mover.(Lister)
+	if !ok {
+		return errors.New("mover does not support listing objects")
+	}
+	reader, ok := mover.(MetadataReader)
+	if !ok {
+		return errors.New("mover does not store object metadata")
+	}
+	enc := json.NewEncoder(out)
+	return lister.List(func(oi *ObjectInfo) error {
+		md, err := reader.ReadMetadata(oi.ID)
+		if err != nil && !os.IsNotExist(err) {
+			alert.Warnf("%s: read metadata failed: %v", oi.ID, err)
+		}
+		oi.Metadata = md
+		return enc.Encode(oi)
+	})
+}
+
+func removeObjects(mover Mover, in io.Reader, out io.Writer) error {
+	remover, ok := mover.(Remover)
+	if !ok {
+		return errors.New("mover does not support removing objects")
+	}
+	enc := json.NewEncoder(out)
+	return readIDs(in, func(id string) error {
+		action := &offlineAction{&dmAction{
+			item: &pb.ActionItem{Op: pb.Command_REMOVE, Uuid: id},
+		}}
+		result := &RemoveResult{ID: id}
+		if err := remover.Remove(action); err != nil {
+			result.Error = err.Error()
+		}
+		return enc.Encode(result)
+	})
+}
+
+func rekeyObjects(mover Mover, in io.Reader, out io.Writer) error {
+	rekeyer, ok := mover.(Rekeyer)
+	if !ok {
+		return errors.New("mover does not support encryption")
+	}
+	enc := json.NewEncoder(out)
+	return readIDs(in, func(id string) error {
+		result := &RekeyResult{ID: id}
+		var err error
+		if result.From, result.To, err = rekeyer.Rekey(id); err != nil {
+			result.Error = err.Error()
+		}
+		return enc.Encode(result)
+	})
+}
+
+func verifyObjects(mover Mover, in io.Reader, out io.Writer) error {
+	verifier, ok := mover.(Verifier)
+	if !ok {
+		return errors.New("mover does not support verifying objects")
+	}
+	enc := json.NewEncoder(out)
+	dec := json.NewDecoder(in)
+	for dec.More() {
+		var req VerifyRequest
+		if err := dec.Decode(&req); err != nil {
+			return errors.Wrap(err, "decode request failed")
+		}
+		action := &offlineAction{&dmAction{
+			item: &pb.ActionItem{Op: pb.Command_VERIFY, Uuid: req.ID, Hash: req.Hash},
+		}}
+		result := &VerifyResult{ID: req.ID}
+		if err := verifier.Verify(action); err != nil {
+			if errors.Cause(err) == ErrChecksumMismatch {
+				result.Mismatch = true
+			} else {
+				result.Error = err.Error()
+			}
+		}
+		if err := enc.Encode(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func compactArchive(mover Mover, out io.Writer) error {
+	compacter, ok := mover.(Compacter)
+	if !ok {
+		return errors.New("mover does not support compaction")
+	}
+	result, err := compacter.Compact()
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return json.NewEncoder(out).Encode(result)
+}
+
+func migrateArchive(mover Mover, out io.Writer) error {
+	migrater, ok := mover.(Migrater)
+	if !ok {
+		return errors.New("mover does not support migrating objects")
+	}
+	result, err := migrater.Migrate()
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return json.NewEncoder(out).Encode(result)
+}
+
+// readIDs calls fn for each object id read from in, one per line.
+func readIDs(in io.Reader, fn func(string) error) error {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		id := strings.TrimSpace(scanner.Text())
+		if id == "" {
+			continue
+		}
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func (p *OfflinePlugin) command(name string) *exec.Cmd {
+	cmd := exec.Command(p.Path)
+	cmd.Env = append(os.Environ(),
+		config.ConfigDirEnvVar+"="+p.ConfigDir,
+		config.PluginMountpointEnvVar+"="+p.Mountpoint,
+		config.PluginCommandEnvVar+"="+name,
+		fmt.Sprintf("%s=%d", config.PluginArchiveEnvVar, p.ArchiveID),
+	)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// run runs the command, and calls fn to decode each result it writes.
+func (p *OfflinePlugin) run(cmd *exec.Cmd, fn func(*json.Decoder) error) error {
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return errors.Wrap(err, "create pipe failed")
+	}
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "start %s failed", p.Path)
+	}
+
+	dec := json.NewDecoder(out)
+	for dec.More() {
+		if err = fn(dec); err != nil {
+			cmd.Process.Kill()
+			break
+		}
+	}
+	if werr := cmd.Wait(); err == nil && werr != nil {
+		err = errors.Wrapf(werr, "%s failed", p.Path)
+	}
+	return err
+}
+
+// List calls fn for each object in the archive.
+func (p *OfflinePlugin) List(fn func(*ObjectInfo) error) error {
+	return p.run(p.command(CommandList), func(dec *json.Decoder) error {
+		var oi ObjectInfo
+		if err := dec.Decode(&oi); err != nil {
+			return errors.Wrap(err, "decode object failed")
+		}
+		return fn(&oi)
+	})
+}
+
+// ListMetadata calls fn for each object in the archive, including the
+// object's metadata if the mover stored it.
+func (p *OfflinePlugin) ListMetadata(fn func(*ObjectInfo) error) error {
+	return p.run(p.command(CommandMetadata), func(dec *json.Decoder) error {
+		var oi ObjectInfo
+		if err := dec.Decode(&oi); err != nil {
+			return errors.Wrap(err, "decode object failed")
+		}
+		return fn(&oi)
+	})
+}
+
+// Remove removes the objects from the archive, and calls fn with the
+// result of each removal.
+func (p *OfflinePlugin) Remove(ids []string, fn func(*RemoveResult)) error {
+	cmd := p.command(CommandRemove)
+	cmd.Stdin = strings.NewReader(strings.Join(ids, "\n") + "\n")
+	return p.run(cmd, func(dec *json.Decoder) error {
+		var result RemoveResult
+		if err := dec.Decode(&result); err != nil {
+			return errors.Wrap(err, "decode result failed")
+		}
+		fn(&result)
+		return nil
+	})
+}
+
+// Rekey rewraps the data keys of the encrypted objects with the archive's
+// current key, and calls fn with the result for each object.
+func (p *OfflinePlugin) Rekey(ids []string, fn func(*RekeyResult)) error {
+	cmd := p.command(CommandRekey)
+	cmd.Stdin = strings.NewReader(strings.Join(ids, "\n") + "\n")
+	return p.run(cmd, func(dec *json.Decoder) error {
+		var result RekeyResult
+		if err := dec.Decode(&result); err != nil {
+			return errors.Wrap(err, "decode result failed")
+		}
+		fn(&result)
+		return nil
+	})
+}
+
+// Verify compares the objects with their recorded checksums, and calls fn
+// with the result for each object.
+func (p *OfflinePlugin) Verify(reqs []*VerifyRequest, fn func(*VerifyResult)) error {
+	var in bytes.Buffer
+	enc := json.NewEncoder(&in)
+	for _, req := range reqs {
+		if err := enc.Encode(req); err != nil {
+			return errors.Wrap(err, "encode request failed")
+		}
+	}
+	cmd := p.command(CommandVerify)
+	cmd.Stdin = &in
+	return p.run(cmd, func(dec *json.Decoder) error {
+		var result VerifyResult
+		if err := dec.Decode(&result); err != nil {
+			return errors.Wrap(err, "decode result failed")
+		}
+		fn(&result)
+		return nil
+	})
+}
+
+// Compact reclaims the space of removed data in the archive.
+func (p *OfflinePlugin) Compact() (*CompactResult, error) {
+	var result CompactResult
+	err := p.run(p.command(CommandCompact), func(dec *json.Decoder) error {
+		return errors.Wrap(dec.Decode(&result), "decode result failed")
+	})
+	if err == nil && result.Error != "" {
+		err = errors.New(result.Error)
+	}
+	return &result, err
+}
+
+// Migrate moves the archive's objects to their places under its current
+// layout.
+func (p *OfflinePlugin) Migrate() (*MigrateResult, error) {
+	var result MigrateResult
+	err := p.run(p.command(CommandMigrate), func(dec *json.Decoder) error {
+		return errors.Wrap(dec.Decode(&result), "decode result failed")
+	})
+	if err == nil && result.Error != "" {
+		err = errors.New(result.Error)
+	}
+	return &result, err
+}
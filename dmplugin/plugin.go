@@ -6,6 +6,7 @@ package dmplugin
 
 import (
 	"net"
+	"os"
 	"path"
 	"sync"
 	"time"
@@ -16,12 +17,15 @@ import (
 
 	pb "github.com/intel-hpdd/lemur/pdm"
 	"github.com/intel-hpdd/lemur/pkg/fsroot"
+	"github.com/intel-hpdd/logging/alert"
+	"github.com/intel-hpdd/logging/audit"
 	"google.golang.org/grpc"
 )
 
 // Plugin manages communication between the HSM agent and the datamover
 type Plugin struct {
 	name          string
+	version       string
 	ctx           context.Context
 	cancelContext context.CancelFunc
 	rpcConn       *grpc.ClientConn
@@ -45,6 +49,18 @@ func New(name string, initClient func(string) (fsroot.Client, error)) (*Plugin,
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
+	if config.Command != "" {
+		// Offline commands write their results to stdout.
+		audit.SetOutput(os.Stderr)
+		return &Plugin{
+			name:          name,
+			ctx:           ctx,
+			cancelContext: cancel,
+			fsClient:      fsClient,
+			config:        config,
+		}, nil
+	}
+
 	conn, err := grpc.Dial(config.AgentAddress, grpc.WithDialer(unixDialer), grpc.WithInsecure())
 	if err != nil {
 		return nil, errors.Wrap(err, "dial gprc server failed")
@@ -65,6 +81,11 @@ func (a *Plugin) FsName() string {
 	return a.fsClient.FsName()
 }
 
+// SetVersion sets the version reported to the agent when movers register.
+func (a *Plugin) SetVersion(version string) {
+	a.version = version
+}
+
 // Base returns the root directory for plugin.
 func (a *Plugin) Base() string {
 	return a.fsClient.Path()
@@ -81,8 +102,17 @@ func (a *Plugin) AddMover(config *Config) {
 	a.movers = append(a.movers, dm)
 }
 
-// Run starts the data mover threads and blocks until they complete.
+// Run starts the data mover threads and blocks until they complete. If
+// the plugin was started to perform an offline command, Run performs the
+// command instead.
 func (a *Plugin) Run() {
+	if a.config.Command != "" {
+		if err := a.runOffline(os.Stdin, os.Stdout); err != nil {
+			alert.Abort(errors.Wrap(err, a.config.Command))
+		}
+		return
+	}
+
 	var wg sync.WaitGroup
 	for _, dm := range a.movers {
 		wg.Add(1)
@@ -102,5 +132,8 @@ func (a *Plugin) Stop() {
 
 // Close closes the connection to the agent
 func (a *Plugin) Close() error {
+	if a.rpcConn == nil {
+		return nil
+	}
 	return errors.Wrap(a.rpcConn.Close(), "closed failed")
 }
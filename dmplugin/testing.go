@@ -28,6 +28,8 @@ type TestAction struct {
 	url          string
 	ActualLength int
 	Updates      int
+	done         chan struct{}
+	err          error
 }
 
 // NewTestAction returns a stub action that can be used for testing.
@@ -40,6 +42,7 @@ func NewTestAction(t Fataler, path string, offset int64, length int64, uuid stri
 		length: length,
 		uuid:   uuid,
 		data:   data,
+		done:   make(chan struct{}),
 	}
 }
 
@@ -60,6 +63,19 @@ func (a *TestAction) Fail(err error) error {
 	return nil
 }
 
+// Finish finishes an action whose completion was deferred
+func (a *TestAction) Finish(err error) {
+	a.err = err
+	close(a.done)
+}
+
+// Wait waits for an action whose completion was deferred to be finished,
+// and returns its error
+func (a *TestAction) Wait() error {
+	<-a.done
+	return a.err
+}
+
 // ID returns the action item's ID
 func (a *TestAction) ID() uint64 {
 	return a.id
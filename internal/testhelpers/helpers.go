@@ -15,7 +15,7 @@ var testPrefix = "ptest"
 
 // TempDir returns path to a new temporary directory and function that will
 // forcibly remove it.
-func TempDir(t *testing.T) (string, func()) {
+func TempDir(t testing.TB) (string, func()) {
 	tdir, err := ioutil.TempDir("", testPrefix)
 	if err != nil {
 		t.Fatal(err)
@@ -31,7 +31,7 @@ func TempDir(t *testing.T) (string, func()) {
 // ChdirTemp changes the working directory to a new TempDir. The cleanup
 // function returns to the previous working directoy and removes the temp
 // directory.
-func ChdirTemp(t *testing.T) func() {
+func ChdirTemp(t testing.TB) func() {
 	tdir, cleanDir := TempDir(t)
 
 	cwd, err := os.Getwd()
@@ -54,7 +54,7 @@ func ChdirTemp(t *testing.T) func() {
 }
 
 // Fill writes size amount of bytes to the file.
-func Fill(t *testing.T, fp io.Writer, size int64) {
+func Fill(t testing.TB, fp io.Writer, size int64) {
 	var bs int64 = 1024 * 1024
 	buf := make([]byte, bs)
 
@@ -91,7 +91,7 @@ func CorruptFile(t *testing.T, path string) {
 
 // TempFile creates a temporary file. If size is >0 then that amount of bytes
 // will be written to the file.
-func TempFile(t *testing.T, size int64) (string, func()) {
+func TempFile(t testing.TB, size int64) (string, func()) {
 	fp, err := ioutil.TempFile(".", testPrefix)
 	if err != nil {
 		t.Fatal(err)
@@ -45,6 +45,7 @@ const (
 	Command_RESTORE Command = 2
 	Command_REMOVE  Command = 3
 	Command_CANCEL  Command = 4
+	Command_VERIFY  Command = 5
 )
 
 var Command_name = map[int32]string{
@@ -53,6 +54,7 @@ var Command_name = map[int32]string{
 	2: "RESTORE",
 	3: "REMOVE",
 	4: "CANCEL",
+	5: "VERIFY",
 }
 var Command_value = map[string]int32{
 	"NONE":    0,
@@ -60,6 +62,7 @@ var Command_value = map[string]int32{
 	"RESTORE": 2,
 	"REMOVE":  3,
 	"CANCEL":  4,
+	"VERIFY":  5,
 }
 
 func (x Command) String() string {
@@ -68,8 +71,13 @@ func (x Command) String() string {
 func (Command) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
 
 type Endpoint struct {
-	FsUrl   string `protobuf:"bytes,2,opt,name=fs_url,json=fsUrl" json:"fs_url,omitempty"`
-	Archive uint32 `protobuf:"varint,1,opt,name=archive" json:"archive,omitempty"`
+	FsUrl           string    `protobuf:"bytes,2,opt,name=fs_url,json=fsUrl" json:"fs_url,omitempty"`
+	Archive         uint32    `protobuf:"varint,1,opt,name=archive" json:"archive,omitempty"`
+	ProtocolVersion uint32    `protobuf:"varint,3,opt,name=protocol_version,json=protocolVersion" json:"protocol_version,omitempty"`
+	Commands        []Command `protobuf:"varint,4,rep,packed,name=commands,enum=pdm.Command" json:"commands,omitempty"`
+	MoverName       string    `protobuf:"bytes,5,opt,name=mover_name,json=moverName" json:"mover_name,omitempty"`
+	MoverVersion    string    `protobuf:"bytes,6,opt,name=mover_version,json=moverVersion" json:"mover_version,omitempty"`
+	Features        []string  `protobuf:"bytes,7,rep,name=features" json:"features,omitempty"`
 }
 
 func (m *Endpoint) Reset()                    { *m = Endpoint{} }
@@ -351,37 +359,42 @@ var _DataMover_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("pdm.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 507 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x94, 0x53, 0x51, 0x8b, 0xd3, 0x40,
-	0x10, 0x36, 0x69, 0x92, 0x36, 0x93, 0xdc, 0x59, 0x07, 0x95, 0x50, 0x14, 0xce, 0x0a, 0x72, 0x88,
-	0x9c, 0x5a, 0x1f, 0x7d, 0x2a, 0x35, 0x78, 0x07, 0x5e, 0x2b, 0x5b, 0xf5, 0xf5, 0x88, 0xcd, 0xb6,
-	0x0d, 0x24, 0xdd, 0xb0, 0xd9, 0x9e, 0xdc, 0xdf, 0xf0, 0x4d, 0xf0, 0xc7, 0xba, 0x3b, 0xdb, 0xd2,
-	0x78, 0xe8, 0xc3, 0xbd, 0x7d, 0xf3, 0x7d, 0xd3, 0xce, 0x7c, 0xdf, 0x6c, 0x20, 0xac, 0xf3, 0xea,
-	0xac, 0x96, 0x42, 0x09, 0xec, 0x68, 0x38, 0x7c, 0x0f, 0xbd, 0x74, 0x93, 0xd7, 0xa2, 0xd8, 0x28,
-	0x7c, 0x04, 0xc1, 0xb2, 0xb9, 0xda, 0xca, 0x32, 0x71, 0x4f, 0x9c, 0xd3, 0x90, 0xf9, 0xcb, 0xe6,
-	0xab, 0x2c, 0x31, 0x81, 0x6e, 0x26, 0x17, 0xeb, 0xe2, 0x9a, 0x27, 0x8e, 0xe6, 0x8f, 0xd8, 0xbe,
-	0x1c, 0x26, 0x10, 0x9c, 0x67, 0x9b, 0xbc, 0xe4, 0x78, 0x0c, 0x6e, 0x91, 0x93, 0xec, 0x31, 0x8d,
-	0x86, 0xbf, 0x5d, 0x80, 0xf1, 0x42, 0x15, 0x62, 0x73, 0xa1, 0x78, 0x75, 0x5b, 0xc6, 0x27, 0xe0,
-	0x8a, 0x9a, 0xa6, 0x1c, 0x8f, 0xe2, 0x33, 0xb3, 0xd2, 0x44, 0x54, 0x95, 0xfe, 0x2b, 0xa6, 0x79,
-	0x7c, 0x06, 0x71, 0x2d, 0x8b, 0x2a, 0x93, 0x37, 0x57, 0x75, 0xa6, 0xd6, 0x49, 0x87, 0xb6, 0x89,
-	0x76, 0xdc, 0x67, 0x4d, 0xe1, 0x53, 0x80, 0x1f, 0xb2, 0x50, 0xdc, 0x36, 0x78, 0xd4, 0x10, 0x12,
-	0x43, 0xf2, 0x63, 0x08, 0xc4, 0x72, 0xd9, 0x70, 0x95, 0xf8, 0x5a, 0xea, 0xb0, 0x5d, 0x65, 0xf8,
-	0x92, 0x6f, 0x56, 0xfa, 0x27, 0x81, 0xe5, 0x6d, 0x85, 0x27, 0x10, 0xe5, 0xbc, 0x96, 0x7c, 0x91,
-	0x29, 0x9e, 0xbf, 0x4d, 0xba, 0x5a, 0x8c, 0x59, 0x9b, 0x42, 0x04, 0x2f, 0xcf, 0x54, 0x96, 0xf4,
-	0x48, 0x22, 0x6c, 0xb8, 0xed, 0x56, 0xfb, 0x0a, 0x69, 0x3c, 0x61, 0xc3, 0xad, 0xb3, 0x66, 0x9d,
-	0x80, 0xed, 0x33, 0x18, 0xfb, 0xd0, 0x31, 0xa1, 0xc6, 0xd4, 0x66, 0xe0, 0xf0, 0x97, 0x0b, 0xb1,
-	0x8d, 0x67, 0xae, 0x32, 0xb5, 0x6d, 0xfe, 0x11, 0x50, 0xb8, 0x10, 0x55, 0x5d, 0x72, 0x3d, 0x9c,
-	0x72, 0xea, 0xb1, 0x03, 0x81, 0x0f, 0xc1, 0xe7, 0x52, 0x0a, 0x49, 0xc9, 0xf8, 0xcc, 0x16, 0x2d,
-	0xd3, 0xde, 0x7f, 0x4c, 0xfb, 0x7f, 0x99, 0x7e, 0x0e, 0xc1, 0x9a, 0xae, 0x47, 0x61, 0x44, 0xa3,
-	0x88, 0x0e, 0x61, 0x0f, 0xca, 0x76, 0xd2, 0x2e, 0x99, 0x85, 0xe4, 0xb7, 0x93, 0xd9, 0x53, 0x66,
-	0x99, 0x65, 0x99, 0xad, 0x1a, 0x8a, 0x46, 0x2f, 0x43, 0xc5, 0x5d, 0xb3, 0x89, 0x0e, 0xd9, 0x74,
-	0xc1, 0x4f, 0xab, 0x5a, 0xdd, 0xbc, 0x4c, 0xa1, 0xbb, 0x7b, 0x15, 0xd8, 0x03, 0x6f, 0x3a, 0x9b,
-	0xa6, 0xfd, 0x7b, 0x18, 0x41, 0x77, 0xcc, 0x26, 0xe7, 0x17, 0xdf, 0xd2, 0xbe, 0x63, 0x0a, 0x96,
-	0xce, 0xbf, 0xcc, 0x58, 0xda, 0x77, 0x11, 0x20, 0x60, 0xe9, 0xe5, 0x4c, 0x0b, 0x1d, 0x83, 0x27,
-	0xe3, 0xe9, 0x24, 0xfd, 0xd4, 0xf7, 0x46, 0x3f, 0x1d, 0x08, 0x3f, 0xe8, 0x73, 0x5d, 0x8a, 0x6b,
-	0x2e, 0xf1, 0x05, 0xf4, 0x18, 0x5f, 0x15, 0x8d, 0xd2, 0xf8, 0x88, 0x0c, 0xef, 0x9f, 0xff, 0xa0,
-	0xed, 0x1f, 0x5f, 0x01, 0x7c, 0xe4, 0xca, 0xde, 0xa8, 0xc1, 0xb6, 0x34, 0xb8, 0x4f, 0xc5, 0xe1,
-	0x75, 0xbf, 0x71, 0xf0, 0x35, 0xc4, 0xf6, 0x90, 0x73, 0xa5, 0x63, 0xa9, 0xf0, 0x41, 0xab, 0xc5,
-	0x0a, 0x03, 0xb0, 0xc3, 0x8c, 0xb3, 0x53, 0xe7, 0x7b, 0x40, 0x9f, 0xe0, 0xbb, 0x3f, 0x01, 0x00,
-	0x00, 0xff, 0xff, 0xeb, 0x9a, 0x8c, 0x36, 0x8f, 0x03, 0x00, 0x00,
+	// 592 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x95, 0x53, 0x6d, 0x8f, 0xd2, 0x40,
+	0x10, 0xb6, 0xf4, 0x85, 0x76, 0x28, 0x77, 0x75, 0xa3, 0xa6, 0x21, 0x9a, 0x20, 0x97, 0x18, 0x34,
+	0xe6, 0x54, 0xfc, 0x05, 0x04, 0xab, 0x47, 0xe2, 0x81, 0x2e, 0x7a, 0x89, 0x9f, 0x48, 0xa5, 0x0b,
+	0x34, 0x69, 0x69, 0xb3, 0x5d, 0xce, 0xdc, 0xdf, 0xf0, 0x9b, 0x89, 0x3f, 0xd2, 0x9f, 0xe0, 0xee,
+	0x2c, 0x3d, 0x90, 0xe8, 0x07, 0xbf, 0xcd, 0x3c, 0xcf, 0x74, 0x67, 0x9e, 0x67, 0xa6, 0xe0, 0x95,
+	0x49, 0x7e, 0x5e, 0xf2, 0x42, 0x14, 0xc4, 0x94, 0x61, 0xef, 0x97, 0x01, 0x6e, 0xb4, 0x49, 0xca,
+	0x22, 0xdd, 0x08, 0x72, 0x1f, 0x9c, 0x65, 0x35, 0xdf, 0xf2, 0x2c, 0x6c, 0x74, 0x8d, 0xbe, 0x47,
+	0xed, 0x65, 0xf5, 0x99, 0x67, 0x24, 0x84, 0x66, 0xcc, 0x17, 0xeb, 0xf4, 0x9a, 0x85, 0x86, 0xc4,
+	0xdb, 0xb4, 0x4e, 0xc9, 0x53, 0x08, 0xf0, 0xad, 0x45, 0x91, 0xcd, 0xaf, 0x19, 0xaf, 0xd2, 0x62,
+	0x13, 0x9a, 0x58, 0x72, 0x5a, 0xe3, 0x57, 0x1a, 0x26, 0x7d, 0x70, 0x17, 0x45, 0x9e, 0xc7, 0x9b,
+	0xa4, 0x0a, 0xad, 0xae, 0xd9, 0x3f, 0x19, 0xf8, 0xe7, 0x6a, 0x96, 0x91, 0x06, 0xe9, 0x2d, 0x4b,
+	0x1e, 0x01, 0xe4, 0x85, 0x7c, 0x6d, 0xbe, 0x89, 0x73, 0x16, 0xda, 0x38, 0x89, 0x87, 0xc8, 0x44,
+	0x02, 0xe4, 0x0c, 0xda, 0x9a, 0xae, 0x1b, 0x3a, 0x58, 0xe1, 0x23, 0x58, 0x77, 0xeb, 0x80, 0xbb,
+	0x64, 0xb1, 0xd8, 0x72, 0x56, 0x85, 0x4d, 0xd9, 0xcd, 0xa3, 0xb7, 0x79, 0x2f, 0x04, 0xe7, 0x42,
+	0x36, 0xca, 0x18, 0x39, 0x81, 0x46, 0x9a, 0xa0, 0x26, 0x8b, 0xca, 0xa8, 0xf7, 0xb3, 0x01, 0x30,
+	0x5c, 0x08, 0xf9, 0xc0, 0x58, 0xb0, 0xfc, 0x98, 0x26, 0x0f, 0xa1, 0x51, 0x94, 0x68, 0xcd, 0xf1,
+	0xf0, 0x12, 0x27, 0x8f, 0xc1, 0x2f, 0x79, 0x9a, 0xc7, 0xfc, 0x66, 0x5e, 0xc6, 0x62, 0x8d, 0x3e,
+	0x78, 0xb4, 0xb5, 0xc3, 0x3e, 0x48, 0x48, 0x29, 0xfb, 0xc6, 0x53, 0xc1, 0x74, 0x81, 0xa5, 0x95,
+	0x21, 0x82, 0xf4, 0x03, 0x70, 0x8a, 0xe5, 0xb2, 0x62, 0x02, 0x45, 0x9b, 0x74, 0x97, 0x29, 0x3c,
+	0x63, 0x9b, 0x95, 0xfc, 0xc4, 0xd1, 0xb8, 0xce, 0x48, 0x17, 0x5a, 0x09, 0x2b, 0x39, 0x5b, 0xc4,
+	0x82, 0x25, 0xaf, 0xa4, 0x4e, 0xa3, 0xef, 0xd3, 0x43, 0x88, 0x10, 0xb0, 0x92, 0x58, 0xc4, 0xa1,
+	0x8b, 0x14, 0xc6, 0x0a, 0xdb, 0x6e, 0xa5, 0x2e, 0x0f, 0xdb, 0x63, 0xac, 0xb0, 0x75, 0x5c, 0xad,
+	0x43, 0xd0, 0x75, 0x2a, 0x26, 0x01, 0x98, 0xea, 0x12, 0x7c, 0x2c, 0x53, 0x61, 0xef, 0x47, 0x03,
+	0x7c, 0x6d, 0xcf, 0x4c, 0x48, 0x2f, 0xab, 0xbf, 0x18, 0xe4, 0xc9, 0x2d, 0x96, 0x19, 0x93, 0xcd,
+	0xd1, 0x27, 0x97, 0xee, 0x01, 0x72, 0x0f, 0x6c, 0xc6, 0x79, 0xc1, 0xd1, 0x19, 0x9b, 0xea, 0xe4,
+	0x40, 0xb4, 0xf5, 0x0f, 0xd1, 0xf6, 0x1f, 0xa2, 0xcf, 0xc0, 0x59, 0xe3, 0xf6, 0xd0, 0x8c, 0xd6,
+	0xa0, 0x85, 0x8b, 0xd0, 0x0b, 0xa5, 0x3b, 0x6a, 0xe7, 0xcc, 0x82, 0xb3, 0x63, 0x67, 0x6a, 0x48,
+	0x0d, 0xb3, 0xcc, 0xe2, 0x55, 0x85, 0xd6, 0xc8, 0x61, 0x30, 0xf9, 0x5f, 0x6f, 0x5a, 0x7b, 0x6f,
+	0x9a, 0x60, 0x47, 0x79, 0x29, 0x6e, 0x9e, 0x7d, 0x84, 0xe6, 0xee, 0x2a, 0x88, 0x0b, 0xd6, 0x64,
+	0x3a, 0x89, 0x82, 0x3b, 0xa4, 0x05, 0xcd, 0x21, 0x1d, 0x5d, 0x8c, 0xaf, 0xa2, 0xc0, 0x50, 0x09,
+	0x8d, 0x66, 0x9f, 0xa6, 0x34, 0x0a, 0x1a, 0x04, 0xc0, 0xa1, 0xd1, 0xe5, 0x54, 0x12, 0xa6, 0x8a,
+	0x47, 0xc3, 0xc9, 0x28, 0x7a, 0x1f, 0x58, 0x2a, 0xbe, 0x8a, 0xe8, 0xf8, 0xed, 0x97, 0xc0, 0x1e,
+	0x7c, 0x37, 0xc0, 0x7b, 0x23, 0x57, 0x77, 0xa9, 0x2e, 0x9c, 0x3c, 0x01, 0x97, 0xb2, 0x55, 0x5a,
+	0x09, 0x19, 0xb7, 0x51, 0x7c, 0xfd, 0xff, 0x76, 0x0e, 0xbd, 0x20, 0xcf, 0x01, 0xde, 0x31, 0xa1,
+	0xf7, 0x55, 0x91, 0x43, 0xaa, 0x73, 0x8a, 0xc9, 0xfe, 0xd2, 0x5f, 0x1a, 0xe4, 0x05, 0xf8, 0x7a,
+	0xa9, 0x33, 0x21, 0x2d, 0xca, 0xc9, 0xdd, 0x83, 0x12, 0x4d, 0x74, 0x40, 0x37, 0x53, 0x2a, 0xfb,
+	0xc6, 0x57, 0x07, 0x7f, 0xf0, 0xd7, 0xbf, 0x01, 0x94, 0x9f, 0x81, 0xbb, 0x51, 0x04, 0x00, 0x00,
 }
@@ -0,0 +1,159 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package checksum
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"sort"
+	"strings"
+
+	"github.com/cespare/xxhash"
+	"github.com/dchest/blake2b"
+	"github.com/pkg/errors"
+)
+
+// Checksum algorithms.
+const (
+	// SHA1 is the algorithm of checksums recorded before algorithms
+	// could be selected, and is the default.
+	SHA1 = "sha1"
+
+	// SHA256 is SHA-256.
+	SHA256 = "sha256"
+
+	// BLAKE2b is the 256 bit BLAKE2b, which is faster than SHA-1 and
+	// as strong as SHA-256.
+	BLAKE2b = "blake2b"
+
+	// XXH64 is the 64 bit xxHash. It is much faster than the
+	// cryptographic algorithms, and detects accidental damage to data
+	// but not deliberate changes.
+	XXH64 = "xxh64"
+
+	// DefaultAlgorithm is used when no algorithm is configured.
+	DefaultAlgorithm = SHA1
+)
+
+// tagSeparator separates the algorithm from the checksum in a tagged
+// checksum.
+const tagSeparator = ":"
+
+type algorithm struct {
+	size          int
+	new           func() hash.Hash
+	cryptographic bool
+}
+
+var algorithms = map[string]algorithm{
+	SHA1:    {sha1.Size, sha1.New, true},
+	SHA256:  {sha256.Size, sha256.New, true},
+	BLAKE2b: {32, blake2b.New256, true},
+	XXH64:   {8, func() hash.Hash { return xxhash.New() }, false},
+}
+
+// Algorithms returns the names of the supported algorithms.
+func Algorithms() []string {
+	var names []string
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckAlgorithm returns an error if alg isn't a supported algorithm.
+func CheckAlgorithm(alg string) error {
+	if _, ok := algorithms[alg]; !ok {
+		return errors.Errorf("unknown checksum algorithm %q (supported: %s)", alg, strings.Join(Algorithms(), ", "))
+	}
+	return nil
+}
+
+// Cryptographic returns true if alg is a cryptographic hash, whose
+// checksums can be trusted to identify data, as they are when
+// deduplicating it.
+func Cryptographic(alg string) bool {
+	return algorithms[alg].cryptographic
+}
+
+// NewHash returns a new hash.Hash for the algorithm.
+func NewHash(alg string) (hash.Hash, error) {
+	if err := CheckAlgorithm(alg); err != nil {
+		return nil, err
+	}
+	return algorithms[alg].new(), nil
+}
+
+// Tag returns a checksum calculated with alg, tagged with the algorithm's
+// name so that it can be compared with a checksum calculated with the
+// same algorithm. SHA1 checksums aren't tagged, so they are the same as
+// checksums recorded before algorithms could be selected.
+func Tag(alg string, sum []byte) []byte {
+	if alg == SHA1 || len(sum) == 0 {
+		return sum
+	}
+	tagged := make([]byte, 0, len(alg)+len(tagSeparator)+len(sum))
+	tagged = append(tagged, alg+tagSeparator...)
+	return append(tagged, sum...)
+}
+
+// Split returns the algorithm and untagged checksum of a tagged checksum.
+// Checksums without a tag are SHA1.
+func Split(tagged []byte) (string, []byte) {
+	for name, a := range algorithms {
+		prefix := []byte(name + tagSeparator)
+		if len(tagged) == len(prefix)+a.size && bytes.HasPrefix(tagged, prefix) {
+			return name, tagged[len(prefix):]
+		}
+	}
+	return SHA1, tagged
+}
+
+// Algorithm returns the algorithm of a tagged checksum.
+func Algorithm(tagged []byte) string {
+	alg, _ := Split(tagged)
+	return alg
+}
+
+// Format returns the text form of a tagged checksum, which is the
+// algorithm's name and the checksum in hex separated by a colon, such as
+// "sha256:9f86d0...". SHA1 checksums are plain hex.
+func Format(tagged []byte) string {
+	alg, sum := Split(tagged)
+	if alg == SHA1 {
+		return hex.EncodeToString(sum)
+	}
+	return alg + tagSeparator + hex.EncodeToString(sum)
+}
+
+// Parse returns the tagged checksum of a checksum formatted by Format.
+// Plain hex checksums are SHA1, and aren't checked to be the size of one
+// so that checksums imported from elsewhere are still accepted.
+func Parse(s string) ([]byte, error) {
+	i := strings.Index(s, tagSeparator)
+	if i < 0 {
+		sum, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, errors.Wrap(err, "bad checksum")
+		}
+		return sum, nil
+	}
+	alg := s[:i]
+	if err := CheckAlgorithm(alg); err != nil {
+		return nil, err
+	}
+	sum, err := hex.DecodeString(s[i+len(tagSeparator):])
+	if err != nil {
+		return nil, errors.Wrap(err, "bad checksum")
+	}
+	if len(sum) != algorithms[alg].size {
+		return nil, errors.Errorf("bad %s checksum: %d bytes, expected %d", alg, len(sum), algorithms[alg].size)
+	}
+	return Tag(alg, sum), nil
+}
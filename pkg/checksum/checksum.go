@@ -6,6 +6,7 @@ package checksum
 
 import (
 	"crypto/sha1"
+	"encoding"
 	"hash"
 	"io"
 	"os"
@@ -15,36 +16,75 @@ import (
 
 type (
 	// Writer wraps an io.WriterAt and updates the checksum
-	// with every write.
+	// with every write. Sum returns the checksum tagged with its
+	// algorithm (see Tag).
 	Writer interface {
 		io.Writer
 		Sum() []byte
 	}
 
-	// Sha1HashWriter implements Writer and uses the SHA1
-	// algorithm to calculate the file checksum
-	Sha1HashWriter struct {
+	// HashWriter implements Writer and calculates the checksum of the
+	// data written with one of the supported algorithms.
+	HashWriter struct {
 		dest  io.Writer
+		alg   string
 		cksum hash.Hash
 	}
 
+	// ResumableHashWriter is a HashWriter whose state can be saved and
+	// restored, which is possible for the SHA1 and SHA256 algorithms.
+	ResumableHashWriter struct {
+		*HashWriter
+	}
+
 	// NoopHashWriter implements Writer but doesn't
 	// actually calculate a checksum
 	NoopHashWriter struct {
 		dest io.Writer
 	}
+
+	// ChunkedHashWriter implements Writer and calculates the checksum
+	// of data that is copied in fixed size chunks. The checksum of each
+	// chunk is calculated separately, and the checksum is the checksum
+	// of the chunk checksums in order, so chunks copied in parallel
+	// produce the same checksum as a sequential copy.
+	ChunkedHashWriter struct {
+		dest      io.Writer
+		alg       string
+		chunkSize int64
+		written   int64 // Bytes written to the current chunk
+		chunk     hash.Hash
+		sums      [][]byte
+	}
 )
 
-// NewSha1HashWriter returns a new Sha1HashWriter
-func NewSha1HashWriter(dest io.Writer) Writer {
-	return &Sha1HashWriter{
+// NewHashWriter returns a new HashWriter for the algorithm. If the
+// algorithm's state can be saved it is a ResumableHashWriter.
+func NewHashWriter(dest io.Writer, alg string) (Writer, error) {
+	cksum, err := NewHash(alg)
+	if err != nil {
+		return nil, err
+	}
+	hw := &HashWriter{
 		dest:  dest,
-		cksum: sha1.New(),
+		alg:   alg,
+		cksum: cksum,
+	}
+	if _, ok := cksum.(encoding.BinaryMarshaler); ok {
+		return &ResumableHashWriter{hw}, nil
 	}
+	return hw, nil
+}
+
+// NewSha1HashWriter returns a new HashWriter that uses the SHA1
+// algorithm.
+func NewSha1HashWriter(dest io.Writer) Writer {
+	hw, _ := NewHashWriter(dest, SHA1)
+	return hw
 }
 
 // Write updates the checksum and writes the byte slice at offset
-func (hw *Sha1HashWriter) Write(b []byte) (int, error) {
+func (hw *HashWriter) Write(b []byte) (int, error) {
 	_, err := hw.cksum.Write(b)
 	if err != nil {
 		return 0, errors.Wrap(err, "updating checksum failed")
@@ -52,9 +92,20 @@ func (hw *Sha1HashWriter) Write(b []byte) (int, error) {
 	return hw.dest.Write(b)
 }
 
-// Sum returns the checksum
-func (hw *Sha1HashWriter) Sum() []byte {
-	return hw.cksum.Sum(nil)
+// Sum returns the checksum, tagged with its algorithm.
+func (hw *HashWriter) Sum() []byte {
+	return Tag(hw.alg, hw.cksum.Sum(nil))
+}
+
+// MarshalBinary returns the state of the checksum, so that it can be
+// continued by another writer after a restart.
+func (hw *ResumableHashWriter) MarshalBinary() ([]byte, error) {
+	return hw.cksum.(encoding.BinaryMarshaler).MarshalBinary()
+}
+
+// UnmarshalBinary restores a checksum state returned by MarshalBinary.
+func (hw *ResumableHashWriter) UnmarshalBinary(state []byte) error {
+	return hw.cksum.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
 }
 
 // NewNoopHashWriter returns a new NoopHashWriter
@@ -74,6 +125,82 @@ func (hw *NoopHashWriter) Sum() []byte {
 	return []byte{}
 }
 
+// MarshalBinary returns an empty state.
+func (hw *NoopHashWriter) MarshalBinary() ([]byte, error) {
+	return []byte{}, nil
+}
+
+// UnmarshalBinary ignores the state.
+func (hw *NoopHashWriter) UnmarshalBinary(state []byte) error {
+	return nil
+}
+
+// NewChunkedHashWriter returns a new ChunkedHashWriter for the
+// algorithm.
+func NewChunkedHashWriter(dest io.Writer, chunkSize int64, alg string) (Writer, error) {
+	chunk, err := NewHash(alg)
+	if err != nil {
+		return nil, err
+	}
+	return &ChunkedHashWriter{
+		dest:      dest,
+		alg:       alg,
+		chunkSize: chunkSize,
+		chunk:     chunk,
+	}, nil
+}
+
+// NewChunkedSha1HashWriter returns a new ChunkedHashWriter that uses the
+// SHA1 algorithm.
+func NewChunkedSha1HashWriter(dest io.Writer, chunkSize int64) Writer {
+	hw, _ := NewChunkedHashWriter(dest, chunkSize, SHA1)
+	return hw
+}
+
+// Write updates the chunk checksums and writes the byte slice
+func (hw *ChunkedHashWriter) Write(b []byte) (int, error) {
+	for p := b; len(p) > 0; {
+		n := hw.chunkSize - hw.written
+		if n > int64(len(p)) {
+			n = int64(len(p))
+		}
+		hw.chunk.Write(p[:n])
+		hw.written += n
+		p = p[n:]
+		if hw.written == hw.chunkSize {
+			hw.sums = append(hw.sums, hw.chunk.Sum(nil))
+			hw.chunk.Reset()
+			hw.written = 0
+		}
+	}
+	return hw.dest.Write(b)
+}
+
+// Sum returns the checksum, tagged with its algorithm.
+func (hw *ChunkedHashWriter) Sum() []byte {
+	sums := hw.sums
+	if hw.written > 0 {
+		sums = append(sums[:len(sums):len(sums)], hw.chunk.Sum(nil))
+	}
+	return CombineSums(hw.alg, sums)
+}
+
+// CombineSums returns the tagged checksum of data from the untagged
+// checksums of its chunks, as calculated by ChunkedHashWriter.
+func CombineSums(alg string, sums [][]byte) []byte {
+	hash := algorithms[alg].new()
+	for _, sum := range sums {
+		hash.Write(sum)
+	}
+	return Tag(alg, hash.Sum(nil))
+}
+
+// CombineSha1Sums returns the checksum of data from the SHA1 checksums of
+// its chunks, as calculated by ChunkedHashWriter.
+func CombineSha1Sums(sums [][]byte) []byte {
+	return CombineSums(SHA1, sums)
+}
+
 // FileSha1Sum returns the SHA1 checksum for the supplied file path
 func FileSha1Sum(filePath string) ([]byte, error) {
 	file, err := os.Open(filePath)
@@ -85,7 +212,7 @@ func FileSha1Sum(filePath string) ([]byte, error) {
 	hash := sha1.New()
 	_, err = io.Copy(hash, file)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Failed to compute checksum for %s")
+		return nil, errors.Wrapf(err, "Failed to compute checksum for %s", filePath)
 	}
 
 	return hash.Sum(nil), nil
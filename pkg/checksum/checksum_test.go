@@ -0,0 +1,113 @@
+// Copyright (c) 2018 DDN. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package checksum
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestFormatParse(t *testing.T) {
+	data := []byte(strings.Repeat("checksum data ", 1000))
+	for _, alg := range Algorithms() {
+		cw, err := NewHashWriter(ioutil.Discard, alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cw.Write(data)
+		sum := cw.Sum()
+		if got := Algorithm(sum); got != alg {
+			t.Fatalf("%s: tagged as %s", alg, got)
+		}
+
+		text := Format(sum)
+		if alg != SHA1 && !strings.HasPrefix(text, alg+":") {
+			t.Fatalf("%s: formatted as %q", alg, text)
+		}
+		parsed, err := Parse(text)
+		if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		if !bytes.Equal(parsed, sum) {
+			t.Fatalf("%s: parsed %q as %x, expected %x", alg, text, parsed, sum)
+		}
+	}
+}
+
+func TestLegacySha1(t *testing.T) {
+	raw := sha1.Sum([]byte("legacy"))
+	text := hex.EncodeToString(raw[:])
+
+	sum, err := Parse(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sum, raw[:]) {
+		t.Fatalf("expected %x, got %x", raw, sum)
+	}
+	if alg, untagged := Split(sum); alg != SHA1 || !bytes.Equal(untagged, raw[:]) {
+		t.Fatalf("expected untagged sha1, got %s %x", alg, untagged)
+	}
+	if got := Format(sum); got != text {
+		t.Fatalf("expected %q, got %q", text, got)
+	}
+	if sum, err := Parse("sha1:" + text); err != nil || !bytes.Equal(sum, raw[:]) {
+		t.Fatalf("expected %x, got %x (%v)", raw, sum, err)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, text := range []string{
+		"not hex",
+		"md5:d41d8cd98f00b204e9800998ecf8427e",
+		"sha256:0123",
+		"xxh64:zz",
+	} {
+		if _, err := Parse(text); err == nil {
+			t.Errorf("%q: expected an error", text)
+		}
+	}
+}
+
+func TestChunkedHashWriter(t *testing.T) {
+	data := []byte(strings.Repeat("chunked data ", 1000))
+	const chunkSize = 1000
+	for _, alg := range Algorithms() {
+		cw, err := NewChunkedHashWriter(ioutil.Discard, chunkSize, alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Writes that don't line up with the chunks.
+		for p := data; len(p) > 0; {
+			n := 333
+			if n > len(p) {
+				n = len(p)
+			}
+			cw.Write(p[:n])
+			p = p[n:]
+		}
+
+		var sums [][]byte
+		for off := 0; off < len(data); off += chunkSize {
+			end := off + chunkSize
+			if end > len(data) {
+				end = len(data)
+			}
+			h, err := NewHash(alg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.Write(data[off:end])
+			sums = append(sums, h.Sum(nil))
+		}
+		if expected := CombineSums(alg, sums); !bytes.Equal(cw.Sum(), expected) {
+			t.Fatalf("%s: expected %x, got %x", alg, expected, cw.Sum())
+		}
+	}
+}